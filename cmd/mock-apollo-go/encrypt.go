@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/figroc/mock-apollo-go/pkg/jasypt"
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+)
+
+// runEncrypt runs `encrypt -key-file file [value]`, printing the AGE[...] value of the value or stdin,
+// `encrypt -jasypt-password password [value]` printing its jasypt ENC(...) value instead,
+// or `encrypt -new-key` printing a new key, and returns the exit code
+func runEncrypt(args []string) int {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	keyFile := fs.String("key-file", "", "file of the age identity, the one given to -decrypt-key-file")
+	newKey := fs.Bool("new-key", false, "print a new age identity instead of encrypting")
+	jasyptPassword := fs.String("jasypt-password", "", "print the jasypt ENC(...) value encrypted with the password instead")
+	usage := "usage: mock-apollo-go encrypt -key-file file [value]\n" +
+		"       mock-apollo-go encrypt -jasypt-password password [value]\n" +
+		"       mock-apollo-go encrypt -new-key"
+	fs.Parse(args)
+
+	if *newKey {
+		key, err := watcher.NewKey()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(key)
+		return 0
+	}
+	if (*keyFile == "") == (*jasyptPassword == "") || fs.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	value := fs.Arg(0)
+	if fs.NArg() == 0 {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		// the trailing newline of echo is not part of the value
+		value = strings.TrimSuffix(string(b), "\n")
+	}
+	var (
+		enc string
+		err error
+	)
+	if *jasyptPassword != "" {
+		enc, err = jasypt.Encrypt(*jasyptPassword, value)
+	} else {
+		enc, err = encryptWithKeyFile(*keyFile, value)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(enc)
+	return 0
+}
+
+// encryptWithKeyFile returns the AGE[...] value of value encrypted with the key of keyFile
+func encryptWithKeyFile(keyFile string, value string) (string, error) {
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return "", err
+	}
+	key, err := watcher.ParseKey(string(b))
+	if err != nil {
+		return "", err
+	}
+	return watcher.Encrypt(key, value)
+}
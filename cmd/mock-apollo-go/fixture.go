@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/figroc/mock-apollo-go/internal/fixture"
+)
+
+// runFixture runs `fixture generate [-o file] capture` and returns the exit code
+func runFixture(args []string) int {
+	fs := flag.NewFlagSet("fixture generate", flag.ExitOnError)
+	out := fs.String("o", "", "output file of the fixture (default stdout)")
+	usage := "usage: mock-apollo-go fixture generate [-o file] capture"
+	if len(args) == 0 || args[0] != "generate" {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	entries, err := fixture.Load(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	b, err := fixture.Marshal(fixture.Infer(entries))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *out == "" {
+		os.Stdout.Write(b)
+		return 0
+	}
+	if err := os.WriteFile(*out, b, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
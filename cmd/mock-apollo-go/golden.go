@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/figroc/mock-apollo-go/internal/golden"
+	"github.com/figroc/mock-apollo-go/pkg/flagarray"
+)
+
+// runGolden runs `golden record [-url url] [-app appId] [-cluster cluster] [-namespace namespace] dir`
+// and returns the exit code
+func runGolden(args []string) int {
+	fs := flag.NewFlagSet("golden record", flag.ExitOnError)
+	base := fs.String("url", "http://localhost:8070", "base URL of the running config server")
+	appID := fs.String("app", "SampleApp", "appId of the requests")
+	cluster := fs.String("cluster", "default", "cluster of the requests")
+	timeout := fs.Duration("timeout", 90*time.Second, "timeout of each request, long polls are answered within the poll timeout")
+	var namespaces flagarray.FlagArray
+	fs.Var(&namespaces, "namespace", "namespace of the requests (default application)")
+	usage := "usage: mock-apollo-go golden record [-url url] [-app appId] [-cluster cluster] [-namespace namespace] dir"
+	if len(args) == 0 || args[0] != "record" {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	u, err := url.Parse(*base)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fmt.Fprintf(os.Stderr, "invalid url: %s\n", *base)
+		return 2
+	}
+	if len(namespaces) == 0 {
+		namespaces = flagarray.FlagArray{"application"}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	reqs := golden.Requests(*appID, *cluster, namespaces)
+	if err := golden.Record(ctx, &http.Client{Timeout: *timeout}, u, reqs, fs.Arg(0)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "recorded %d responses of %s in %s\n", len(reqs), u, fs.Arg(0))
+	return 0
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// limitBody answers 413 to the requests whose body exceeds max bytes, 0 means no limit.
+// Bodies are read up front so that handlers never see a truncated body
+func limitBody(h http.Handler, max int64) http.Handler {
+	if max <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > max {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.ContentLength != 0 && r.Body != nil {
+			b, err := io.ReadAll(io.LimitReader(r.Body, max+1))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if int64(len(b)) > max {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(b))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitBody(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		w.Write(b)
+	})
+	serve := func(max int64, body string, chunked bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/ctrl/import", strings.NewReader(body))
+		if chunked {
+			// the size of a chunked body is unknown until it is read
+			r.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		limitBody(echo, max).ServeHTTP(w, r)
+		return w
+	}
+
+	for _, chunked := range []bool{false, true} {
+		w := serve(4, "abcd", chunked)
+		require.Equal(t, 200, w.Code)
+		require.Equal(t, "abcd", w.Body.String())
+		w = serve(4, "abcde", chunked)
+		require.Equal(t, 413, w.Code)
+		require.Empty(t, w.Body.String())
+	}
+	require.Equal(t, 200, serve(4, "", false).Code)
+	// no limit
+	w := serve(0, strings.Repeat("a", 1<<10), true)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, 1<<10, w.Body.Len())
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.MaxHeaderBytes = 1 << 10
+	srv.Start()
+	defer srv.Close()
+	get := func(size int) int {
+		req, err := http.NewRequest("GET", srv.URL+"/healthz", nil)
+		require.Nil(t, err)
+		req.Header.Set("X-Padding", strings.Repeat("a", size))
+		// the limit is looser on a reused connection
+		req.Close = true
+		rsp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		rsp.Body.Close()
+		return rsp.StatusCode
+	}
+
+	require.Equal(t, 200, get(1<<9))
+	// the Go HTTP server keeps 4KiB of slack over the limit
+	require.Equal(t, 431, get(8<<10))
+}
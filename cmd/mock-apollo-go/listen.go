@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// listen opens a tcp listener whose connections are probed with tcp keep-alives once idle for period,
+// so that clients that vanished mid-poll without closing their connection are detected after period
+// and count unanswered probes, and their polls reclaimed. A period of 0 disables the probes
+func listen(addr string, period time.Duration, count int) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAliveConfig: keepAliveConfig(period, count)}
+	if period == 0 {
+		lc.KeepAlive = -1
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// keepAliveConfig probes every period once a connection is idle for period, giving up after count probes
+func keepAliveConfig(period time.Duration, count int) net.KeepAliveConfig {
+	return net.KeepAliveConfig{Enable: period > 0, Idle: period, Interval: period, Count: count}
+}
+
+// handshakeListener accepts at most a number of connections that have not sent a complete request yet,
+// so that clients sending their headers byte by byte cannot exhaust the server.
+// Accept waits for a slot, leaving the pending connections in the backlog of the listener,
+// or for the listener to be closed so that the server shuts down while the slots are taken
+type handshakeListener struct {
+	net.Listener
+	slots  chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+// limitHandshakes wraps ln with a handshakeListener, max 0 means no limit
+func limitHandshakes(ln net.Listener, max int) net.Listener {
+	if max <= 0 {
+		return ln
+	}
+	return &handshakeListener{Listener: ln, slots: make(chan struct{}, max), closed: make(chan struct{})}
+}
+
+func (l *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &handshakeConn{Conn: c, slots: l.slots}, nil
+}
+
+func (l *handshakeListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
+
+// handshakeConn holds a slot of its listener until its first request is read or it is closed
+type handshakeConn struct {
+	net.Conn
+	slots chan struct{}
+	once  sync.Once
+}
+
+func (c *handshakeConn) release() {
+	c.once.Do(func() {
+		<-c.slots
+	})
+}
+
+func (c *handshakeConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+type connKey struct{}
+
+// connContext stores the connection of the requests in their context, see http.Server.ConnContext
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// releaseHandshake releases the handshake slot of a connection once its request headers are read
+func releaseHandshake(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _ := r.Context().Value(connKey{}).(net.Conn)
+		if tc, ok := c.(*tls.Conn); ok {
+			c = tc.NetConn()
+		}
+		if hc, ok := c.(*handshakeConn); ok {
+			hc.release()
+		}
+		h.ServeHTTP(w, r)
+	})
+}
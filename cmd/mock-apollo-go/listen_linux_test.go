@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenKeepAlive(t *testing.T) {
+	sockopt := func(period time.Duration, count int, opt int) int {
+		ln, err := listen("127.0.0.1:0", period, count)
+		require.Nil(t, err)
+		defer ln.Close()
+		go func() {
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if err == nil {
+				defer c.Close()
+				time.Sleep(100 * time.Millisecond)
+			}
+		}()
+		c, err := ln.Accept()
+		require.Nil(t, err)
+		defer c.Close()
+		raw, err := c.(*net.TCPConn).SyscallConn()
+		require.Nil(t, err)
+		var v int
+		require.Nil(t, raw.Control(func(fd uintptr) {
+			v, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+			if err == nil && v == 1 && opt != syscall.SO_KEEPALIVE {
+				v, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, opt)
+			}
+		}))
+		require.Nil(t, err)
+		return v
+	}
+	// a vanished client is detected 2s after its last packet and 3 probes 2s apart
+	require.Equal(t, 2, sockopt(2*time.Second, 3, syscall.TCP_KEEPIDLE))
+	require.Equal(t, 2, sockopt(2*time.Second, 3, syscall.TCP_KEEPINTVL))
+	require.Equal(t, 3, sockopt(2*time.Second, 3, syscall.TCP_KEEPCNT))
+	require.Equal(t, 0, sockopt(0, 3, syscall.SO_KEEPALIVE))
+}
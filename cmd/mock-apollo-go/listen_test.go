@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDroppedClient(t *testing.T) {
+	ln, err := listen("127.0.0.1:0", time.Second, 3)
+	require.Nil(t, err)
+	held := make(chan struct{})
+	released := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a long poll held until the client goes away
+		close(held)
+		<-r.Context().Done()
+		close(released)
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	_, err = c.Write([]byte("GET /notifications/v2 HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.Nil(t, err)
+	<-held
+	c.Close()
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		require.Fail(t, "the poll of the dropped client is held")
+	}
+}
+
+func TestHandshakeLimit(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	ln := limitHandshakes(inner, 1)
+	srv := &http.Server{
+		Handler:     releaseHandshake(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})),
+		ConnContext: connContext,
+	}
+	served := make(chan error)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+
+	// a client holding the only slot without sending its request
+	slow, err := net.Dial("tcp", inner.Addr().String())
+	require.Nil(t, err)
+	defer slow.Close()
+	c, err := net.Dial("tcp", inner.Addr().String())
+	require.Nil(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("GET /healthz HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.Nil(t, err)
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = c.Read(make([]byte, 1))
+	require.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+
+	// the server shuts down while the slots are taken, the slow client is given up after 100ms
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- srv.Shutdown(ctx)
+	}()
+	select {
+	case err := <-served:
+		require.Equal(t, http.ErrServerClosed, err)
+	case <-time.After(time.Second):
+		require.Fail(t, "the server is blocked accepting a connection")
+	}
+	select {
+	case <-shutdown:
+	case <-time.After(time.Second):
+		require.Fail(t, "the server is not shut down")
+	}
+}
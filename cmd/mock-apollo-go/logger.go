@@ -14,28 +14,77 @@ func (dl *defaultLogger) Debug(msg string) {
 	dl.l.Debug(msg)
 }
 
+// DebugWithFields will print the message with its fields in debug level
+func (dl *defaultLogger) DebugWithFields(msg string, ef nlogger.EntryFunc) {
+	dl.l.WithFields(fields(ef)).Debug(msg)
+}
+
 // Info will print the message in info level
 func (dl *defaultLogger) Info(msg string) {
 	dl.l.Info(msg)
 }
 
+// InfoWithFields will print the message with its fields in info level
+func (dl *defaultLogger) InfoWithFields(msg string, ef nlogger.EntryFunc) {
+	dl.l.WithFields(fields(ef)).Info(msg)
+}
+
 // Warn will print the message in warning level
 func (dl *defaultLogger) Warn(msg string) {
 	dl.l.Warn(msg)
 }
 
+// WarnWithFields will print the message with its fields in warning level
+func (dl *defaultLogger) WarnWithFields(msg string, ef nlogger.EntryFunc) {
+	dl.l.WithFields(fields(ef)).Warn(msg)
+}
+
 // Error will print the message in error level
 func (dl *defaultLogger) Error(msg string) {
 	dl.l.Error(msg)
 }
 
+// ErrorWithFields will print the message with its fields in error level
+func (dl *defaultLogger) ErrorWithFields(msg string, ef nlogger.EntryFunc) {
+	dl.l.WithFields(fields(ef)).Error(msg)
+}
+
 // Fatal will print the message in fatal level and kill the main process
 func (dl *defaultLogger) Fatal(msg string) {
 	dl.l.Fatal(msg)
 }
 
+// FatalWithFields will print the message with its fields in fatal level and kill the main process
+func (dl *defaultLogger) FatalWithFields(msg string, ef nlogger.EntryFunc) {
+	dl.l.WithFields(fields(ef)).Fatal(msg)
+}
+
+// entry collects the fields of a log line as logrus fields
+type entry logrus.Fields
+
+func (e entry) String(key string, value string) { e[key] = value }
+func (e entry) Int(key string, value int)       { e[key] = value }
+func (e entry) Int64(key string, value int64)   { e[key] = value }
+func (e entry) Float(key string, value float64) { e[key] = value }
+func (e entry) Bool(key string, value bool)     { e[key] = value }
+func (e entry) Err(key string, value error)     { e[key] = value.Error() }
+func (e entry) ObjectFunc(key string, value nlogger.EntryFunc) {
+	e[key] = fields(value)
+}
+
+// fields returns the fields added by ef
+func fields(ef nlogger.EntryFunc) logrus.Fields {
+	e := entry{}
+	ef(e)
+	return logrus.Fields(e)
+}
+
+// newLogger returns a logger of a level printing the lines in the format of -log-format
 func newLogger(level logrus.Level) nlogger.Structured {
 	var log = logrus.New()
 	log.SetLevel(level)
-	return nlogger.ToStructured(&defaultLogger{log})
+	if logFormat == "json" {
+		log.SetFormatter(&logrus.JSONFormatter{})
+	}
+	return &defaultLogger{log}
 }
@@ -2,39 +2,209 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/figroc/mock-apollo-go/internal/routes/apollo"
+	"github.com/figroc/mock-apollo-go/pkg/auth"
 	"github.com/figroc/mock-apollo-go/pkg/flagarray"
+	"github.com/figroc/mock-apollo-go/pkg/hooks"
+	"github.com/figroc/mock-apollo-go/pkg/metrics"
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
 	"github.com/julienschmidt/httprouter"
 	"github.com/lalamove/nui/nlogger"
 	"github.com/sirupsen/logrus"
 )
 
 var (
-	filePaths    flagarray.FlagArray
-	configPort   int
-	internalPort int
-	pollTimeout  time.Duration
-	logger       nlogger.Provider
+	filePaths       flagarray.FlagArray
+	configPort      int
+	internalPort    int
+	pollTimeout     time.Duration
+	shutdownTimeout time.Duration
+	handlerTimeout  time.Duration
+	notifyRate      int
+	maxPollsPerIP   int
+	backoff         apollo.Backoff
+	notifyWindow    time.Duration
+	keepAlive       time.Duration
+	keepAliveCount  int
+	charset         string
+	maxFileSize     int64
+	watchMode       string
+	watchDebounce   time.Duration
+	decryptKeyFile  string
+	decryptionKey   []byte
+	jasyptPassword  string
+	unicodeEscape   bool
+	compression     bool
+	compressMinSize int
+	quota           int
+	appQuotas       flagarray.FlagArray
+	appQuota        map[string]int
+	appWindows      flagarray.FlagArray
+	appWindow       map[string]apollo.AppWindow
+	statsdAddr      string
+	statsdPrefix    string
+	statsdPeriod    time.Duration
+	statsdTags      flagarray.FlagArray
+	serviceName     string
+	serviceID       string
+	serviceFields   flagarray.FlagArray
+	serviceField    map[string]interface{}
+	serviceInsts    flagarray.FlagArray
+	serviceInstance []apollo.ServiceInstance
+	advertiseScheme string
+	mirrorURL       string
+	mirror          *url.URL
+	upstreamURL     string
+	upstream        *url.URL
+	upstreamPeriod  time.Duration
+	clusterAliases  flagarray.FlagArray
+	redirectPrefix  flagarray.FlagArray
+	envs            flagarray.FlagArray
+	debugOverride   bool
+	looseAppID      bool
+	notFoundHints   bool
+	graphQL         bool
+	hookScript      string
+	releaseKeyMode  string
+	pollFault       apollo.NotificationFault
+	fault           apollo.FaultRule
+	faultDelay      time.Duration
+	faultJitter     time.Duration
+	faultPaths      flagarray.FlagArray
+	faultApps       flagarray.FlagArray
+	faultAgents     flagarray.FlagArray
+	accessLog       apollo.AccessLog
+	logFormat       string
+	maxHeaderBytes  int
+	maxBodyBytes    int64
+	headerTimeout   time.Duration
+	idleTimeout     time.Duration
+	maxHandshakes   int
+	startupTimeout  time.Duration
+	staleAfter      time.Duration
+	cacheFile       string
+	snapshotDir     string
+	snapshotPeriod  time.Duration
+	soakPeriod      time.Duration
+	soakSamples     int
+	snapshotRetain  int
+	requestLogSize  int
+	requestJournal  string
+	tlsCert         string
+	tlsKey          string
+	tlsClientCA     string
+	tlsClientApps   flagarray.FlagArray
+	authenticator   auth.Authenticator
+	tlsCfg          *tls.Config
+	accessLogPaths  flagarray.FlagArray
+	accessLogApps   flagarray.FlagArray
+	hook            hooks.Hook
+	clusterAlias    map[string]string
+	logger          nlogger.Provider
 )
 
 func init() {
-	flag.Var(&filePaths, "file", "config filepath")
-	flag.IntVar(&internalPort, "internal-port", 9090, "internal HTTP server port")
+	flag.Var(&filePaths, "file", "config filepath, directory or glob pattern, e.g. ./configs/*.yaml")
+	flag.IntVar(&internalPort, "internal-port", 9090, "internal HTTP server port (0 to disable the internal server)")
 	flag.IntVar(&configPort, "config-port", 8070, "config HTTP server port")
 	flag.DurationVar(&pollTimeout, "poll-timeout", time.Minute, "long poll timeout")
-	flag.Parse()
-	writeEnvConf()
-	validateInput()
-	logger = nlogger.NewProvider(newLogger(logrus.InfoLevel))
+	flag.IntVar(&maxPollsPerIP, "max-polls-per-ip", 0, "max open long polls of a remote ip, further ones are answered with a 429 (0 for unlimited)")
+	flag.IntVar(&notifyRate, "notify-rate", 0, "max change notifications sent per second (0 for unlimited)")
+	flag.DurationVar(&notifyWindow, "notify-window", 0, "window of the changes answered together to a long poll (0 to answer the first change)")
+	flag.StringVar(&watchMode, "watch-mode", "poll", "how the config files are watched: poll every second, or notify with the OS notifications falling back to poll where unsupported")
+	flag.DurationVar(&watchDebounce, "watch-debounce", 0, "delay of the reload of a changed config file until it is left unchanged for it, e.g. 200ms (0 for none)")
+	flag.Int64Var(&maxFileSize, "max-file-size", 0, "max size of a config file in bytes, decompressed if compressed (0 for unlimited)")
+	flag.StringVar(&decryptKeyFile, "decrypt-key-file", "", "file of the age identity decrypting the AGE[...] values of the config files, see the encrypt subcommand")
+	flag.StringVar(&jasyptPassword, "jasypt-password", os.Getenv("JASYPT_ENCRYPTOR_PASSWORD"), "password encrypting the jasypt properties of the config files in the ENC(...) form (defaults to $JASYPT_ENCRYPTOR_PASSWORD)")
+	flag.StringVar(&charset, "charset", "UTF-8", "charset appended to the Content-Type of responses (empty for none)")
+	flag.BoolVar(&compression, "compression", true, "compress the config and notification responses with the gzip or deflate encoding accepted by the client")
+	flag.IntVar(&compressMinSize, "compression-min-size", 0, "min size in bytes of the compressed response bodies (0 compresses all)")
+	flag.BoolVar(&unicodeEscape, "unicode-escape", false, "write non-ASCII characters of properties files as \\uXXXX escapes")
+	flag.DurationVar(&handlerTimeout, "handler-timeout", 10*time.Second, "max duration of a non long polling request (0 for no limit)")
+	flag.DurationVar(&backoff.RetryAfter, "retry-after", 5*time.Second, "Retry-After of the 429 and 503 responses shedding load (0 for none)")
+	flag.BoolVar(&backoff.Body, "backoff-body", false, "answer the 429 and 503 responses shedding load with an Apollo-style JSON error carrying the backoff hints")
+	flag.DurationVar(&backoff.PollInterval, "backoff-poll-interval", 0, "poll interval advised by the JSON error of -backoff-body (0 for none)")
+	flag.DurationVar(&keepAlive, "tcp-keepalive", 5*time.Second, "tcp keep-alive probe period used to detect vanished clients (0 for no probes)")
+	flag.IntVar(&keepAliveCount, "tcp-keepalive-count", 3, "unanswered tcp keep-alive probes after which a client is considered vanished")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 5*time.Second, "time allowed for completing open polls on shutdown")
+	flag.IntVar(&quota, "quota", 0, "requests allowed per appId per minute (0 for unlimited)")
+	flag.Var(&appQuotas, "app-quota", "requests allowed per minute for an appId, in the form appId=limit")
+	flag.Var(&appWindows, "app-window", "daily service window of an appId in local time, refused with 503 or the given status outside of it, in the form appId=09:00-18:00[,403]")
+	flag.StringVar(&statsdAddr, "statsd-addr", "", "StatsD agent address to push metrics to, e.g. localhost:8125")
+	flag.StringVar(&statsdPrefix, "statsd-prefix", "", "prefix of the metrics pushed to StatsD")
+	flag.DurationVar(&statsdPeriod, "statsd-interval", 10*time.Second, "StatsD push interval")
+	flag.Var(&statsdTags, "statsd-tag", "DogStatsD tag added to the pushed metrics, e.g. env:dev")
+	flag.StringVar(&serviceName, "service-app-name", "APOLLO-CONFIGSERVICE", "appName of the /services/config response")
+	flag.StringVar(&serviceID, "service-instance-id", "{host}:apollo-configservice:{port}", "instanceId format of the /services/config response, {host} and {port} are replaced")
+	flag.Var(&serviceFields, "service-field", "field added to the /services/config response, in the form key=value, JSON values are decoded")
+	flag.Var(&serviceInsts, "service-instance", "config service listed by the /services/config response in place of the mock, in the form instanceId=homepageUrl[,weight]")
+	flag.Var(&redirectPrefix, "redirect-prefix", "base path, e.g. /apollo, whose requests of a route are answered with a 301 to the route")
+	flag.StringVar(&mirrorURL, "mirror-url", "", "base URL, e.g. of a candidate build or a real Apollo, receiving a copy of the config requests whose responses are compared at /ctrl/mirror")
+	flag.StringVar(&upstreamURL, "upstream", "", "base URL of a real Apollo config service the served namespaces are compared with, reported at /admin/upstream")
+	flag.DurationVar(&upstreamPeriod, "upstream-interval", time.Minute, "min interval between two comparisons of a namespace with the upstream")
+	flag.StringVar(&advertiseScheme, "advertise-scheme", "", "scheme of the discovered config service URLs, http or https (default from X-Forwarded-Proto or the connection)")
+	flag.Var(&envs, "env", "env, e.g. DEV, served under /envs/{env} from the envs section of the config files")
+	flag.Var(&clusterAliases, "cluster-alias", "cluster served for a requested cluster, in the form requested=cluster")
+	flag.BoolVar(&looseAppID, "loose-app-id", false, "serve the namespace of another app to the requests of an app without it")
+	flag.BoolVar(&notFoundHints, "not-found-hints", false, "answer the requests of a missing namespace with a JSON body listing the nearest namespaces of the app")
+	flag.BoolVar(&debugOverride, "debug-override", false, "overlay properties given as _mock_override=key:value query parameters onto a response")
+	flag.BoolVar(&graphQL, "graphql", false, "serve GraphQL queries of apps, namespaces, clients and stats at /admin/graphql on the internal port")
+	flag.StringVar(&releaseKeyMode, "release-key-mode", apollo.ReleaseKeyFile, "releaseKeys served: file, counter for an increasing integer per change, apollo for increasing timestamp-random keys, or hash for increasing timestamp-content hash keys")
+	flag.DurationVar(&pollFault.FirstDelay, "poll-first-delay", 0, "delay of the first long poll of each client (0 for none)")
+	flag.DurationVar(&pollFault.ErrorAfter, "poll-error-after", 0, "fail long polls with a 500 after the duration (0 for none)")
+	flag.BoolVar(&pollFault.Empty, "poll-empty", false, "answer long polls right away with an empty array of notifications")
+	flag.IntVar(&pollFault.Percent, "poll-fault-percent", 0, "percent of the long polls failed by -poll-error-after or -poll-empty (0 for all)")
+	flag.IntVar(&fault.ErrorPercent, "fault-error-percent", 0, "percent of the requests answered with an injected 500")
+	flag.IntVar(&fault.DropPercent, "fault-drop-percent", 0, "percent of the requests whose connection is dropped without a response")
+	flag.DurationVar(&faultDelay, "fault-delay", 0, "latency injected into the requests")
+	flag.DurationVar(&faultJitter, "fault-jitter", 0, "max random latency injected into the requests on top of -fault-delay")
+	flag.Var(&faultPaths, "fault-path", "path prefix of the requests the faults are injected into, e.g. /notifications/v2 (default all paths)")
+	flag.Var(&faultApps, "fault-app", "appId of the requests the faults are injected into (default all appIds)")
+	flag.Var(&faultAgents, "fault-user-agent", "substring of the User-Agent of the requests the faults are injected into, e.g. apollo-client-go/1. (default all User-Agents)")
+	flag.BoolVar(&accessLog.Enabled, "access-log", false, "log a line per served request")
+	flag.IntVar(&accessLog.Sample, "access-log-sample", 1, "log 1 in N of the requests passing the access log filters")
+	flag.Var(&accessLogPaths, "access-log-path", "path prefix of the requests logged, e.g. /configs/ (default all paths)")
+	flag.Var(&accessLogApps, "access-log-app", "appId of the requests logged (default all appIds)")
+	flag.StringVar(&logFormat, "log-format", "text", "format of the log lines, text or json with the access log fields as keys")
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "max size of the request headers in bytes, larger ones are answered with a 431")
+	flag.Int64Var(&maxBodyBytes, "max-body-bytes", 1<<20, "max size of a request body in bytes, larger ones are answered with a 413 (0 for unlimited)")
+	flag.DurationVar(&headerTimeout, "read-header-timeout", 10*time.Second, "max duration of reading the request headers (0 for no limit)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 2*time.Minute, "max duration a keep-alive connection waits for its next request (0 for no limit)")
+	flag.IntVar(&maxHandshakes, "max-handshakes", 1024, "max connections of the config server that have not sent a complete request yet (0 for unlimited)")
+	flag.DurationVar(&startupTimeout, "startup-timeout", 0, "time allowed for the config files to become loadable at startup, retried with backoff (0 to fail fast)")
+	flag.StringVar(&tlsCert, "tls-cert", "", "certificate file serving both servers over HTTPS")
+	flag.StringVar(&tlsKey, "tls-key", "", "private key file of -tls-cert")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "CA file verifying the client certificates required by both servers (mutual TLS)")
+	flag.Var(&tlsClientApps, "tls-client-app", "appIds allowed to the client certificates of a SPIFFE ID or common name, in the form identity=appId[,appId] or identity=* (default no binding)")
+	flag.StringVar(&cacheFile, "cache-file", "", "file persisting the last loaded config, served at startup while the config files fail to load")
+	flag.StringVar(&snapshotDir, "snapshot-dir", "", "directory receiving a timestamped snapshot of the served config every -snapshot-interval")
+	flag.DurationVar(&soakPeriod, "soak-interval", 0, "interval of the samples of goroutines, open fds and polls flagging the ones growing in /admin/status (0 for none)")
+	flag.IntVar(&soakSamples, "soak-samples", 10, "number of latest soak samples a resource must grow over to be flagged")
+	flag.DurationVar(&snapshotPeriod, "snapshot-interval", time.Minute, "interval of the config snapshots, unchanged configs are not written again")
+	flag.IntVar(&snapshotRetain, "snapshot-retain", 10, "number of latest config snapshots kept (0 to keep all)")
+	flag.IntVar(&requestLogSize, "request-log-size", 1000, "number of latest requests of the config routes recorded for /ctrl/requests (0 for none)")
+	flag.StringVar(&requestJournal, "request-journal", "", "SQLite database storing the recorded requests in place of the memory, kept across restarts")
+	flag.DurationVar(&staleAfter, "stale-after", time.Minute, "duration a config file may fail to load before /readyz reports it stale")
+	flag.StringVar(&hookScript, "hook-script", "", "Starlark script or WASM module (.wasm) deciding the delays, faults or properties of each request")
+	if isSubcommand() {
+		// subcommands parse their own flags
+		logger = nlogger.NewProvider(newLogger(logrus.WarnLevel))
+	}
 }
 
 func writeEnvConf() {
@@ -64,58 +234,483 @@ func validateInput() {
 		log.Fatal("missing file arguments")
 	}
 
-	for _, f := range filePaths {
-		if _, err := os.Stat(f); err != nil {
+	if notifyWindow < 0 {
+		log.Fatalf("invalid notify window: %s", notifyWindow)
+	}
+	if keepAlive < 0 {
+		log.Fatalf("invalid tcp keepalive: %s", keepAlive)
+	}
+	if keepAliveCount < 1 {
+		log.Fatalf("invalid tcp keepalive count: %d", keepAliveCount)
+	}
+	if backoff.RetryAfter < 0 {
+		log.Fatalf("invalid retry after: %s", backoff.RetryAfter)
+	}
+	if backoff.PollInterval < 0 {
+		log.Fatalf("invalid backoff poll interval: %s", backoff.PollInterval)
+	}
+	if maxPollsPerIP < 0 {
+		log.Fatalf("invalid max polls per ip: %d", maxPollsPerIP)
+	}
+	if staleAfter < 0 {
+		log.Fatalf("invalid stale after: %s", staleAfter)
+	}
+	if soakPeriod < 0 {
+		log.Fatalf("invalid soak interval: %s", soakPeriod)
+	}
+	if soakSamples < 2 {
+		log.Fatalf("invalid soak samples: %d", soakSamples)
+	}
+	if snapshotPeriod <= 0 {
+		log.Fatalf("invalid snapshot interval: %s", snapshotPeriod)
+	}
+	if snapshotRetain < 0 {
+		log.Fatalf("invalid snapshot retain: %d", snapshotRetain)
+	}
+	if compressMinSize < 0 {
+		log.Fatalf("invalid compression min size: %d", compressMinSize)
+	}
+	if watchMode != "poll" && watchMode != "notify" {
+		log.Fatalf("invalid watch mode: %s", watchMode)
+	}
+	if internalPort < 0 {
+		log.Fatalf("invalid internal port: %d", internalPort)
+	}
+	if watchDebounce < 0 {
+		log.Fatalf("invalid watch debounce: %s", watchDebounce)
+	}
+	if requestLogSize < 0 {
+		log.Fatalf("invalid request log size: %d", requestLogSize)
+	}
+	if startupTimeout < 0 {
+		log.Fatalf("invalid startup timeout: %s", startupTimeout)
+	}
+	// missing files are waited for at startup when retried
+	if startupTimeout == 0 {
+		for _, f := range filePaths {
+			// glob patterns may match no file yet, their directory has to exist
+			if strings.ContainsAny(f, "*?[") {
+				f = filepath.Dir(f)
+			}
+			if _, err := os.Stat(f); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if hookScript != "" {
+		s, err := hooks.Load(hookScript)
+		if err != nil {
 			log.Fatal(err)
 		}
+		hook = s
+	}
+
+	if logFormat != "text" && logFormat != "json" {
+		log.Fatalf("invalid log format: %s", logFormat)
+	}
+	if accessLog.Sample < 1 {
+		log.Fatalf("invalid access log sample: %d", accessLog.Sample)
+	}
+	accessLog.Paths = accessLogPaths
+	accessLog.AppIDs = accessLogApps
+
+	if pollFault.Percent < 0 || pollFault.Percent > 100 {
+		log.Fatalf("invalid poll fault percent: %d", pollFault.Percent)
+	}
+	if fault.ErrorPercent < 0 || fault.ErrorPercent > 100 {
+		log.Fatalf("invalid fault error percent: %d", fault.ErrorPercent)
+	}
+	if fault.DropPercent < 0 || fault.DropPercent > 100 {
+		log.Fatalf("invalid fault drop percent: %d", fault.DropPercent)
+	}
+	if faultDelay < 0 || faultJitter < 0 {
+		log.Fatalf("invalid fault delay: %s", faultDelay)
+	}
+	fault.DelayMs = int(faultDelay / time.Millisecond)
+	fault.JitterMs = int(faultJitter / time.Millisecond)
+	fault.Paths = faultPaths
+	fault.AppIDs = faultApps
+	fault.UserAgents = faultAgents
+
+	switch releaseKeyMode {
+	case apollo.ReleaseKeyFile, apollo.ReleaseKeyCounter, apollo.ReleaseKeyApollo, apollo.ReleaseKeyHash:
+	default:
+		log.Fatalf("invalid release key mode: %s", releaseKeyMode)
+	}
+
+	if advertiseScheme != "" && advertiseScheme != "http" && advertiseScheme != "https" {
+		log.Fatalf("invalid advertise scheme: %s", advertiseScheme)
+	}
+
+	if mirrorURL != "" {
+		u, err := url.Parse(mirrorURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("invalid mirror URL: %s", mirrorURL)
+		}
+		mirror = u
+	}
+	if upstreamURL != "" {
+		u, err := url.Parse(upstreamURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("invalid upstream: %s", upstreamURL)
+		}
+		upstream = u
+	}
+	if upstreamPeriod <= 0 {
+		log.Fatalf("invalid upstream interval: %s", upstreamPeriod)
+	}
+
+	for _, p := range redirectPrefix {
+		if !strings.HasPrefix(p, "/") || strings.Trim(p, "/") == "" {
+			log.Fatalf("invalid redirect prefix: %s", p)
+		}
+	}
+
+	for _, e := range envs {
+		if e == "" || strings.Contains(e, "/") {
+			log.Fatalf("invalid env: %s", e)
+		}
+	}
+
+	if (tlsCert == "") != (tlsKey == "") {
+		log.Fatalf("invalid TLS: -tls-cert and -tls-key are required together")
+	}
+	if tlsClientCA != "" && tlsCert == "" {
+		log.Fatalf("invalid TLS: -tls-client-ca requires -tls-cert")
+	}
+	var err error
+	if tlsCfg, err = tlsConfig(tlsCert, tlsKey, tlsClientCA); err != nil {
+		log.Fatalf("invalid TLS: %s", err)
+	}
+	if len(tlsClientApps) > 0 {
+		if tlsClientCA == "" {
+			log.Fatalf("invalid TLS: -tls-client-app requires -tls-client-ca")
+		}
+		// the config routes are only served the apps bound to the identity of the client certificate
+		certs := auth.Certificates{}
+		for _, b := range tlsClientApps {
+			k, v, ok := splitPair(b)
+			if !ok || v == "" {
+				log.Fatalf("invalid TLS client app: %s", b)
+			}
+			for _, appID := range strings.Split(v, ",") {
+				if appID = strings.TrimSpace(appID); appID == "" {
+					log.Fatalf("invalid TLS client app: %s", b)
+				}
+				certs[k] = append(certs[k], appID)
+			}
+		}
+		authenticator = certs
+	}
+
+	if decryptKeyFile != "" {
+		b, err := os.ReadFile(decryptKeyFile)
+		if err != nil {
+			log.Fatalf("invalid decrypt key file: %s", err)
+		}
+		if decryptionKey, err = watcher.ParseKey(string(b)); err != nil {
+			log.Fatalf("invalid decrypt key file %s: %s", decryptKeyFile, err)
+		}
+	}
+
+	appQuota = make(map[string]int)
+	for _, q := range appQuotas {
+		k, v, ok := splitPair(q)
+		if !ok {
+			log.Fatalf("invalid app quota: %s", q)
+		}
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 0 {
+			log.Fatalf("invalid app quota: %s", q)
+		}
+		appQuota[k] = l
+	}
+
+	appWindow = make(map[string]apollo.AppWindow)
+	for _, w := range appWindows {
+		k, v, ok := splitPair(w)
+		if !ok {
+			log.Fatalf("invalid app window: %s", w)
+		}
+		win, err := parseAppWindow(v)
+		if err != nil {
+			log.Fatalf("invalid app window %s: %v", w, err)
+		}
+		appWindow[k] = win
+	}
+
+	clusterAlias = make(map[string]string)
+	for _, c := range clusterAliases {
+		k, v, ok := splitPair(c)
+		if !ok || v == "" {
+			log.Fatalf("invalid cluster alias: %s", c)
+		}
+		clusterAlias[k] = v
+	}
+
+	serviceField = make(map[string]interface{})
+	for _, f := range serviceFields {
+		k, v, ok := splitPair(f)
+		if !ok {
+			log.Fatalf("invalid service field: %s", f)
+		}
+		// values such as numbers are kept as JSON, anything else is a string
+		var value interface{}
+		if err := json.Unmarshal([]byte(v), &value); err != nil {
+			value = v
+		}
+		serviceField[k] = value
+	}
+
+	for _, i := range serviceInsts {
+		k, v, ok := splitPair(i)
+		if !ok || v == "" {
+			log.Fatalf("invalid service instance: %s", i)
+		}
+		inst := apollo.ServiceInstance{InstanceID: k, HomepageURL: v}
+		if n := strings.LastIndex(v, ","); n >= 0 {
+			weight, err := strconv.Atoi(v[n+1:])
+			if err != nil || weight <= 0 {
+				log.Fatalf("invalid service instance weight: %s", i)
+			}
+			inst.HomepageURL, inst.Weight = v[:n], weight
+		}
+		// the placeholders are replaced when served
+		placeholders := strings.NewReplacer("{host}", "localhost", "{port}", "8070")
+		if u, err := url.Parse(placeholders.Replace(inst.HomepageURL)); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("invalid service instance URL: %s", i)
+		}
+		serviceInstance = append(serviceInstance, inst)
+	}
+}
+
+// faults returns the fault rule set by the flags, if any
+func faults() []apollo.FaultRule {
+	if fault.IsZero() {
+		return nil
+	}
+	return []apollo.FaultRule{fault}
+}
+
+// parseAppWindow parses a service window in the form 09:00-18:00[,status]
+func parseAppWindow(s string) (apollo.AppWindow, error) {
+	win := apollo.AppWindow{}
+	if i := strings.LastIndex(s, ","); i >= 0 {
+		status, err := strconv.Atoi(s[i+1:])
+		if err != nil || (status != 403 && status != 503) {
+			return win, fmt.Errorf("invalid status %s", s[i+1:])
+		}
+		win.Status, s = status, s[:i]
+	}
+	bounds := strings.SplitN(s, "-", 2)
+	if len(bounds) != 2 {
+		return win, fmt.Errorf("invalid window %s", s)
+	}
+	var err error
+	if win.From, err = parseClock(bounds[0]); err != nil {
+		return win, err
+	}
+	if win.To, err = parseClock(bounds[1]); err != nil {
+		return win, err
+	}
+	if win.From == win.To {
+		return win, fmt.Errorf("empty window %s", s)
+	}
+	return win, nil
+}
+
+// parseClock parses a time of day in the form 09:00 as the duration since midnight
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %s", s)
 	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// splitPair splits a flag value in the form key=value
+func splitPair(s string) (string, string, bool) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return "", "", false
+	}
+	return kv[0], kv[1], true
 }
 
 func main() {
+	if isSubcommand() {
+		os.Exit(runSubcommand(os.Args[1], os.Args[2:]))
+	}
+	// the flags are parsed by main rather than init, leaving them to the testing package in the tests
+	flag.Parse()
+	writeEnvConf()
+	validateInput()
+	logger = nlogger.NewProvider(newLogger(logrus.InfoLevel))
+	if startupTimeout > 0 {
+		// the cache is served if the files still fail to load
+		if err := waitConfigFiles(logger, watcher.ManagerConfig{
+			Files:          filePaths,
+			MaxFileSize:    maxFileSize,
+			DecryptionKey:  decryptionKey,
+			JasyptPassword: jasyptPassword,
+		}, startupTimeout); err != nil && cacheFile == "" {
+			log.Fatal(err)
+		}
+	}
 	ctx, cancel := context.WithCancel(context.Background())
-	termChan := make(chan os.Signal)
+	termChan := make(chan os.Signal, 1)
 	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
 
-	// internal server for telemetry and ctrl
-	internalRouter := httprouter.New()
-	ctrlRoutes(internalRouter)
-	pprofRoutes(internalRouter)
-	internalSrv := &http.Server{
-		Addr:    ":" + strconv.Itoa(internalPort),
-		Handler: internalRouter,
-	}
-	go func() {
-		if err := internalSrv.ListenAndServe(); err != nil {
+	// metrics are served via the internal server and optionally pushed to StatsD
+	reg := metrics.NewRegistry()
+	if statsdAddr != "" {
+		if _, err := metrics.NewStatsD(ctx, metrics.StatsDConfig{
+			Log:      logger,
+			Addr:     statsdAddr,
+			Prefix:   statsdPrefix,
+			Interval: statsdPeriod,
+			Tags:     statsdTags,
+		}, reg); err != nil {
 			log.Fatal(err)
 		}
-	}()
+	}
 
-	// public server for serving config via Apollo APIs
-	router := httprouter.New()
+	// config served via Apollo APIs
 	a, err := apollo.New(ctx, apollo.Config{
-		ConfigPath:  filePaths,
-		PollTimeout: pollTimeout,
-		Log:         logger,
-		Port:        configPort,
+		ConfigPath:         filePaths,
+		PollTimeout:        pollTimeout,
+		HandlerTimeout:     handlerTimeout,
+		Backoff:            backoff,
+		NotifyRate:         notifyRate,
+		MaxPollsPerIP:      maxPollsPerIP,
+		NotifyWindow:       notifyWindow,
+		Charset:            charset,
+		MaxFileSize:        maxFileSize,
+		WatchNotify:        watchMode == "notify",
+		WatchDebounce:      watchDebounce,
+		DecryptionKey:      decryptionKey,
+		JasyptPassword:     jasyptPassword,
+		UnicodeEscape:      unicodeEscape,
+		DisableCompression: !compression,
+		CompressionMinSize: compressMinSize,
+		Log:                logger,
+		Port:               configPort,
+		Quota:              quota,
+		AppQuota:           appQuota,
+		AppWindows:         appWindow,
+		Metrics:            reg,
+		AdvertiseScheme:    advertiseScheme,
+		MirrorURL:          mirror,
+		Upstream:           upstream,
+		UpstreamInterval:   upstreamPeriod,
+		RedirectPrefixes:   redirectPrefix,
+		Envs:               envs,
+		ClusterAlias:       clusterAlias,
+		DebugOverride:      debugOverride,
+		LooseAppID:         looseAppID,
+		NotFoundHints:      notFoundHints,
+		GraphQL:            graphQL,
+		Hook:               hook,
+		Authenticator:      authenticator,
+		ReleaseKeyMode:     releaseKeyMode,
+		NotificationFault:  pollFault,
+		Faults:             faults(),
+		AccessLog:          accessLog,
+		StaleAfter:         staleAfter,
+		CacheFile:          cacheFile,
+		SnapshotDir:        snapshotDir,
+		SnapshotInterval:   snapshotPeriod,
+		SoakInterval:       soakPeriod,
+		SoakSamples:        soakSamples,
+		SnapshotRetain:     snapshotRetain,
+		RequestLogSize:     requestLogSize,
+		RequestJournal:     requestJournal,
+		Service: apollo.ServiceConfig{
+			AppName:    serviceName,
+			InstanceID: serviceID,
+			Fields:     serviceField,
+			Instances:  serviceInstance,
+		},
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// internal server for telemetry and ctrl, disabled by port 0 so that only the Apollo APIs are served
+	var internalSrv *http.Server
+	if internalPort > 0 {
+		internalRouter := httprouter.New()
+		ctrlRoutes(internalRouter)
+		pprofRoutes(internalRouter)
+		internalRouter.Handler("GET", "/metrics", reg)
+		internalRouter.Handler("GET", "/admin/dashboard.json", metrics.DashboardHandler(reg))
+		a.AdminRoutes(internalRouter)
+		a.CtrlRoutes(internalRouter)
+		internalSrv = &http.Server{
+			Addr:              ":" + strconv.Itoa(internalPort),
+			Handler:           limitBody(internalRouter, maxBodyBytes),
+			MaxHeaderBytes:    maxHeaderBytes,
+			ReadHeaderTimeout: headerTimeout,
+			IdleTimeout:       idleTimeout,
+			TLSConfig:         tlsCfg,
+		}
+		go func() {
+			serve := internalSrv.ListenAndServe
+			if tlsCfg != nil {
+				serve = func() error { return internalSrv.ListenAndServeTLS("", "") }
+			}
+			if err := serve(); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	} else {
+		logger.Get().Info("internal server disabled")
+	}
+
+	// public server for serving config via Apollo APIs
+	router := httprouter.New()
 	a.Routes(router)
+	a.OpenAPIRoutes(router)
+	// no read or write timeouts, they would cut the long polls
 	srv := &http.Server{
-		Addr:    ":" + strconv.Itoa(configPort),
-		Handler: router,
+		Addr:              ":" + strconv.Itoa(configPort),
+		Handler:           releaseHandshake(limitBody(router, maxBodyBytes)),
+		MaxHeaderBytes:    maxHeaderBytes,
+		ReadHeaderTimeout: headerTimeout,
+		IdleTimeout:       idleTimeout,
+		ConnContext:       connContext,
+		ConnState:         a.ConnState,
+	}
+	ln, err := listen(srv.Addr, keepAlive, keepAliveCount)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ln = limitHandshakes(ln, maxHandshakes)
+	if tlsCfg != nil {
+		// wrapping the limited listener keeps *tls.Conn as the connection of the requests, setting r.TLS
+		ln = tls.NewListener(ln, tlsCfg)
 	}
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
 	}()
 
 	// graceful shutdown
 	<-termChan
-	cancel()
-	internalSrv.Close()
-	srv.Close()
 	logger.Get().Info("shutting down")
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer shutdownCancel()
+	// complete open polls before closing the listeners so that clients reconnect cleanly
+	if err := a.Shutdown(shutdownCtx); err != nil {
+		logger.Get().Warn(fmt.Sprintf("error completing polls: %v", err))
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Get().Warn(fmt.Sprintf("error shutting down server: %v", err))
+	}
+	cancel()
+	if internalSrv != nil {
+		internalSrv.Close()
+	}
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/figroc/mock-apollo-go/internal/scenario"
+)
+
+// runScenario runs `scenario run [-junit file] spec.yaml` and returns the exit code
+func runScenario(args []string) int {
+	fs := flag.NewFlagSet("scenario run", flag.ExitOnError)
+	junit := fs.String("junit", "", "JUnit XML report file of the assertions")
+	if len(args) == 0 || args[0] != "run" {
+		fmt.Fprintln(os.Stderr, "usage: mock-apollo-go scenario run [-junit file] spec.yaml")
+		return 2
+	}
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: mock-apollo-go scenario run [-junit file] spec.yaml")
+		return 2
+	}
+
+	spec, err := scenario.Load(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	r, err := scenario.New(ctx, scenario.Config{Log: logger, Spec: spec, Output: os.Stderr})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Fprintf(os.Stderr, "running scenario %s against %s\n", spec.Name, r.URL())
+	report, err := r.Run(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	report.WriteText(os.Stdout)
+	if *junit != "" {
+		f, err := os.Create(*junit)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		defer f.Close()
+		if err := report.WriteJUnit(f); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	if report.Failures() > 0 {
+		return 1
+	}
+	return 0
+}
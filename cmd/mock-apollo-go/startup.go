@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+	"github.com/lalamove/nui/nlogger"
+)
+
+const (
+	startupMinBackoff = 100 * time.Millisecond
+	startupMaxBackoff = 5 * time.Second
+)
+
+// waitConfigFiles retries loading the config files of cfg with an exponential backoff
+// until all of them load or timeout passes, so that files provisioned shortly after
+// the start of the server do not fail it. It returns the last error on timeout
+func waitConfigFiles(log nlogger.Provider, cfg watcher.ManagerConfig, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := startupMinBackoff
+	for {
+		err := loadConfigFiles(cfg)
+		if err == nil {
+			return nil
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return err
+		}
+		if backoff > left {
+			backoff = left
+		}
+		log.Get().Warn(fmt.Sprintf("config files are not ready, retrying in %s: %v", backoff, err))
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > startupMaxBackoff {
+			backoff = startupMaxBackoff
+		}
+	}
+}
+
+// loadConfigFiles returns the first error loading the config files
+func loadConfigFiles(cfg watcher.ManagerConfig) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg.Log = nlogger.NewProvider(nlogger.New(io.Discard, ""))
+	_, err := watcher.NewManager(ctx, cfg)
+	return err
+}
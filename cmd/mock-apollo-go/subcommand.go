@@ -0,0 +1,24 @@
+package main
+
+import "os"
+
+// subcommands are run instead of the server, they return the exit code
+var subcommands = map[string]func(args []string) int{
+	"scenario": runScenario,
+	"fixture":  runFixture,
+	"encrypt":  runEncrypt,
+	"golden":   runGolden,
+}
+
+// isSubcommand returns true if a subcommand is run instead of the server
+func isSubcommand() bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+	_, ok := subcommands[os.Args[1]]
+	return ok
+}
+
+func runSubcommand(name string, args []string) int {
+	return subcommands[name](args)
+}
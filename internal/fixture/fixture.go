@@ -0,0 +1,254 @@
+package fixture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+	"gopkg.in/yaml.v2"
+)
+
+// Entry is a request of a client captured with its response
+type Entry struct {
+	URL *url.URL
+	// Status is the status of the response, 0 means no response was captured
+	Status int
+	Body   []byte
+}
+
+type har struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				URL string `json:"url"`
+			} `json:"request"`
+			Response struct {
+				Status  int `json:"status"`
+				Content struct {
+					Text     string `json:"text"`
+					Encoding string `json:"encoding"`
+				} `json:"content"`
+			} `json:"response"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// Load reads a capture file, either a HAR file or a list of request URLs, one per line
+func Load(path string) ([]Entry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if entries, err := parseHAR(b); err == nil {
+		return entries, nil
+	}
+	entries := []Entry{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		u, err := url.Parse(line)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, Entry{URL: u})
+	}
+	return entries, s.Err()
+}
+
+func parseHAR(b []byte) ([]Entry, error) {
+	h := har{}
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, err
+	}
+	entries := []Entry{}
+	for _, e := range h.Log.Entries {
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			return nil, err
+		}
+		body := []byte(e.Response.Content.Text)
+		if e.Response.Content.Encoding == "base64" {
+			if body, err = base64.StdEncoding.DecodeString(e.Response.Content.Text); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, Entry{URL: u, Status: e.Response.Status, Body: body})
+	}
+	return entries, nil
+}
+
+type key struct {
+	appID     string
+	cluster   string
+	namespace string
+}
+
+// Infer returns the minimal ConfigMap serving the captured requests,
+// the keys and values are taken from the captured responses, later entries win
+func Infer(entries []Entry) watcher.ConfigMap {
+	found := make(map[key]*watcher.Namespace)
+	namespace := func(appID string, cluster string, name string) (*watcher.Namespace, string) {
+		ext := filepath.Ext(name)
+		switch ext {
+		case ".properties", ".yml", ".yaml", ".xml", ".json":
+			name = strings.TrimSuffix(name, ext)
+		default:
+			ext = ".properties"
+		}
+		k := key{appID, cluster, name}
+		if found[k] == nil {
+			found[k] = &watcher.Namespace{}
+		}
+		return found[k], ext
+	}
+
+	for _, e := range entries {
+		parts := strings.Split(strings.Trim(e.URL.Path, "/"), "/")
+		switch {
+		case len(parts) == 4 && parts[0] == "configs":
+			ns, ext := namespace(parts[1], parts[2], parts[3])
+			res := struct {
+				ReleaseKey     string            `json:"releaseKey"`
+				Configurations map[string]string `json:"configurations"`
+			}{}
+			if e.Status == 200 && json.Unmarshal(e.Body, &res) == nil {
+				ns.ReleaseKey = res.ReleaseKey
+				setConfig(ns, ext, res.Configurations)
+			}
+		case len(parts) == 5 && parts[0] == "configfiles" && parts[1] == "json":
+			ns, ext := namespace(parts[2], parts[3], parts[4])
+			config := map[string]string{}
+			if e.Status == 200 && json.Unmarshal(e.Body, &config) == nil {
+				setConfig(ns, ext, config)
+			}
+		case len(parts) == 4 && parts[0] == "configfiles":
+			ns, ext := namespace(parts[1], parts[2], parts[3])
+			if e.Status == 200 {
+				if ext == ".properties" {
+					setConfig(ns, ext, parseProperties(string(e.Body)))
+				} else {
+					setConfig(ns, ext, map[string]string{"content": string(e.Body)})
+				}
+			}
+		case len(parts) == 2 && parts[0] == "notifications" && parts[1] == "v2":
+			q := e.URL.Query()
+			notifications := []struct {
+				NamespaceName string `json:"namespaceName"`
+			}{}
+			if json.Unmarshal([]byte(q.Get("notifications")), &notifications) != nil {
+				continue
+			}
+			for _, n := range notifications {
+				namespace(q.Get("appId"), q.Get("cluster"), n.NamespaceName)
+			}
+		}
+	}
+
+	cm := watcher.ConfigMap{}
+	for k, ns := range found {
+		// requests missing a path segment or query parameter are skipped
+		if k.appID == "" || k.cluster == "" || k.namespace == "" {
+			continue
+		}
+		if cm[k.appID] == nil {
+			cm[k.appID] = make(map[string]map[string]watcher.Namespace)
+		}
+		if cm[k.appID][k.cluster] == nil {
+			cm[k.appID][k.cluster] = make(map[string]watcher.Namespace)
+		}
+		cm[k.appID][k.cluster][k.namespace] = *ns
+	}
+	return cm
+}
+
+// setConfig merges the config served for a namespace into it
+func setConfig(ns *watcher.Namespace, ext string, config map[string]string) {
+	switch ext {
+	case ".yml":
+		ns.Yml = config["content"]
+	case ".yaml":
+		ns.Yaml = config["content"]
+	case ".json":
+		ns.JSON = config["content"]
+	case ".xml":
+		ns.XML = config["content"]
+	default:
+		if ns.Properties == nil {
+			ns.Properties = make(map[string]string)
+		}
+		for k, v := range config {
+			ns.Properties[k] = v
+		}
+	}
+}
+
+// parseProperties parses the key=value and key:value lines of a properties file,
+// continuation lines and escapes other than \uXXXX are not supported
+func parseProperties(s string) map[string]string {
+	props := make(map[string]string)
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		i := strings.IndexAny(line, "=:")
+		if i < 0 {
+			props[unescape(line)] = ""
+			continue
+		}
+		props[unescape(strings.TrimSpace(line[:i]))] = unescape(strings.TrimSpace(line[i+1:]))
+	}
+	return props
+}
+
+func unescape(s string) string {
+	if !strings.Contains(s, "\\u") {
+		return s
+	}
+	if u, err := strconv.Unquote(`"` + strings.ReplaceAll(s, `"`, `\"`) + `"`); err == nil {
+		return u
+	}
+	return s
+}
+
+// fixtureNamespace is a Namespace written without its empty fields
+type fixtureNamespace struct {
+	ReleaseKey string            `yaml:"releaseKey,omitempty"`
+	Properties map[string]string `yaml:"properties,omitempty"`
+	Yml        string            `yaml:"yml,omitempty"`
+	Yaml       string            `yaml:"yaml,omitempty"`
+	JSON       string            `yaml:"json,omitempty"`
+	XML        string            `yaml:"xml,omitempty"`
+}
+
+// Marshal returns the YAML config file of a ConfigMap
+func Marshal(cm watcher.ConfigMap) ([]byte, error) {
+	out := make(map[string]map[string]map[string]fixtureNamespace)
+	for appID, clusters := range cm {
+		out[appID] = make(map[string]map[string]fixtureNamespace)
+		for cluster, namespaces := range clusters {
+			out[appID][cluster] = make(map[string]fixtureNamespace)
+			for name, ns := range namespaces {
+				out[appID][cluster][name] = fixtureNamespace{
+					ReleaseKey: ns.ReleaseKey,
+					Properties: ns.Properties,
+					Yml:        ns.Yml,
+					Yaml:       ns.Yaml,
+					JSON:       ns.JSON,
+					XML:        ns.XML,
+				}
+			}
+		}
+	}
+	return yaml.Marshal(out)
+}
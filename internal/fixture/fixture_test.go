@@ -0,0 +1,80 @@
+package fixture
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestInfer(t *testing.T) {
+	dir := t.TempDir()
+	notifications, err := json.Marshal([]map[string]interface{}{
+		{"namespaceName": "application", "notificationId": -1},
+		{"namespaceName": "db.yaml", "notificationId": -1},
+	})
+	require.Nil(t, err)
+	capture, err := json.Marshal(map[string]interface{}{"log": map[string]interface{}{"entries": []interface{}{
+		map[string]interface{}{
+			"request":  map[string]interface{}{"url": "http://apollo/configs/app/cluster/application?ip=10.0.0.1"},
+			"response": map[string]interface{}{"status": 200, "content": map[string]interface{}{"text": `{"releaseKey":"abc","configurations":{"timeout":"5s"}}`}},
+		},
+		map[string]interface{}{
+			"request":  map[string]interface{}{"url": "http://apollo/configfiles/app/cluster/application"},
+			"response": map[string]interface{}{"status": 200, "content": map[string]interface{}{"text": "# comment\nname = caf\\u00e9\n"}},
+		},
+		map[string]interface{}{
+			"request":  map[string]interface{}{"url": "http://apollo/configs/app/cluster/db.yaml"},
+			"response": map[string]interface{}{"status": 200, "content": map[string]interface{}{"text": `{"configurations":{"content":"url: mysql://db"}}`}},
+		},
+		map[string]interface{}{
+			"request":  map[string]interface{}{"url": "http://apollo/notifications/v2?appId=app&cluster=cluster&notifications=" + string(notifications)},
+			"response": map[string]interface{}{"status": 304, "content": map[string]interface{}{}},
+		},
+		map[string]interface{}{
+			"request":  map[string]interface{}{"url": "http://apollo/configs/app/cluster/missing"},
+			"response": map[string]interface{}{"status": 404, "content": map[string]interface{}{}},
+		},
+	}}})
+	require.Nil(t, err)
+	path := filepath.Join(dir, "capture.har")
+	require.Nil(t, os.WriteFile(path, capture, 0644))
+
+	entries, err := Load(path)
+	require.Nil(t, err)
+	require.Len(t, entries, 5)
+	cm := Infer(entries)
+	require.Equal(t, watcher.ConfigMap{
+		"app": {
+			"cluster": {
+				"application": {ReleaseKey: "abc", Properties: map[string]string{"timeout": "5s", "name": "café"}},
+				"db":          {Yaml: "url: mysql://db"},
+				"missing":     {},
+			},
+		},
+	}, cm)
+
+	b, err := Marshal(cm)
+	require.Nil(t, err)
+	loaded := watcher.ConfigMap{}
+	require.Nil(t, yaml.Unmarshal(b, &loaded))
+	require.Equal(t, cm, loaded)
+	require.NotContains(t, string(b), "xml")
+
+	t.Run("urls", func(t *testing.T) {
+		path := filepath.Join(dir, "urls")
+		require.Nil(t, os.WriteFile(path, []byte("# access log\n/configs/app/cluster/application\n\n/configfiles/json/app/other/feature\n/healthz\n"), 0644))
+		entries, err := Load(path)
+		require.Nil(t, err)
+		require.Equal(t, watcher.ConfigMap{
+			"app": {
+				"cluster": {"application": {}},
+				"other":   {"feature": {}},
+			},
+		}, Infer(entries))
+	})
+}
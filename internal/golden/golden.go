@@ -0,0 +1,145 @@
+package golden
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Request is a canonical request sent to the server, its response is written to a file named after it
+type Request struct {
+	Name   string
+	Method string
+	// Path is the path with the query of the request
+	Path string
+}
+
+// volatileHeaders vary between two runs of the same server, they are left out of the responses
+var volatileHeaders = map[string]bool{
+	"Date":                  true,
+	"Content-Length":        true,
+	"X-Ratelimit-Remaining": true,
+	"X-Ratelimit-Reset":     true,
+}
+
+// Requests returns the canonical requests of the namespaces of an app: the configs, configfiles,
+// notification and service discovery routes, a namespace that is not served and a path without a route
+func Requests(appID string, cluster string, namespaces []string) []Request {
+	app := url.PathEscape(appID) + "/" + url.PathEscape(cluster)
+	reqs := []Request{}
+	notifications := []map[string]interface{}{}
+	for _, ns := range namespaces {
+		path := app + "/" + url.PathEscape(ns)
+		reqs = append(reqs,
+			Request{Name: "configs-" + ns, Method: "GET", Path: "/configs/" + path},
+			Request{Name: "configs-" + ns + "-head", Method: "HEAD", Path: "/configs/" + path},
+			Request{Name: "configs-" + ns + "-release-key", Method: "GET", Path: "/configs/" + path + "?releaseKey=golden"},
+			Request{Name: "configfiles-" + ns, Method: "GET", Path: "/configfiles/" + path},
+			Request{Name: "configfiles-json-" + ns, Method: "GET", Path: "/configfiles/json/" + path},
+		)
+		notifications = append(notifications, map[string]interface{}{"namespaceName": ns, "notificationId": -1})
+	}
+	b, _ := json.Marshal(notifications)
+	query := url.Values{"appId": {appID}, "cluster": {cluster}}
+	reqs = append(reqs,
+		Request{Name: "configs-missing", Method: "GET", Path: "/configs/" + app + "/golden-missing"},
+		Request{Name: "notifications", Method: "GET", Path: "/notifications/v2?" + query.Encode() + "&notifications=" + url.QueryEscape(string(b))},
+		Request{Name: "services", Method: "GET", Path: "/services/config?appId=" + url.QueryEscape(appID)},
+		Request{Name: "healthz", Method: "GET", Path: "/healthz"},
+		Request{Name: "not-found", Method: "GET", Path: "/golden/not-found"},
+	)
+	return reqs
+}
+
+// Record sends the requests to the server at base in order and writes their responses to dir,
+// one file per request numbered in order, so that the dirs of two versions of the server can be diffed
+func Record(ctx context.Context, client *http.Client, base *url.URL, reqs []Request, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i, req := range reqs {
+		b, err := send(ctx, client, base, req)
+		if err != nil {
+			return fmt.Errorf("%s: %v", req.Name, err)
+		}
+		name := fmt.Sprintf("%02d-%s.txt", i+1, fileName(req.Name))
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileName replaces the characters of a request name that are not safe in a file name
+func fileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// send sends a request and returns its response formatted
+func send(ctx context.Context, client *http.Client, base *url.URL, req Request) ([]byte, error) {
+	u, err := base.Parse(strings.TrimSuffix(base.Path, "/") + req.Path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequestWithContext(ctx, req.Method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return Format(req, res, body), nil
+}
+
+// Format writes the request line, the status, the headers sorted and the body of a response,
+// JSON bodies are indented with their keys sorted so that their diffs are readable
+func Format(req Request, res *http.Response, body []byte) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "%s %s\n", req.Method, req.Path)
+	fmt.Fprintf(buf, "%d\n", res.StatusCode)
+	names := make([]string, 0, len(res.Header))
+	for k := range res.Header {
+		if !volatileHeaders[k] {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		for _, v := range res.Header[k] {
+			fmt.Fprintf(buf, "%s: %s\n", k, v)
+		}
+	}
+	buf.WriteString("\n")
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	// numbers are kept as written
+	d.UseNumber()
+	if err := d.Decode(&v); err == nil && !d.More() {
+		// maps are marshaled with their keys sorted
+		if b, err := json.MarshalIndent(v, "", "  "); err == nil {
+			body = append(b, '\n')
+		}
+	}
+	buf.Write(body)
+	return buf.Bytes()
+}
@@ -0,0 +1,67 @@
+package golden
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequests(t *testing.T) {
+	reqs := Requests("app", "default", []string{"application", "db.yaml"})
+	require.Len(t, reqs, 15)
+	require.Equal(t, Request{Name: "configs-application", Method: "GET", Path: "/configs/app/default/application"}, reqs[0])
+	require.Equal(t, "HEAD", reqs[1].Method)
+	require.Equal(t, "/configfiles/json/app/default/db.yaml", reqs[9].Path)
+	require.Equal(t, "notifications", reqs[11].Name)
+	require.Contains(t, reqs[11].Path, url.QueryEscape(`[{"namespaceName":"application","notificationId":-1},{"namespaceName":"db.yaml","notificationId":-1}]`))
+}
+
+func TestRecord(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Ratelimit-Remaining", "9")
+		if r.URL.Path == "/apollo/configs/app/default/application" {
+			w.Write([]byte(`{"releaseKey":"k","configurations":{"b":"2","a":"1"},"size":12345678901234567890}`))
+			return
+		}
+		w.WriteHeader(404)
+		w.Write([]byte("not found"))
+	}))
+	defer srv.Close()
+	base, err := url.Parse(srv.URL + "/apollo/")
+	require.Nil(t, err)
+
+	dir := t.TempDir()
+	reqs := []Request{
+		{Name: "configs", Method: "GET", Path: "/configs/app/default/application"},
+		{Name: "missing?", Method: "GET", Path: "/configs/app/default/missing"},
+	}
+	require.Nil(t, Record(context.Background(), srv.Client(), base, reqs, dir))
+	b, err := os.ReadFile(filepath.Join(dir, "01-configs.txt"))
+	require.Nil(t, err)
+	require.Equal(t, `GET /configs/app/default/application
+200
+Content-Type: application/json
+
+{
+  "configurations": {
+    "a": "1",
+    "b": "2"
+  },
+  "releaseKey": "k",
+  "size": 12345678901234567890
+}
+`, string(b))
+	b, err = os.ReadFile(filepath.Join(dir, "02-missing_.txt"))
+	require.Nil(t, err)
+	require.Equal(t, "GET /configs/app/default/missing\n404\nContent-Type: application/json\n\nnot found", string(b))
+
+	srv.Close()
+	require.NotNil(t, Record(context.Background(), srv.Client(), base, reqs, dir))
+}
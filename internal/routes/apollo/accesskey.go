@@ -0,0 +1,90 @@
+package apollo
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// accessKeyTolerance is how far the Timestamp of a signed request may be off, as with Apollo
+const accessKeyTolerance = time.Minute
+
+// accessKeys returns the access key secrets of an app, collected from all its namespaces
+func (a *Apollo) accessKeys(appID string) []string {
+	var secrets []string
+	seen := make(map[string]bool)
+	for _, k := range a.store.ListApp(appID) {
+		ns, err := a.store.Get(k.AppID, k.Cluster, k.Namespace)
+		if err != nil {
+			continue
+		}
+		for _, s := range ns.AccessKeys {
+			if s != "" && !seen[s] {
+				seen[s] = true
+				secrets = append(secrets, s)
+			}
+		}
+	}
+	return secrets
+}
+
+// signature returns the signature of a request with the accesskey mechanism of Apollo,
+// the base64 encoded HMAC-SHA1 of the timestamp and the path with the query
+func signature(timestamp string, pathWithQuery string, secret string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + pathWithQuery))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkAccessKey verifies the Authorization and Timestamp headers of r against the secrets of appID
+func checkAccessKey(r *http.Request, appID string, secrets []string, now time.Time) error {
+	timestamp := r.Header.Get("Timestamp")
+	ms, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp '%s'", timestamp)
+	}
+	if d := now.Sub(time.Unix(0, ms*int64(time.Millisecond))); d > accessKeyTolerance || d < -accessKeyTolerance {
+		return fmt.Errorf("request time expired: %s", timestamp)
+	}
+	auth := r.Header.Get("Authorization")
+	prefix := "Apollo " + appID + ":"
+	if !strings.HasPrefix(auth, prefix) {
+		return fmt.Errorf("invalid authorization '%s'", auth)
+	}
+	pathWithQuery := r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		pathWithQuery += "?" + r.URL.RawQuery
+	}
+	for _, s := range secrets {
+		if hmac.Equal([]byte(auth[len(prefix):]), []byte(signature(timestamp, pathWithQuery, s))) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid signature for %s", appID)
+}
+
+// withAccessKey rejects the unsigned requests of the apps with access keys with 401
+func (a *Apollo) withAccessKey(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		appID := ps.ByName("appId")
+		if appID == "" {
+			appID = r.URL.Query().Get("appId")
+		}
+		if secrets := a.accessKeys(appID); len(secrets) > 0 {
+			if err := checkAccessKey(r, appID, secrets, time.Now()); err != nil {
+				a.cfg.Log.Get().Warn(fmt.Sprintf("unauthorized request: %s: %v", r.URL.String(), err))
+				w.WriteHeader(401)
+				w.Write([]byte("unauthorized"))
+				return
+			}
+		}
+		h(w, r, ps)
+	}
+}
@@ -0,0 +1,92 @@
+package apollo
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/lalamove/nui/nlogger"
+)
+
+// AccessLog configures the line logged per served request
+type AccessLog struct {
+	Enabled bool
+	// Sample logs 1 in Sample of the requests passing the filters, 0 or 1 logs all of them
+	Sample int
+	// Paths are the prefixes of the paths logged, empty means all paths
+	Paths []string
+	// AppIDs are the appIds logged, empty means all appIds
+	AppIDs []string
+}
+
+// accessLog samples and filters the requests logged
+type accessLog struct {
+	cfg  AccessLog
+	seen uint64
+}
+
+// logged returns true if the request of a path and appId is logged
+func (l *accessLog) logged(path string, appID string) bool {
+	if !l.cfg.Enabled {
+		return false
+	}
+	if len(l.cfg.Paths) > 0 {
+		matched := false
+		for _, prefix := range l.cfg.Paths {
+			if strings.HasPrefix(path, prefix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(l.cfg.AppIDs) > 0 {
+		matched := false
+		for _, id := range l.cfg.AppIDs {
+			if id == appID {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	n := atomic.AddUint64(&l.seen, 1)
+	return l.cfg.Sample <= 1 || n%uint64(l.cfg.Sample) == 1
+}
+
+// logAccess logs a served request of a route if it passes the filters and the sampling,
+// with its fields structured for the loggers printing them as keys, e.g. in JSON
+func (a *Apollo) logAccess(r *http.Request, route string, ps httprouter.Params, code int, elapsed time.Duration) {
+	appID := ps.ByName("appId")
+	if appID == "" {
+		appID = r.URL.Query().Get("appId")
+	}
+	if !a.accessLog.logged(r.URL.Path, appID) {
+		return
+	}
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	msg := fmt.Sprintf("%s %s %s %d %s", clientIP(r), r.Method, r.URL.RequestURI(), code, elapsed)
+	a.cfg.Log.Get().InfoWithFields(msg, func(e nlogger.Entry) {
+		e.String("route", route)
+		e.String("method", r.Method)
+		e.String("uri", r.URL.RequestURI())
+		e.Int("status", code)
+		e.Float("durationMs", float64(elapsed)/float64(time.Millisecond))
+		e.String("appId", appID)
+		e.String("cluster", ps.ByName("cluster"))
+		e.String("namespace", ps.ByName("namespace"))
+		e.String("ip", clientIP(r))
+		e.String("remoteIp", remoteIP)
+	})
+}
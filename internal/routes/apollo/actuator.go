@@ -0,0 +1,20 @@
+package apollo
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// actuatorHealth answers the Spring Boot health endpoint of the Apollo config service,
+// which some SDKs call as a heartbeat of the server they were discovered
+func (a *Apollo) actuatorHealth(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	if atomic.LoadInt32(&a.closing) != 0 {
+		w.WriteHeader(503)
+		w.Write([]byte(`{"status":"OUT_OF_SERVICE"}`))
+		return
+	}
+	w.Write([]byte(`{"status":"UP"}`))
+}
@@ -0,0 +1,50 @@
+package apollo
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/figroc/mock-apollo-go/pkg/auth"
+	"github.com/julienschmidt/httprouter"
+)
+
+// withAuth rejects the requests denied by the configured authenticator with 401,
+// and the ones of an app their caller may not read with 403
+func (a *Apollo) withAuth(h httprouter.Handle) httprouter.Handle {
+	if a.cfg.Authenticator == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		param := func(name string) string {
+			if v := ps.ByName(name); v != "" {
+				return v
+			}
+			return r.URL.Query().Get(name)
+		}
+		appID := param("appId")
+		namespace, _ := a.parseNamespace(ps.ByName("namespace"))
+		id, err := a.cfg.Authenticator.Authenticate(auth.Request{
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Header:    r.Header,
+			TLS:       r.TLS,
+			AppID:     appID,
+			Cluster:   param("cluster"),
+			Namespace: namespace,
+			ClientIP:  clientIP(r),
+		})
+		if err != nil {
+			a.cfg.Log.Get().Warn(fmt.Sprintf("unauthenticated request: %s: %v", r.URL.String(), err))
+			w.WriteHeader(401)
+			w.Write([]byte("unauthorized"))
+			return
+		}
+		if appID != "" && !id.Allows(appID) {
+			a.cfg.Log.Get().Warn(fmt.Sprintf("forbidden request of %s: %s", id.Subject, r.URL.String()))
+			w.WriteHeader(403)
+			w.Write([]byte("forbidden"))
+			return
+		}
+		h(w, r.WithContext(auth.NewContext(r.Context(), id)), ps)
+	}
+}
@@ -0,0 +1,89 @@
+package apollo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+	"gopkg.in/yaml.v2"
+)
+
+// configCache is a store source serving the config persisted by the last successful load of the files,
+// while the files fail to load at startup
+type configCache struct {
+	path string
+	// cm is empty once the files loaded
+	cm atomic.Value
+}
+
+func newConfigCache(path string) *configCache {
+	c := &configCache{path: path}
+	c.cm.Store(watcher.ConfigMap{})
+	return c
+}
+
+func (c *configCache) Config() watcher.ConfigMap {
+	return c.cm.Load().(watcher.ConfigMap)
+}
+
+// load serves the persisted config
+func (c *configCache) load() error {
+	b, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	cm := watcher.ConfigMap{}
+	if err := yaml.Unmarshal(b, &cm); err != nil {
+		return fmt.Errorf("%s: %v", c.path, err)
+	}
+	if len(cm) == 0 {
+		return fmt.Errorf("%s: empty config cache", c.path)
+	}
+	c.cm.Store(cm)
+	return nil
+}
+
+// save persists cm and stops serving the persisted config, the file is replaced atomically
+func (c *configCache) save(cm watcher.ConfigMap) error {
+	c.cm.Store(watcher.ConfigMap{})
+	b, err := yaml.Marshal(cm)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path)
+}
+
+// saveConfigCache persists the live config once all the files loaded
+func (a *Apollo) saveConfigCache() {
+	if a.cache == nil {
+		return
+	}
+	for _, w := range a.watchers() {
+		if s := w.Status(); s.LastReload.IsZero() || s.LastError != "" {
+			return
+		}
+	}
+	a.fixtures.mu.RLock()
+	live := a.fixtures.live
+	a.fixtures.mu.RUnlock()
+	if live == nil {
+		return
+	}
+	if err := a.cache.save(live.m.Config()); err != nil {
+		a.cfg.Log.Get().Warn(fmt.Sprintf("error saving config cache: %v", err))
+	}
+}
@@ -0,0 +1,109 @@
+package apollo
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// clientStat counts the open connections and polls of a remote ip
+type clientStat struct {
+	IP          string `json:"ip"`
+	Connections int    `json:"connections"`
+	Polls       int    `json:"polls"`
+}
+
+// connCounter counts the open connections per remote ip
+type connCounter struct {
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// ConnState tracks the connections of the config server, see http.Server.ConnState
+func (a *Apollo) ConnState(c net.Conn, state http.ConnState) {
+	ip := remoteHost(c.RemoteAddr().String())
+	a.conns.mu.Lock()
+	defer a.conns.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		a.conns.conns[ip]++
+	case http.StateHijacked, http.StateClosed:
+		if a.conns.conns[ip] <= 1 {
+			delete(a.conns.conns, ip)
+		} else {
+			a.conns.conns[ip]--
+		}
+	}
+}
+
+// topClients returns the n remote ips with the most open connections and polls
+func (a *Apollo) topClients(n int) []clientStat {
+	stats := make(map[string]*clientStat)
+	stat := func(ip string) *clientStat {
+		if stats[ip] == nil {
+			stats[ip] = &clientStat{IP: ip}
+		}
+		return stats[ip]
+	}
+	a.conns.mu.Lock()
+	for ip, count := range a.conns.conns {
+		stat(ip).Connections = count
+	}
+	a.conns.mu.Unlock()
+	a.mu.RLock()
+	for ip, count := range a.ipPolls {
+		stat(ip).Polls = count
+	}
+	a.mu.RUnlock()
+
+	top := make([]clientStat, 0, len(stats))
+	for _, s := range stats {
+		top = append(top, *s)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Connections != top[j].Connections {
+			return top[i].Connections > top[j].Connections
+		}
+		if top[i].Polls != top[j].Polls {
+			return top[i].Polls > top[j].Polls
+		}
+		return top[i].IP < top[j].IP
+	})
+	if n > 0 && len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+func (a *Apollo) getTopClients(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	n := 10
+	if v := r.URL.Query().Get("top"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("invalid top"))
+			return
+		}
+	}
+	json, err := json.Marshal(a.topClients(n))
+	if err != nil {
+		a.cfg.Log.Get().Error(err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
@@ -0,0 +1,124 @@
+package apollo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// acceptedEncoding returns the content coding of the response to r, gzip or deflate,
+// empty if the client accepts neither
+func acceptedEncoding(r *http.Request) string {
+	accepted := make(map[string]bool)
+	for _, e := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(e, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		q := 1.0
+		for _, p := range parts[1:] {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[name] = q > 0
+	}
+	// * stands for the codings not listed, a coding refused with q=0 stays refused
+	acceptable := func(name string) bool {
+		if ok, listed := accepted[name]; listed {
+			return ok
+		}
+		return accepted["*"]
+	}
+	switch {
+	case acceptable("gzip"):
+		return "gzip"
+	case acceptable("deflate"):
+		return "deflate"
+	}
+	return ""
+}
+
+// compressWriter compresses the body of a response once it reaches minSize,
+// smaller bodies are written as is along with the status held until then
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	code     int
+	buf      bytes.Buffer
+	w        io.WriteCloser
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.code == 0 {
+		c.code = code
+	}
+}
+
+func (c *compressWriter) Write(b []byte) (int, error) {
+	if c.code == 0 {
+		c.code = 200
+	}
+	if c.w != nil {
+		return c.w.Write(b)
+	}
+	c.buf.Write(b)
+	if c.buf.Len() < c.minSize || c.buf.Len() == 0 {
+		return len(b), nil
+	}
+	h := c.Header()
+	h.Set("Content-Encoding", c.encoding)
+	h.Del("Content-Length")
+	c.ResponseWriter.WriteHeader(c.code)
+	if c.encoding == "gzip" {
+		c.w = gzip.NewWriter(c.ResponseWriter)
+	} else {
+		c.w = zlib.NewWriter(c.ResponseWriter)
+	}
+	if _, err := c.w.Write(c.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	c.buf.Reset()
+	return len(b), nil
+}
+
+// close completes the compressed body, or writes the response held back as is
+func (c *compressWriter) close() error {
+	if c.w != nil {
+		return c.w.Close()
+	}
+	if c.code != 0 {
+		c.ResponseWriter.WriteHeader(c.code)
+	}
+	if c.buf.Len() > 0 {
+		_, err := c.ResponseWriter.Write(c.buf.Bytes())
+		return err
+	}
+	return nil
+}
+
+// withCompression compresses the responses of h with the gzip or deflate encoding accepted by the client,
+// the bodies smaller than CompressionMinSize are not compressed
+func (a *Apollo) withCompression(h httprouter.Handle) httprouter.Handle {
+	if a.cfg.DisableCompression {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := acceptedEncoding(r)
+		if encoding == "" || r.Method == "HEAD" {
+			h(w, r, ps)
+			return
+		}
+		c := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: a.cfg.CompressionMinSize}
+		h(c, r, ps)
+		c.close()
+	}
+}
@@ -0,0 +1,223 @@
+package apollo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/figroc/mock-apollo-go/pkg/store"
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/yaml.v2"
+)
+
+// CtrlRoutes registers the http handles mutating the served namespaces at runtime,
+// e.g. from an integration test changing the config of its client
+func (a *Apollo) CtrlRoutes(r *httprouter.Router) {
+	r.PanicHandler = a.recoverPanic
+	r.GET("/ctrl/configs/:appId/:cluster/:namespace", a.getCtrlConfig)
+	r.PUT("/ctrl/configs/:appId/:cluster/:namespace", a.putCtrlConfig)
+	r.POST("/ctrl/configs/:appId/:cluster/:namespace", a.postCtrlConfig)
+	r.DELETE("/ctrl/configs/:appId/:cluster/:namespace", a.deleteCtrlConfig)
+	r.GET("/ctrl/export", a.getCtrlExport)
+	r.POST("/ctrl/import", a.postCtrlImport)
+	r.GET("/ctrl/requests", a.getCtrlRequests)
+	r.DELETE("/ctrl/requests", a.deleteCtrlRequests)
+	r.GET("/ctrl/faults", a.getFaults)
+	r.PUT("/ctrl/faults", a.putFaults)
+	r.DELETE("/ctrl/faults", a.deleteFaults)
+	r.GET("/ctrl/mirror", a.getCtrlMirror)
+	r.DELETE("/ctrl/mirror", a.deleteCtrlMirror)
+	r.GET("/ctrl/files", a.getCtrlFiles)
+	r.POST("/ctrl/files", a.postCtrlFiles)
+	r.DELETE("/ctrl/files", a.deleteCtrlFiles)
+	a.envRoutes(r, (*Apollo).CtrlRoutes)
+}
+
+func ctrlKey(ps httprouter.Params) store.Key {
+	return store.Key{AppID: ps.ByName("appId"), Cluster: ps.ByName("cluster"), Namespace: ps.ByName("namespace")}
+}
+
+// ctrlReleaseKey returns a new releaseKey, so that the clients fetch the mutated namespace
+func ctrlReleaseKey() string {
+	return "ctrl-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+func (a *Apollo) getCtrlConfig(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	k := ctrlKey(ps)
+	ns, err := a.store.Get(k.AppID, k.Cluster, k.Namespace)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	json, err := json.Marshal(ns)
+	if err != nil {
+		a.cfg.Log.Get().Error(err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// putCtrlConfig creates or replaces a namespace
+func (a *Apollo) putCtrlConfig(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ns := watcher.Namespace{}
+	if err := json.NewDecoder(r.Body).Decode(&ns); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !hasContent(ns) {
+		w.WriteHeader(400)
+		w.Write([]byte("missing properties, yml, yaml, xml or json"))
+		return
+	}
+	if ns.ReleaseKey == "" {
+		ns.ReleaseKey = ctrlReleaseKey()
+	}
+	a.upsertCtrlConfig(w, ctrlKey(ps), ns)
+}
+
+func hasContent(ns watcher.Namespace) bool {
+	return ns.Properties != nil || ns.Yml != "" || ns.Yaml != "" || ns.XML != "" || ns.JSON != ""
+}
+
+// postCtrlConfig updates a namespace, the given properties are set and the removed ones deleted,
+// the other given fields replace the ones of the namespace
+func (a *Apollo) postCtrlConfig(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	req := struct {
+		watcher.Namespace
+		Remove []string `json:"remove"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	k := ctrlKey(ps)
+	ns, err := a.store.Get(k.AppID, k.Cluster, k.Namespace)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	// the namespace is shared with the sources, so the properties are merged into a copy
+	props := make(map[string]string, len(ns.Properties)+len(req.Properties))
+	for k, v := range ns.Properties {
+		props[k] = v
+	}
+	for k, v := range req.Properties {
+		props[k] = v
+	}
+	for _, k := range req.Remove {
+		delete(props, k)
+	}
+	ns.Properties = props
+	if req.Yml != "" {
+		ns.Yml = req.Yml
+	}
+	if req.Yaml != "" {
+		ns.Yaml = req.Yaml
+	}
+	if req.XML != "" {
+		ns.XML = req.XML
+	}
+	if req.JSON != "" {
+		ns.JSON = req.JSON
+	}
+	if req.PollTimeout != 0 {
+		ns.PollTimeout = req.PollTimeout
+	}
+	if req.MaxPollTimeout != 0 {
+		ns.MaxPollTimeout = req.MaxPollTimeout
+	}
+	ns.ReleaseKey = req.ReleaseKey
+	if ns.ReleaseKey == "" {
+		ns.ReleaseKey = ctrlReleaseKey()
+	}
+	a.upsertCtrlConfig(w, k, ns)
+}
+
+func (a *Apollo) upsertCtrlConfig(w http.ResponseWriter, k store.Key, ns watcher.Namespace) {
+	if err := a.store.Upsert(k, ns); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+func (a *Apollo) deleteCtrlConfig(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := a.store.Delete(ctrlKey(ps)); err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// getCtrlExport returns all the served namespaces in the format of a config file, including the changes made at runtime,
+// as JSON if the request accepts it and as YAML otherwise
+func (a *Apollo) getCtrlExport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	cm := a.servedConfig()
+	var (
+		b   []byte
+		err error
+	)
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		b, err = json.Marshal(cm)
+	} else {
+		w.Header().Set("Content-Type", "application/yaml")
+		b, err = yaml.Marshal(cm)
+	}
+	if err != nil {
+		a.cfg.Log.Get().Error(err.Error())
+		w.Header().Del("Content-Type")
+		w.WriteHeader(500)
+		return
+	}
+	w.Write(b)
+}
+
+// postCtrlImport replaces all the served namespaces with the ones of a config file, e.g. a former export,
+// given as JSON if the request is JSON and as YAML otherwise. The namespaces of the config files missing
+// from the import stop being served, the long polls watching the changed namespaces are notified
+func (a *Apollo) postCtrlImport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	cm := watcher.ConfigMap{}
+	var err error
+	if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		err = json.NewDecoder(r.Body).Decode(&cm)
+	} else {
+		err = yaml.NewDecoder(r.Body).Decode(&cm)
+	}
+	if err != nil && err != io.EOF {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	for appID, app := range cm {
+		for cluster, c := range app {
+			for namespace, ns := range c {
+				if !hasContent(ns) {
+					w.WriteHeader(400)
+					w.Write([]byte(fmt.Sprintf("missing properties, yml, yaml, xml or json in %s/%s/%s", appID, cluster, namespace)))
+					return
+				}
+				if ns.ReleaseKey == "" {
+					ns.ReleaseKey = ctrlReleaseKey()
+					c[namespace] = ns
+				}
+			}
+		}
+	}
+	if err := a.store.Replace(cm); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,102 @@
+package apollo
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/figroc/mock-apollo-go/pkg/events"
+	"github.com/julienschmidt/httprouter"
+)
+
+// dashboardTemplate renders the served namespaces and the polling clients,
+// each namespace has a button notifying its clients of a change
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mock-apollo-go</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #eee; }
+code { font-size: 90%; }
+</style>
+</head>
+<body>
+<h1>mock-apollo-go</h1>
+<p>{{.Stats.Polls}} open polls, {{.Stats.Reloads}} reloads, {{.Stats.Notifications}} notifications sent</p>
+
+<h2>Namespaces</h2>
+<table>
+<tr><th>appId</th><th>cluster</th><th>namespace</th><th>releaseKey</th><th>properties</th><th></th></tr>
+{{range .Apps}}{{$app := .AppID}}{{range .Clusters}}{{$cluster := .Cluster}}{{range .Namespaces}}
+<tr>
+<td>{{$app}}</td><td>{{$cluster}}</td><td>{{.Namespace}}</td><td><code>{{.ReleaseKey}}</code></td>
+<td>{{range .Configurations}}<code>{{.Key}}={{.Value}}</code><br>{{end}}</td>
+<td><form method="post" action="/admin/ui/notify">
+<input type="hidden" name="appId" value="{{$app}}">
+<input type="hidden" name="cluster" value="{{$cluster}}">
+<input type="hidden" name="namespace" value="{{.Namespace}}">
+<button type="submit">Notify change</button>
+</form></td>
+</tr>
+{{end}}{{end}}{{else}}
+<tr><td colspan="6">no namespace served</td></tr>
+{{end}}
+</table>
+
+<h2>Long polls</h2>
+<table>
+<tr><th>appId</th><th>cluster</th><th>ip</th><th>remote ip</th><th>since</th><th>notifications</th></tr>
+{{range .Clients}}
+<tr>
+<td>{{.AppID}}</td><td>{{.Cluster}}</td><td>{{.IP}}</td><td>{{.RemoteIP}}</td><td>{{.Since.Format "2006-01-02 15:04:05"}}</td>
+<td>{{range .Notifications}}<code>{{.Namespace}}:{{.ID}}</code><br>{{end}}</td>
+</tr>
+{{else}}
+<tr><td colspan="6">no open poll</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+type dashboard struct {
+	Apps    []gqlApp
+	Clients []gqlClient
+	Stats   gqlStats
+}
+
+// getDashboard serves the HTML dashboard of the served config and the polling clients
+func (a *Apollo) getDashboard(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	d := dashboard{
+		Apps:    gqlApps(a.gqlNamespaces("", "")),
+		Clients: a.gqlClients(""),
+		Stats:   a.gqlStats(),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, &d); err != nil {
+		a.cfg.Log.Get().Error(err.Error())
+	}
+}
+
+// postDashboardNotify notifies the clients polling a namespace of a change without changing it,
+// so that they fetch it again
+func (a *Apollo) postDashboardNotify(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	appID, cluster, namespace := r.FormValue("appId"), r.FormValue("cluster"), r.FormValue("namespace")
+	if _, err := a.store.Get(appID, cluster, namespace); err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte("namespace not found"))
+		return
+	}
+	a.cfg.Log.Get().Info(fmt.Sprintf("notifying the clients of %s/%s/%s from the dashboard", appID, cluster, namespace))
+	a.bus.Publish(events.Event{
+		Type:      events.NamespaceUpdated,
+		AppID:     appID,
+		Cluster:   cluster,
+		Namespace: namespace,
+	})
+	http.Redirect(w, r, "/admin/ui", http.StatusSeeOther)
+}
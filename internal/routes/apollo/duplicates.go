@@ -0,0 +1,85 @@
+package apollo
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// errTooManyPolls rejects a poll of a remote ip holding MaxPollsPerIP polls already
+var errTooManyPolls = errors.New("too many polls")
+
+// duplicateWatch reports a client watching the same namespaces from several open polls,
+// e.g. an SDK wrapper starting a poll loop per config it reads
+type duplicateWatch struct {
+	AppID   string `json:"appId"`
+	Cluster string `json:"cluster"`
+	IP      string `json:"ip"`
+	// Polls is the number of open polls of the client
+	Polls int `json:"polls"`
+	// Namespaces are the namespaces watched by more than one of them
+	Namespaces []string `json:"namespaces"`
+}
+
+// duplicateWatches returns the clients, by appId, cluster and ip, watching a namespace from several polls
+func (a *Apollo) duplicateWatches() []duplicateWatch {
+	type clientKey struct {
+		appID, cluster, ip string
+	}
+	polls := make(map[clientKey]int)
+	watches := make(map[clientKey]map[string]int)
+	a.mu.RLock()
+	for p, c := range a.polls {
+		k := clientKey{c.AppID, c.Cluster, c.IP}
+		polls[k]++
+		if watches[k] == nil {
+			watches[k] = make(map[string]int)
+		}
+		for _, n := range p.Notifications() {
+			name, _ := a.parseNamespace(n.Namespace)
+			watches[k][name]++
+		}
+	}
+	a.mu.RUnlock()
+
+	dups := []duplicateWatch{}
+	for k, names := range watches {
+		d := duplicateWatch{AppID: k.appID, Cluster: k.cluster, IP: k.ip, Polls: polls[k]}
+		for name, count := range names {
+			if count > 1 {
+				d.Namespaces = append(d.Namespaces, name)
+			}
+		}
+		if len(d.Namespaces) > 0 {
+			sort.Strings(d.Namespaces)
+			dups = append(dups, d)
+		}
+	}
+	sort.Slice(dups, func(i, j int) bool {
+		if dups[i].Polls != dups[j].Polls {
+			return dups[i].Polls > dups[j].Polls
+		}
+		if dups[i].AppID != dups[j].AppID {
+			return dups[i].AppID < dups[j].AppID
+		}
+		if dups[i].Cluster != dups[j].Cluster {
+			return dups[i].Cluster < dups[j].Cluster
+		}
+		return dups[i].IP < dups[j].IP
+	})
+	return dups
+}
+
+func (a *Apollo) getDuplicateWatches(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	json, err := json.Marshal(a.duplicateWatches())
+	if err != nil {
+		a.cfg.Log.Get().Error(err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
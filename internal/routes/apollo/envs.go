@@ -0,0 +1,68 @@
+package apollo
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// newEnvs creates the Apollo of each of the Envs, serving the envs sections of the config files.
+// The cache, the snapshots and the soak samples of the process are the ones of the default env
+func (a *Apollo) newEnvs(ctx context.Context) error {
+	var first error
+	a.envs = make(map[string]*Apollo, len(a.cfg.Envs))
+	for _, env := range a.cfg.Envs {
+		cfg := a.cfg
+		cfg.Env = strings.ToUpper(env)
+		cfg.Envs = nil
+		cfg.CacheFile = ""
+		cfg.RequestJournal = ""
+		cfg.SnapshotDir = ""
+		cfg.SoakInterval = 0
+		e, err := New(ctx, cfg)
+		if err != nil && first == nil {
+			first = err
+		}
+		a.envs[cfg.Env] = e
+	}
+	return first
+}
+
+// envRoutes serves the routes registered by routes for the Apollo of each env under /envs/{env},
+// e.g. /envs/DEV/configs/...
+func (a *Apollo) envRoutes(r *httprouter.Router, routes func(*Apollo, *httprouter.Router)) {
+	if len(a.envs) == 0 {
+		return
+	}
+	routers := make(map[string]*httprouter.Router, len(a.envs))
+	for env, e := range a.envs {
+		routers[env] = httprouter.New()
+		routes(e, routers[env])
+	}
+	h := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		// env names are case insensitive like with Apollo
+		router, ok := routers[strings.ToUpper(ps.ByName("env"))]
+		if !ok {
+			a.notFound(w, r)
+			return
+		}
+		u := *r.URL
+		u.Path, u.RawPath = ps.ByName("path"), ""
+		er := *r
+		er.URL = &u
+		router.ServeHTTP(w, &er)
+	}
+	for _, method := range []string{"GET", "HEAD", "PUT", "POST", "DELETE"} {
+		r.Handle(method, "/envs/:env/*path", h)
+	}
+}
+
+// envPath returns the path prefix of the routes of the env, empty for the default env
+func (a *Apollo) envPath() string {
+	if a.cfg.Env == "" {
+		return ""
+	}
+	return "envs/" + a.cfg.Env + "/"
+}
@@ -0,0 +1,135 @@
+package apollo
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/figroc/mock-apollo-go/pkg/longpoll"
+)
+
+// fanout delivers update notifications to polls, optionally batched over a window
+// and paced to a rate per second
+type fanout struct {
+	mu     sync.Mutex
+	a      *Apollo
+	rate   int
+	queue  []*longpoll.Poll
+	wakeup chan struct{}
+	// window delays the notifications so that the namespaces changed meanwhile are answered together
+	window  time.Duration
+	pending map[*longpoll.Poll]bool
+}
+
+func newFanout(a *Apollo, rate int, window time.Duration) *fanout {
+	return &fanout{
+		a:       a,
+		rate:    rate,
+		wakeup:  make(chan struct{}, 1),
+		window:  window,
+		pending: make(map[*longpoll.Poll]bool),
+	}
+}
+
+// notify updates the polls once the batching window is over, if any
+func (f *fanout) notify(polls []*longpoll.Poll) {
+	if f.window <= 0 {
+		f.deliver(polls)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// the window starts with the first change of a batch
+	if len(f.pending) == 0 {
+		time.AfterFunc(f.window, f.flush)
+	}
+	for _, p := range polls {
+		f.pending[p] = true
+	}
+}
+
+// flush delivers the batched notifications
+func (f *fanout) flush() {
+	f.mu.Lock()
+	polls := make([]*longpoll.Poll, 0, len(f.pending))
+	for p := range f.pending {
+		polls = append(polls, p)
+	}
+	f.pending = make(map[*longpoll.Poll]bool)
+	f.mu.Unlock()
+	f.deliver(polls)
+}
+
+// deliver updates the polls right away, or queues them when pacing is enabled
+func (f *fanout) deliver(polls []*longpoll.Poll) {
+	if f.rate <= 0 {
+		for _, p := range polls {
+			f.update(p)
+		}
+		return
+	}
+	f.mu.Lock()
+	f.queue = append(f.queue, polls...)
+	f.a.metrics.queueDepth.Set(float64(len(f.queue)))
+	f.mu.Unlock()
+	select {
+	case f.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers queued notifications at the configured rate until ctx is done
+func (f *fanout) run(ctx context.Context) {
+	if f.rate <= 0 {
+		return
+	}
+	t := time.NewTicker(time.Second / time.Duration(f.rate))
+	defer t.Stop()
+	for {
+		p := f.pop()
+		if p == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-f.wakeup:
+				continue
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			f.update(p)
+		}
+	}
+}
+
+func (f *fanout) pop() *longpoll.Poll {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.queue) == 0 {
+		return nil
+	}
+	p := f.queue[0]
+	f.queue[0] = nil
+	f.queue = f.queue[1:]
+	f.a.metrics.queueDepth.Set(float64(len(f.queue)))
+	return p
+}
+
+func (f *fanout) update(p *longpoll.Poll) {
+	// polls woken by a change of another app or cluster keep waiting
+	changed := f.a.changedNotifications(p)
+	if len(changed) == 0 {
+		return
+	}
+	// polls closed after the snapshot was taken reject the update
+	if err := p.Update(changed); err != nil {
+		f.a.cfg.Log.Get().Debug(err.Error())
+		return
+	}
+	f.a.metrics.notifications.Inc()
+	for _, n := range changed {
+		f.a.metrics.nsNotified.Inc(n.Namespace)
+	}
+}
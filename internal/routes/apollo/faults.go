@@ -0,0 +1,280 @@
+package apollo
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// NotificationFault injects faults into the long polls of /notifications/v2
+type NotificationFault struct {
+	// FirstDelay holds the first poll of each client before it starts waiting for changes,
+	// simulating a slow config service at client startup
+	FirstDelay time.Duration
+	// ErrorAfter fails the polls with a 500 after the duration instead of waiting for changes
+	ErrorAfter time.Duration
+	// Empty answers the polls right away with an empty array of notifications
+	Empty bool
+	// Percent of the polls failed by ErrorAfter or Empty, 0 means all of them
+	Percent int
+}
+
+// FaultRule injects errors and latency into the requests matching its paths, appIds and User-Agents
+type FaultRule struct {
+	// Paths are the path prefixes of the matched requests, e.g. /notifications/v2, empty matches all paths
+	Paths []string `json:"paths,omitempty"`
+	// AppIDs are the appIds of the matched requests, empty matches all appIds
+	AppIDs []string `json:"appIds,omitempty"`
+	// UserAgents are substrings of the User-Agents of the matched requests, e.g. apollo-client-go/1.,
+	// empty matches all User-Agents
+	UserAgents []string `json:"userAgents,omitempty"`
+	// ErrorPercent of the matched requests are answered with a 500
+	ErrorPercent int `json:"errorPercent,omitempty"`
+	// DropPercent of the matched requests have their connection closed without a response
+	DropPercent int `json:"dropPercent,omitempty"`
+	// DelayMs is waited before the matched requests are handled, plus a random duration up to JitterMs
+	DelayMs  int `json:"delayMs,omitempty"`
+	JitterMs int `json:"jitterMs,omitempty"`
+}
+
+func (f *FaultRule) validate() error {
+	if f.ErrorPercent < 0 || f.ErrorPercent > 100 {
+		return errors.New("invalid errorPercent")
+	}
+	if f.DropPercent < 0 || f.DropPercent > 100 {
+		return errors.New("invalid dropPercent")
+	}
+	if f.DelayMs < 0 || f.JitterMs < 0 {
+		return errors.New("invalid delay")
+	}
+	return nil
+}
+
+// IsZero returns true if the rule injects no fault
+func (f *FaultRule) IsZero() bool {
+	return f.ErrorPercent == 0 && f.DropPercent == 0 && f.DelayMs == 0 && f.JitterMs == 0
+}
+
+func (f *FaultRule) match(path string, appID string, userAgent string) bool {
+	if len(f.Paths) > 0 {
+		matched := false
+		for _, p := range f.Paths {
+			if strings.HasPrefix(path, p) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(f.UserAgents) > 0 {
+		matched := false
+		for _, ua := range f.UserAgents {
+			if strings.Contains(userAgent, ua) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(f.AppIDs) > 0 {
+		for _, id := range f.AppIDs {
+			if id == appID {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// seenTTL is how long a client whose first poll was delayed is remembered after its last poll,
+// a client polling again later is delayed as a restarted one
+const seenTTL = 30 * time.Minute
+
+// faults applies the NotificationFault to the polls and the fault rules to the requests,
+// the rules are set by the flags and replaced through the ctrl interface
+type faults struct {
+	poll NotificationFault
+	mu   sync.Mutex
+	// seen are the clients whose first poll has been delayed, with the time of their last poll.
+	// The clients idle for seenTTL are swept once per seenTTL, so that a scan with many clients is forgotten
+	seen  map[pollClient]time.Time
+	swept time.Time
+	rules []FaultRule
+	rand  func(n int) int
+	now   func() time.Time
+}
+
+func newFaults(poll NotificationFault, rules []FaultRule) *faults {
+	return &faults{
+		poll:  poll,
+		seen:  make(map[pollClient]time.Time),
+		swept: time.Now(),
+		rules: rules,
+		rand:  rand.Intn,
+		now:   time.Now,
+	}
+}
+
+func (f *faults) get() []FaultRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FaultRule{}, f.rules...)
+}
+
+func (f *faults) set(rules []FaultRule) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = rules
+}
+
+// rule returns the first fault rule matching a request, nil if none
+func (f *faults) rule(path string, appID string, userAgent string) *FaultRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.rules {
+		if f.rules[i].match(path, appID, userAgent) {
+			rule := f.rules[i]
+			return &rule
+		}
+	}
+	return nil
+}
+
+// firstDelay returns the delay of the poll of a client, only its first poll is delayed
+func (f *faults) firstDelay(client pollClient) time.Duration {
+	if f.poll.FirstDelay <= 0 {
+		return 0
+	}
+	client.Since = time.Time{}
+	now := f.now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now.Sub(f.swept) >= seenTTL {
+		for c, last := range f.seen {
+			if now.Sub(last) >= seenTTL {
+				delete(f.seen, c)
+			}
+		}
+		f.swept = now
+	}
+	last, ok := f.seen[client]
+	f.seen[client] = now
+	if ok && now.Sub(last) < seenTTL {
+		return 0
+	}
+	return f.poll.FirstDelay
+}
+
+// failed returns true if the poll is failed by an ErrorAfter or Empty fault
+func (f *faults) failed() bool {
+	if f.poll.ErrorAfter <= 0 && !f.poll.Empty {
+		return false
+	}
+	return f.poll.Percent <= 0 || f.rand(100) < f.poll.Percent
+}
+
+// serve applies the NotificationFault to a poll, it returns false if the poll is left to be served
+func (f *faults) serve(w http.ResponseWriter, r *http.Request, client pollClient) bool {
+	if d := f.firstDelay(client); d > 0 {
+		select {
+		case <-r.Context().Done():
+			return true
+		case <-time.After(d):
+		}
+	}
+	if !f.failed() {
+		return false
+	}
+	if f.poll.Empty {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("[]"))
+		return true
+	}
+	select {
+	case <-r.Context().Done():
+	case <-time.After(f.poll.ErrorAfter):
+		w.WriteHeader(500)
+	}
+	return true
+}
+
+// withFaults applies the first fault rule matching the request before it is handled
+func (a *Apollo) withFaults(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		appID := ps.ByName("appId")
+		if appID == "" {
+			appID = r.URL.Query().Get("appId")
+		}
+		rule := a.faults.rule(r.URL.Path, appID, r.UserAgent())
+		if rule == nil {
+			h(w, r, ps)
+			return
+		}
+		delay := time.Duration(rule.DelayMs) * time.Millisecond
+		if rule.JitterMs > 0 {
+			delay += time.Duration(a.faults.rand(rule.JitterMs+1)) * time.Millisecond
+		}
+		if delay > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+		if rule.DropPercent > 0 && a.faults.rand(100) < rule.DropPercent {
+			// the server closes the connection without writing a response
+			panic(http.ErrAbortHandler)
+		}
+		if rule.ErrorPercent > 0 && a.faults.rand(100) < rule.ErrorPercent {
+			w.WriteHeader(500)
+			w.Write([]byte("injected fault"))
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+func (a *Apollo) getFaults(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	json, err := json.Marshal(a.faults.get())
+	if err != nil {
+		a.cfg.Log.Get().Error(err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func (a *Apollo) putFaults(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rules := []FaultRule{}
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	a.faults.set(rules)
+	w.Write([]byte("OK"))
+}
+
+func (a *Apollo) deleteFaults(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	a.faults.set(nil)
+	w.Write([]byte("OK"))
+}
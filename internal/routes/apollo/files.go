@@ -0,0 +1,161 @@
+package apollo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// liveFiles returns the live config files
+func (a *Apollo) liveFiles() ([]string, error) {
+	a.fixtures.mu.RLock()
+	defer a.fixtures.mu.RUnlock()
+	if a.fixtures.live == nil {
+		return nil, errors.New("live files are not served")
+	}
+	return append([]string{}, a.fixtures.live.files...), nil
+}
+
+// sameFile returns true if two paths of config files are the same file
+func sameFile(a string, b string) bool {
+	pa, err := filepath.Abs(a)
+	if err != nil {
+		return a == b
+	}
+	pb, err := filepath.Abs(b)
+	if err != nil {
+		return a == b
+	}
+	return pa == pb
+}
+
+func indexFile(files []string, file string) int {
+	for i, f := range files {
+		if sameFile(f, file) {
+			return i
+		}
+	}
+	return -1
+}
+
+// addFiles serves files along with the live ones, with the lowest precedence so that the served
+// namespaces are left unchanged. Only the added files are loaded, the staged and the previous files are left as they are
+func (a *Apollo) addFiles(files []string) (fixtureDiff, error) {
+	if len(files) == 0 {
+		return fixtureDiff{}, errors.New("missing files")
+	}
+	a.fixtures.editing.Lock()
+	defer a.fixtures.editing.Unlock()
+	live, err := a.liveFiles()
+	if err != nil {
+		return fixtureDiff{}, err
+	}
+	for _, f := range files {
+		if indexFile(live, f) >= 0 {
+			return fixtureDiff{}, fmt.Errorf("file already served: %s", f)
+		}
+		live = append(live, f)
+	}
+	return a.editFixtures(live, func(m *watcher.Manager) error {
+		return m.AddFiles(files)
+	})
+}
+
+// removeFiles stops serving files of the live ones, refused unless forced if an open long poll watches
+// a namespace only they serve. The staged and the previous files are left as they are
+func (a *Apollo) removeFiles(files []string, force bool) (fixtureDiff, error) {
+	if len(files) == 0 {
+		return fixtureDiff{}, errors.New("missing files")
+	}
+	a.fixtures.editing.Lock()
+	defer a.fixtures.editing.Unlock()
+	live, err := a.liveFiles()
+	if err != nil {
+		return fixtureDiff{}, err
+	}
+	for _, f := range files {
+		i := indexFile(live, f)
+		if i < 0 {
+			return fixtureDiff{}, fmt.Errorf("file not served: %s", f)
+		}
+		live = append(live[:i], live[i+1:]...)
+	}
+	var verify func(cm watcher.ConfigMap) error
+	if !force {
+		verify = func(cm watcher.ConfigMap) error {
+			if err := a.verifyFixtures(cm); err != nil {
+				return errVerification{err}
+			}
+			return nil
+		}
+	}
+	return a.editFixtures(live, func(m *watcher.Manager) error {
+		return m.RemoveFiles(files, verify)
+	})
+}
+
+// editFixtures applies edit to the manager of the live files, which become files once it succeeds.
+// The manager publishes the changes to the live bus
+func (a *Apollo) editFixtures(files []string, edit func(m *watcher.Manager) error) (fixtureDiff, error) {
+	a.fixtures.mu.RLock()
+	m := a.fixtures.live.m
+	a.fixtures.mu.RUnlock()
+	old := m.Config()
+	if err := edit(m); err != nil {
+		return fixtureDiff{}, err
+	}
+	a.fixtures.mu.Lock()
+	a.fixtures.live.files = files
+	a.w = m.Files()
+	a.fixtures.mu.Unlock()
+	a.updateParseWarnings()
+	a.cfg.Log.Get().Info(fmt.Sprintf("serving config files %s", strings.Join(files, ", ")))
+	return newFixtureDiff(old, m.Config()), nil
+}
+
+// decodeFiles decodes the files of a request body
+func decodeFiles(r *http.Request) ([]string, error) {
+	req := struct {
+		Files []string `json:"files"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	return req.Files, nil
+}
+
+func (a *Apollo) getCtrlFiles(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	files, err := a.liveFiles()
+	a.writeFixtures(w, struct {
+		Files []string `json:"files"`
+	}{files}, err)
+}
+
+func (a *Apollo) postCtrlFiles(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	files, err := decodeFiles(r)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	diff, err := a.addFiles(files)
+	a.writeFixtures(w, diff, err)
+}
+
+func (a *Apollo) deleteCtrlFiles(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	files, err := decodeFiles(r)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	diff, err := a.removeFiles(files, r.URL.Query().Get("force") == "true")
+	a.writeFixtures(w, diff, err)
+}
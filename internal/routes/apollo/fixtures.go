@@ -0,0 +1,295 @@
+package apollo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/figroc/mock-apollo-go/pkg/events"
+	"github.com/figroc/mock-apollo-go/pkg/store"
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+	"github.com/julienschmidt/httprouter"
+)
+
+// fixtureSet is a set of config files watched by a manager
+type fixtureSet struct {
+	files  []string
+	m      *watcher.Manager
+	cancel context.CancelFunc
+}
+
+// fixtures holds the live set of config files served and the next one staged for a blue/green switch
+type fixtures struct {
+	mu   sync.RWMutex
+	ctx  context.Context
+	live *fixtureSet
+	next *fixtureSet
+	// previous are the files of the set replaced by the last switch
+	previous []string
+	// editing serializes the files added to and removed from the live set
+	editing sync.Mutex
+}
+
+// fixtureDiff lists the namespaces changed by a switch to the next set of files
+type fixtureDiff struct {
+	Added   []store.Key `json:"added"`
+	Changed []store.Key `json:"changed"`
+	Removed []store.Key `json:"removed"`
+}
+
+func newFixtureDiff(old watcher.ConfigMap, cm watcher.ConfigMap) fixtureDiff {
+	diff := fixtureDiff{Added: []store.Key{}, Changed: []store.Key{}, Removed: []store.Key{}}
+	for _, e := range watcher.Diff(old, cm) {
+		k := store.Key{AppID: e.AppID, Cluster: e.Cluster, Namespace: e.Namespace}
+		switch {
+		case e.Type == events.NamespaceDeleted:
+			diff.Removed = append(diff.Removed, k)
+		case hasNamespace(old, k):
+			diff.Changed = append(diff.Changed, k)
+		default:
+			diff.Added = append(diff.Added, k)
+		}
+	}
+	for _, keys := range [][]store.Key{diff.Added, diff.Changed, diff.Removed} {
+		sortKeys(keys)
+	}
+	return diff
+}
+
+func hasNamespace(cm watcher.ConfigMap, k store.Key) bool {
+	_, ok := cm[k.AppID][k.Cluster][k.Namespace]
+	return ok
+}
+
+func sortKeys(keys []store.Key) {
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.AppID != b.AppID {
+			return a.AppID < b.AppID
+		}
+		if a.Cluster != b.Cluster {
+			return a.Cluster < b.Cluster
+		}
+		return a.Namespace < b.Namespace
+	})
+}
+
+// loadFixtures watches a set of files publishing its changes to bus
+func (a *Apollo) loadFixtures(files []string, bus *events.Bus) (*fixtureSet, error) {
+	ctx, cancel := context.WithCancel(a.fixtures.ctx)
+	m, err := watcher.NewManager(ctx, watcher.ManagerConfig{
+		Log:            a.cfg.Log,
+		Files:          files,
+		Notify:         a.cfg.WatchNotify,
+		Debounce:       a.cfg.WatchDebounce,
+		MaxFileSize:    a.cfg.MaxFileSize,
+		DecryptionKey:  a.cfg.DecryptionKey,
+		JasyptPassword: a.cfg.JasyptPassword,
+		Env:            a.cfg.Env,
+		Bus:            bus,
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &fixtureSet{files: files, m: m, cancel: cancel}, nil
+}
+
+// watchers returns the watchers of the live files
+func (a *Apollo) watchers() []*watcher.Watcher {
+	a.fixtures.mu.RLock()
+	defer a.fixtures.mu.RUnlock()
+	if a.fixtures.live != nil {
+		// the files of a directory or a glob pattern come and go
+		return a.fixtures.live.m.Files()
+	}
+	return a.w
+}
+
+// stageFixtures loads the next set of files, its changes are not published until it is switched to
+func (a *Apollo) stageFixtures(files []string) (fixtureDiff, error) {
+	if len(files) == 0 {
+		return fixtureDiff{}, errors.New("missing files")
+	}
+	next, err := a.loadFixtures(files, events.NewBus())
+	if err != nil {
+		return fixtureDiff{}, err
+	}
+	a.fixtures.mu.Lock()
+	defer a.fixtures.mu.Unlock()
+	if a.fixtures.next != nil {
+		a.fixtures.next.cancel()
+	}
+	a.fixtures.next = next
+	return newFixtureDiff(a.fixtures.live.m.Config(), next.m.Config()), nil
+}
+
+// verifyFixtures returns an error listing the namespaces watched by the open polls that cm does not serve
+func (a *Apollo) verifyFixtures(cm watcher.ConfigMap) error {
+	s := store.New(events.NewBus(), sourceOf(cm))
+	missing := make(map[string]bool)
+	a.mu.RLock()
+	for p, c := range a.polls {
+		cluster := c.Cluster
+		if alias, ok := a.cfg.ClusterAlias[cluster]; ok {
+			cluster = alias
+		}
+		for _, n := range p.Notifications() {
+			name, _ := a.parseNamespace(n.Namespace)
+			if _, err := s.Get(c.AppID, cluster, name); err != nil {
+				missing[c.AppID+"/"+cluster+"/"+name] = true
+			}
+		}
+	}
+	a.mu.RUnlock()
+	if len(missing) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(missing))
+	for name := range missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("namespaces watched by open polls are missing: %s", strings.Join(names, ", "))
+}
+
+// sourceOf is a store source serving a ConfigMap
+type sourceOf watcher.ConfigMap
+
+func (s sourceOf) Config() watcher.ConfigMap {
+	return watcher.ConfigMap(s)
+}
+
+// errVerification is returned when the files to switch to fail the verification
+type errVerification struct {
+	error
+}
+
+// switchFixtures serves files in place of the live ones, unless they fail to load or the verification.
+// The files are loaded again so that the switched set publishes its changes to the live bus
+func (a *Apollo) switchFixtures(files []string, force bool) (fixtureDiff, error) {
+	set, err := a.loadFixtures(files, a.bus)
+	if err != nil {
+		return fixtureDiff{}, err
+	}
+	if !force {
+		if err := a.verifyFixtures(set.m.Config()); err != nil {
+			set.cancel()
+			return fixtureDiff{}, errVerification{err}
+		}
+	}
+	a.fixtures.mu.Lock()
+	live := a.fixtures.live
+	if !a.store.ReplaceSource(live.m, set.m) {
+		a.fixtures.mu.Unlock()
+		set.cancel()
+		return fixtureDiff{}, errors.New("live files are not served")
+	}
+	a.w = set.m.Files()
+	a.fixtures.live = set
+	a.fixtures.previous = live.files
+	if a.fixtures.next != nil {
+		a.fixtures.next.cancel()
+		a.fixtures.next = nil
+	}
+	a.fixtures.mu.Unlock()
+	live.cancel()
+
+	// notify the polls of the namespaces changed by the switch
+	old, cm := live.m.Config(), set.m.Config()
+	for _, e := range watcher.Diff(old, cm) {
+		a.bus.Publish(e)
+	}
+	a.updateParseWarnings()
+	a.cfg.Log.Get().Info(fmt.Sprintf("switched config files to %s", strings.Join(files, ", ")))
+	return newFixtureDiff(old, cm), nil
+}
+
+func (a *Apollo) writeFixtures(w http.ResponseWriter, v interface{}, err error) {
+	if err != nil {
+		switch err.(type) {
+		case errVerification:
+			w.WriteHeader(409)
+		default:
+			w.WriteHeader(400)
+		}
+		w.Write([]byte(err.Error()))
+		return
+	}
+	json, err := json.Marshal(v)
+	if err != nil {
+		a.cfg.Log.Get().Error(err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func (a *Apollo) putNextFixtures(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	req := struct {
+		Files []string `json:"files"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	diff, err := a.stageFixtures(req.Files)
+	a.writeFixtures(w, diff, err)
+}
+
+func (a *Apollo) getNextFixtures(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	a.fixtures.mu.RLock()
+	live, next := a.fixtures.live, a.fixtures.next
+	a.fixtures.mu.RUnlock()
+	if next == nil {
+		w.WriteHeader(404)
+		return
+	}
+	a.writeFixtures(w, struct {
+		Files []string    `json:"files"`
+		Diff  fixtureDiff `json:"diff"`
+	}{next.files, newFixtureDiff(live.m.Config(), next.m.Config())}, nil)
+}
+
+func (a *Apollo) deleteNextFixtures(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	a.fixtures.mu.Lock()
+	if a.fixtures.next != nil {
+		a.fixtures.next.cancel()
+		a.fixtures.next = nil
+	}
+	a.fixtures.mu.Unlock()
+	w.Write([]byte("OK"))
+}
+
+func (a *Apollo) postSwitchFixtures(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	a.fixtures.mu.RLock()
+	next := a.fixtures.next
+	a.fixtures.mu.RUnlock()
+	if next == nil {
+		w.WriteHeader(409)
+		w.Write([]byte("no next config files staged"))
+		return
+	}
+	diff, err := a.switchFixtures(next.files, r.URL.Query().Get("force") == "true")
+	a.writeFixtures(w, diff, err)
+}
+
+func (a *Apollo) postRollbackFixtures(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	a.fixtures.mu.RLock()
+	previous := a.fixtures.previous
+	a.fixtures.mu.RUnlock()
+	if previous == nil {
+		w.WriteHeader(409)
+		w.Write([]byte("no previous config files"))
+		return
+	}
+	diff, err := a.switchFixtures(previous, r.URL.Query().Get("force") == "true")
+	a.writeFixtures(w, diff, err)
+}
@@ -0,0 +1,155 @@
+package apollo
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/figroc/mock-apollo-go/pkg/graphql"
+	"github.com/figroc/mock-apollo-go/pkg/longpoll"
+	"github.com/figroc/mock-apollo-go/pkg/store"
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+)
+
+type gqlConfiguration struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type gqlNamespace struct {
+	AppID          string             `json:"appId"`
+	Cluster        string             `json:"cluster"`
+	Namespace      string             `json:"namespace"`
+	ReleaseKey     string             `json:"releaseKey"`
+	Configurations []gqlConfiguration `json:"configurations"`
+}
+
+type gqlCluster struct {
+	Cluster    string         `json:"cluster"`
+	Namespaces []gqlNamespace `json:"namespaces"`
+}
+
+type gqlApp struct {
+	AppID    string       `json:"appId"`
+	Clusters []gqlCluster `json:"clusters"`
+}
+
+type gqlClient struct {
+	pollClient
+	Notifications []longpoll.Notification `json:"notifications"`
+}
+
+type gqlStats struct {
+	Polls           int64   `json:"polls"`
+	Notifications   float64 `json:"notifications"`
+	Reloads         float64 `json:"reloads"`
+	Abandoned       float64 `json:"abandoned"`
+	QueueDepth      float64 `json:"queueDepth"`
+	CoalescedEvents int64   `json:"coalescedEvents"`
+}
+
+// schema returns the GraphQL schema of the admin query endpoint
+func (a *Apollo) schema() graphql.Schema {
+	str := func(args map[string]interface{}, name string) string {
+		s, _ := args[name].(string)
+		return s
+	}
+	return graphql.Schema{
+		"apps": func(args map[string]interface{}) (interface{}, error) {
+			return gqlApps(a.gqlNamespaces(str(args, "appId"), str(args, "cluster"))), nil
+		},
+		"namespaces": func(args map[string]interface{}) (interface{}, error) {
+			return a.gqlNamespaces(str(args, "appId"), str(args, "cluster")), nil
+		},
+		"clients": func(args map[string]interface{}) (interface{}, error) {
+			return a.gqlClients(str(args, "appId")), nil
+		},
+		"watchers": func(args map[string]interface{}) (interface{}, error) {
+			statuses := []watcher.Status{}
+			for _, w := range a.watchers() {
+				statuses = append(statuses, w.Status())
+			}
+			return statuses, nil
+		},
+		"stats": func(args map[string]interface{}) (interface{}, error) {
+			return a.gqlStats(), nil
+		},
+	}
+}
+
+// gqlNamespaces returns the namespaces of an app and cluster, empty filters match all
+func (a *Apollo) gqlNamespaces(appID string, cluster string) []gqlNamespace {
+	namespaces := []gqlNamespace{}
+	for _, k := range a.store.List() {
+		if (appID != "" && k.AppID != appID) || (cluster != "" && k.Cluster != cluster) {
+			continue
+		}
+		ns, err := a.store.Get(k.AppID, k.Cluster, k.Namespace)
+		if err != nil {
+			continue
+		}
+		namespaces = append(namespaces, newGQLNamespace(k, a.progression.apply(k, ns)))
+	}
+	return namespaces
+}
+
+func newGQLNamespace(k store.Key, ns watcher.Namespace) gqlNamespace {
+	n := gqlNamespace{
+		AppID:          k.AppID,
+		Cluster:        k.Cluster,
+		Namespace:      k.Namespace,
+		ReleaseKey:     ns.ReleaseKey,
+		Configurations: []gqlConfiguration{},
+	}
+	for key, value := range ns.Properties {
+		n.Configurations = append(n.Configurations, gqlConfiguration{Key: key, Value: value})
+	}
+	sort.Slice(n.Configurations, func(i, j int) bool {
+		return n.Configurations[i].Key < n.Configurations[j].Key
+	})
+	return n
+}
+
+// gqlApps groups the sorted namespaces by app and cluster
+func gqlApps(namespaces []gqlNamespace) []gqlApp {
+	apps := []gqlApp{}
+	for _, ns := range namespaces {
+		if len(apps) == 0 || apps[len(apps)-1].AppID != ns.AppID {
+			apps = append(apps, gqlApp{AppID: ns.AppID, Clusters: []gqlCluster{}})
+		}
+		app := &apps[len(apps)-1]
+		if len(app.Clusters) == 0 || app.Clusters[len(app.Clusters)-1].Cluster != ns.Cluster {
+			app.Clusters = append(app.Clusters, gqlCluster{Cluster: ns.Cluster, Namespaces: []gqlNamespace{}})
+		}
+		c := &app.Clusters[len(app.Clusters)-1]
+		c.Namespaces = append(c.Namespaces, ns)
+	}
+	return apps
+}
+
+// gqlClients returns the clients of the open polls sorted by the time they started polling
+func (a *Apollo) gqlClients(appID string) []gqlClient {
+	a.mu.RLock()
+	clients := make([]gqlClient, 0, len(a.polls))
+	for p, c := range a.polls {
+		if appID != "" && c.AppID != appID {
+			continue
+		}
+		clients = append(clients, gqlClient{pollClient: c, Notifications: p.Notifications()})
+	}
+	a.mu.RUnlock()
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Since.Before(clients[j].Since)
+	})
+	return clients
+}
+
+func (a *Apollo) gqlStats() gqlStats {
+	return gqlStats{
+		Polls:           atomic.LoadInt64(&a.npolls),
+		Notifications:   a.metrics.notifications.Value(),
+		Reloads:         a.metrics.reloads.Value(),
+		Abandoned:       a.metrics.abandoned.Value(),
+		QueueDepth:      a.metrics.queueDepth.Value(),
+		CoalescedEvents: a.bus.Coalesced(),
+	}
+}
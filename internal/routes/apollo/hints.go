@@ -0,0 +1,120 @@
+package apollo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// maxSuggestions is the max number of nearest namespaces suggested by a hint
+const maxSuggestions = 3
+
+// notFoundHint is the body of a 404 listing what the app serves instead of the requested namespace
+type notFoundHint struct {
+	Error     string `json:"error"`
+	AppID     string `json:"appId"`
+	Cluster   string `json:"cluster"`
+	Namespace string `json:"namespace"`
+	// Suggestions are the namespaces of the cluster nearest to the requested one
+	Suggestions []string `json:"suggestions"`
+	// Namespaces are all namespaces of the cluster
+	Namespaces []string `json:"namespaces"`
+	// Clusters are the clusters of the app, listed when the cluster serves no namespace
+	Clusters []string `json:"clusters,omitempty"`
+}
+
+// namespaceNotFound answers a request for a namespace that is not served with a 404,
+// the body lists the nearest namespaces of the app and cluster if NotFoundHints is set
+func (a *Apollo) namespaceNotFound(w http.ResponseWriter, r *http.Request, appID string, cluster string, namespace string) {
+	a.cfg.Log.Get().Warn(fmt.Sprintf("no namespace for request: %s", r.URL.String()))
+	if !a.cfg.NotFoundHints {
+		w.WriteHeader(404)
+		return
+	}
+	json, err := json.Marshal(a.notFoundHint(appID, cluster, namespace))
+	if err != nil {
+		a.cfg.Log.Get().Error(err.Error())
+		w.WriteHeader(404)
+		return
+	}
+	w.Header().Set("Content-Type", a.contentType(r, "application/json"))
+	w.WriteHeader(404)
+	w.Write(json)
+}
+
+func (a *Apollo) notFoundHint(appID string, cluster string, namespace string) notFoundHint {
+	h := notFoundHint{
+		Error:       "namespace not found",
+		AppID:       appID,
+		Cluster:     cluster,
+		Namespace:   namespace,
+		Suggestions: []string{},
+		Namespaces:  []string{},
+	}
+	// aliased clusters are served from their canonical cluster
+	if c, ok := a.cfg.ClusterAlias[cluster]; ok {
+		cluster = c
+	}
+	clusters := make(map[string]bool)
+	for _, k := range a.store.List() {
+		if k.AppID != appID {
+			continue
+		}
+		clusters[k.Cluster] = true
+		if k.Cluster == cluster {
+			h.Namespaces = append(h.Namespaces, k.Namespace)
+		}
+	}
+	if len(h.Namespaces) == 0 {
+		for c := range clusters {
+			h.Clusters = append(h.Clusters, c)
+		}
+		sort.Strings(h.Clusters)
+		return h
+	}
+
+	// suggest the namespaces within a third of the length of the requested one, nearest first
+	limit := len(namespace)/3 + 1
+	dist := make(map[string]int, len(h.Namespaces))
+	for _, ns := range h.Namespaces {
+		if d := editDistance(namespace, ns); d <= limit {
+			dist[ns] = d
+			h.Suggestions = append(h.Suggestions, ns)
+		}
+	}
+	sort.SliceStable(h.Suggestions, func(i, j int) bool {
+		return dist[h.Suggestions[i]] < dist[h.Suggestions[j]]
+	})
+	if len(h.Suggestions) > maxSuggestions {
+		h.Suggestions = h.Suggestions[:maxSuggestions]
+	}
+	return h
+}
+
+// editDistance returns the Levenshtein distance of a and b
+func editDistance(a string, b string) int {
+	s, t := []rune(a), []rune(b)
+	prev := make([]int, len(t)+1)
+	cur := make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		cur[0] = i
+		for j := 1; j <= len(t); j++ {
+			cur[j] = prev[j-1]
+			if s[i-1] != t[j-1] {
+				cur[j]++
+			}
+			if d := prev[j] + 1; d < cur[j] {
+				cur[j] = d
+			}
+			if d := cur[j-1] + 1; d < cur[j] {
+				cur[j] = d
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(t)]
+}
@@ -0,0 +1,114 @@
+package apollo
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/figroc/mock-apollo-go/pkg/hooks"
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+	"github.com/julienschmidt/httprouter"
+)
+
+// hookActionKey is the context key of the action of a hook applied while the request is handled,
+// e.g. the overlaid properties or the compat switches
+type hookActionKey struct{}
+
+// withHooks applies the action of the configured hook before the request is handled
+func (a *Apollo) withHooks(h httprouter.Handle) httprouter.Handle {
+	if a.cfg.Hook == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		param := func(name string) string {
+			if v := ps.ByName(name); v != "" {
+				return v
+			}
+			return r.URL.Query().Get(name)
+		}
+		namespace, _ := a.parseNamespace(ps.ByName("namespace"))
+		action, ok := a.cfg.Hook.Handle(hooks.Request{
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Query:     r.URL.Query(),
+			Header:    r.Header,
+			AppID:     param("appId"),
+			Cluster:   param("cluster"),
+			Namespace: namespace,
+			ClientIP:  clientIP(r),
+			UserAgent: r.UserAgent(),
+		})
+		if !ok {
+			h(w, r, ps)
+			return
+		}
+		if action.Delay > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(action.Delay):
+			}
+		}
+		if action.Drop {
+			// the server closes the connection without writing a response
+			panic(http.ErrAbortHandler)
+		}
+		for k, v := range action.Headers {
+			w.Header().Set(k, v)
+		}
+		if action.Status != 0 {
+			w.WriteHeader(action.Status)
+			w.Write([]byte(action.Body))
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), hookActionKey{}, action))
+		h(w, r, ps)
+	}
+}
+
+// hookProperties returns ns with the properties overlaid by a hook for r
+func hookProperties(ns watcher.Namespace, r *http.Request) watcher.Namespace {
+	action, _ := r.Context().Value(hookActionKey{}).(hooks.Action)
+	overlay := action.Properties
+	if len(overlay) == 0 {
+		return ns
+	}
+	props := make(map[string]string, len(ns.Properties)+len(overlay))
+	for k, v := range ns.Properties {
+		props[k] = v
+	}
+	for k, v := range overlay {
+		props[k] = v
+	}
+	ns.Properties = props
+	return ns
+}
+
+// grayLabel returns the label r is served with, the one of a hook or else its label query parameter
+func grayLabel(r *http.Request) string {
+	if action, _ := r.Context().Value(hookActionKey{}).(hooks.Action); action.Label != "" {
+		return action.Label
+	}
+	return r.URL.Query().Get("label")
+}
+
+// contentType appends the charset served to r to a mime type, the one of a hook or else the configured one
+func (a *Apollo) contentType(r *http.Request, mime string) string {
+	charset := a.cfg.Charset
+	if action, _ := r.Context().Value(hookActionKey{}).(hooks.Action); action.Charset != nil {
+		charset = *action.Charset
+	}
+	if charset == "" {
+		return mime
+	}
+	return mime + ";charset=" + charset
+}
+
+// unicodeEscape returns true if the properties rendered for r escape their non-ASCII characters,
+// as switched by a hook or else configured
+func (a *Apollo) unicodeEscape(r *http.Request) bool {
+	if action, _ := r.Context().Value(hookActionKey{}).(hooks.Action); action.UnicodeEscape != nil {
+		return *action.UnicodeEscape
+	}
+	return a.cfg.UnicodeEscape
+}
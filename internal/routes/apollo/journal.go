@@ -0,0 +1,139 @@
+package apollo
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/url"
+	"time"
+
+	// the pure Go driver of SQLite, so that the binary stays static
+	_ "modernc.org/sqlite"
+)
+
+// requestJournal stores the recorded requests in a SQLite database, so that the requests of long sessions
+// survive the restarts of the mock and can be queried with SQL. Like requestLog it keeps the latest size requests
+type requestJournal struct {
+	db   *sql.DB
+	size int
+	// logError logs the errors of the database, the requests are recorded on a best effort basis
+	logError func(err error)
+}
+
+// journalSchema creates the table of the requests, the times are UTC in journalTime so that they sort as text
+const journalSchema = `CREATE TABLE IF NOT EXISTS requests (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	method TEXT NOT NULL,
+	path TEXT NOT NULL,
+	query TEXT NOT NULL,
+	app_id TEXT NOT NULL,
+	cluster TEXT NOT NULL,
+	namespace TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	status INTEGER NOT NULL,
+	received TEXT NOT NULL,
+	completed TEXT NOT NULL
+)`
+
+const journalTime = "2006-01-02T15:04:05.000000000Z"
+
+// openJournal opens the journal database at path keeping the latest size requests, the requests already in it are kept
+func openJournal(path string, size int, logError func(err error)) (*requestJournal, error) {
+	// the requests are listed while others are added, waiting for the lock of the writer
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(journalSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &requestJournal{db: db, size: size, logError: logError}, nil
+}
+
+func (j *requestJournal) add(req recordedRequest) {
+	if j.size <= 0 {
+		return
+	}
+	query, err := json.Marshal(req.Query)
+	if err != nil {
+		j.logError(err)
+		return
+	}
+	res, err := j.db.Exec("INSERT INTO requests (method, path, query, app_id, cluster, namespace, ip, status, received, completed) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		req.Method, req.Path, string(query), req.AppID, req.Cluster, req.Namespace, req.IP, req.Status,
+		req.Received.UTC().Format(journalTime), req.Completed.UTC().Format(journalTime))
+	if err != nil {
+		j.logError(err)
+		return
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		j.logError(err)
+		return
+	}
+	// the oldest requests are dropped beyond size
+	if _, err := j.db.Exec("DELETE FROM requests WHERE id <= ?", id-int64(j.size)); err != nil {
+		j.logError(err)
+	}
+}
+
+func (j *requestJournal) list(f requestFilter) []recordedRequest {
+	q := "SELECT method, path, query, app_id, cluster, namespace, ip, status, received, completed FROM requests WHERE received >= ?"
+	args := []interface{}{f.Since.UTC().Format(journalTime)}
+	if f.Method != "" {
+		q += " AND method = ? COLLATE NOCASE"
+		args = append(args, f.Method)
+	}
+	if f.Path != "" {
+		q += " AND substr(path, 1, length(?)) = ?"
+		args = append(args, f.Path, f.Path)
+	}
+	for _, c := range []struct {
+		column string
+		value  string
+	}{
+		{"app_id", f.AppID},
+		{"cluster", f.Cluster},
+		{"namespace", f.Namespace},
+		{"ip", f.IP},
+	} {
+		if c.value != "" {
+			q += " AND " + c.column + " = ?"
+			args = append(args, c.value)
+		}
+	}
+	requests := []recordedRequest{}
+	rows, err := j.db.Query(q+" ORDER BY id", args...)
+	if err != nil {
+		j.logError(err)
+		return requests
+	}
+	defer rows.Close()
+	for rows.Next() {
+		req := recordedRequest{}
+		var query, received, completed string
+		if err := rows.Scan(&req.Method, &req.Path, &query, &req.AppID, &req.Cluster, &req.Namespace, &req.IP, &req.Status, &received, &completed); err != nil {
+			j.logError(err)
+			return requests
+		}
+		req.Query = url.Values{}
+		json.Unmarshal([]byte(query), &req.Query)
+		req.Received, _ = time.Parse(journalTime, received)
+		req.Completed, _ = time.Parse(journalTime, completed)
+		requests = append(requests, req)
+	}
+	if err := rows.Err(); err != nil {
+		j.logError(err)
+	}
+	return requests
+}
+
+func (j *requestJournal) reset() {
+	if _, err := j.db.Exec("DELETE FROM requests"); err != nil {
+		j.logError(err)
+	}
+}
+
+func (j *requestJournal) close() {
+	j.db.Close()
+}
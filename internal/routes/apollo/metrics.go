@@ -0,0 +1,125 @@
+package apollo
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/figroc/mock-apollo-go/pkg/metrics"
+	"github.com/julienschmidt/httprouter"
+)
+
+// metric names are prefixed so that they can be told apart on a shared dashboard
+const metricPrefix = "mock_apollo_"
+
+type apolloMetrics struct {
+	requests      *metrics.Metric
+	pollsActive   *metrics.Metric
+	notifications *metrics.Metric
+	reloads       *metrics.Metric
+	quotaExceeded *metrics.Metric
+	nsPolls       *metrics.Metric
+	nsNotified    *metrics.Metric
+	queueDepth    *metrics.Metric
+	abandoned     *metrics.Metric
+	panics        *metrics.Metric
+	parseWarnings *metrics.Metric
+	// upstreamChecks and upstreamDiverged are the comparisons of the served namespaces with the upstream
+	upstreamChecks   *metrics.Metric
+	upstreamDiverged *metrics.Metric
+}
+
+// newMetrics registers the metrics of the Apollo serving env, the Apollo of each env writes the same metrics
+// told apart by their env label, empty for the default env
+func newMetrics(reg *metrics.Registry, env string) *apolloMetrics {
+	counter := func(name string, help string, labels ...string) *metrics.Metric {
+		return reg.Counter(metricPrefix+name, help, append([]string{"env"}, labels...)...).With(env)
+	}
+	gauge := func(name string, help string, labels ...string) *metrics.Metric {
+		return reg.Gauge(metricPrefix+name, help, append([]string{"env"}, labels...)...).With(env)
+	}
+	return &apolloMetrics{
+		requests: counter("requests_total",
+			"Number of served http requests.", "route", "code"),
+		pollsActive: gauge("polls_active",
+			"Number of open long polls."),
+		notifications: counter("notifications_total",
+			"Number of change notifications sent to long polls."),
+		reloads: counter("config_reloads_total",
+			"Number of config file reloads."),
+		quotaExceeded: counter("quota_exceeded_total",
+			"Number of requests rejected for being over quota.", "app"),
+		nsPolls: gauge("namespace_polls_active",
+			"Number of open long polls watching a namespace.", "namespace"),
+		nsNotified: counter("namespace_notifications_total",
+			"Number of change notifications sent for a namespace.", "namespace"),
+		queueDepth: gauge("notification_queue_depth",
+			"Number of change notifications waiting to be sent."),
+		abandoned: counter("polls_abandoned_total",
+			"Number of long polls closed early by the client."),
+		panics: counter("panics_total",
+			"Number of requests whose handler panicked, answered with a 500."),
+		parseWarnings: gauge("namespace_parse_warnings",
+			"Number of yml, yaml or json contents of a namespace that failed to parse in the loaded config files.", "app", "cluster", "namespace"),
+		upstreamChecks: counter("upstream_checks_total",
+			"Number of comparisons of a served namespace with the upstream, by result: match, diverge or error.", "result"),
+		upstreamDiverged: gauge("upstream_divergent_namespaces",
+			"Number of served namespaces diverging from the upstream at their last comparison."),
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = 200
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// statusDropped is the status the requests whose connection is dropped without a response are recorded with,
+// the one of nginx
+const statusDropped = 444
+
+// instrument counts the requests served by h per route and status code, and logs their access
+func (a *Apollo) instrument(route string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		done := func(code int) {
+			a.metrics.requests.Inc(route, strconv.Itoa(code))
+			a.logAccess(r, route, ps, code, time.Since(start))
+			a.recordRequest(r, ps, code, start)
+		}
+		// the panics are left to recoverPanic, answering them with a 500 unless the status was written
+		defer func() {
+			if v := recover(); v != nil {
+				switch {
+				case v == http.ErrAbortHandler:
+					done(statusDropped)
+				case rec.code != 0:
+					done(rec.code)
+				default:
+					done(500)
+				}
+				panic(v)
+			}
+		}()
+		h(rec, r, ps)
+		code := rec.code
+		if code == 0 {
+			code = 200
+		}
+		done(code)
+	}
+}
@@ -0,0 +1,217 @@
+package apollo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// mirrorMaxBody is the max size of the compared bodies, larger bodies only have their status compared
+	mirrorMaxBody = 1 << 20
+	// mirrorMaxInFlight is the max number of mirrored requests waiting for the mirror, more are dropped
+	mirrorMaxInFlight = 64
+	// mirrorMaxDiffs is the number of latest diffs kept for /ctrl/mirror
+	mirrorMaxDiffs = 100
+	mirrorTimeout  = 10 * time.Second
+)
+
+// mirrorDiff is a request of the config routes answered differently by the mirror
+type mirrorDiff struct {
+	Method       string    `json:"method"`
+	URI          string    `json:"uri"`
+	Status       int       `json:"status"`
+	MirrorStatus int       `json:"mirrorStatus,omitempty"`
+	Body         string    `json:"body,omitempty"`
+	MirrorBody   string    `json:"mirrorBody,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+// mirrorReport counts the mirrored requests along with the latest diffs
+type mirrorReport struct {
+	Mirrored int          `json:"mirrored"`
+	Matched  int          `json:"matched"`
+	Differed int          `json:"differed"`
+	Failed   int          `json:"failed"`
+	Dropped  int          `json:"dropped"`
+	Diffs    []mirrorDiff `json:"diffs"`
+}
+
+// mirror sends a copy of the served requests to another server, e.g. a candidate build or a real Apollo,
+// and compares its responses to the served ones
+type mirror struct {
+	base     *url.URL
+	client   *http.Client
+	inFlight chan struct{}
+	mu       sync.Mutex
+	report   mirrorReport
+}
+
+func newMirror(base *url.URL) *mirror {
+	return &mirror{
+		base:     base,
+		client:   &http.Client{Timeout: mirrorTimeout},
+		inFlight: make(chan struct{}, mirrorMaxInFlight),
+		report:   mirrorReport{Diffs: []mirrorDiff{}},
+	}
+}
+
+// bodyRecorder records the status and the body written to a response
+type bodyRecorder struct {
+	http.ResponseWriter
+	code      int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (r *bodyRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = 200
+	}
+	if r.body.Len()+len(b) > mirrorMaxBody {
+		r.truncated = true
+	} else {
+		r.body.Write(b)
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// withMirror sends a copy of the requests served by h to the MirrorURL once they are answered,
+// without waiting for the mirror
+func (a *Apollo) withMirror(h httprouter.Handle) httprouter.Handle {
+	if a.mirror == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		rec := &bodyRecorder{ResponseWriter: w}
+		h(rec, r, ps)
+		if rec.code == 0 {
+			rec.code = 200
+		}
+		select {
+		case a.mirror.inFlight <- struct{}{}:
+		default:
+			a.mirror.mu.Lock()
+			a.mirror.report.Dropped++
+			a.mirror.mu.Unlock()
+			return
+		}
+		req, err := a.mirrorRequest(r)
+		if err != nil {
+			<-a.mirror.inFlight
+			a.cfg.Log.Get().Warn(fmt.Sprintf("error mirroring request %s: %v", r.URL.String(), err))
+			return
+		}
+		go func() {
+			defer func() { <-a.mirror.inFlight }()
+			a.compareMirrored(req, rec.code, rec.body.Bytes(), rec.truncated)
+		}()
+	}
+}
+
+// mirrorRequest returns a copy of r to the mirror, under the path of the env of the requests
+func (a *Apollo) mirrorRequest(r *http.Request) (*http.Request, error) {
+	u := *a.mirror.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + a.envPath() + strings.TrimPrefix(r.URL.Path, "/")
+	u.RawPath = ""
+	u.RawQuery = r.URL.RawQuery
+	req, err := http.NewRequest(r.Method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	return req, nil
+}
+
+// compareMirrored sends req to the mirror and records whether it answers with code and body,
+// the bodies of JSON responses are compared by value
+func (a *Apollo) compareMirrored(req *http.Request, code int, body []byte, truncated bool) {
+	diff := mirrorDiff{Method: req.Method, URI: req.URL.RequestURI(), Status: code, Time: time.Now()}
+	rsp, err := a.mirror.client.Do(req)
+	var mirrored []byte
+	if err == nil {
+		mirrored, err = io.ReadAll(io.LimitReader(rsp.Body, mirrorMaxBody+1))
+		rsp.Body.Close()
+	}
+
+	m := a.mirror
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.report.Mirrored++
+	switch {
+	case err != nil:
+		m.report.Failed++
+		diff.Error = err.Error()
+	case rsp.StatusCode == code && (truncated || len(mirrored) > mirrorMaxBody || sameBody(body, mirrored)):
+		m.report.Matched++
+		return
+	default:
+		m.report.Differed++
+		diff.MirrorStatus = rsp.StatusCode
+		diff.Body, diff.MirrorBody = string(body), string(mirrored)
+	}
+	a.cfg.Log.Get().Warn(fmt.Sprintf("mirrored response differs for request: %s", diff.URI))
+	m.report.Diffs = append(m.report.Diffs, diff)
+	if len(m.report.Diffs) > mirrorMaxDiffs {
+		m.report.Diffs = m.report.Diffs[len(m.report.Diffs)-mirrorMaxDiffs:]
+	}
+}
+
+func sameBody(a []byte, b []byte) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// getCtrlMirror reports the mirrored requests along with the latest diffs
+func (a *Apollo) getCtrlMirror(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if a.mirror == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("no mirror"))
+		return
+	}
+	a.mirror.mu.Lock()
+	report := a.mirror.report
+	report.Diffs = append([]mirrorDiff{}, report.Diffs...)
+	a.mirror.mu.Unlock()
+	json, err := json.Marshal(report)
+	if err != nil {
+		a.cfg.Log.Get().Error(err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// deleteCtrlMirror resets the report of the mirrored requests
+func (a *Apollo) deleteCtrlMirror(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if a.mirror != nil {
+		a.mirror.mu.Lock()
+		a.mirror.report = mirrorReport{Diffs: []mirrorDiff{}}
+		a.mirror.mu.Unlock()
+	}
+	w.Write([]byte("OK"))
+}
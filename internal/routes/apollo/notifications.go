@@ -0,0 +1,64 @@
+package apollo
+
+import (
+	"sync"
+
+	"github.com/figroc/mock-apollo-go/pkg/longpoll"
+	"github.com/figroc/mock-apollo-go/pkg/store"
+)
+
+// notificationIDs tracks the notificationId of each namespace, taken from a counter increased
+// on every change like the ids of the release messages of Apollo. Namespaces unchanged since
+// the start have the id 0
+type notificationIDs struct {
+	mu   sync.Mutex
+	last int
+	ids  map[store.Key]int
+}
+
+// bump gives a namespace the next id
+func (n *notificationIDs) bump(k store.Key) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ids == nil {
+		n.ids = make(map[store.Key]int)
+	}
+	n.last++
+	n.ids[k] = n.last
+}
+
+func (n *notificationIDs) get(k store.Key) (int, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	id, ok := n.ids[k]
+	return id, ok
+}
+
+// notificationID returns the id of a namespace, false if it never existed. A namespace borrowed
+// from another app with LooseAppID has the id of the owning namespace, so that it follows its changes
+func (a *Apollo) notificationID(appID string, cluster string, namespace string) (int, bool) {
+	k, served := a.resolveKey(appID, cluster, namespace)
+	if id, ok := a.notificationIDs.get(k); ok {
+		return id, true
+	}
+	return 0, served
+}
+
+// changedNotifications returns the namespaces watched by a poll whose id differs from the one of the client,
+// with their current ids. An id ahead of the server, e.g. after a restart, is answered too so that the client resyncs
+func (a *Apollo) changedNotifications(p *longpoll.Poll) []longpoll.Notification {
+	a.mu.RLock()
+	client, ok := a.polls[p]
+	a.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	changed := []longpoll.Notification{}
+	for _, n := range p.Notifications() {
+		name, _ := a.parseNamespace(n.Namespace)
+		if id, ok := a.notificationID(client.AppID, client.Cluster, name); ok && id != n.ID {
+			changed = append(changed, longpoll.Notification{ID: id, Namespace: n.Namespace})
+		}
+	}
+	return changed
+}
@@ -0,0 +1,378 @@
+package apollo
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/figroc/mock-apollo-go/pkg/store"
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+	"github.com/julienschmidt/httprouter"
+)
+
+// openAPIItem is an item of a namespace in the portal OpenAPI of Apollo,
+// the properties or the content of the other formats
+type openAPIItem struct {
+	Key                      string `json:"key"`
+	Value                    string `json:"value"`
+	Comment                  string `json:"comment,omitempty"`
+	DataChangeCreatedBy      string `json:"dataChangeCreatedBy,omitempty"`
+	DataChangeLastModifiedBy string `json:"dataChangeLastModifiedBy,omitempty"`
+}
+
+type openAPINamespace struct {
+	AppID     string        `json:"appId"`
+	Cluster   string        `json:"clusterName"`
+	Namespace string        `json:"namespaceName"`
+	Format    string        `json:"format"`
+	IsPublic  bool          `json:"isPublic"`
+	Items     []openAPIItem `json:"items"`
+}
+
+type openAPIRelease struct {
+	AppID          string            `json:"appId"`
+	Cluster        string            `json:"clusterName"`
+	Namespace      string            `json:"namespaceName"`
+	Name           string            `json:"name"`
+	Configurations map[string]string `json:"configurations"`
+	Comment        string            `json:"comment"`
+}
+
+// openAPIDrafts holds the items edited through the OpenAPI until they are released,
+// keyed by the namespace names with their format extension
+type openAPIDrafts struct {
+	mu       sync.Mutex
+	items    map[store.Key]map[string]openAPIItem
+	releases map[store.Key]openAPIRelease
+}
+
+// OpenAPIRoutes registers the http handles of the portal OpenAPI of Apollo, editing the items of the served namespaces
+// and releasing them to the clients. The env and the token of the requests are ignored
+func (a *Apollo) OpenAPIRoutes(r *httprouter.Router) {
+	const prefix = "/openapi/v1/envs/:env/apps/:appId/clusters/:cluster/namespaces"
+	r.GET(prefix, a.listOpenAPINamespaces)
+	r.GET(prefix+"/:namespace", a.getOpenAPINamespace)
+	r.GET(prefix+"/:namespace/items/:key", a.getOpenAPIItem)
+	r.POST(prefix+"/:namespace/items", a.createOpenAPIItem)
+	r.PUT(prefix+"/:namespace/items/:key", a.updateOpenAPIItem)
+	r.DELETE(prefix+"/:namespace/items/:key", a.deleteOpenAPIItem)
+	r.POST(prefix+"/:namespace/releases", a.releaseOpenAPINamespace)
+	r.GET(prefix+"/:namespace/releases/latest", a.getOpenAPIRelease)
+}
+
+// openAPIKey returns the key of the draft of a namespace
+func openAPIKey(ps httprouter.Params) store.Key {
+	return store.Key{AppID: ps.ByName("appId"), Cluster: ps.ByName("cluster"), Namespace: ps.ByName("namespace")}
+}
+
+// openAPIName returns the name of a served namespace in the OpenAPI,
+// namespaces without properties are named with the extension of their format
+func openAPIName(name string, ns watcher.Namespace) string {
+	if ns.Properties != nil {
+		return name
+	}
+	switch {
+	case ns.Yml != "":
+		return name + ".yml"
+	case ns.Yaml != "":
+		return name + ".yaml"
+	case ns.JSON != "":
+		return name + ".json"
+	case ns.XML != "":
+		return name + ".xml"
+	}
+	return name
+}
+
+// openAPIFormat returns the format of a namespace named with its extension, as in Apollo
+func openAPIFormat(ext string) string {
+	return strings.TrimPrefix(ext, ".")
+}
+
+// publishedItems returns the items of the served namespace of k
+func (a *Apollo) publishedItems(k store.Key) (map[string]openAPIItem, error) {
+	name, ext := a.parseNamespace(k.Namespace)
+	ns, err := a.store.Get(k.AppID, k.Cluster, name)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := a.getNamespaceConfig(ext, ns)
+	if err != nil {
+		return nil, err
+	}
+	items := make(map[string]openAPIItem)
+	for key, value := range cfg.(map[string]string) {
+		items[key] = openAPIItem{Key: key, Value: value}
+	}
+	return items, nil
+}
+
+// draftItems returns the items of the draft of k, the draft starts from the served namespace.
+// The caller must hold the lock of the drafts
+func (a *Apollo) draftItems(k store.Key) (map[string]openAPIItem, error) {
+	if items, ok := a.openAPI.items[k]; ok {
+		return items, nil
+	}
+	items, err := a.publishedItems(k)
+	if err != nil {
+		return nil, err
+	}
+	if a.openAPI.items == nil {
+		a.openAPI.items = make(map[store.Key]map[string]openAPIItem)
+	}
+	a.openAPI.items[k] = items
+	return items, nil
+}
+
+func (a *Apollo) openAPINamespace(k store.Key) (openAPINamespace, error) {
+	a.openAPI.mu.Lock()
+	defer a.openAPI.mu.Unlock()
+	items, err := a.draftItems(k)
+	if err != nil {
+		return openAPINamespace{}, err
+	}
+	_, ext := a.parseNamespace(k.Namespace)
+	n := openAPINamespace{
+		AppID:     k.AppID,
+		Cluster:   k.Cluster,
+		Namespace: k.Namespace,
+		Format:    openAPIFormat(ext),
+		Items:     []openAPIItem{},
+	}
+	for _, item := range items {
+		n.Items = append(n.Items, item)
+	}
+	sort.Slice(n.Items, func(i, j int) bool {
+		return n.Items[i].Key < n.Items[j].Key
+	})
+	return n, nil
+}
+
+func (a *Apollo) writeOpenAPI(w http.ResponseWriter, v interface{}) {
+	json, err := json.Marshal(v)
+	if err != nil {
+		a.cfg.Log.Get().Error(err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func (a *Apollo) listOpenAPINamespaces(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	namespaces := []openAPINamespace{}
+	for _, k := range a.store.List() {
+		if k.AppID != ps.ByName("appId") || k.Cluster != ps.ByName("cluster") {
+			continue
+		}
+		ns, err := a.store.Get(k.AppID, k.Cluster, k.Namespace)
+		if err != nil {
+			continue
+		}
+		k.Namespace = openAPIName(k.Namespace, ns)
+		n, err := a.openAPINamespace(k)
+		if err != nil {
+			continue
+		}
+		namespaces = append(namespaces, n)
+	}
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].Namespace < namespaces[j].Namespace
+	})
+	a.writeOpenAPI(w, namespaces)
+}
+
+func (a *Apollo) getOpenAPINamespace(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	n, err := a.openAPINamespace(openAPIKey(ps))
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	a.writeOpenAPI(w, n)
+}
+
+func (a *Apollo) getOpenAPIItem(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	a.openAPI.mu.Lock()
+	items, err := a.draftItems(openAPIKey(ps))
+	item, ok := items[ps.ByName("key")]
+	a.openAPI.mu.Unlock()
+	if err != nil || !ok {
+		w.WriteHeader(404)
+		return
+	}
+	a.writeOpenAPI(w, item)
+}
+
+// setOpenAPIItem sets an item of the draft of k, existing items are only replaced if replace is set
+// and missing items only created if create is set
+func (a *Apollo) setOpenAPIItem(w http.ResponseWriter, k store.Key, item openAPIItem, create bool, replace bool) {
+	if item.Key == "" {
+		w.WriteHeader(400)
+		w.Write([]byte("missing key"))
+		return
+	}
+	a.openAPI.mu.Lock()
+	defer a.openAPI.mu.Unlock()
+	items, err := a.draftItems(k)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	prev, ok := items[item.Key]
+	switch {
+	case ok && !replace:
+		w.WriteHeader(400)
+		w.Write([]byte("item already exists"))
+		return
+	case !ok && !create:
+		w.WriteHeader(404)
+		return
+	case ok:
+		item.DataChangeCreatedBy = prev.DataChangeCreatedBy
+	}
+	items[item.Key] = item
+	a.writeOpenAPI(w, item)
+}
+
+func (a *Apollo) createOpenAPIItem(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	item := openAPIItem{}
+	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	item.DataChangeLastModifiedBy = item.DataChangeCreatedBy
+	a.setOpenAPIItem(w, openAPIKey(ps), item, true, false)
+}
+
+func (a *Apollo) updateOpenAPIItem(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	item := openAPIItem{}
+	if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if item.Key != ps.ByName("key") {
+		w.WriteHeader(400)
+		w.Write([]byte("key mismatch"))
+		return
+	}
+	create := r.URL.Query().Get("createIfNotExists") == "true"
+	if create && item.DataChangeCreatedBy == "" {
+		item.DataChangeCreatedBy = item.DataChangeLastModifiedBy
+	}
+	a.setOpenAPIItem(w, openAPIKey(ps), item, create, true)
+}
+
+func (a *Apollo) deleteOpenAPIItem(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	a.openAPI.mu.Lock()
+	defer a.openAPI.mu.Unlock()
+	items, err := a.draftItems(openAPIKey(ps))
+	if _, ok := items[ps.ByName("key")]; err != nil || !ok {
+		w.WriteHeader(404)
+		return
+	}
+	delete(items, ps.ByName("key"))
+	w.Write([]byte("OK"))
+}
+
+// releaseOpenAPINamespace serves the draft of a namespace with a new releaseKey, notifying the clients watching it
+func (a *Apollo) releaseOpenAPINamespace(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	req := struct {
+		Title   string `json:"releaseTitle"`
+		Comment string `json:"releaseComment"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	k := openAPIKey(ps)
+	name, ext := a.parseNamespace(k.Namespace)
+	a.openAPI.mu.Lock()
+	defer a.openAPI.mu.Unlock()
+	items, err := a.draftItems(k)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	ns, err := a.store.Get(k.AppID, k.Cluster, name)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	configurations := make(map[string]string, len(items))
+	for key, item := range items {
+		configurations[key] = item.Value
+	}
+	switch ext {
+	case ".yml":
+		ns.Yml = configurations["content"]
+	case ".yaml":
+		ns.Yaml = configurations["content"]
+	case ".json":
+		ns.JSON = configurations["content"]
+	case ".xml":
+		ns.XML = configurations["content"]
+	default:
+		ns.Properties = configurations
+	}
+	ns.ReleaseKey = ctrlReleaseKey()
+	if err := a.store.Upsert(store.Key{AppID: k.AppID, Cluster: k.Cluster, Namespace: name}, ns); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	release := openAPIRelease{
+		AppID:          k.AppID,
+		Cluster:        k.Cluster,
+		Namespace:      k.Namespace,
+		Name:           req.Title,
+		Configurations: configurations,
+		Comment:        req.Comment,
+	}
+	// the next edits start from the released namespace
+	delete(a.openAPI.items, k)
+	if a.openAPI.releases == nil {
+		a.openAPI.releases = make(map[store.Key]openAPIRelease)
+	}
+	a.openAPI.releases[k] = release
+	a.writeOpenAPI(w, release)
+}
+
+// getOpenAPIRelease returns the last release through the OpenAPI,
+// or the served namespace named after its releaseKey if it was never released through it
+func (a *Apollo) getOpenAPIRelease(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	k := openAPIKey(ps)
+	a.openAPI.mu.Lock()
+	release, ok := a.openAPI.releases[k]
+	a.openAPI.mu.Unlock()
+	if ok {
+		a.writeOpenAPI(w, release)
+		return
+	}
+	items, err := a.publishedItems(k)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	name, _ := a.parseNamespace(k.Namespace)
+	ns, err := a.store.Get(k.AppID, k.Cluster, name)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	release = openAPIRelease{
+		AppID:          k.AppID,
+		Cluster:        k.Cluster,
+		Namespace:      k.Namespace,
+		Name:           ns.ReleaseKey,
+		Configurations: make(map[string]string, len(items)),
+	}
+	for key, item := range items {
+		release.Configurations[key] = item.Value
+	}
+	a.writeOpenAPI(w, release)
+}
@@ -0,0 +1,104 @@
+package apollo
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Backoff configures the hints of the responses shedding load, the 429 of the polls beyond MaxPollsPerIP
+// and the 503 of the handlers beyond HandlerTimeout, so that the backoff of the clients can be validated
+type Backoff struct {
+	// RetryAfter is sent in seconds, rounded up, as the Retry-After header, 0 sends none
+	RetryAfter time.Duration
+	// Body answers with an Apollo-style JSON error carrying the hints in place of the plain text one
+	Body bool
+	// PollInterval is advised in seconds, rounded up, by the JSON error, 0 advises none
+	PollInterval time.Duration
+}
+
+// overloadError is the JSON error of a response shedding load, with the fields of an Apollo error
+type overloadError struct {
+	Status    int    `json:"status"`
+	Message   string `json:"message"`
+	Timestamp string `json:"timestamp"`
+	// RetryAfter and PollInterval are in seconds
+	RetryAfter   int64 `json:"retryAfter,omitempty"`
+	PollInterval int64 `json:"pollInterval,omitempty"`
+}
+
+// seconds rounds d up to whole seconds
+func seconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// overloaded answers a request shed with code and the backoff hints
+func (a *Apollo) overloaded(w http.ResponseWriter, code int, msg string) {
+	cfg := a.cfg.Backoff
+	if cfg.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(seconds(cfg.RetryAfter), 10))
+	}
+	if !cfg.Body {
+		w.WriteHeader(code)
+		w.Write([]byte(msg))
+		return
+	}
+	b, _ := json.Marshal(&overloadError{
+		Status:       code,
+		Message:      msg,
+		Timestamp:    time.Now().Format("2006-01-02T15:04:05.000-0700"),
+		RetryAfter:   seconds(cfg.RetryAfter),
+		PollInterval: seconds(cfg.PollInterval),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// timeoutBody is the body of the 503 written by http.TimeoutHandler, telling its timeout
+// apart from the 503 written by the handlers
+const timeoutBody = "handler timeout"
+
+// overloadWriter answers the timeout of http.TimeoutHandler with the backoff hints,
+// the 503 written by the handlers are passed through unchanged
+type overloadWriter struct {
+	http.ResponseWriter
+	a *Apollo
+	// held is set while a 503 is held until its body tells whether it's the timeout
+	held bool
+	// shed is set once the timeout is answered, dropping the body of http.TimeoutHandler
+	shed bool
+}
+
+func (w *overloadWriter) WriteHeader(code int) {
+	if code != http.StatusServiceUnavailable {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.held = true
+}
+
+func (w *overloadWriter) Write(b []byte) (int, error) {
+	if w.shed {
+		return len(b), nil
+	}
+	if w.held {
+		w.held = false
+		if string(b) == timeoutBody {
+			w.shed = true
+			w.a.overloaded(w.ResponseWriter, http.StatusServiceUnavailable, timeoutBody)
+			return len(b), nil
+		}
+		w.ResponseWriter.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// flush writes a held 503 that got no body
+func (w *overloadWriter) flush() {
+	if w.held {
+		w.held = false
+		w.ResponseWriter.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
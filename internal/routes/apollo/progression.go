@@ -0,0 +1,116 @@
+package apollo
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/figroc/mock-apollo-go/pkg/store"
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+)
+
+// releaseKey modes
+const (
+	// ReleaseKeyFile serves the releaseKeys of the config files
+	ReleaseKeyFile = "file"
+	// ReleaseKeyCounter serves an increasing integer per change of a namespace
+	ReleaseKeyCounter = "counter"
+	// ReleaseKeyApollo serves releaseKeys in the timestamp-random format of Apollo,
+	// with strictly increasing timestamps
+	ReleaseKeyApollo = "apollo"
+	// ReleaseKeyHash serves releaseKeys of the strictly increasing timestamp of a change
+	// and the hash of the content, so that a key tells the content it was released with
+	ReleaseKeyHash = "hash"
+)
+
+// release is the releaseKey generated for a version of a namespace
+type release struct {
+	sum uint64
+	key string
+}
+
+// progression generates a new releaseKey whenever the content of a namespace changes
+type progression struct {
+	mu    sync.Mutex
+	mode  string
+	now   func() time.Time
+	rand  *rand.Rand
+	last  int64
+	names map[store.Key]release
+}
+
+func newProgression(mode string) *progression {
+	return &progression{
+		mode:  mode,
+		now:   time.Now,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		names: make(map[store.Key]release),
+	}
+}
+
+// apply returns ns with the releaseKey of its current content
+func (p *progression) apply(k store.Key, ns watcher.Namespace) watcher.Namespace {
+	if p.mode == "" || p.mode == ReleaseKeyFile {
+		return ns
+	}
+	sum := fingerprint(ns)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r, ok := p.names[k]
+	if !ok || r.sum != sum {
+		r = release{sum: sum, key: p.next(sum)}
+		p.names[k] = r
+	}
+	ns.ReleaseKey = r.key
+	return ns
+}
+
+// next returns a releaseKey of the content hashed to sum greater than all the previous ones
+func (p *progression) next(sum uint64) string {
+	if p.mode == ReleaseKeyCounter {
+		p.last++
+		return strconv.FormatInt(p.last, 10)
+	}
+	// timestamps have a second resolution, keys generated within a second take the next ones
+	ts := p.now().Unix()
+	if ts <= p.last {
+		ts = p.last + 1
+	}
+	p.last = ts
+	b := make([]byte, 8)
+	if p.mode == ReleaseKeyHash {
+		binary.BigEndian.PutUint64(b, sum)
+	} else {
+		p.rand.Read(b)
+	}
+	return time.Unix(ts, 0).Format("20060102150405") + "-" + hex.EncodeToString(b)
+}
+
+// fingerprint returns the hash of the content of a namespace
+func fingerprint(ns watcher.Namespace) uint64 {
+	h := fnv.New64a()
+	write := func(s string) {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	write(ns.ReleaseKey)
+	keys := make([]string, 0, len(ns.Properties))
+	for k := range ns.Properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		write(k)
+		write(ns.Properties[k])
+	}
+	write(ns.Yml)
+	write(ns.Yaml)
+	write(ns.JSON)
+	write(ns.XML)
+	return h.Sum64()
+}
@@ -0,0 +1,92 @@
+package apollo
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+)
+
+// renderProperties renders properties as the text of a java .properties file, sorted by key,
+// non-ASCII characters are written as \uXXXX escapes when unicode is set
+func renderProperties(properties map[string]string, unicode bool) string {
+	keys := make([]string, 0, len(properties))
+	for k := range properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(escapeProperty(k, true, unicode))
+		b.WriteByte('=')
+		b.WriteString(escapeProperty(properties[k], false, unicode))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// escapeProperty escapes s following the rules of java.util.Properties#store
+func escapeProperty(s string, key bool, unicode bool) string {
+	var b strings.Builder
+	for i, c := range s {
+		switch c {
+		case '\\':
+			b.WriteString(`\\`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '=', ':', '#', '!':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case ' ':
+			// spaces are significant in keys and at the start of values
+			if key || i == 0 {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(c)
+		default:
+			if unicode && (c < 0x20 || c > 0x7e) {
+				// characters outside the BMP are written as surrogate pairs like java does
+				for _, u := range utf16.Encode([]rune{c}) {
+					fmt.Fprintf(&b, `\u%04X`, u)
+				}
+			} else {
+				b.WriteRune(c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// debugOverrideParam overlays properties onto a single response, in the form key:value
+const debugOverrideParam = "_mock_override"
+
+// debugOverride returns ns with the properties given by the debug override parameters of r merged over it
+func debugOverride(ns watcher.Namespace, r *http.Request) watcher.Namespace {
+	overrides := r.URL.Query()[debugOverrideParam]
+	if len(overrides) == 0 {
+		return ns
+	}
+	props := make(map[string]string, len(ns.Properties)+len(overrides))
+	for k, v := range ns.Properties {
+		props[k] = v
+	}
+	for _, o := range overrides {
+		kv := strings.SplitN(o, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		props[kv[0]] = kv[1]
+	}
+	ns.Properties = props
+	return ns
+}
@@ -0,0 +1,54 @@
+package apollo
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+	"github.com/julienschmidt/httprouter"
+)
+
+type fileReadiness struct {
+	watcher.Status
+	Stale bool `json:"stale"`
+}
+
+type readiness struct {
+	Status string          `json:"status"`
+	Files  []fileReadiness `json:"files"`
+}
+
+// readyz reports the config files failing to load for longer than StaleAfter,
+// the server stays ready as it keeps serving the last loaded config
+func (a *Apollo) readyz(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rd := readiness{Status: "ok", Files: []fileReadiness{}}
+	stale := []string{}
+	for _, fw := range a.watchers() {
+		s := fw.Status()
+		fr := fileReadiness{Status: s, Stale: !s.FailingSince.IsZero() && time.Since(s.FailingSince) >= a.cfg.StaleAfter}
+		if fr.Stale {
+			rd.Status = "degraded"
+			stale = append(stale, s.File)
+		}
+		rd.Files = append(rd.Files, fr)
+	}
+
+	if r.URL.Query().Get("format") != "json" && !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		if len(stale) == 0 {
+			w.Write([]byte("OK"))
+		} else {
+			w.Write([]byte("stale config files: " + strings.Join(stale, ", ")))
+		}
+		return
+	}
+	json, err := json.Marshal(&rd)
+	if err != nil {
+		a.cfg.Log.Get().Error(err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
@@ -0,0 +1,19 @@
+package apollo
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverPanic is the PanicHandler of the routers, it answers a request whose handler panicked with a 500
+// and logs the stack trace, so that a bug of a route leaves the other requests of a shared mock served.
+// The panics aborting a response on purpose, e.g. to drop the connection, are left to the HTTP server
+func (a *Apollo) recoverPanic(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if v == http.ErrAbortHandler {
+		panic(v)
+	}
+	a.metrics.panics.Inc()
+	a.cfg.Log.Get().Error(fmt.Sprintf("panic serving request %s: %v\n%s", r.URL.String(), v, debug.Stack()))
+	w.WriteHeader(500)
+}
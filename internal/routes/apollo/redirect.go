@@ -0,0 +1,35 @@
+package apollo
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// redirectMoved answers the requests of a route under one of the RedirectPrefixes, e.g. /apollo/configs/...,
+// with a 301 to the canonical route, so that misrouted clients get a hint instead of a 404
+func (a *Apollo) redirectMoved(router *httprouter.Router, notFound http.HandlerFunc) http.HandlerFunc {
+	if len(a.cfg.RedirectPrefixes) == 0 {
+		return notFound
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, prefix := range a.cfg.RedirectPrefixes {
+			prefix = strings.TrimSuffix(prefix, "/")
+			if !strings.HasPrefix(r.URL.Path, prefix+"/") {
+				continue
+			}
+			path := strings.TrimPrefix(r.URL.Path, prefix)
+			if h, _, _ := router.Lookup(r.Method, path); h == nil {
+				continue
+			}
+			u := *r.URL
+			u.Path, u.RawPath = path, ""
+			a.cfg.Log.Get().Warn(fmt.Sprintf("redirecting moved path: %s to %s", r.URL.Path, path))
+			http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+			return
+		}
+		notFound(w, r)
+	}
+}
@@ -0,0 +1,184 @@
+package apollo
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/figroc/mock-apollo-go/pkg/graphql"
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+	"github.com/julienschmidt/httprouter"
+)
+
+// releaseKeyOverride serves a distinct releaseKey to the clients matching an ip, a label, headers
+// or a stable share of the clients, simulating a gray release. The served properties are
+// left unchanged unless branch properties are given, which are merged over them
+type releaseKeyOverride struct {
+	AppID     string `json:"appId,omitempty"`
+	Cluster   string `json:"cluster,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	Label     string `json:"label,omitempty"`
+	// Headers are matched against the request headers, e.g. routing labels injected by a service mesh
+	Headers map[string]string `json:"headers,omitempty"`
+	// Percent of the clients matched, a client is picked by its watcher.ClientBucket
+	// so that it keeps getting the same config
+	Percent    int               `json:"percent,omitempty"`
+	ReleaseKey string            `json:"releaseKey"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+func (o *releaseKeyOverride) validate() error {
+	if o.ReleaseKey == "" {
+		return errors.New("missing releaseKey")
+	}
+	if o.Percent < 0 || o.Percent > 100 {
+		return errors.New("invalid percent")
+	}
+	if o.IP == "" && o.Label == "" && len(o.Headers) == 0 && o.Percent == 0 {
+		return errors.New("missing ip, label, headers or percent")
+	}
+	return nil
+}
+
+func (o *releaseKeyOverride) match(appID string, cluster string, namespace string, ip string, label string, header http.Header) bool {
+	if o.AppID != "" && o.AppID != appID {
+		return false
+	}
+	if o.Cluster != "" && o.Cluster != cluster {
+		return false
+	}
+	if o.Namespace != "" && o.Namespace != namespace {
+		return false
+	}
+	if o.IP != "" && o.IP != ip {
+		return false
+	}
+	if o.Label != "" && o.Label != label {
+		return false
+	}
+	for k, v := range o.Headers {
+		if header.Get(k) != v {
+			return false
+		}
+	}
+	if o.Percent > 0 && watcher.ClientBucket(appID, ip) >= o.Percent {
+		return false
+	}
+	return true
+}
+
+type releaseKeyOverrides struct {
+	mu    sync.RWMutex
+	rules []releaseKeyOverride
+}
+
+func (o *releaseKeyOverrides) get() []releaseKeyOverride {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return append([]releaseKeyOverride{}, o.rules...)
+}
+
+func (o *releaseKeyOverrides) set(rules []releaseKeyOverride) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.rules = rules
+}
+
+// apply returns ns as served to the client of r, with the releaseKey and branch properties
+// of the first matching override
+func (o *releaseKeyOverrides) apply(ns watcher.Namespace, appID string, cluster string, namespace string, r *http.Request) watcher.Namespace {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if len(o.rules) == 0 {
+		return ns
+	}
+	ip, label := clientIP(r), grayLabel(r)
+	for _, rule := range o.rules {
+		if !rule.match(appID, cluster, namespace, ip, label, r.Header) {
+			continue
+		}
+		ns.ReleaseKey = rule.ReleaseKey
+		if len(rule.Properties) > 0 {
+			// the namespace is shared, so the branch is merged into a copy
+			props := make(map[string]string, len(ns.Properties)+len(rule.Properties))
+			for k, v := range ns.Properties {
+				props[k] = v
+			}
+			for k, v := range rule.Properties {
+				props[k] = v
+			}
+			ns.Properties = props
+		}
+		return ns
+	}
+	return ns
+}
+
+// clientIP returns the ip reported by the client, or the remote address of the request
+func clientIP(r *http.Request) string {
+	if ip := r.URL.Query().Get("ip"); ip != "" {
+		return ip
+	}
+	return remoteHost(r.RemoteAddr)
+}
+
+// AdminRoutes registers the http handles for administrating Apollo
+func (a *Apollo) AdminRoutes(r *httprouter.Router) {
+	r.PanicHandler = a.recoverPanic
+	r.GET("/admin/releasekeys", a.getReleaseKeys)
+	r.PUT("/admin/releasekeys", a.putReleaseKeys)
+	r.DELETE("/admin/releasekeys", a.deleteReleaseKeys)
+	r.GET("/admin/clients", a.getTopClients)
+	r.GET("/admin/clients/duplicates", a.getDuplicateWatches)
+	r.GET("/admin/status", a.getStatus)
+	r.GET("/admin/ui", a.getDashboard)
+	r.POST("/admin/ui/notify", a.postDashboardNotify)
+	r.GET("/admin/fixtures/next", a.getNextFixtures)
+	r.PUT("/admin/fixtures/next", a.putNextFixtures)
+	r.DELETE("/admin/fixtures/next", a.deleteNextFixtures)
+	r.POST("/admin/fixtures/switch", a.postSwitchFixtures)
+	r.POST("/admin/fixtures/rollback", a.postRollbackFixtures)
+	r.GET("/admin/upstream", a.getUpstream)
+	r.DELETE("/admin/upstream", a.deleteUpstream)
+	if a.cfg.GraphQL {
+		h := graphql.Handler(a.schema())
+		r.Handler("GET", "/admin/graphql", h)
+		r.Handler("POST", "/admin/graphql", h)
+	}
+}
+
+func (a *Apollo) getReleaseKeys(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	json, err := json.Marshal(a.releaseKeys.get())
+	if err != nil {
+		a.cfg.Log.Get().Error(err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+func (a *Apollo) putReleaseKeys(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	rules := []releaseKeyOverride{}
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	a.releaseKeys.set(rules)
+	w.Write([]byte("OK"))
+}
+
+func (a *Apollo) deleteReleaseKeys(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	a.releaseKeys.set(nil)
+	w.Write([]byte("OK"))
+}
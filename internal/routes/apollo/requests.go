@@ -0,0 +1,161 @@
+package apollo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// recordedRequest is a request of the config routes, recorded for the assertions of the tests
+type recordedRequest struct {
+	Method    string     `json:"method"`
+	Path      string     `json:"path"`
+	Query     url.Values `json:"query,omitempty"`
+	AppID     string     `json:"appId,omitempty"`
+	Cluster   string     `json:"cluster,omitempty"`
+	Namespace string     `json:"namespace,omitempty"`
+	IP        string     `json:"ip"`
+	Status    int        `json:"status"`
+	Received  time.Time  `json:"received"`
+	Completed time.Time  `json:"completed"`
+}
+
+// requestFilter selects the recorded requests listed, the empty fields match all of the requests
+type requestFilter struct {
+	Method string
+	// Path is a prefix of the path
+	Path      string
+	AppID     string
+	Cluster   string
+	Namespace string
+	IP        string
+	// Since matches the requests received from a time
+	Since time.Time
+}
+
+func (f requestFilter) match(req recordedRequest) bool {
+	match := func(filter string, v string) bool {
+		return filter == "" || filter == v
+	}
+	return (f.Method == "" || strings.EqualFold(f.Method, req.Method)) &&
+		strings.HasPrefix(req.Path, f.Path) &&
+		match(f.AppID, req.AppID) &&
+		match(f.Cluster, req.Cluster) &&
+		match(f.Namespace, req.Namespace) &&
+		match(f.IP, req.IP) &&
+		!req.Received.Before(f.Since)
+}
+
+// requestStore stores the recorded requests, in memory or in a journal database surviving restarts
+type requestStore interface {
+	add(req recordedRequest)
+	// list returns the recorded requests matching f from the oldest to the latest
+	list(f requestFilter) []recordedRequest
+	reset()
+}
+
+// requestLog keeps the latest requests of the config routes, the oldest ones are dropped beyond size
+type requestLog struct {
+	mu       sync.Mutex
+	size     int
+	requests []recordedRequest
+}
+
+func (l *requestLog) add(req recordedRequest) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size <= 0 {
+		return
+	}
+	l.requests = append(l.requests, req)
+	if len(l.requests) > l.size {
+		l.requests = l.requests[len(l.requests)-l.size:]
+	}
+}
+
+// list returns the recorded requests matching f from the oldest to the latest
+func (l *requestLog) list(f requestFilter) []recordedRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	requests := []recordedRequest{}
+	for _, req := range l.requests {
+		if f.match(req) {
+			requests = append(requests, req)
+		}
+	}
+	return requests
+}
+
+func (l *requestLog) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.requests = nil
+}
+
+// recordRequest records a request answered with code, received at start
+func (a *Apollo) recordRequest(r *http.Request, ps httprouter.Params, code int, start time.Time) {
+	param := func(name string) string {
+		if v := ps.ByName(name); v != "" {
+			return v
+		}
+		return r.URL.Query().Get(name)
+	}
+	namespace, _ := a.parseNamespace(ps.ByName("namespace"))
+	a.requests.add(recordedRequest{
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Query:     r.URL.Query(),
+		AppID:     param("appId"),
+		Cluster:   param("cluster"),
+		Namespace: namespace,
+		IP:        clientIP(r),
+		Status:    code,
+		Received:  start,
+		Completed: time.Now(),
+	})
+}
+
+// getCtrlRequests lists the recorded requests from the oldest to the latest, filtered by the method, path prefix,
+// appId, cluster, namespace and ip query parameters, and by since for the requests received from an RFC 3339 time
+func (a *Apollo) getCtrlRequests(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	q := r.URL.Query()
+	var since time.Time
+	if s := q.Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("invalid since '%s'", s)))
+			return
+		}
+		since = t
+	}
+	requests := a.requests.list(requestFilter{
+		Method:    q.Get("method"),
+		Path:      q.Get("path"),
+		AppID:     q.Get("appId"),
+		Cluster:   q.Get("cluster"),
+		Namespace: q.Get("namespace"),
+		IP:        q.Get("ip"),
+		Since:     since,
+	})
+	json, err := json.Marshal(requests)
+	if err != nil {
+		a.cfg.Log.Get().Error(err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// deleteCtrlRequests forgets the recorded requests, e.g. between the cases of a test
+func (a *Apollo) deleteCtrlRequests(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	a.requests.reset()
+	w.Write([]byte("OK"))
+}
@@ -5,13 +5,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/figroc/mock-apollo-go/pkg/auth"
+	"github.com/figroc/mock-apollo-go/pkg/events"
+	"github.com/figroc/mock-apollo-go/pkg/hooks"
 	"github.com/figroc/mock-apollo-go/pkg/longpoll"
+	"github.com/figroc/mock-apollo-go/pkg/metrics"
+	"github.com/figroc/mock-apollo-go/pkg/quota"
+	"github.com/figroc/mock-apollo-go/pkg/store"
 	"github.com/figroc/mock-apollo-go/pkg/watcher"
 	"github.com/julienschmidt/httprouter"
 	"github.com/lalamove/nui/nlogger"
@@ -19,71 +28,452 @@ import (
 
 // Config is an object that stores the package config
 type Config struct {
-	Log         nlogger.Provider
-	ConfigPath  []string
-	PollTimeout time.Duration
-	Port        int
+	Log        nlogger.Provider
+	ConfigPath []string
+	// WatchNotify watches the config files with the notifications of the OS in place of polling them every second,
+	// the files are polled where the notifications are not supported
+	WatchNotify bool
+	// WatchDebounce delays the reload of a changed config file until it was left unchanged for it,
+	// so that the clients are notified once of a file written several times in quick succession, 0 means no delay
+	WatchDebounce time.Duration
+	PollTimeout   time.Duration
+	Port          int
+	// Quota is the number of requests allowed per appId per minute, 0 means unlimited
+	Quota int
+	// AppQuota overrides Quota for specific appIds
+	AppQuota map[string]int
+	// AppWindows are the daily service windows of specific appIds, the other appIds are always served
+	AppWindows map[string]AppWindow
+	Metrics    *metrics.Registry
+	// NotifyRate is the max number of notifications sent per second on a reload, 0 means no limit
+	NotifyRate int
+	// NotifyWindow delays the change notifications so that the namespaces changed within it are answered together,
+	// 0 means answering on the first change
+	NotifyWindow time.Duration
+	// MaxPollsPerIP is the max number of open polls of a remote ip, 0 means no limit
+	MaxPollsPerIP int
+	// Faults are the rules injecting errors and latency into the requests, the first matching rule applies
+	Faults []FaultRule
+	// MaxFileSize is the max size of a config file in bytes, 0 means no limit
+	MaxFileSize int64
+	// DecryptionKey decrypts the encrypted values of the config files, see watcher.Encrypt
+	DecryptionKey []byte
+	// JasyptPassword encrypts the jasypt properties of the config files, see watcher.Namespace
+	JasyptPassword string
+	// DisableCompression serves the config and notification responses uncompressed
+	// whatever the Accept-Encoding of the clients
+	DisableCompression bool
+	// CompressionMinSize is the min size in bytes of the compressed response bodies, 0 compresses all of them
+	CompressionMinSize int
+	// Charset is appended to the Content-Type of responses, empty means no charset
+	Charset string
+	// UnicodeEscape writes non-ASCII characters of rendered properties as \uXXXX escapes
+	UnicodeEscape bool
+	// HandlerTimeout is the max duration of non long polling handlers, 0 means no limit
+	HandlerTimeout time.Duration
+	// Backoff configures the hints of the 429 and 503 responses shedding load
+	Backoff Backoff
+	// WatchdogInterval is how often the lock is sampled for a deadlock
+	WatchdogInterval time.Duration
+	// WatchdogTimeout is how long a lock sample may wait before reporting contention
+	WatchdogTimeout time.Duration
+	// Service customizes the response of /services/config
+	Service ServiceConfig
+	// ClusterAlias maps requested cluster names to the cluster served from the config files
+	ClusterAlias map[string]string
+	// NotFoundHints answers the requests of a namespace that is not served with a JSON body
+	// listing the nearest namespaces of the app and cluster
+	NotFoundHints bool
+	// LooseAppID serves the namespace of another app to the requests of an app without it,
+	// by default namespaces are only served to their own app like Apollo does
+	LooseAppID bool
+	// DebugOverride honors the _mock_override=key:value query parameters overlaying properties onto a response
+	DebugOverride bool
+	// GraphQL enables the GraphQL query endpoint of the admin routes
+	GraphQL bool
+	// Hook decides the behavior of each request, e.g. a fault or a delay, nil means no hook
+	Hook hooks.Hook
+	// Authenticator authenticates the requests of the config routes, nil means no authentication
+	Authenticator auth.Authenticator
+	// NotificationFault injects faults into the long polls
+	NotificationFault NotificationFault
+	// AccessLog configures the log line of each served request
+	AccessLog AccessLog
+	// RequestLogSize is the number of latest requests of the config routes recorded for /ctrl/requests,
+	// 0 records none
+	RequestLogSize int
+	// RequestJournal is the SQLite database storing the RequestLogSize latest requests in place of the memory,
+	// kept across restarts, empty means the requests are kept in memory
+	RequestJournal string
+	// CacheFile persists the config loaded from the files, served at startup while the files fail to load,
+	// empty means no cache
+	CacheFile string
+	// SnapshotDir receives a timestamped snapshot of the served config every SnapshotInterval,
+	// empty means no snapshots
+	SnapshotDir      string
+	SnapshotInterval time.Duration
+	// SnapshotRetain is the number of latest snapshots kept, 0 keeps all
+	SnapshotRetain int
+	// StaleAfter is how long a config file may fail to load before /readyz reports it stale,
+	// the last loaded config keeps being served meanwhile
+	StaleAfter time.Duration
+	// ReleaseKeyMode is how releaseKeys are generated, one of ReleaseKeyFile, ReleaseKeyCounter,
+	// ReleaseKeyApollo or ReleaseKeyHash, empty means ReleaseKeyFile
+	ReleaseKeyMode string
+	// RedirectPrefixes are the base paths, e.g. /apollo, whose requests of a route are redirected to the route
+	RedirectPrefixes []string
+	// Env is the env whose apps are served from the envs sections of the config files, e.g. DEV,
+	// empty serves the apps outside of them
+	Env string
+	// Envs are the envs served under /envs/{env} of the config and ctrl routes, each by an Apollo of its own,
+	// so that the clients of several envs are served by one server
+	Envs []string
+	// MirrorURL receives a copy of the requests of the configs and configfiles routes, e.g. a candidate build
+	// or a real Apollo, whose responses are compared to the served ones. Nil mirrors nothing
+	MirrorURL *url.URL
+	// SoakInterval is how often the goroutines, open file descriptors and polls are sampled,
+	// reporting the ones growing over the last SoakSamples in /admin/status. 0 samples nothing
+	SoakInterval time.Duration
+	SoakSamples  int
+	// Upstream is a real Apollo the served namespaces are compared with, reported at /admin/upstream.
+	// Nil compares nothing
+	Upstream *url.URL
+	// UpstreamInterval is how often a namespace is compared with the upstream at most
+	UpstreamInterval time.Duration
+	// AdvertiseScheme is the scheme of the discovered URLs, empty means the scheme of the request
+	// taken from X-Forwarded-Proto or the connection
+	AdvertiseScheme string
 }
 
 // Apollo serves the mock apollo http routes
 type Apollo struct {
-	mu    sync.Mutex
-	cfg   Config
-	w     []*watcher.Watcher
-	polls map[*longpoll.Poll]bool
+	// mu guards the poll bookkeeping, fan-out only holds it to take a snapshot
+	mu      sync.RWMutex
+	npolls  int64
+	closing int32
+	cfg     Config
+	w       []*watcher.Watcher
+	bus     *events.Bus
+	store   *store.Layered
+	polls   map[*longpoll.Poll]pollClient
+	// ipPolls counts the open polls by remote ip along with polls
+	ipPolls   map[string]int
+	quota     *quota.Quota
+	metrics   *apolloMetrics
+	watchdog  *watchdog
+	fanout    *fanout
+	faults    *faults
+	accessLog *accessLog
+	conns     connCounter
+	fixtures  fixtures
+	cache     *configCache
+	snapshots *snapshotter
+	warnings  parseWarnings
+	// progression generates the releaseKeys unless they are taken from the config files
+	progression *progression
+	// releaseKeys is embedded by value, it's guarded by its own lock
+	releaseKeys releaseKeyOverrides
+	// notificationIDs is embedded by value, it's guarded by its own lock
+	notificationIDs notificationIDs
+	// openAPI is embedded by value, it's guarded by its own lock
+	openAPI openAPIDrafts
+	// requests is guarded by its own lock
+	requests requestStore
+	// envs are the Apollos of the Envs keyed by their upper cased names
+	envs map[string]*Apollo
+	// mirror is nil unless MirrorURL is set
+	mirror *mirror
+	// upstream is nil unless Upstream is set
+	upstream *upstream
+	// soak is nil unless SoakInterval is set
+	soak *soak
 }
 
 // New creates a new Apollo
 func New(ctx context.Context, cfg Config) (*Apollo, error) {
 	validateConfig(&cfg)
+	bus := events.NewBus()
 	a := &Apollo{
-		cfg:   cfg,
-		polls: make(map[*longpoll.Poll]bool),
+		cfg:     cfg,
+		bus:     bus,
+		store:   store.New(bus),
+		polls:   make(map[*longpoll.Poll]pollClient),
+		ipPolls: make(map[string]int),
+		conns:   connCounter{conns: make(map[string]int)},
+		quota: quota.New(quota.Config{
+			Limit:     cfg.Quota,
+			AppLimits: cfg.AppQuota,
+		}),
+		metrics:     newMetrics(cfg.Metrics, cfg.Env),
+		progression: newProgression(cfg.ReleaseKeyMode),
+		faults:      newFaults(cfg.NotificationFault, cfg.Faults),
+		accessLog:   &accessLog{cfg: cfg.AccessLog},
+		requests:    &requestLog{size: cfg.RequestLogSize},
 	}
-	// start watching the config file
-	for _, f := range a.cfg.ConfigPath {
-		if err := a.watch(ctx, f); err != nil {
-			return a, err
+	if cfg.RequestJournal != "" {
+		j, err := openJournal(cfg.RequestJournal, cfg.RequestLogSize, func(err error) {
+			a.cfg.Log.Get().Error(fmt.Sprintf("request journal: %v", err))
+		})
+		if err != nil {
+			return nil, err
 		}
+		a.requests = j
+		go func() {
+			<-ctx.Done()
+			j.close()
+		}()
 	}
-	return a, nil
+	if cfg.CacheFile != "" {
+		a.cache = newConfigCache(cfg.CacheFile)
+	}
+	if cfg.MirrorURL != nil {
+		a.mirror = newMirror(cfg.MirrorURL)
+	}
+	if cfg.Upstream != nil {
+		a.upstream = newUpstream(cfg.Upstream, cfg.UpstreamInterval)
+	}
+	if cfg.SoakInterval > 0 {
+		a.soak = newSoak(cfg.SoakSamples)
+		go a.runSoak(ctx)
+	}
+	a.fanout = newFanout(a, cfg.NotifyRate, cfg.NotifyWindow)
+	go a.fanout.run(ctx)
+	// the ids are bumped as the store changes, before the polls are notified
+	bus.Hook(func(e events.Event) {
+		if e.Type == events.NamespaceUpdated || e.Type == events.NamespaceDeleted {
+			a.notificationIDs.bump(store.Key{AppID: e.AppID, Cluster: e.Cluster, Namespace: e.Namespace})
+		}
+	})
+	// notify the polls watching the namespaces changed in the store
+	go func(changes <-chan events.Event) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-changes:
+				switch e.Type {
+				case events.FileReloaded:
+					a.metrics.reloads.Inc()
+					a.updateParseWarnings()
+					a.saveConfigCache()
+				case events.NamespaceUpdated, events.NamespaceDeleted:
+					a.fanout.notify(a.watchingPolls(e.Namespace))
+				}
+			}
+		}
+	}(a.store.Watch(ctx))
+	if cfg.SnapshotDir != "" {
+		a.snapshots = newSnapshotter(cfg.SnapshotDir, cfg.SnapshotRetain)
+		go a.runSnapshots(ctx)
+	}
+	a.watchdog = newWatchdog(&a.mu, cfg.WatchdogTimeout)
+	go a.watchdog.run(ctx, cfg.WatchdogInterval, func(msg string) {
+		a.cfg.Log.Get().Error(msg)
+	})
+	// start watching the config files
+	a.fixtures.ctx = ctx
+	wctx, cancel := context.WithCancel(ctx)
+	m, err := watcher.NewManager(wctx, watcher.ManagerConfig{
+		Log:            a.cfg.Log,
+		Files:          a.cfg.ConfigPath,
+		Notify:         a.cfg.WatchNotify,
+		Debounce:       a.cfg.WatchDebounce,
+		MaxFileSize:    a.cfg.MaxFileSize,
+		DecryptionKey:  a.cfg.DecryptionKey,
+		JasyptPassword: a.cfg.JasyptPassword,
+		Env:            a.cfg.Env,
+		Bus:            a.bus,
+	})
+	if m != nil {
+		a.w = m.Files()
+		a.store.AddSource(m)
+		a.fixtures.live = &fixtureSet{files: a.cfg.ConfigPath, m: m, cancel: cancel}
+		a.updateParseWarnings()
+	} else {
+		cancel()
+	}
+	if a.cache != nil && m != nil {
+		a.store.AddSource(a.cache)
+		if err == nil {
+			a.saveConfigCache()
+		} else if cerr := a.cache.load(); cerr != nil {
+			a.cfg.Log.Get().Warn(fmt.Sprintf("error loading config cache: %v", cerr))
+		} else {
+			a.cfg.Log.Get().Warn(fmt.Sprintf("serving the config cached in %s until the files load: %v", cfg.CacheFile, err))
+			err = nil
+		}
+	}
+	if eerr := a.newEnvs(ctx); err == nil {
+		err = eerr
+	}
+	return a, err
 }
 
 func validateConfig(cfg *Config) {
 	if cfg.Log == nil {
 		cfg.Log = nlogger.NewProvider(nlogger.New(os.Stdout, ""))
 	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = metrics.NewRegistry()
+	}
+	if cfg.WatchdogInterval <= 0 {
+		cfg.WatchdogInterval = 5 * time.Second
+	}
+	if cfg.WatchdogTimeout <= 0 {
+		cfg.WatchdogTimeout = time.Second
+	}
+	if cfg.SnapshotInterval <= 0 {
+		cfg.SnapshotInterval = time.Minute
+	}
+	if cfg.UpstreamInterval <= 0 {
+		cfg.UpstreamInterval = time.Minute
+	}
+	if cfg.SoakSamples < 2 {
+		cfg.SoakSamples = 10
+	}
+	validateServiceConfig(&cfg.Service)
 }
 
 // Routes registers the http handles for Apollo
 func (a *Apollo) Routes(r *httprouter.Router) {
-	r.GET("/healthz", a.healthz)
-	r.GET("/configs/:appId/:cluster/:namespace", a.queryConfig)
-	r.GET("/configfiles/json/:appId/:cluster/:namespace", a.queryConfigJSON)
-	r.GET("/services/config", a.queryService)
-	r.GET("/notifications/v2", a.longPolling)
+	r.PanicHandler = a.recoverPanic
+	get := func(path string, h httprouter.Handle) {
+		r.GET(path, a.instrument(path, a.withFaults(a.withHooks(h))))
+	}
+	// SDKs check that a namespace exists with a HEAD of its config, answered without a body
+	getHead := func(path string, h httprouter.Handle) {
+		h = a.instrument(path, a.withFaults(a.withHooks(h)))
+		r.GET(path, h)
+		r.HEAD(path, h)
+	}
+	// the health checks are left out of the faults, so that they don't get the server restarted
+	r.GET("/healthz", a.instrument("/healthz", a.withHooks(a.withDeadline(a.healthz))))
+	r.GET("/readyz", a.instrument("/readyz", a.withHooks(a.withDeadline(a.readyz))))
+	r.GET("/health", a.instrument("/health", a.withHooks(a.actuatorHealth)))
+	getHead("/configs/:appId/:cluster/:namespace", a.withCompression(a.withDeadline(a.withAuth(a.withAccessKey(a.withWindow(a.withQuota(a.withMirror(a.withUpstream(a.queryConfig)))))))))
+	// httprouter doesn't allow the json segment next to the appId wildcard, so they share a route
+	configFiles := a.configFiles(
+		a.instrument("/configfiles/json/:appId/:cluster/:namespace", a.withFaults(a.withHooks(a.withCompression(a.withDeadline(a.withAuth(a.withAccessKey(a.withWindow(a.withQuota(a.withMirror(a.withUpstream(a.queryConfigJSON))))))))))),
+		a.instrument("/configfiles/:appId/:cluster/:namespace", a.withFaults(a.withHooks(a.withCompression(a.withDeadline(a.withAuth(a.withAccessKey(a.withWindow(a.withQuota(a.withMirror(a.withUpstream(a.queryConfigFile))))))))))),
+	)
+	r.GET("/configfiles/*path", configFiles)
+	r.HEAD("/configfiles/*path", configFiles)
+	get("/services/config", a.withDeadline(a.withAuth(a.withWindow(a.withQuota(a.queryService)))))
+	// long polls are bound by their own timeout
+	get("/notifications/v2", a.withCompression(a.withAuth(a.withAccessKey(a.withWindow(a.withQuota(a.longPolling))))))
+	a.envRoutes(r, (*Apollo).Routes)
 
 	// capture invalid http calls
 	r.HandleMethodNotAllowed = false
-	r.NotFound = &notFoundHandler{a.cfg.Log}
+	r.NotFound = a.redirectMoved(r, a.notFound)
 }
 
-type notFoundHandler struct {
-	log nlogger.Provider
-}
-
-func (h *notFoundHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.log.Get().Warn(fmt.Sprintf("http path not found: %s %s", r.Method, r.URL.String()))
+func (a *Apollo) notFound(w http.ResponseWriter, r *http.Request) {
+	a.cfg.Log.Get().Warn(fmt.Sprintf("http path not found: %s %s", r.Method, r.URL.String()))
 	w.WriteHeader(404)
 	w.Write([]byte("path not found"))
 }
 
+// withDeadline cancels the request context and responds with 503 and the backoff hints once HandlerTimeout is exceeded
+func (a *Apollo) withDeadline(h httprouter.Handle) httprouter.Handle {
+	if a.cfg.HandlerTimeout <= 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h(w, r, ps)
+		})
+		ow := &overloadWriter{ResponseWriter: w, a: a}
+		http.TimeoutHandler(handler, a.cfg.HandlerTimeout, timeoutBody).ServeHTTP(ow, r)
+		ow.flush()
+	}
+}
+
+// withQuota rejects requests of an appId with 403 once its quota has been used up
+func (a *Apollo) withQuota(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		appID := ps.ByName("appId")
+		if appID == "" {
+			appID = r.URL.Query().Get("appId")
+		}
+		res := a.quota.Take(appID)
+		if res.Limit > 0 {
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(res.Reset.Unix(), 10))
+		}
+		if !res.Allowed {
+			a.metrics.quotaExceeded.Inc(appID)
+			a.cfg.Log.Get().Warn(fmt.Sprintf("quota exceeded for request: %s", r.URL.String()))
+			w.WriteHeader(403)
+			w.Write([]byte("quota exceeded"))
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+type watcherHealth struct {
+	watcher.Status
+	Degraded bool `json:"degraded"`
+}
+
+type health struct {
+	Status   string          `json:"status"`
+	Degraded bool            `json:"degraded"`
+	Polls    int             `json:"polls"`
+	Lock     lockHealth      `json:"lock"`
+	Watchers []watcherHealth `json:"watchers"`
+}
+
 func (a *Apollo) healthz(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	// make sure there's no deadlock
-	a.mu.Lock()
-	defer a.mu.Unlock()
+	// the lock is sampled by the watchdog so that a deadlock fails the probe instead of hanging it
+	lock := a.watchdog.current()
+	code := 200
+	if !lock.Healthy {
+		code = 503
+	}
+
+	if r.URL.Query().Get("format") != "json" && !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.WriteHeader(code)
+		if lock.Healthy {
+			w.Write([]byte("OK"))
+		} else {
+			w.Write([]byte("lock contention"))
+		}
+		return
+	}
 
-	w.Write([]byte("OK"))
+	h := health{
+		Status:   "ok",
+		Polls:    int(atomic.LoadInt64(&a.npolls)),
+		Lock:     lock,
+		Watchers: []watcherHealth{},
+	}
+	if !lock.Healthy {
+		h.Status = "unhealthy"
+	}
+	for _, fw := range a.watchers() {
+		s := fw.Status()
+		// a watcher is degraded if it never loaded or failed to reload its file
+		wh := watcherHealth{Status: s, Degraded: s.LastReload.IsZero() || s.LastError != ""}
+		if wh.Degraded {
+			if lock.Healthy {
+				h.Status = "degraded"
+			}
+			h.Degraded = true
+		}
+		h.Watchers = append(h.Watchers, wh)
+	}
+	json, err := json.Marshal(&h)
+	if err != nil {
+		a.cfg.Log.Get().Error(err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(json)
 }
 
 func (a *Apollo) parseNamespace(namespace string) (string, string) {
@@ -98,19 +488,68 @@ func (a *Apollo) parseNamespace(namespace string) (string, string) {
 	}
 }
 
-func (a *Apollo) getNamespace(appID string, cluster string, namespace string) (watcher.Namespace, error) {
-	for _, w := range a.w {
-		cm := w.Config()
+// rawContentTypes are the mime types of the raw config files by format, like the ones of Apollo,
+// as some client stacks dispatch the parsing on the Content-Type
+var rawContentTypes = map[string]string{
+	".properties": "text/plain",
+	".yml":        "text/plain",
+	".yaml":       "text/plain",
+	".xml":        "application/xml",
+	".json":       "application/json",
+}
+
+// Store returns the store of the served namespaces
+func (a *Apollo) Store() store.Store {
+	return a.store
+}
 
-		for _, v := range cm {
-			ns, ok := v[cluster][namespace]
-			if ok {
-				return ns, nil
+// resolveKey returns the key of the namespace served to the requests of an app, the one of
+// another app with LooseAppID, false if the namespace is not served
+func (a *Apollo) resolveKey(appID string, cluster string, namespace string) (store.Key, bool) {
+	// aliased clusters are served from their canonical cluster
+	if c, ok := a.cfg.ClusterAlias[cluster]; ok {
+		cluster = c
+	}
+	k := store.Key{AppID: appID, Cluster: cluster, Namespace: namespace}
+	if _, err := a.store.Get(appID, cluster, namespace); err == nil {
+		return k, true
+	}
+	if a.cfg.LooseAppID {
+		for _, owner := range a.store.List() {
+			if owner.Cluster == cluster && owner.Namespace == namespace {
+				return owner, true
 			}
 		}
 	}
+	return k, false
+}
 
-	return watcher.Namespace{}, fmt.Errorf("namespace no found")
+func (a *Apollo) getNamespace(appID string, cluster string, namespace string) (watcher.Namespace, error) {
+	k, ok := a.resolveKey(appID, cluster, namespace)
+	if !ok {
+		return watcher.Namespace{}, store.ErrNotFound
+	}
+	ns, err := a.store.Get(k.AppID, k.Cluster, k.Namespace)
+	if err != nil {
+		return ns, err
+	}
+	return a.progression.apply(store.Key{AppID: appID, Cluster: k.Cluster, Namespace: namespace}, ns), nil
+}
+
+// serveNamespace returns the namespace as served to the client of r
+func (a *Apollo) serveNamespace(appID string, cluster string, namespace string, r *http.Request) (watcher.Namespace, error) {
+	ns, err := a.getNamespace(appID, cluster, namespace)
+	if err != nil {
+		return ns, err
+	}
+	// the branches of the config files are overridden by the rules set at runtime
+	ns = ns.Gray(appID, clientIP(r), grayLabel(r))
+	ns = a.releaseKeys.apply(ns, appID, cluster, namespace, r)
+	ns = hookProperties(ns, r)
+	if a.cfg.DebugOverride {
+		ns = debugOverride(ns, r)
+	}
+	return expandVars(ns, newRequestVars(appID, cluster, namespace, r)), nil
 }
 
 func (a *Apollo) getNamespaceConfig(extension string, namespace watcher.Namespace) (interface{}, error) {
@@ -130,45 +569,15 @@ func (a *Apollo) getNamespaceConfig(extension string, namespace watcher.Namespac
 	return nil, fmt.Errorf("non-support format")
 }
 
-func (a *Apollo) queryService(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	log := a.cfg.Log.Get()
-	host, err := os.Hostname()
-	if err != nil {
-		log.Warn(err.Error())
-		host = "localhost"
-	}
-	type svc struct {
-		AppName     string `json:"appName"`
-		InstanceID  string `json:"instanceId"`
-		HomepageURL string `json:"homepageUrl"`
-	}
-	type rsp []*svc
-	json, err := json.Marshal(rsp{
-		&svc{
-			AppName:     "APOLLO-CONFIGSERVICE",
-			InstanceID:  fmt.Sprintf("%s:apollo-configservice:%d", host, a.cfg.Port),
-			HomepageURL: fmt.Sprintf("http://%s/", r.Host),
-		},
-	})
-	if err != nil {
-		log.Error(err.Error())
-		w.WriteHeader(500)
-		return
-	}
-	w.Write(json)
-	log.Debug(fmt.Sprintf("served service for request: %s", r.URL.String()))
-}
-
 func (a *Apollo) queryConfig(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	log := a.cfg.Log.Get()
 	appID := ps.ByName("appId")
 	cluster := ps.ByName("cluster")
 	namespace, ext := a.parseNamespace(ps.ByName("namespace"))
 
-	ns, err := a.getNamespace(appID, cluster, namespace)
+	ns, err := a.serveNamespace(appID, cluster, namespace, r)
 	if err != nil {
-		log.Warn(fmt.Sprintf("no namespace for request: %s", r.URL.String()))
-		w.WriteHeader(404)
+		a.namespaceNotFound(w, r, appID, cluster, namespace)
 		return
 	}
 
@@ -179,6 +588,13 @@ func (a *Apollo) queryConfig(w http.ResponseWriter, r *http.Request, ps httprout
 		return
 	}
 
+	// clients holding the current release skip it like with Apollo
+	if rk := r.URL.Query().Get("releaseKey"); rk != "" && rk == ns.ReleaseKey {
+		w.WriteHeader(304)
+		log.Debug(fmt.Sprintf("config not modified for request: %s", r.URL.String()))
+		return
+	}
+
 	type rsp struct {
 		AppID          string      `json:"appId"`
 		Cluster        string      `json:"cluster"`
@@ -198,23 +614,79 @@ func (a *Apollo) queryConfig(w http.ResponseWriter, r *http.Request, ps httprout
 		w.WriteHeader(500)
 		return
 	}
+	w.Header().Set("Content-Type", a.contentType(r, "application/json"))
 	w.Write(json)
 	log.Debug(fmt.Sprintf("served config for request: %s", r.URL.String()))
 }
 
-func (a *Apollo) queryConfigJSON(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+// configFiles dispatches the configfiles routes by the number of path segments
+func (a *Apollo) configFiles(jsonHandle httprouter.Handle, rawHandle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		segments := strings.Split(strings.Trim(ps.ByName("path"), "/"), "/")
+		params := func(s []string) httprouter.Params {
+			return httprouter.Params{
+				httprouter.Param{Key: "appId", Value: s[0]},
+				httprouter.Param{Key: "cluster", Value: s[1]},
+				httprouter.Param{Key: "namespace", Value: s[2]},
+			}
+		}
+		switch {
+		case len(segments) == 4 && segments[0] == "json":
+			jsonHandle(w, r, params(segments[1:]))
+		case len(segments) == 3:
+			rawHandle(w, r, params(segments))
+		default:
+			a.notFound(w, r)
+		}
+	}
+}
+
+func (a *Apollo) queryConfigFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	log := a.cfg.Log.Get()
 	appID := ps.ByName("appId")
 	cluster := ps.ByName("cluster")
 	namespace, ext := a.parseNamespace(ps.ByName("namespace"))
 
-	ns, err := a.getNamespace(appID, cluster, namespace)
+	ns, err := a.serveNamespace(appID, cluster, namespace, r)
 	if err != nil {
-		log.Warn(fmt.Sprintf("no namespace for request: %s", r.URL.String()))
+		a.namespaceNotFound(w, r, appID, cluster, namespace)
+		return
+	}
+
+	cfg, err := a.getNamespaceConfig(ext, ns)
+	if err != nil {
+		log.Warn(fmt.Sprintf("no config for request: %s", r.URL.String()))
 		w.WriteHeader(404)
 		return
 	}
 
+	// properties are rendered as a .properties file, other formats are served as is
+	var content string
+	switch c := cfg.(type) {
+	case map[string]string:
+		if ext == ".properties" {
+			content = renderProperties(c, a.unicodeEscape(r))
+		} else {
+			content = c["content"]
+		}
+	}
+	w.Header().Set("Content-Type", a.contentType(r, rawContentTypes[ext]))
+	w.Write([]byte(content))
+	log.Debug(fmt.Sprintf("served config file for request: %s", r.URL.String()))
+}
+
+func (a *Apollo) queryConfigJSON(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log := a.cfg.Log.Get()
+	appID := ps.ByName("appId")
+	cluster := ps.ByName("cluster")
+	namespace, ext := a.parseNamespace(ps.ByName("namespace"))
+
+	ns, err := a.serveNamespace(appID, cluster, namespace, r)
+	if err != nil {
+		a.namespaceNotFound(w, r, appID, cluster, namespace)
+		return
+	}
+
 	cfg, err := a.getNamespaceConfig(ext, ns)
 	if err != nil {
 		log.Warn(fmt.Sprintf("no config for request: %s", r.URL.String()))
@@ -228,6 +700,7 @@ func (a *Apollo) queryConfigJSON(w http.ResponseWriter, r *http.Request, ps http
 		w.WriteHeader(500)
 		return
 	}
+	w.Header().Set("Content-Type", a.contentType(r, "application/json"))
 	w.Write(json)
 	log.Debug(fmt.Sprintf("served config for request: %s", r.URL.String()))
 }
@@ -245,7 +718,31 @@ func (a *Apollo) longPolling(w http.ResponseWriter, r *http.Request, ps httprout
 		w.WriteHeader(400)
 		return
 	}
-	if err := a.newPoll(r.Context(), notifications, w); err != nil {
+	q := r.URL.Query()
+	timeout := a.pollTimeout(q.Get("appId"), q.Get("cluster"), notifications)
+	hint, err := pollTimeoutHint(r)
+	if err != nil {
+		a.cfg.Log.Get().Warn(fmt.Sprintf("invalid request: %s: %v", r.URL.String(), err))
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if hint > 0 {
+		timeout = hint
+		if ceiling := a.maxPollTimeout(q.Get("appId"), q.Get("cluster"), notifications, timeout); hint > ceiling {
+			timeout = ceiling
+		}
+	}
+	client := pollClient{AppID: q.Get("appId"), Cluster: q.Get("cluster"), IP: clientIP(r), RemoteIP: remoteHost(r.RemoteAddr)}
+	if a.faults.serve(w, r, client) {
+		return
+	}
+	client.Since = time.Now()
+	if err := a.newPoll(r.Context(), client, notifications, timeout, w); err == errTooManyPolls {
+		a.cfg.Log.Get().Warn(fmt.Sprintf("too many polls from %s for request: %s", client.RemoteIP, r.URL.String()))
+		a.overloaded(w, 429, err.Error())
+		return
+	} else if err != nil {
 		a.cfg.Log.Get().Error(err.Error())
 		w.WriteHeader(500)
 		return
@@ -253,52 +750,221 @@ func (a *Apollo) longPolling(w http.ResponseWriter, r *http.Request, ps httprout
 	a.cfg.Log.Get().Debug(fmt.Sprintf("served poll for request: %s", r.URL.String()))
 }
 
-func (a *Apollo) newPoll(ctx context.Context, notifications []longpoll.Notification, w http.ResponseWriter) error {
+// pollTimeout returns the shortest timeout configured for the watched namespaces,
+// falling back to the app poll timeout of the appId and then the default one
+func (a *Apollo) pollTimeout(appID string, cluster string, notifications []longpoll.Notification) time.Duration {
+	var timeout time.Duration
+	for _, n := range notifications {
+		name, _ := a.parseNamespace(n.Namespace)
+		ns, err := a.getNamespace(appID, cluster, name)
+		if err != nil || ns.PollTimeout <= 0 {
+			continue
+		}
+		if timeout == 0 || ns.PollTimeout < timeout {
+			timeout = ns.PollTimeout
+		}
+	}
+	if timeout > 0 {
+		return timeout
+	}
+	if t := a.appPollTimeout(appID); t > 0 {
+		return t
+	}
+	return a.cfg.PollTimeout
+}
+
+// appPollTimeout returns the shortest app poll timeout of the namespaces of appID, 0 if none is configured
+func (a *Apollo) appPollTimeout(appID string) time.Duration {
+	var timeout time.Duration
+	for _, k := range a.store.ListApp(appID) {
+		ns, err := a.store.Get(k.AppID, k.Cluster, k.Namespace)
+		if err != nil || ns.AppPollTimeout <= 0 {
+			continue
+		}
+		if timeout == 0 || ns.AppPollTimeout < timeout {
+			timeout = ns.AppPollTimeout
+		}
+	}
+	return timeout
+}
+
+// pollTimeoutParam and pollTimeoutHeader ask for the timeout of a single long poll, e.g. 5s,
+// bound by the max poll timeout of its namespaces
+const (
+	pollTimeoutParam  = "_mock_poll_timeout"
+	pollTimeoutHeader = "X-Mock-Poll-Timeout"
+)
+
+// pollTimeoutHint returns the timeout asked for by the request of a poll, 0 if none is asked for
+func pollTimeoutHint(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get(pollTimeoutParam)
+	if v == "" {
+		v = r.Header.Get(pollTimeoutHeader)
+	}
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid poll timeout '%s'", v)
+	}
+	return d, nil
+}
+
+// maxPollTimeout returns the longest timeout the poll of the namespaces may ask for,
+// the shortest max poll timeout configured for them and timeout otherwise
+func (a *Apollo) maxPollTimeout(appID string, cluster string, notifications []longpoll.Notification, timeout time.Duration) time.Duration {
+	var ceiling time.Duration
+	for _, n := range notifications {
+		name, _ := a.parseNamespace(n.Namespace)
+		ns, err := a.getNamespace(appID, cluster, name)
+		if err != nil || ns.MaxPollTimeout <= 0 {
+			continue
+		}
+		if ceiling == 0 || ns.MaxPollTimeout < ceiling {
+			ceiling = ns.MaxPollTimeout
+		}
+	}
+	if ceiling > 0 {
+		return ceiling
+	}
+	return timeout
+}
+
+// pollClient describes the client of an open poll
+type pollClient struct {
+	AppID   string `json:"appId"`
+	Cluster string `json:"cluster"`
+	IP      string `json:"ip"`
+	// RemoteIP is the address of the connection, IP may be given by the client
+	RemoteIP string    `json:"remoteIp"`
+	Since    time.Time `json:"since"`
+}
+
+func (a *Apollo) newPoll(ctx context.Context, client pollClient, notifications []longpoll.Notification, timeout time.Duration, w http.ResponseWriter) error {
 	cfg := longpoll.Config{
 		Log:           a.cfg.Log,
 		Notifications: notifications,
-		Timeout:       a.cfg.PollTimeout,
+		Timeout:       timeout,
 	}
-	p, err := longpoll.New(ctx, cfg, w)
+	p, err := longpoll.New(ctx, cfg)
 	if err != nil {
 		return err
 	}
-	a.mu.Lock()
-	a.polls[p] = true
-	a.mu.Unlock()
+	if !a.addPoll(p, client) {
+		p.Close()
+		return errTooManyPolls
+	}
+	// polls opened while shutting down are completed right away
+	if atomic.LoadInt32(&a.closing) == 1 {
+		p.Close()
+	}
+	// polls of clients behind the current ids are answered right away,
+	// checked once the poll is registered so that no change is missed
+	a.fanout.update(p)
 
 	// wait until the poll has been closed
-	p.Wait()
+	res := p.Wait()
+	if err := longpoll.WriteResult(w, res); err != nil {
+		a.cfg.Log.Get().Error(fmt.Sprintf("error writing poll rsp: %v", err))
+	}
+
+	a.removePoll(p)
+	if ctx.Err() != nil {
+		// the client went away before the poll completed
+		a.metrics.abandoned.Inc()
+	}
+	return nil
+}
 
+// addPoll registers an open poll, false if its remote ip has MaxPollsPerIP polls already
+func (a *Apollo) addPoll(p *longpoll.Poll, client pollClient) bool {
 	a.mu.Lock()
-	delete(a.polls, p)
+	if a.cfg.MaxPollsPerIP > 0 && a.ipPolls[client.RemoteIP] >= a.cfg.MaxPollsPerIP {
+		a.mu.Unlock()
+		return false
+	}
+	a.polls[p] = client
+	a.ipPolls[client.RemoteIP]++
 	a.mu.Unlock()
+	atomic.AddInt64(&a.npolls, 1)
+	a.metrics.pollsActive.Inc()
+	for _, n := range p.Notifications() {
+		a.metrics.nsPolls.Inc(n.Namespace)
+	}
+	return true
+}
 
-	return nil
+// removePoll unregisters an open poll, a poll already removed is left alone
+func (a *Apollo) removePoll(p *longpoll.Poll) {
+	a.mu.Lock()
+	client, ok := a.polls[p]
+	if !ok {
+		a.mu.Unlock()
+		return
+	}
+	delete(a.polls, p)
+	if a.ipPolls[client.RemoteIP] <= 1 {
+		delete(a.ipPolls, client.RemoteIP)
+	} else {
+		a.ipPolls[client.RemoteIP]--
+	}
+	a.mu.Unlock()
+	atomic.AddInt64(&a.npolls, -1)
+	a.metrics.pollsActive.Dec()
+	for _, n := range p.Notifications() {
+		a.metrics.nsPolls.Dec(n.Namespace)
+	}
 }
 
-func (a *Apollo) watch(ctx context.Context, filePath string) error {
-	cfg := watcher.Config{
-		Log:  a.cfg.Log,
-		File: filePath,
+// snapshotPolls returns the open polls without holding the lock during fan-out
+func (a *Apollo) snapshotPolls() []*longpoll.Poll {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	polls := make([]*longpoll.Poll, 0, len(a.polls))
+	for p := range a.polls {
+		polls = append(polls, p)
 	}
-	w, err := watcher.New(ctx, cfg)
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-w.UpdateEvent:
-				a.mu.Lock()
-				for p := range a.polls {
-					if err := p.Update(); err != nil {
-						a.cfg.Log.Get().Error(err.Error())
-					}
-				}
-				a.mu.Unlock()
+	return polls
+}
+
+// watchingPolls returns the open polls watching the namespace,
+// the app of the poll is not compared as namespaces are looked up through all apps
+func (a *Apollo) watchingPolls(namespace string) []*longpoll.Poll {
+	polls := []*longpoll.Poll{}
+	for _, p := range a.snapshotPolls() {
+		for _, n := range p.Notifications() {
+			if name, _ := a.parseNamespace(n.Namespace); name == namespace {
+				polls = append(polls, p)
+				break
 			}
 		}
-	}()
-	a.w = append(a.w, w)
-	return err
+	}
+	return polls
+}
+
+// Shutdown completes all open polls with no change and waits until they are written,
+// so that clients reconnect instead of seeing a broken connection.
+// The served config is snapshotted a last time
+func (a *Apollo) Shutdown(ctx context.Context) error {
+	for _, e := range a.envs {
+		if err := e.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&a.closing, 1)
+	a.writeSnapshot()
+	for _, p := range a.snapshotPolls() {
+		p.Close()
+	}
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for atomic.LoadInt64(&a.npolls) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
 }
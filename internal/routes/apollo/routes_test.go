@@ -1,18 +1,35 @@
 package apollo
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/figroc/mock-apollo-go/pkg/events"
+	"github.com/figroc/mock-apollo-go/pkg/hooks"
+	"github.com/figroc/mock-apollo-go/pkg/longpoll"
+	"github.com/figroc/mock-apollo-go/pkg/metrics"
+	"github.com/figroc/mock-apollo-go/pkg/store"
 	"github.com/figroc/mock-apollo-go/pkg/watcher"
 	"github.com/julienschmidt/httprouter"
 	"github.com/lalamove/nui/nlogger"
-	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v2"
 )
@@ -67,23 +84,12 @@ key = value
 }
 
 func TestParseNamespace(t *testing.T) {
-	log := nlogger.NewProvider(nlogger.New(os.Stdout, ""))
-
-	// mock fs
-	appFS := afero.NewMemMapFs()
-	appFS.MkdirAll("/dev", 0755)
-	data, err := yaml.Marshal(stubConfigs[0])
-	require.Nil(t, err)
-	require.Nil(t, afero.WriteFile(appFS, "/dev/null", data, 0644))
 
 	// setup apollo
 	filepaths := []string{"/dev/null"}
 	a, err := New(context.Background(), Config{ConfigPath: filepaths})
 	require.EqualError(t, err, "invalid config file")
-	for _, w := range a.w {
-		w.MockFS(appFS)
-		require.Nil(t, w.ReloadConfig(log))
-	}
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
 
 	t.Run("get ns.properties", func(t *testing.T) {
 		ns, ext := a.parseNamespace("ns.properties")
@@ -167,23 +173,12 @@ func TestParseNamespace(t *testing.T) {
 }
 
 func TestGetNamespace(t *testing.T) {
-	log := nlogger.NewProvider(nlogger.New(os.Stdout, ""))
-
-	// mock fs
-	appFS := afero.NewMemMapFs()
-	appFS.MkdirAll("/dev", 0755)
-	data, err := yaml.Marshal(stubConfigs[0])
-	require.Nil(t, err)
-	require.Nil(t, afero.WriteFile(appFS, "/dev/null", data, 0644))
 
 	// setup apollo
 	filepaths := []string{"/dev/null"}
 	a, err := New(context.Background(), Config{ConfigPath: filepaths})
 	require.EqualError(t, err, "invalid config file")
-	for _, w := range a.w {
-		w.MockFS(appFS)
-		require.Nil(t, w.ReloadConfig(log))
-	}
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
 
 	t.Run("get namespace in properties format", func(t *testing.T) {
 		ns, err := a.getNamespace("app", "cluster", "ns")
@@ -206,26 +201,34 @@ func TestGetNamespace(t *testing.T) {
 			ns,
 		)
 	})
-}
 
-func TestGetNamespaceConfig(t *testing.T) {
-	log := nlogger.NewProvider(nlogger.New(os.Stdout, ""))
+	t.Run("get namespace of aliased cluster", func(t *testing.T) {
+		a.cfg.ClusterAlias = map[string]string{"sg-1": "cluster"}
+		defer func() { a.cfg.ClusterAlias = nil }()
+		ns, err := a.getNamespace("app", "sg-1", "ns")
+		require.Nil(t, err)
+		require.Equal(t, stubConfigs[0]["app"]["cluster"]["ns"], ns)
+		_, err = a.getNamespace("app", "sg-2", "ns")
+		require.Error(t, err)
+	})
 
-	// mock fs
-	appFS := afero.NewMemMapFs()
-	appFS.MkdirAll("/dev", 0755)
-	data, err := yaml.Marshal(stubConfigs[0])
-	require.Nil(t, err)
-	require.Nil(t, afero.WriteFile(appFS, "/dev/null", data, 0644))
+	t.Run("get namespace of another app", func(t *testing.T) {
+		_, err := a.getNamespace("app2", "cluster", "ns")
+		require.Equal(t, store.ErrNotFound, err)
+		a.cfg.LooseAppID = true
+		defer func() { a.cfg.LooseAppID = false }()
+		ns, err := a.getNamespace("app2", "cluster", "ns")
+		require.Nil(t, err)
+		require.Equal(t, stubConfigs[0]["app"]["cluster"]["ns"], ns)
+	})
+}
 
+func TestGetNamespaceConfig(t *testing.T) {
 	// setup apollo
 	filepaths := []string{"/dev/null"}
 	a, err := New(context.Background(), Config{ConfigPath: filepaths, Port: 8070})
 	require.EqualError(t, err, "invalid config file")
-	for _, w := range a.w {
-		w.MockFS(appFS)
-		require.Nil(t, w.ReloadConfig(log))
-	}
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
 
 	t.Run("get properties", func(t *testing.T) {
 		cfg, err := a.getNamespaceConfig(".properties", stubConfigs[0]["app"]["cluster"]["ns"])
@@ -335,23 +338,12 @@ func TestGetNamespaceConfig(t *testing.T) {
 }
 
 func TestQueryService(t *testing.T) {
-	log := nlogger.NewProvider(nlogger.New(os.Stdout, ""))
-
-	// mock fs
-	appFS := afero.NewMemMapFs()
-	appFS.MkdirAll("/dev", 0755)
-	data, err := yaml.Marshal(stubConfigs[0])
-	require.Nil(t, err)
-	require.Nil(t, afero.WriteFile(appFS, "/dev/null", data, 0644))
 
 	// setup apollo
 	filepaths := []string{"/dev/null"}
 	a, err := New(context.Background(), Config{ConfigPath: filepaths, Port: 8070})
 	require.EqualError(t, err, "invalid config file")
-	for _, w := range a.w {
-		w.MockFS(appFS)
-		require.Nil(t, w.ReloadConfig(log))
-	}
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
 
 	t.Run("status 200", func(t *testing.T) {
 		// call the handler
@@ -376,26 +368,103 @@ func TestQueryService(t *testing.T) {
 			string(b),
 		)
 	})
+
+	t.Run("forwarded scheme", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/services/config?appId=app", nil)
+		req.Header.Set("host", "example.com")
+		req.Header.Set("X-Forwarded-Proto", "https, http")
+		req.Header.Set("X-Forwarded-Host", "config.example.com")
+		w := httptest.NewRecorder()
+		a.queryService(w, req, httprouter.Params{})
+
+		var rsp []map[string]interface{}
+		require.Nil(t, json.NewDecoder(w.Result().Body).Decode(&rsp))
+		require.Equal(t, "https://config.example.com/", rsp[0]["homepageUrl"])
+	})
+
+	t.Run("advertise scheme", func(t *testing.T) {
+		a, err := New(context.Background(), Config{ConfigPath: filepaths, AdvertiseScheme: "https"})
+		require.EqualError(t, err, "invalid config file")
+
+		req := httptest.NewRequest("GET", "/services/config?appId=app", nil)
+		req.Header.Set("host", "example.com")
+		req.Header.Set("X-Forwarded-Proto", "http")
+		w := httptest.NewRecorder()
+		a.queryService(w, req, httprouter.Params{})
+
+		var rsp []map[string]interface{}
+		require.Nil(t, json.NewDecoder(w.Result().Body).Decode(&rsp))
+		require.Equal(t, "https://example.com/", rsp[0]["homepageUrl"])
+	})
+
+	t.Run("custom service", func(t *testing.T) {
+		a, err := New(context.Background(), Config{
+			ConfigPath: filepaths,
+			Port:       8070,
+			Service: ServiceConfig{
+				AppName:    "CONFIG",
+				InstanceID: "config-{port}",
+				Fields: map[string]interface{}{
+					"dataCenter": "dc-{port}",
+					"port":       8070,
+					"appName":    "ignored",
+				},
+			},
+		})
+		require.EqualError(t, err, "invalid config file")
+
+		req := httptest.NewRequest("GET", "/services/config?appId=app", nil)
+		req.Header.Set("host", "example.com")
+		w := httptest.NewRecorder()
+		a.queryService(w, req, httprouter.Params{})
+
+		rsp := w.Result()
+		require.Equal(t, 200, rsp.StatusCode)
+		b, err := io.ReadAll(rsp.Body)
+		require.Nil(t, err)
+		require.JSONEq(
+			t,
+			`[{"appName":"CONFIG","instanceId":"config-8070","homepageUrl":"http://example.com/","dataCenter":"dc-8070","port":8070}]`,
+			string(b),
+			string(b),
+		)
+	})
+
+	t.Run("instances", func(t *testing.T) {
+		a, err := New(context.Background(), Config{
+			ConfigPath: filepaths,
+			Port:       8070,
+			Service: ServiceConfig{
+				Fields: map[string]interface{}{"dataCenter": "dc1"},
+				Instances: []ServiceInstance{
+					{InstanceID: "config-1", HomepageURL: "http://10.0.0.1:{port}/", Weight: 3},
+					{InstanceID: "config-2", HomepageURL: "http://10.0.0.2:8080/"},
+					{InstanceID: "mock"},
+				},
+			},
+		})
+		require.EqualError(t, err, "invalid config file")
+
+		req := httptest.NewRequest("GET", "/services/config?appId=app", nil)
+		req.Header.Set("host", "example.com")
+		w := httptest.NewRecorder()
+		a.queryService(w, req, httprouter.Params{})
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `[
+			{"appName":"APOLLO-CONFIGSERVICE","instanceId":"config-1","homepageUrl":"http://10.0.0.1:8070/","weight":3,"dataCenter":"dc1"},
+			{"appName":"APOLLO-CONFIGSERVICE","instanceId":"config-2","homepageUrl":"http://10.0.0.2:8080/","dataCenter":"dc1"},
+			{"appName":"APOLLO-CONFIGSERVICE","instanceId":"mock","homepageUrl":"http://example.com/","dataCenter":"dc1"}
+		]`, w.Body.String())
+	})
 }
 
 func TestQueryConfig(t *testing.T) {
-	log := nlogger.NewProvider(nlogger.New(os.Stdout, ""))
-
-	// mock fs
-	appFS := afero.NewMemMapFs()
-	appFS.MkdirAll("/dev", 0755)
-	data, err := yaml.Marshal(stubConfigs[0])
-	require.Nil(t, err)
-	require.Nil(t, afero.WriteFile(appFS, "/dev/null", data, 0644))
 
 	// setup apollo
 	filepaths := []string{"/dev/null"}
 	a, err := New(context.Background(), Config{ConfigPath: filepaths})
 	require.EqualError(t, err, "invalid config file")
-	for _, w := range a.w {
-		w.MockFS(appFS)
-		require.Nil(t, w.ReloadConfig(log))
-	}
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
 
 	t.Run("status 200", func(t *testing.T) {
 		// call the handler
@@ -419,7 +488,7 @@ func TestQueryConfig(t *testing.T) {
 		)
 	})
 
-	t.Run("status 200 - with releaseKey", func(t *testing.T) {
+	t.Run("status 304 - with releaseKey", func(t *testing.T) {
 		// call the handler
 		req := httptest.NewRequest("GET", "/configs/app/cluster/ns?releaseKey=abc", nil)
 		w := httptest.NewRecorder()
@@ -430,6 +499,23 @@ func TestQueryConfig(t *testing.T) {
 		}
 		a.queryConfig(w, req, ps)
 		rsp := w.Result()
+		require.Equal(t, 304, rsp.StatusCode)
+		b, err := io.ReadAll(rsp.Body)
+		require.Nil(t, err)
+		require.Equal(t, "", string(b))
+	})
+
+	t.Run("status 200 - with outdated releaseKey", func(t *testing.T) {
+		// call the handler
+		req := httptest.NewRequest("GET", "/configs/app/cluster/ns?releaseKey=-1", nil)
+		w := httptest.NewRecorder()
+		ps := httprouter.Params{
+			httprouter.Param{Key: "appId", Value: "app"},
+			httprouter.Param{Key: "cluster", Value: "cluster"},
+			httprouter.Param{Key: "namespace", Value: "ns"},
+		}
+		a.queryConfig(w, req, ps)
+		rsp := w.Result()
 		require.Equal(t, 200, rsp.StatusCode)
 		b, err := io.ReadAll(rsp.Body)
 		require.Nil(t, err)
@@ -457,26 +543,57 @@ func TestQueryConfig(t *testing.T) {
 		require.Nil(t, err)
 		require.Equal(t, "", string(b))
 	})
+
+	t.Run("status 404 - hint", func(t *testing.T) {
+		a.cfg.NotFoundHints = true
+		defer func() { a.cfg.NotFoundHints = false }()
+		for _, c := range []struct {
+			appID   string
+			cluster string
+			hint    notFoundHint
+		}{
+			{"app", "cluster", notFoundHint{
+				Error:       "namespace not found",
+				AppID:       "app",
+				Cluster:     "cluster",
+				Namespace:   "ns3",
+				Suggestions: []string{"ns", "ns2"},
+				Namespaces:  []string{"ns", "ns2"},
+			}},
+			{"app", "cluster404", notFoundHint{
+				Error:       "namespace not found",
+				AppID:       "app",
+				Cluster:     "cluster404",
+				Namespace:   "ns3",
+				Suggestions: []string{},
+				Namespaces:  []string{},
+				Clusters:    []string{"cluster"},
+			}},
+		} {
+			req := httptest.NewRequest("GET", "/configs/"+c.appID+"/"+c.cluster+"/ns3", nil)
+			w := httptest.NewRecorder()
+			ps := httprouter.Params{
+				httprouter.Param{Key: "appId", Value: c.appID},
+				httprouter.Param{Key: "cluster", Value: c.cluster},
+				httprouter.Param{Key: "namespace", Value: "ns3"},
+			}
+			a.queryConfig(w, req, ps)
+			rsp := w.Result()
+			require.Equal(t, 404, rsp.StatusCode)
+			var hint notFoundHint
+			require.Nil(t, json.NewDecoder(rsp.Body).Decode(&hint))
+			require.Equal(t, c.hint, hint)
+		}
+	})
 }
 
 func TestQueryConfigJSON(t *testing.T) {
-	log := nlogger.NewProvider(nlogger.New(os.Stdout, ""))
-
-	// mock fs
-	appFS := afero.NewMemMapFs()
-	appFS.MkdirAll("/dev", 0755)
-	data, err := yaml.Marshal(stubConfigs[0])
-	require.Nil(t, err)
-	require.Nil(t, afero.WriteFile(appFS, "/dev/null", data, 0644))
 
 	// setup apollo
 	filepaths := []string{"/dev/null"}
 	a, err := New(context.Background(), Config{ConfigPath: filepaths})
 	require.EqualError(t, err, "invalid config file")
-	for _, w := range a.w {
-		w.MockFS(appFS)
-		require.Nil(t, w.ReloadConfig(log))
-	}
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
 
 	t.Run("status 200", func(t *testing.T) {
 		// call the handler
@@ -524,18 +641,8 @@ func TestNotificationsLongPolling(t *testing.T) {
 		a, err := New(context.Background(), Config{ConfigPath: filepaths})
 		require.Error(t, err)
 
-		// mock fs
-		appFS := afero.NewMemMapFs()
-		appFS.MkdirAll("/dev", 0755)
-		data, err := yaml.Marshal(stubConfigs[0])
-		require.Nil(t, err)
-		require.Nil(t, afero.WriteFile(appFS, "/dev/null", data, 0644))
-		for _, w := range a.w {
-			w.MockFS(appFS)
-		}
-
 		// call the handler
-		q := "?notifications=" + url.QueryEscape(`[{"notificationId":1,"namespaceName":"ns"}]`)
+		q := "?appId=app&cluster=cluster&notifications=" + url.QueryEscape(`[{"notificationId":-1,"namespaceName":"ns"}]`)
 		req := httptest.NewRequest("GET", "/notifications/v2"+q, nil)
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 		defer cancel()
@@ -547,30 +654,24 @@ func TestNotificationsLongPolling(t *testing.T) {
 			httprouter.Param{Key: "namespace", Value: "ns"},
 		}
 		go func() {
-			// trigger config update in the background
+			// update the config in the background
 			time.Sleep(5 * time.Millisecond)
-			for _, w := range a.w {
-				w.TriggerEvent()
-			}
+			a.w[0].SetConfig(stubConfigs[0])
 		}()
 		a.longPolling(w, req, ps)
 		rsp := w.Result()
 		require.Equal(t, 200, rsp.StatusCode)
-		b, err := io.ReadAll(rsp.Body)
-		require.Nil(t, err)
-		require.JSONEq(
-			t,
-			`[{"notificationId":1,"namespaceName":"ns"}]`,
-			string(b),
-			string(b),
-		)
+		notifications := []longpoll.Notification{}
+		require.Nil(t, json.NewDecoder(rsp.Body).Decode(&notifications))
+		require.Len(t, notifications, 1)
+		require.Equal(t, "ns", notifications[0].Namespace)
+		// the id of the change is taken from a counter shared by all namespaces
+		require.Greater(t, notifications[0].ID, 0)
+		require.Equal(t, float64(1), a.metrics.nsNotified.Value("ns"))
+		require.Equal(t, float64(0), a.metrics.nsPolls.Value("ns"))
 	})
 
 	t.Run("no change", func(t *testing.T) {
-		// mock fs
-		appFS := afero.NewMemMapFs()
-		appFS.MkdirAll("/dev", 0755)
-
 		// setup apollo
 		filepaths := []string{"/dev/null"}
 		a, err := New(context.Background(), Config{
@@ -578,9 +679,6 @@ func TestNotificationsLongPolling(t *testing.T) {
 			PollTimeout: time.Second,
 		})
 		require.Error(t, err)
-		for _, w := range a.w {
-			w.MockFS(appFS)
-		}
 
 		// call the handler
 		q := "?notifications=" + url.QueryEscape(`[{"notificationId":1,"namespaceName":"ns"}]`)
@@ -600,17 +698,10 @@ func TestNotificationsLongPolling(t *testing.T) {
 	})
 
 	t.Run("context cancelled", func(t *testing.T) {
-		// mock fs
-		appFS := afero.NewMemMapFs()
-		appFS.MkdirAll("/dev", 0755)
-
 		// setup apollo
 		filepaths := []string{"/dev/null"}
 		a, err := New(context.Background(), Config{ConfigPath: filepaths})
 		require.Error(t, err)
-		for _, w := range a.w {
-			w.MockFS(appFS)
-		}
 
 		// call the handler
 		q := "?notifications=" + url.QueryEscape(`[{"notificationId":1,"namespaceName":"ns"}]`)
@@ -634,5 +725,2393 @@ func TestNotificationsLongPolling(t *testing.T) {
 		b, err := io.ReadAll(rsp.Body)
 		require.Nil(t, err)
 		require.Equal(t, "", string(b))
+		require.Equal(t, float64(1), a.metrics.abandoned.Value())
+		require.Equal(t, float64(0), a.metrics.pollsActive.Value())
+	})
+}
+
+func TestQuota(t *testing.T) {
+
+	// setup apollo
+	filepaths := []string{"/dev/null"}
+	a, err := New(context.Background(), Config{
+		ConfigPath: filepaths,
+		Quota:      1,
+		AppQuota:   map[string]int{"app2": 0},
+	})
+	require.EqualError(t, err, "invalid config file")
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
+	router := httprouter.New()
+	a.Routes(router)
+
+	t.Run("status 200", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/configs/app/cluster/ns", nil))
+		rsp := w.Result()
+		require.Equal(t, 200, rsp.StatusCode)
+		require.Equal(t, "1", rsp.Header.Get("X-RateLimit-Limit"))
+		require.Equal(t, "0", rsp.Header.Get("X-RateLimit-Remaining"))
+		require.NotEmpty(t, rsp.Header.Get("X-RateLimit-Reset"))
+	})
+
+	t.Run("status 403", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/configfiles/json/app/cluster/ns", nil))
+		rsp := w.Result()
+		require.Equal(t, 403, rsp.StatusCode)
+		require.Equal(t, "0", rsp.Header.Get("X-RateLimit-Remaining"))
+		b, err := io.ReadAll(rsp.Body)
+		require.Nil(t, err)
+		require.Equal(t, "quota exceeded", string(b))
+		require.Equal(t, float64(1), a.metrics.quotaExceeded.Value("app"))
+		require.Equal(t, float64(1), a.metrics.requests.Value("/configfiles/json/:appId/:cluster/:namespace", "403"))
+	})
+
+	t.Run("unlimited app", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", "/services/config?appId=app2", nil))
+			rsp := w.Result()
+			require.Equal(t, 200, rsp.StatusCode)
+			require.Equal(t, "", rsp.Header.Get("X-RateLimit-Limit"))
+		}
+	})
+}
+
+func TestHealthz(t *testing.T) {
+	// setup apollo
+	filepaths := []string{"/dev/null"}
+	a, err := New(context.Background(), Config{ConfigPath: filepaths})
+	require.EqualError(t, err, "invalid config file")
+
+	t.Run("plain", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/healthz", nil)
+		w := httptest.NewRecorder()
+		a.healthz(w, req, httprouter.Params{})
+		rsp := w.Result()
+		require.Equal(t, 200, rsp.StatusCode)
+		b, err := io.ReadAll(rsp.Body)
+		require.Nil(t, err)
+		require.Equal(t, "OK", string(b))
+	})
+
+	t.Run("json degraded", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/healthz?format=json", nil)
+		w := httptest.NewRecorder()
+		a.healthz(w, req, httprouter.Params{})
+		rsp := w.Result()
+		require.Equal(t, 200, rsp.StatusCode)
+		require.Equal(t, "application/json", rsp.Header.Get("Content-Type"))
+		h := health{}
+		require.Nil(t, json.NewDecoder(rsp.Body).Decode(&h))
+		require.Equal(t, "degraded", h.Status)
+		require.True(t, h.Degraded)
+		require.Len(t, h.Watchers, 1)
+		require.Equal(t, "/dev/null", h.Watchers[0].File)
+		require.Equal(t, "invalid config file", h.Watchers[0].LastError)
+	})
+
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
+
+	t.Run("json ok", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/healthz", nil)
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		a.healthz(w, req, httprouter.Params{})
+		rsp := w.Result()
+		require.Equal(t, 200, rsp.StatusCode)
+		h := health{}
+		require.Nil(t, json.NewDecoder(rsp.Body).Decode(&h))
+		require.Equal(t, "ok", h.Status)
+		require.False(t, h.Degraded)
+		require.Equal(t, 0, h.Polls)
+		require.False(t, h.Watchers[0].LastReload.IsZero())
+		require.Empty(t, h.Watchers[0].LastError)
+	})
+}
+
+func TestReadyz(t *testing.T) {
+	// setup apollo
+	a, err := New(context.Background(), Config{ConfigPath: []string{"/dev/null"}, StaleAfter: time.Hour})
+	require.EqualError(t, err, "invalid config file")
+	readyz := func(query string) *http.Response {
+		w := httptest.NewRecorder()
+		a.readyz(w, httptest.NewRequest("GET", "/readyz"+query, nil), httprouter.Params{})
+		return w.Result()
+	}
+
+	t.Run("failing", func(t *testing.T) {
+		rsp := readyz("")
+		require.Equal(t, 200, rsp.StatusCode)
+		b, err := io.ReadAll(rsp.Body)
+		require.Nil(t, err)
+		require.Equal(t, "OK", string(b))
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		a.cfg.StaleAfter = 0
+		rsp := readyz("")
+		require.Equal(t, 200, rsp.StatusCode)
+		b, err := io.ReadAll(rsp.Body)
+		require.Nil(t, err)
+		require.Equal(t, "stale config files: /dev/null", string(b))
+
+		rd := readiness{}
+		require.Nil(t, json.NewDecoder(readyz("?format=json").Body).Decode(&rd))
+		require.Equal(t, "degraded", rd.Status)
+		require.Len(t, rd.Files, 1)
+		require.True(t, rd.Files[0].Stale)
+		require.False(t, rd.Files[0].FailingSince.IsZero())
+		require.Equal(t, "invalid config file", rd.Files[0].LastError)
+	})
+
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
+
+	t.Run("loaded", func(t *testing.T) {
+		rd := readiness{}
+		require.Nil(t, json.NewDecoder(readyz("?format=json").Body).Decode(&rd))
+		require.Equal(t, "ok", rd.Status)
+		require.False(t, rd.Files[0].Stale)
+		require.True(t, rd.Files[0].FailingSince.IsZero())
+		require.False(t, rd.Files[0].LastReload.IsZero())
+	})
+}
+
+func TestWatchdog(t *testing.T) {
+	var mu sync.Mutex
+	d := newWatchdog(&mu, 10*time.Millisecond)
+	require.True(t, d.current().Healthy)
+
+	require.True(t, d.sample().Healthy)
+
+	// a held lock is reported without blocking the sample
+	mu.Lock()
+	require.False(t, d.sample().Healthy)
+	require.False(t, d.sample().Healthy)
+	require.False(t, d.current().Healthy)
+
+	mu.Unlock()
+	require.Eventually(t, func() bool {
+		return d.sample().Healthy
+	}, time.Second, 5*time.Millisecond)
+
+	t.Run("healthz", func(t *testing.T) {
+		a := &Apollo{watchdog: d, metrics: newMetrics(metrics.NewRegistry(), "")}
+		mu.Lock()
+		defer mu.Unlock()
+		d.sample()
+
+		req := httptest.NewRequest("GET", "/healthz", nil)
+		w := httptest.NewRecorder()
+		a.healthz(w, req, httprouter.Params{})
+		rsp := w.Result()
+		require.Equal(t, 503, rsp.StatusCode)
+
+		req = httptest.NewRequest("GET", "/healthz?format=json", nil)
+		w = httptest.NewRecorder()
+		a.healthz(w, req, httprouter.Params{})
+		rsp = w.Result()
+		require.Equal(t, 503, rsp.StatusCode)
+		h := health{}
+		require.Nil(t, json.NewDecoder(rsp.Body).Decode(&h))
+		require.Equal(t, "unhealthy", h.Status)
+		require.False(t, h.Lock.Healthy)
+	})
+}
+
+func TestPollBookkeeping(t *testing.T) {
+	a := &Apollo{
+		polls:   make(map[*longpoll.Poll]pollClient),
+		ipPolls: make(map[string]int),
+		metrics: newMetrics(metrics.NewRegistry(), ""),
+	}
+
+	// registration and fan-out run concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, err := longpoll.New(context.Background(), longpoll.Config{Timeout: time.Millisecond})
+			require.Nil(t, err)
+			a.addPoll(p, pollClient{})
+			for _, p := range a.snapshotPolls() {
+				p.Update(p.Notifications())
+			}
+			p.Wait()
+			a.removePoll(p)
+		}()
+	}
+	wg.Wait()
+	require.Empty(t, a.snapshotPolls())
+	require.Equal(t, int64(0), a.npolls)
+	require.Equal(t, float64(0), a.metrics.pollsActive.Value())
+}
+
+func TestShutdown(t *testing.T) {
+	// setup apollo
+	filepaths := []string{"/dev/null"}
+	a, err := New(context.Background(), Config{ConfigPath: filepaths, PollTimeout: time.Minute})
+	require.Error(t, err)
+
+	// open a poll in the background
+	q := "?notifications=" + url.QueryEscape(`[{"notificationId":1,"namespaceName":"ns"}]`)
+	req := httptest.NewRequest("GET", "/notifications/v2"+q, nil)
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		a.longPolling(w, req, httprouter.Params{})
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		return len(a.snapshotPolls()) == 1
+	}, time.Second, time.Millisecond)
+	require.Equal(t, float64(1), a.metrics.nsPolls.Value("ns"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(t, a.Shutdown(ctx))
+	<-done
+	require.Equal(t, 304, w.Result().StatusCode)
+
+	// polls opened after shutdown are completed right away
+	w = httptest.NewRecorder()
+	a.longPolling(w, req, httprouter.Params{})
+	require.Equal(t, 304, w.Result().StatusCode)
+}
+
+func TestHandlerDeadline(t *testing.T) {
+	a := &Apollo{cfg: Config{HandlerTimeout: 10 * time.Millisecond}}
+	stuck := a.withDeadline(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		// a stuck handler is released by the request context
+		<-r.Context().Done()
+	})
+	fast := a.withDeadline(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Write([]byte(ps.ByName("name")))
+	})
+
+	w := httptest.NewRecorder()
+	stuck(w, httptest.NewRequest("GET", "/", nil), httprouter.Params{})
+	require.Equal(t, 503, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	fast(w, httptest.NewRequest("GET", "/", nil), httprouter.Params{{Key: "name", Value: "ok"}})
+	require.Equal(t, 200, w.Result().StatusCode)
+	b, err := io.ReadAll(w.Result().Body)
+	require.Nil(t, err)
+	require.Equal(t, "ok", string(b))
+
+	t.Run("backoff", func(t *testing.T) {
+		a.cfg.Backoff = Backoff{RetryAfter: 1500 * time.Millisecond, Body: true, PollInterval: 30 * time.Second}
+		stuck := a.withDeadline(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			<-r.Context().Done()
+		})
+		w := httptest.NewRecorder()
+		stuck(w, httptest.NewRequest("GET", "/", nil), httprouter.Params{})
+		require.Equal(t, 503, w.Code)
+		require.Equal(t, "2", w.Header().Get("Retry-After"))
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		var res overloadError
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+		require.Equal(t, 503, res.Status)
+		require.Equal(t, "handler timeout", res.Message)
+		require.Equal(t, int64(2), res.RetryAfter)
+		require.Equal(t, int64(30), res.PollInterval)
+
+		// the 503 of a handler is passed through
+		unavailable := a.withDeadline(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(503)
+			w.Write([]byte("lock contention"))
+		})
+		w = httptest.NewRecorder()
+		unavailable(w, httptest.NewRequest("GET", "/", nil), httprouter.Params{})
+		require.Equal(t, 503, w.Code)
+		require.Equal(t, "7", w.Header().Get("Retry-After"))
+		require.Equal(t, "lock contention", w.Body.String())
+
+		empty := a.withDeadline(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			w.WriteHeader(503)
+		})
+		w = httptest.NewRecorder()
+		empty(w, httptest.NewRequest("GET", "/", nil), httprouter.Params{})
+		require.Equal(t, 503, w.Code)
+		require.Empty(t, w.Header().Get("Retry-After"))
+		require.Empty(t, w.Body.String())
+	})
+}
+
+func TestFanoutRate(t *testing.T) {
+	a := &Apollo{
+		cfg:     Config{Log: nlogger.NewProvider(nlogger.New(os.Stdout, ""))},
+		metrics: newMetrics(metrics.NewRegistry(), ""),
+		polls:   make(map[*longpoll.Poll]pollClient),
+		ipPolls: make(map[string]int),
+		store:   store.New(events.NewBus()),
+	}
+	a.notificationIDs.bump(store.Key{AppID: "app", Cluster: "cluster", Namespace: "ns"})
+	f := newFanout(a, 20, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.run(ctx)
+
+	polls := []*longpoll.Poll{}
+	for i := 0; i < 3; i++ {
+		p, err := longpoll.New(context.Background(), longpoll.Config{
+			Notifications: []longpoll.Notification{{ID: -i, Namespace: "ns"}},
+			Timeout:       time.Second,
+		})
+		require.Nil(t, err)
+		a.addPoll(p, pollClient{AppID: "app", Cluster: "cluster"})
+		defer a.removePoll(p)
+		polls = append(polls, p)
+	}
+
+	start := time.Now()
+	f.notify(polls)
+	require.LessOrEqual(t, a.metrics.queueDepth.Value(), float64(3))
+	for _, p := range polls {
+		require.Equal(t, longpoll.Changed, p.Wait().Reason)
+	}
+	// notifications are paced at 20 per second
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(100*time.Millisecond))
+	require.Equal(t, float64(0), a.metrics.queueDepth.Value())
+	require.Equal(t, float64(3), a.metrics.nsNotified.Value("ns"))
+}
+
+func TestPollTimeout(t *testing.T) {
+	cm := watcher.ConfigMap{}
+	require.Nil(t, yaml.Unmarshal([]byte(`app:
+  cluster:
+    ns:
+      pollTimeout: 30s
+      properties:
+        k: v
+    ns2:
+      pollTimeout: 10s
+      yml: "k: v"
+    ns3:
+      maxPollTimeout: 2m
+      appPollTimeout: 45s
+      properties:
+        k: v
+`), &cm))
+
+	// setup apollo
+	filepaths := []string{"/dev/null"}
+	a, err := New(context.Background(), Config{
+		ConfigPath:  filepaths,
+		PollTimeout: time.Minute,
 	})
+	require.EqualError(t, err, "invalid config file")
+	require.Nil(t, a.w[0].SetConfig(cm))
+
+	notifications := func(names ...string) []longpoll.Notification {
+		ns := []longpoll.Notification{}
+		for _, n := range names {
+			ns = append(ns, longpoll.Notification{ID: 1, Namespace: n})
+		}
+		return ns
+	}
+	require.Equal(t, 30*time.Second, a.pollTimeout("app", "cluster", notifications("ns")))
+	require.Equal(t, 10*time.Second, a.pollTimeout("app", "cluster", notifications("ns", "ns2.yml")))
+	require.Equal(t, 45*time.Second, a.pollTimeout("app", "cluster", notifications("ns3")))
+	require.Equal(t, time.Minute, a.pollTimeout("app2", "cluster", notifications("ns404")))
+
+	t.Run("reload", func(t *testing.T) {
+		reloaded := watcher.ConfigMap{"app": {"cluster": {}}}
+		for name, ns := range cm["app"]["cluster"] {
+			ns.AppPollTimeout = 0
+			reloaded["app"]["cluster"][name] = ns
+		}
+		require.Nil(t, a.w[0].SetConfig(reloaded))
+		require.Equal(t, time.Minute, a.pollTimeout("app", "cluster", notifications("ns3")))
+		require.Nil(t, a.w[0].SetConfig(cm))
+		require.Equal(t, 45*time.Second, a.pollTimeout("app", "cluster", notifications("ns3")))
+	})
+
+	t.Run("hint", func(t *testing.T) {
+		require.Equal(t, 2*time.Minute, a.maxPollTimeout("app", "cluster", notifications("ns3"), time.Minute))
+		require.Equal(t, 30*time.Second, a.maxPollTimeout("app", "cluster", notifications("ns"), 30*time.Second))
+
+		r := httprouter.New()
+		a.Routes(r)
+		poll := func(query string, header string) (*httptest.ResponseRecorder, time.Duration) {
+			req := httptest.NewRequest("GET", "/notifications/v2?appId=app&cluster=cluster&notifications="+
+				url.QueryEscape(`[{"namespaceName":"ns404","notificationId":-1}]`)+query, nil)
+			if header != "" {
+				req.Header.Set(pollTimeoutHeader, header)
+			}
+			w := httptest.NewRecorder()
+			start := time.Now()
+			r.ServeHTTP(w, req)
+			return w, time.Since(start)
+		}
+		w, elapsed := poll("&_mock_poll_timeout=50ms", "")
+		require.Equal(t, 304, w.Code)
+		require.True(t, elapsed >= 50*time.Millisecond && elapsed < time.Second)
+		w, elapsed = poll("", "50ms")
+		require.Equal(t, 304, w.Code)
+		require.True(t, elapsed < time.Second)
+		w, _ = poll("&_mock_poll_timeout=soon", "")
+		require.Equal(t, 400, w.Code)
+	})
+}
+
+func TestReleaseKeyOverride(t *testing.T) {
+
+	// setup apollo
+	filepaths := []string{"/dev/null"}
+	a, err := New(context.Background(), Config{ConfigPath: filepaths})
+	require.EqualError(t, err, "invalid config file")
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
+	router := httprouter.New()
+	a.Routes(router)
+	admin := httprouter.New()
+	a.AdminRoutes(admin)
+
+	releaseKey := func(target string) string {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		rsp := struct {
+			ReleaseKey     string            `json:"releaseKey"`
+			Configurations map[string]string `json:"configurations"`
+		}{}
+		require.Nil(t, json.NewDecoder(w.Result().Body).Decode(&rsp))
+		require.Equal(t, "mysql://root@localhost/mysql", rsp.Configurations["mysql"])
+		return rsp.ReleaseKey
+	}
+
+	t.Run("invalid override", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("PUT", "/admin/releasekeys", strings.NewReader(`[{"releaseKey":"canary"}]`)))
+		require.Equal(t, 400, w.Result().StatusCode)
+	})
+
+	t.Run("override", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		body := `[{"appId":"app","ip":"10.0.0.1","releaseKey":"canary-ip"},{"label":"canary","releaseKey":"canary-label"}]`
+		admin.ServeHTTP(w, httptest.NewRequest("PUT", "/admin/releasekeys", strings.NewReader(body)))
+		require.Equal(t, 200, w.Result().StatusCode)
+
+		w = httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("GET", "/admin/releasekeys", nil))
+		b, err := io.ReadAll(w.Result().Body)
+		require.Nil(t, err)
+		require.JSONEq(t, body, string(b))
+
+		require.Equal(t, "abc", releaseKey("/configs/app/cluster/ns"))
+		require.Equal(t, "canary-ip", releaseKey("/configs/app/cluster/ns?ip=10.0.0.1"))
+		require.Equal(t, "canary-label", releaseKey("/configs/app/cluster/ns?label=canary"))
+	})
+
+	t.Run("headers", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		body := `[{"headers":{"X-Canary-Group":"blue"},"releaseKey":"canary-header"}]`
+		admin.ServeHTTP(w, httptest.NewRequest("PUT", "/admin/releasekeys", strings.NewReader(body)))
+		require.Equal(t, 200, w.Result().StatusCode)
+
+		releaseKey := func(group string) string {
+			req := httptest.NewRequest("GET", "/configs/app/cluster/ns", nil)
+			req.Header.Set("x-canary-group", group)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			rsp := struct {
+				ReleaseKey string `json:"releaseKey"`
+			}{}
+			require.Nil(t, json.NewDecoder(w.Result().Body).Decode(&rsp))
+			return rsp.ReleaseKey
+		}
+		require.Equal(t, "canary-header", releaseKey("blue"))
+		require.Equal(t, "abc", releaseKey("green"))
+	})
+
+	t.Run("percent", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("PUT", "/admin/releasekeys", strings.NewReader(`[{"percent":101,"releaseKey":"gray"}]`)))
+		require.Equal(t, 400, w.Result().StatusCode)
+
+		w = httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("PUT", "/admin/releasekeys", strings.NewReader(`[{"percent":10,"releaseKey":"gray"}]`)))
+		require.Equal(t, 200, w.Result().StatusCode)
+
+		gray := 0
+		for i := 0; i < 1000; i++ {
+			target := fmt.Sprintf("/configs/app/cluster/ns?ip=10.0.%d.%d", i/256, i%256)
+			rk := releaseKey(target)
+			// clients keep getting the same config
+			require.Equal(t, rk, releaseKey(target))
+			if rk == "gray" {
+				gray++
+			}
+		}
+		require.InDelta(t, 100, gray, 30)
+	})
+
+	t.Run("branch properties", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		body := `[{"label":"canary","releaseKey":"branch","properties":{"feature":"on"}}]`
+		admin.ServeHTTP(w, httptest.NewRequest("PUT", "/admin/releasekeys", strings.NewReader(body)))
+		require.Equal(t, 200, w.Result().StatusCode)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/configfiles/json/app/cluster/ns?label=canary", nil))
+		b, err := io.ReadAll(w.Result().Body)
+		require.Nil(t, err)
+		require.JSONEq(t, `{"mysql":"mysql://root@localhost/mysql","feature":"on"}`, string(b))
+		require.Equal(t, "branch", releaseKey("/configs/app/cluster/ns?label=canary"))
+		// the namespace itself is left unchanged
+		require.Equal(t, "abc", releaseKey("/configs/app/cluster/ns"))
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("DELETE", "/admin/releasekeys", nil))
+		require.Equal(t, 200, w.Result().StatusCode)
+		require.Equal(t, "abc", releaseKey("/configs/app/cluster/ns?ip=10.0.0.1"))
+	})
+
+	t.Run("config file branches", func(t *testing.T) {
+		cm := watcher.ConfigMap{"app": {"cluster": {"ns": stubConfigs[0]["app"]["cluster"]["ns"]}}}
+		ns := cm["app"]["cluster"]["ns"]
+		ns.Branches = []watcher.Branch{{Name: "gray", IPs: []string{"10.0.0.1"}, Labels: []string{"canary"}}}
+		cm["app"]["cluster"]["ns"] = ns
+		require.Nil(t, a.w[0].SetConfig(cm))
+		defer a.w[0].SetConfig(stubConfigs[0])
+
+		require.Equal(t, "abc", releaseKey("/configs/app/cluster/ns"))
+		require.Equal(t, "abc-gray", releaseKey("/configs/app/cluster/ns?ip=10.0.0.1"))
+		require.Equal(t, "abc-gray", releaseKey("/configs/app/cluster/ns?label=canary"))
+
+		// the rules set at runtime take precedence
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("PUT", "/admin/releasekeys", strings.NewReader(`[{"ip":"10.0.0.1","releaseKey":"runtime"}]`)))
+		require.Equal(t, 200, w.Result().StatusCode)
+		defer a.releaseKeys.set(nil)
+		require.Equal(t, "runtime", releaseKey("/configs/app/cluster/ns?ip=10.0.0.1"))
+		require.Equal(t, "abc-gray", releaseKey("/configs/app/cluster/ns?label=canary"))
+	})
+}
+
+func TestQueryConfigFile(t *testing.T) {
+
+	// setup apollo
+	filepaths := []string{"/dev/null"}
+	a, err := New(context.Background(), Config{ConfigPath: filepaths, Charset: "UTF-8"})
+	require.EqualError(t, err, "invalid config file")
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
+	router := httprouter.New()
+	a.Routes(router)
+
+	var contentType string
+	get := func(target string) (int, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		rsp := w.Result()
+		b, err := io.ReadAll(rsp.Body)
+		require.Nil(t, err)
+		contentType = rsp.Header.Get("Content-Type")
+		return rsp.StatusCode, string(b)
+	}
+
+	t.Run("properties", func(t *testing.T) {
+		code, body := get("/configfiles/app/cluster/ns")
+		require.Equal(t, 200, code)
+		require.Equal(t, "text/plain;charset=UTF-8", contentType)
+		require.Equal(t, "mysql=mysql\\://root@localhost/mysql\n", body)
+	})
+
+	t.Run("xml", func(t *testing.T) {
+		code, body := get("/configfiles/app/cluster/ns2.xml")
+		require.Equal(t, 200, code)
+		require.Equal(t, "application/xml;charset=UTF-8", contentType)
+		require.Equal(t, "plain text", body)
+	})
+
+	t.Run("yaml and json namespaces", func(t *testing.T) {
+		code, body := get("/configfiles/app/cluster/ns2.yaml")
+		require.Equal(t, 200, code)
+		require.Equal(t, "text/plain;charset=UTF-8", contentType)
+		require.Equal(t, stubConfigs[0]["app"]["cluster"]["ns2"].Yaml, body)
+		code, body = get("/configfiles/app/cluster/ns.json")
+		require.Equal(t, 200, code)
+		require.Equal(t, "application/json;charset=UTF-8", contentType)
+		require.Equal(t, stubConfigs[0]["app"]["cluster"]["ns"].JSON, body)
+		code, body = get("/configs/app/cluster/ns.yaml")
+		require.Equal(t, 200, code)
+		require.Equal(t, "application/json;charset=UTF-8", contentType)
+		require.Contains(t, body, `"namespaceName":"ns"`)
+		require.Contains(t, body, "p6spy")
+	})
+
+	t.Run("json", func(t *testing.T) {
+		code, body := get("/configfiles/json/app/cluster/ns")
+		require.Equal(t, 200, code)
+		require.Equal(t, "application/json;charset=UTF-8", contentType)
+		require.JSONEq(t, `{"mysql":"mysql://root@localhost/mysql"}`, body)
+	})
+
+	t.Run("head", func(t *testing.T) {
+		head := func(target string) int {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("HEAD", target, nil))
+			return w.Code
+		}
+		require.Equal(t, 200, head("/configs/app/cluster/ns"))
+		require.Equal(t, 200, head("/configfiles/json/app/cluster/ns"))
+		require.Equal(t, 200, head("/configfiles/app/cluster/ns2.yaml"))
+		require.Equal(t, 404, head("/configs/app/cluster/ns404"))
+		require.Equal(t, 404, head("/configfiles/app/cluster/ns404"))
+	})
+
+	t.Run("health", func(t *testing.T) {
+		code, body := get("/health")
+		require.Equal(t, 200, code)
+		require.JSONEq(t, `{"status":"UP"}`, body)
+	})
+
+	t.Run("status 404", func(t *testing.T) {
+		code, _ := get("/configfiles/app/cluster/ns404")
+		require.Equal(t, 404, code)
+		code, body := get("/configfiles/app/cluster")
+		require.Equal(t, 404, code)
+		require.Equal(t, "path not found", body)
+	})
+}
+
+func TestRenderProperties(t *testing.T) {
+	require.Equal(
+		t,
+		"a\\ key=\\ value \\= 1\nb=line1\\nline2\\tend\\\\\nc\\:d=\\#\\!\n",
+		renderProperties(map[string]string{
+			"c:d":   "#!",
+			"a key": " value = 1",
+			"b":     "line1\nline2\tend\\",
+		}, false),
+	)
+
+	// unicode escaping
+	require.Equal(t, `k=caf\u00E9\uD83D\uDE00`+"\n", renderProperties(map[string]string{"k": "café😀"}, true))
+	require.Equal(t, "k=café\n", renderProperties(map[string]string{"k": "café"}, false))
+}
+
+func TestDebugOverride(t *testing.T) {
+	ns := stubConfigs[0]["app"]["cluster"]["ns"]
+	q := "?_mock_override=" + url.QueryEscape("mysql:mysql://debug") + "&_mock_override=feature:on&_mock_override=invalid"
+	got := debugOverride(ns, httptest.NewRequest("GET", "/configs/app/cluster/ns"+q, nil))
+	require.Equal(t, map[string]string{"mysql": "mysql://debug", "feature": "on"}, got.Properties)
+	// the served namespace is left unchanged
+	require.Equal(t, "mysql://root@localhost/mysql", ns.Properties["mysql"])
+
+	got = debugOverride(ns, httptest.NewRequest("GET", "/configs/app/cluster/ns", nil))
+	require.Equal(t, ns, got)
+}
+
+func TestExpandVars(t *testing.T) {
+	ns := watcher.Namespace{
+		Properties: map[string]string{
+			"token": "{{.AppID}}-{{ .Cluster }}-{{.ClientIP}}",
+			"plain": "value",
+		},
+		Yaml: "ns: {{.Namespace}}\nunknown: {{.Unknown}}",
+	}
+	r := httptest.NewRequest("GET", "/configs/app/cluster/ns?ip=10.0.0.1", nil)
+	got := expandVars(ns, newRequestVars("app", "cluster", "ns", r))
+	require.Equal(t, map[string]string{"token": "app-cluster-10.0.0.1", "plain": "value"}, got.Properties)
+	require.Equal(t, "ns: ns\nunknown: {{.Unknown}}", got.Yaml)
+	// the served namespace is left unchanged
+	require.Equal(t, "{{.AppID}}-{{ .Cluster }}-{{.ClientIP}}", ns.Properties["token"])
+}
+
+func TestGraphQL(t *testing.T) {
+
+	// setup apollo
+	filepaths := []string{"/dev/null"}
+	a, err := New(context.Background(), Config{ConfigPath: filepaths, GraphQL: true})
+	require.EqualError(t, err, "invalid config file")
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
+	admin := httprouter.New()
+	a.AdminRoutes(admin)
+
+	// an open poll of a client
+	p, err := longpoll.New(context.Background(), longpoll.Config{
+		Notifications: []longpoll.Notification{{ID: 1, Namespace: "ns"}},
+		Timeout:       time.Minute,
+	})
+	require.Nil(t, err)
+	a.addPoll(p, pollClient{AppID: "app", Cluster: "cluster", IP: "10.0.0.1"})
+	defer a.removePoll(p)
+
+	query := `{
+		apps { appId clusters { cluster namespaces { namespace releaseKey configurations { key value } } } }
+		clients(appId: "app") { ip notifications { namespaceName } }
+		stats { polls }
+	}`
+	body, err := json.Marshal(map[string]string{"query": query})
+	require.Nil(t, err)
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("POST", "/admin/graphql", strings.NewReader(string(body))))
+	require.Equal(t, 200, w.Result().StatusCode)
+	require.JSONEq(t, `{"data":{
+		"apps":[{"appId":"app","clusters":[{"cluster":"cluster","namespaces":[
+			{"namespace":"ns","releaseKey":"abc","configurations":[{"key":"mysql","value":"mysql://root@localhost/mysql"}]},
+			{"namespace":"ns2","releaseKey":"abc","configurations":[]}
+		]}]}],
+		"clients":[{"ip":"10.0.0.1","notifications":[{"namespaceName":"ns"}]}],
+		"stats":{"polls":1}
+	}}`, w.Body.String())
+
+	t.Run("disabled", func(t *testing.T) {
+		a.cfg.GraphQL = false
+		defer func() { a.cfg.GraphQL = true }()
+		admin := httprouter.New()
+		a.AdminRoutes(admin)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("GET", "/admin/graphql?query={stats{polls}}", nil))
+		require.Equal(t, 404, w.Result().StatusCode)
+	})
+}
+
+func TestHooks(t *testing.T) {
+
+	script, err := hooks.Parse(`
+def handle(req):
+    if req.path.startswith("/services/"):
+        return {"status": 503, "body": "injected fault"}
+    if req.sdk == "apollo-client-go" and req.sdkVersion.startswith("1."):
+        return {"label": "legacy", "charset": "GBK", "unicodeEscape": True}
+    if req.appId == "app" and req.namespace == "ns" and req.header("X-Canary") == "1":
+        return {"headers": {"X-Mock": "canary"}, "properties": {"feature": "on"}}
+`)
+	require.Nil(t, err)
+
+	// setup apollo
+	filepaths := []string{"/dev/null"}
+	a, err := New(context.Background(), Config{ConfigPath: filepaths, Hook: script})
+	require.EqualError(t, err, "invalid config file")
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
+	r := httprouter.New()
+	a.Routes(r)
+
+	t.Run("fault", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/services/config", nil))
+		require.Equal(t, 503, w.Result().StatusCode)
+		require.Equal(t, "injected fault", w.Body.String())
+	})
+
+	t.Run("properties", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/configs/app/cluster/ns", nil)
+		req.Header.Set("X-Canary", "1")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Result().StatusCode)
+		require.Equal(t, "canary", w.Result().Header.Get("X-Mock"))
+		var res struct {
+			Configurations map[string]string `json:"configurations"`
+		}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &res))
+		require.Equal(t, map[string]string{"mysql": "mysql://root@localhost/mysql", "feature": "on"}, res.Configurations)
+	})
+
+	t.Run("untouched", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/configs/app/cluster/ns", nil))
+		require.Equal(t, 200, w.Result().StatusCode)
+		require.Equal(t, "", w.Result().Header.Get("X-Mock"))
+		require.NotContains(t, w.Body.String(), "feature")
+	})
+
+	t.Run("user agent", func(t *testing.T) {
+		require.Nil(t, a.store.Upsert(store.Key{AppID: "app", Cluster: "cluster", Namespace: "sdk"}, watcher.Namespace{
+			ReleaseKey: "r1",
+			Properties: map[string]string{"greeting": "héllo"},
+			Branches:   []watcher.Branch{{Name: "legacy", Labels: []string{"legacy"}, Properties: map[string]string{"legacy": "true"}}},
+		}))
+		get := func(userAgent string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/configfiles/app/cluster/sdk", nil)
+			req.Header.Set("User-Agent", userAgent)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			require.Equal(t, 200, w.Code)
+			return w
+		}
+		w := get("apollo-client-go/1.2.0")
+		require.Equal(t, "text/plain;charset=GBK", w.Header().Get("Content-Type"))
+		require.Equal(t, "greeting=h\\u00E9llo\nlegacy=true\n", w.Body.String())
+		w = get("apollo-client-go/2.0.0")
+		require.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+		require.Equal(t, "greeting=héllo\n", w.Body.String())
+	})
+}
+
+func TestReleaseKeyProgression(t *testing.T) {
+	ns := stubConfigs[0]["app"]["cluster"]["ns"]
+	k := store.Key{AppID: "app", Cluster: "cluster", Namespace: "ns"}
+	changed := ns
+	changed.Properties = map[string]string{"mysql": "mysql://root@localhost/other"}
+
+	t.Run("file", func(t *testing.T) {
+		p := newProgression("")
+		require.Equal(t, "abc", p.apply(k, ns).ReleaseKey)
+	})
+
+	t.Run("counter", func(t *testing.T) {
+		p := newProgression(ReleaseKeyCounter)
+		require.Equal(t, "1", p.apply(k, ns).ReleaseKey)
+		require.Equal(t, "1", p.apply(k, ns).ReleaseKey)
+		require.Equal(t, "2", p.apply(k, changed).ReleaseKey)
+		require.Equal(t, "3", p.apply(store.Key{AppID: "app", Cluster: "cluster", Namespace: "ns2"}, ns).ReleaseKey)
+		// the served namespace is left unchanged
+		require.Equal(t, "abc", ns.ReleaseKey)
+	})
+
+	t.Run("apollo", func(t *testing.T) {
+		p := newProgression(ReleaseKeyApollo)
+		now := time.Date(2020, 3, 9, 21, 26, 53, 0, time.Local)
+		p.now = func() time.Time { return now }
+		first := p.apply(k, ns).ReleaseKey
+		require.Regexp(t, `^20200309212653-[0-9a-f]{16}$`, first)
+		require.Equal(t, first, p.apply(k, ns).ReleaseKey)
+		// keys released within the same second keep increasing
+		second := p.apply(k, changed).ReleaseKey
+		require.Regexp(t, `^20200309212654-[0-9a-f]{16}$`, second)
+		require.True(t, second > first)
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		p := newProgression(ReleaseKeyHash)
+		now := time.Date(2020, 3, 9, 21, 26, 53, 0, time.Local)
+		p.now = func() time.Time { return now }
+		first := p.apply(k, ns).ReleaseKey
+		require.Equal(t, fmt.Sprintf("20200309212653-%016x", fingerprint(ns)), first)
+		require.Equal(t, first, p.apply(k, ns).ReleaseKey)
+		second := p.apply(k, changed).ReleaseKey
+		require.Equal(t, fmt.Sprintf("20200309212654-%016x", fingerprint(changed)), second)
+		// a reverted content is released again with a greater key
+		third := p.apply(k, ns).ReleaseKey
+		require.Equal(t, fmt.Sprintf("20200309212655-%016x", fingerprint(ns)), third)
+	})
+}
+
+func TestNotificationFaults(t *testing.T) {
+	client := pollClient{AppID: "app", Cluster: "cluster", IP: "10.0.0.1"}
+	req := func() *http.Request {
+		return httptest.NewRequest("GET", "/notifications/v2?appId=app&cluster=cluster&notifications=[]", nil)
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		f := newFaults(NotificationFault{Empty: true}, nil)
+		w := httptest.NewRecorder()
+		require.True(t, f.serve(w, req(), client))
+		require.Equal(t, 200, w.Result().StatusCode)
+		require.Equal(t, "[]", w.Body.String())
+	})
+
+	t.Run("error after", func(t *testing.T) {
+		f := newFaults(NotificationFault{ErrorAfter: 20 * time.Millisecond}, nil)
+		w := httptest.NewRecorder()
+		start := time.Now()
+		require.True(t, f.serve(w, req(), client))
+		require.True(t, time.Since(start) >= 20*time.Millisecond)
+		require.Equal(t, 500, w.Result().StatusCode)
+	})
+
+	t.Run("percent", func(t *testing.T) {
+		f := newFaults(NotificationFault{Empty: true, Percent: 10}, nil)
+		f.rand = func(int) int { return 50 }
+		require.False(t, f.serve(httptest.NewRecorder(), req(), client))
+		f.rand = func(int) int { return 5 }
+		require.True(t, f.serve(httptest.NewRecorder(), req(), client))
+	})
+
+	t.Run("first delay", func(t *testing.T) {
+		f := newFaults(NotificationFault{FirstDelay: 20 * time.Millisecond}, nil)
+		start := time.Now()
+		require.False(t, f.serve(httptest.NewRecorder(), req(), client))
+		require.True(t, time.Since(start) >= 20*time.Millisecond)
+		require.Equal(t, time.Duration(0), f.firstDelay(client))
+		other := client
+		other.IP = "10.0.0.2"
+		require.Equal(t, 20*time.Millisecond, f.firstDelay(other))
+
+		// the clients idle for seenTTL are forgotten
+		now := time.Now()
+		f.now = func() time.Time { return now }
+		require.Equal(t, time.Duration(0), f.firstDelay(client))
+		now = now.Add(seenTTL / 2)
+		require.Equal(t, time.Duration(0), f.firstDelay(client))
+		now = now.Add(seenTTL / 2)
+		require.Equal(t, time.Duration(0), f.firstDelay(client))
+		require.Len(t, f.seen, 1)
+		now = now.Add(seenTTL)
+		require.Equal(t, 20*time.Millisecond, f.firstDelay(other))
+		require.Len(t, f.seen, 1)
+	})
+
+	t.Run("route", func(t *testing.T) {
+		a, err := New(context.Background(), Config{ConfigPath: []string{"/dev/null"}, NotificationFault: NotificationFault{Empty: true}})
+		require.EqualError(t, err, "invalid config file")
+		r := httprouter.New()
+		a.Routes(r)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/notifications/v2?appId=app&cluster=cluster&notifications="+url.QueryEscape(`[{"namespaceName":"ns","notificationId":1}]`), nil))
+		require.Equal(t, 200, w.Result().StatusCode)
+		require.Equal(t, "[]", w.Body.String())
+		require.Equal(t, int64(0), atomic.LoadInt64(&a.npolls))
+	})
+}
+
+func TestAccessLog(t *testing.T) {
+	t.Run("filters", func(t *testing.T) {
+		l := &accessLog{cfg: AccessLog{Enabled: true, Paths: []string{"/configs/", "/notifications/"}, AppIDs: []string{"app"}}}
+		require.True(t, l.logged("/configs/app/cluster/ns", "app"))
+		require.False(t, l.logged("/configs/other/cluster/ns", "other"))
+		require.False(t, l.logged("/healthz", "app"))
+		require.False(t, (&accessLog{}).logged("/configs/app/cluster/ns", "app"))
+	})
+
+	t.Run("sample", func(t *testing.T) {
+		l := &accessLog{cfg: AccessLog{Enabled: true, Sample: 3}}
+		logged := 0
+		for i := 0; i < 9; i++ {
+			if l.logged("/configs/app/cluster/ns", "app") {
+				logged++
+			}
+		}
+		require.Equal(t, 3, logged)
+	})
+
+	t.Run("route", func(t *testing.T) {
+		buf := &lockedBuffer{}
+		log := nlogger.NewProvider(nlogger.New(buf, ""))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		a, err := New(ctx, Config{Log: log, ConfigPath: []string{"/dev/null"}, AccessLog: AccessLog{Enabled: true, AppIDs: []string{"app"}}})
+		require.EqualError(t, err, "invalid config file")
+		r := httprouter.New()
+		a.Routes(r)
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/configs/app/cluster/ns?ip=10.0.0.1", nil))
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/configs/other/cluster/ns?ip=10.0.0.1", nil))
+		require.Contains(t, buf.String(), "10.0.0.1 GET /configs/app/cluster/ns?ip=10.0.0.1 404")
+		require.Contains(t, buf.String(), " route=/configs/:appId/:cluster/:namespace method=GET uri=/configs/app/cluster/ns?ip=10.0.0.1 status=404 durationMs=")
+		require.Contains(t, buf.String(), " appId=app cluster=cluster namespace=ns ip=10.0.0.1 remoteIp=192.0.2.1")
+		require.NotContains(t, buf.String(), "GET /configs/other/")
+	})
+}
+
+// lockedBuffer is a log output written by the watcher goroutines while a test reads it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// remoteConn is a connection from a remote address
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestTopClients(t *testing.T) {
+	a, err := New(context.Background(), Config{ConfigPath: []string{"/dev/null"}})
+	require.EqualError(t, err, "invalid config file")
+	admin := httprouter.New()
+	a.AdminRoutes(admin)
+
+	conn := func(ip string, port int) net.Conn {
+		return remoteConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: port}}
+	}
+	for port := 1; port <= 3; port++ {
+		a.ConnState(conn("10.0.0.1", port), http.StateNew)
+	}
+	a.ConnState(conn("10.0.0.2", 1), http.StateNew)
+	a.ConnState(conn("10.0.0.3", 1), http.StateNew)
+	a.ConnState(conn("10.0.0.3", 1), http.StateClosed)
+	a.ConnState(conn("10.0.0.1", 1), http.StateHijacked)
+
+	p, err := longpoll.New(context.Background(), longpoll.Config{Timeout: time.Minute})
+	require.Nil(t, err)
+	a.addPoll(p, pollClient{AppID: "app", IP: "192.168.0.1", RemoteIP: "10.0.0.2"})
+	defer a.removePoll(p)
+
+	require.Equal(t, []clientStat{
+		{IP: "10.0.0.1", Connections: 2},
+		{IP: "10.0.0.2", Connections: 1, Polls: 1},
+	}, a.topClients(0))
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/admin/clients?top=1", nil))
+	require.Equal(t, 200, w.Result().StatusCode)
+	require.JSONEq(t, `[{"ip":"10.0.0.1","connections":2,"polls":0}]`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/admin/clients?top=x", nil))
+	require.Equal(t, 400, w.Result().StatusCode)
+}
+
+func TestFixtures(t *testing.T) {
+	dir := t.TempDir()
+	blue := filepath.Join(dir, "blue.yaml")
+	green := filepath.Join(dir, "green.yaml")
+	require.Nil(t, os.WriteFile(blue, []byte("app:\n  cluster:\n    ns:\n      properties: {k: blue}\n    old:\n      properties: {k: old}\n"), 0644))
+	require.Nil(t, os.WriteFile(green, []byte("app:\n  cluster:\n    ns:\n      properties: {k: green}\n    new:\n      properties: {k: new}\n"), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, err := New(ctx, Config{ConfigPath: []string{blue}})
+	require.Nil(t, err)
+	r := httprouter.New()
+	a.Routes(r)
+	admin := httprouter.New()
+	a.AdminRoutes(admin)
+	serve := func(router *httprouter.Router, method string, path string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	fetch := func() string {
+		return serve(r, "GET", "/configfiles/json/app/cluster/ns", "").Body.String()
+	}
+
+	t.Run("stage", func(t *testing.T) {
+		require.Equal(t, 404, serve(admin, "GET", "/admin/fixtures/next", "").Code)
+		require.Equal(t, 409, serve(admin, "POST", "/admin/fixtures/switch", "").Code)
+		require.Equal(t, 400, serve(admin, "PUT", "/admin/fixtures/next", `{"files":["/nonexistent.yaml"]}`).Code)
+
+		w := serve(admin, "PUT", "/admin/fixtures/next", `{"files":["`+green+`"]}`)
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `{
+			"added":[{"appId":"app","cluster":"cluster","namespace":"new"}],
+			"changed":[{"appId":"app","cluster":"cluster","namespace":"ns"}],
+			"removed":[{"appId":"app","cluster":"cluster","namespace":"old"}]
+		}`, w.Body.String())
+		w = serve(admin, "GET", "/admin/fixtures/next", "")
+		require.Equal(t, 200, w.Code)
+		require.Contains(t, w.Body.String(), green)
+		// the staged files are not served
+		require.JSONEq(t, `{"k":"blue"}`, fetch())
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		p, err := longpoll.New(ctx, longpoll.Config{Notifications: []longpoll.Notification{{ID: 1, Namespace: "old"}}, Timeout: time.Minute})
+		require.Nil(t, err)
+		a.addPoll(p, pollClient{AppID: "app", Cluster: "cluster"})
+		w := serve(admin, "POST", "/admin/fixtures/switch", "")
+		a.removePoll(p)
+		require.Equal(t, 409, w.Code)
+		require.Equal(t, "namespaces watched by open polls are missing: app/cluster/old", w.Body.String())
+		require.JSONEq(t, `{"k":"blue"}`, fetch())
+	})
+
+	t.Run("switch", func(t *testing.T) {
+		events := a.bus.Subscribe(ctx)
+		require.Equal(t, 200, serve(admin, "POST", "/admin/fixtures/switch", "").Code)
+		require.JSONEq(t, `{"k":"green"}`, fetch())
+		require.Equal(t, 404, serve(admin, "GET", "/admin/fixtures/next", "").Code)
+		changed := map[string]bool{}
+		for i := 0; i < 3; i++ {
+			select {
+			case e := <-events:
+				changed[e.Namespace] = true
+			case <-time.After(time.Second):
+				t.Fatal("missing switch event")
+			}
+		}
+		require.Equal(t, map[string]bool{"ns": true, "old": true, "new": true}, changed)
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		require.Equal(t, 200, serve(admin, "POST", "/admin/fixtures/rollback", "").Code)
+		require.JSONEq(t, `{"k":"blue"}`, fetch())
+		require.Len(t, a.watchers(), 1)
+		require.Equal(t, blue, a.watchers()[0].Status().File)
+	})
+}
+
+func TestCtrlFiles(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.yaml")
+	other := filepath.Join(dir, "other.yaml")
+	require.Nil(t, os.WriteFile(base, []byte("app:\n  cluster:\n    ns:\n      properties: {k: base}\n"), 0644))
+	require.Nil(t, os.WriteFile(other, []byte("app:\n  cluster:\n    ns:\n      properties: {k: other}\n    extra:\n      properties: {k: extra}\n"), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, err := New(ctx, Config{ConfigPath: []string{base}})
+	require.Nil(t, err)
+	r := httprouter.New()
+	a.Routes(r)
+	ctrl := httprouter.New()
+	a.CtrlRoutes(ctrl)
+	serve := func(router *httprouter.Router, method string, path string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	t.Run("add", func(t *testing.T) {
+		require.Equal(t, 400, serve(ctrl, "POST", "/ctrl/files", `{"files":["/nonexistent.yaml"]}`).Code)
+		require.Equal(t, 400, serve(ctrl, "POST", "/ctrl/files", `{"files":["`+base+`"]}`).Code)
+		w := serve(ctrl, "POST", "/ctrl/files", `{"files":["`+other+`"]}`)
+		require.Equal(t, 200, w.Code)
+		// the live files keep their precedence
+		require.JSONEq(t, `{"added":[{"appId":"app","cluster":"cluster","namespace":"extra"}],"changed":[],"removed":[]}`, w.Body.String())
+		require.JSONEq(t, `{"k":"base"}`, serve(r, "GET", "/configfiles/json/app/cluster/ns", "").Body.String())
+		require.JSONEq(t, `{"k":"extra"}`, serve(r, "GET", "/configfiles/json/app/cluster/extra", "").Body.String())
+		w = serve(ctrl, "GET", "/ctrl/files", "")
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `{"files":["`+base+`","`+other+`"]}`, w.Body.String())
+		require.Len(t, a.watchers(), 2)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		require.Equal(t, 400, serve(ctrl, "DELETE", "/ctrl/files", `{"files":["/nonexistent.yaml"]}`).Code)
+		p, err := longpoll.New(ctx, longpoll.Config{Notifications: []longpoll.Notification{{ID: 1, Namespace: "extra"}}, Timeout: time.Minute})
+		require.Nil(t, err)
+		a.addPoll(p, pollClient{AppID: "app", Cluster: "cluster"})
+		w := serve(ctrl, "DELETE", "/ctrl/files", `{"files":["`+other+`"]}`)
+		a.removePoll(p)
+		require.Equal(t, 409, w.Code)
+
+		w = serve(ctrl, "DELETE", "/ctrl/files", `{"files":["`+other+`"]}`)
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `{"added":[],"changed":[],"removed":[{"appId":"app","cluster":"cluster","namespace":"extra"}]}`, w.Body.String())
+		require.Equal(t, 404, serve(r, "GET", "/configfiles/json/app/cluster/extra", "").Code)
+		require.JSONEq(t, `{"files":["`+base+`"]}`, serve(ctrl, "GET", "/ctrl/files", "").Body.String())
+	})
+
+	t.Run("staged and previous", func(t *testing.T) {
+		next := filepath.Join(dir, "next.yaml")
+		require.Nil(t, os.WriteFile(next, []byte("app:\n  cluster:\n    ns:\n      properties: {k: next}\n"), 0644))
+		admin := httprouter.New()
+		a.AdminRoutes(admin)
+		require.Equal(t, 200, serve(admin, "PUT", "/admin/fixtures/next", `{"files":["`+next+`"]}`).Code)
+		require.Equal(t, 200, serve(admin, "POST", "/admin/fixtures/switch", "").Code)
+		require.Equal(t, 200, serve(admin, "PUT", "/admin/fixtures/next", `{"files":["`+base+`"]}`).Code)
+
+		// only the added and removed files are loaded
+		live := a.watchers()[0]
+		require.Equal(t, 200, serve(ctrl, "POST", "/ctrl/files", `{"files":["`+other+`"]}`).Code)
+		require.Equal(t, live, a.watchers()[0])
+		require.JSONEq(t, `{"k":"extra"}`, serve(r, "GET", "/configfiles/json/app/cluster/extra", "").Body.String())
+		require.Equal(t, 200, serve(ctrl, "DELETE", "/ctrl/files", `{"files":["`+other+`"]}`).Code)
+		require.Equal(t, []*watcher.Watcher{live}, a.watchers())
+
+		w := serve(admin, "GET", "/admin/fixtures/next", "")
+		require.Equal(t, 200, w.Code)
+		require.Contains(t, w.Body.String(), `"files":["`+base+`"]`)
+		require.Equal(t, 200, serve(admin, "POST", "/admin/fixtures/rollback", "").Code)
+		require.JSONEq(t, `{"files":["`+base+`"]}`, serve(ctrl, "GET", "/ctrl/files", "").Body.String())
+		require.JSONEq(t, `{"k":"base"}`, serve(r, "GET", "/configfiles/json/app/cluster/ns", "").Body.String())
+	})
+}
+
+func TestCtrlConfigs(t *testing.T) {
+	// setup apollo
+	a, err := New(context.Background(), Config{ConfigPath: []string{"/dev/null"}})
+	require.EqualError(t, err, "invalid config file")
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
+	r := httprouter.New()
+	a.Routes(r)
+	ctrl := httprouter.New()
+	a.CtrlRoutes(ctrl)
+	serve := func(router *httprouter.Router, method string, path string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	t.Run("put", func(t *testing.T) {
+		require.Equal(t, 400, serve(ctrl, "PUT", "/ctrl/configs/app/cluster/new", `{}`).Code)
+		require.Equal(t, 200, serve(ctrl, "PUT", "/ctrl/configs/app/cluster/new", `{"properties":{"k":"v"}}`).Code)
+		w := serve(r, "GET", "/configfiles/json/app/cluster/new", "")
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `{"k":"v"}`, w.Body.String())
+
+		w = serve(ctrl, "GET", "/ctrl/configs/app/cluster/new", "")
+		require.Equal(t, 200, w.Code)
+		ns := watcher.Namespace{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &ns))
+		require.True(t, strings.HasPrefix(ns.ReleaseKey, "ctrl-"))
+	})
+
+	t.Run("post", func(t *testing.T) {
+		require.Equal(t, 404, serve(ctrl, "POST", "/ctrl/configs/app/cluster/missing", `{}`).Code)
+		require.Equal(t, 200, serve(ctrl, "POST", "/ctrl/configs/app/cluster/ns", `{"releaseKey":"def","properties":{"k":"v"},"remove":["mysql"]}`).Code)
+		w := serve(r, "GET", "/configs/app/cluster/ns", "")
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `{"appId":"app","cluster":"cluster","namespaceName":"ns","releaseKey":"def","configurations":{"k":"v"}}`, w.Body.String())
+		// the config file is left unchanged
+		require.Equal(t, "abc", a.w[0].Config()["app"]["cluster"]["ns"].ReleaseKey)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.Equal(t, 200, serve(ctrl, "DELETE", "/ctrl/configs/app/cluster/ns2", "").Code)
+		require.Equal(t, 404, serve(ctrl, "DELETE", "/ctrl/configs/app/cluster/ns2", "").Code)
+		require.Equal(t, 404, serve(r, "GET", "/configs/app/cluster/ns2", "").Code)
+		require.Equal(t, 404, serve(ctrl, "GET", "/ctrl/configs/app/cluster/ns2", "").Code)
+	})
+
+	t.Run("export", func(t *testing.T) {
+		w := serve(ctrl, "GET", "/ctrl/export", "")
+		require.Equal(t, 200, w.Code)
+		require.Equal(t, "application/yaml", w.Header().Get("Content-Type"))
+		cm := watcher.ConfigMap{}
+		require.Nil(t, yaml.Unmarshal(w.Body.Bytes(), &cm))
+		require.Equal(t, []string{"new", "ns"}, func() []string {
+			names := []string{}
+			for name := range cm["app"]["cluster"] {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return names
+		}())
+		require.Equal(t, map[string]string{"k": "v"}, cm["app"]["cluster"]["ns"].Properties)
+
+		req := httptest.NewRequest("GET", "/ctrl/export", nil)
+		req.Header.Set("Accept", "application/json")
+		w = httptest.NewRecorder()
+		ctrl.ServeHTTP(w, req)
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		exported := watcher.ConfigMap{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &exported))
+		require.Equal(t, cm, exported)
+	})
+
+	t.Run("import", func(t *testing.T) {
+		state := serve(ctrl, "GET", "/ctrl/export", "").Body.String()
+		require.Equal(t, 400, serve(ctrl, "POST", "/ctrl/import", "app:\n  cluster:\n    empty: {}\n").Code)
+		require.Equal(t, 400, serve(ctrl, "POST", "/ctrl/import", "app: [").Code)
+
+		req := httptest.NewRequest("POST", "/ctrl/import", strings.NewReader(`{"app":{"cluster":{"imported":{"properties":{"k":"v2"}}}}}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ctrl.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code)
+		w = serve(r, "GET", "/configfiles/json/app/cluster/imported", "")
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `{"k":"v2"}`, w.Body.String())
+		// the namespaces missing from the import are not served, even the ones of the config file
+		require.Equal(t, 404, serve(r, "GET", "/configs/app/cluster/ns", "").Code)
+		require.Equal(t, 404, serve(r, "GET", "/configs/app/cluster/new", "").Code)
+
+		// restoring an export serves the same config again
+		require.Equal(t, 200, serve(ctrl, "POST", "/ctrl/import", state).Code)
+		require.Equal(t, state, serve(ctrl, "GET", "/ctrl/export", "").Body.String())
+		require.Equal(t, 404, serve(r, "GET", "/configs/app/cluster/imported", "").Code)
+	})
+}
+
+func TestCtrlRequests(t *testing.T) {
+	a, err := New(context.Background(), Config{ConfigPath: []string{"/dev/null"}, RequestLogSize: 3})
+	require.EqualError(t, err, "invalid config file")
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
+	r := httprouter.New()
+	a.Routes(r)
+	ctrl := httprouter.New()
+	a.CtrlRoutes(ctrl)
+	serve := func(router *httprouter.Router, method string, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+	list := func(query string) []recordedRequest {
+		w := serve(ctrl, "GET", "/ctrl/requests"+query)
+		require.Equal(t, 200, w.Code)
+		requests := []recordedRequest{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &requests))
+		return requests
+	}
+
+	start := time.Now()
+	require.Equal(t, 200, serve(r, "GET", "/healthz").Code)
+	require.Equal(t, 200, serve(r, "GET", "/configs/app/cluster/ns?ip=1.2.3.4").Code)
+	require.Equal(t, 404, serve(r, "GET", "/configfiles/json/app/cluster/missing").Code)
+	require.Equal(t, 200, serve(r, "GET", "/configfiles/json/app/cluster/ns.properties").Code)
+
+	// the oldest request is dropped beyond the size of the log
+	requests := list("")
+	require.Len(t, requests, 3)
+	require.Equal(t, "GET", requests[0].Method)
+	require.Equal(t, "/configs/app/cluster/ns", requests[0].Path)
+	require.Equal(t, "1.2.3.4", requests[0].Query.Get("ip"))
+	require.Equal(t, "app", requests[0].AppID)
+	require.Equal(t, "cluster", requests[0].Cluster)
+	require.Equal(t, "ns", requests[0].Namespace)
+	require.Equal(t, 200, requests[0].Status)
+	require.False(t, requests[0].Received.Before(start))
+	require.False(t, requests[0].Completed.Before(requests[0].Received))
+
+	require.Len(t, list("?path=/configfiles/"), 2)
+	require.Len(t, list("?namespace=ns&method=get"), 2)
+	require.Len(t, list("?namespace=missing"), 1)
+	require.Len(t, list("?appId=app2"), 0)
+	require.Len(t, list("?since="+time.Now().Add(time.Minute).Format(time.RFC3339)), 0)
+	require.Equal(t, 400, serve(ctrl, "GET", "/ctrl/requests?since=yesterday").Code)
+
+	require.Equal(t, 200, serve(ctrl, "DELETE", "/ctrl/requests").Code)
+	require.Empty(t, list(""))
+}
+
+func TestRequestJournal(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	journal := filepath.Join(dir, "requests.db")
+	require.Nil(t, os.WriteFile(file, []byte("app:\n  cluster:\n    ns:\n      properties: {k: v}\n"), 0644))
+	serve := func(a *Apollo, method string, path string) *httptest.ResponseRecorder {
+		r := httprouter.New()
+		a.Routes(r)
+		a.CtrlRoutes(r)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+	list := func(a *Apollo, query string) []recordedRequest {
+		w := serve(a, "GET", "/ctrl/requests?appId=app"+query)
+		require.Equal(t, 200, w.Code)
+		requests := []recordedRequest{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &requests))
+		return requests
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a, err := New(ctx, Config{ConfigPath: []string{file}, RequestLogSize: 10, RequestJournal: journal})
+	require.Nil(t, err)
+	start := time.Now()
+	require.Equal(t, 200, serve(a, "GET", "/configs/app/cluster/ns?ip=10.0.0.1").Code)
+	require.Equal(t, 404, serve(a, "GET", "/configs/app/cluster/missing").Code)
+	requests := list(a, "")
+	require.Len(t, requests, 2)
+	require.Equal(t, url.Values{"ip": {"10.0.0.1"}}, requests[0].Query)
+	require.False(t, requests[0].Received.Before(start.Truncate(time.Nanosecond)))
+	require.Len(t, list(a, "&method=get&path=/configs/app&namespace=ns"), 1)
+	require.Empty(t, list(a, "&since="+url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339Nano))))
+	cancel()
+
+	// the requests survive a restart, the latest ones are kept
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	a, err = New(ctx, Config{ConfigPath: []string{file}, RequestLogSize: 2, RequestJournal: journal})
+	require.Nil(t, err)
+	require.Equal(t, 200, serve(a, "GET", "/configfiles/json/app/cluster/ns").Code)
+	requests = list(a, "")
+	require.Len(t, requests, 2)
+	require.Equal(t, 404, requests[0].Status)
+	require.Equal(t, "/configfiles/json/app/cluster/ns", requests[1].Path)
+
+	require.Equal(t, 200, serve(a, "DELETE", "/ctrl/requests").Code)
+	require.Empty(t, list(a, ""))
+	require.Equal(t, 200, serve(a, "GET", "/configs/app/cluster/ns").Code)
+	require.Len(t, list(a, ""), 1)
+
+	_, err = New(ctx, Config{ConfigPath: []string{file}, RequestLogSize: 2, RequestJournal: filepath.Join(dir, "missing", "requests.db")})
+	require.NotNil(t, err)
+}
+
+func TestConfigCache(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	cache := filepath.Join(dir, "cache.yaml")
+	require.Nil(t, os.WriteFile(file, []byte("app:\n  cluster:\n    ns:\n      properties: {k: v1}\n"), 0644))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fetch := func(a *Apollo) (int, string) {
+		r := httprouter.New()
+		a.Routes(r)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/configfiles/json/app/cluster/ns", nil))
+		return w.Code, w.Body.String()
+	}
+
+	t.Run("save", func(t *testing.T) {
+		_, err := New(ctx, Config{ConfigPath: []string{file}, CacheFile: cache})
+		require.Nil(t, err)
+		cm := watcher.ConfigMap{}
+		b, err := os.ReadFile(cache)
+		require.Nil(t, err)
+		require.Nil(t, yaml.Unmarshal(b, &cm))
+		require.Equal(t, "v1", cm["app"]["cluster"]["ns"].Properties["k"])
+	})
+
+	t.Run("load", func(t *testing.T) {
+		require.Nil(t, os.WriteFile(file, []byte(""), 0644))
+		a, err := New(ctx, Config{ConfigPath: []string{file}, CacheFile: cache})
+		require.Nil(t, err)
+		code, body := fetch(a)
+		require.Equal(t, 200, code)
+		require.JSONEq(t, `{"k":"v1"}`, body)
+
+		// the cache is dropped once the files load
+		require.Nil(t, os.WriteFile(file, []byte("app:\n  cluster:\n    ns2:\n      properties: {k: v2}\n"), 0644))
+		require.Eventually(t, func() bool {
+			code, _ := fetch(a)
+			return code == 404
+		}, 5*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		require.Nil(t, os.WriteFile(file, []byte(""), 0644))
+		_, err := New(ctx, Config{ConfigPath: []string{file}, CacheFile: filepath.Join(dir, "missing.yaml")})
+		require.EqualError(t, err, "invalid config file")
+	})
+}
+
+func TestSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	s := newSnapshotter(dir, 2)
+	cm := func(v string) watcher.ConfigMap {
+		return watcher.ConfigMap{"app": {"cluster": {"ns": {Properties: map[string]string{"k": v}}}}}
+	}
+	now := time.Date(2020, 3, 9, 21, 26, 53, 0, time.UTC)
+	require.Nil(t, s.write(cm("v1"), now))
+	// an unchanged config is not written again
+	require.Nil(t, s.write(cm("v1"), now.Add(time.Minute)))
+	require.Nil(t, s.write(cm("v2"), now.Add(2*time.Minute)))
+	require.Nil(t, s.write(cm("v3"), now.Add(3*time.Minute)))
+
+	files, err := s.list()
+	require.Nil(t, err)
+	require.Equal(t, []string{
+		filepath.Join(dir, "snapshot-20200309T212853.000Z.yaml"),
+		filepath.Join(dir, "snapshot-20200309T212953.000Z.yaml"),
+	}, files)
+	b, err := os.ReadFile(files[1])
+	require.Nil(t, err)
+	snapshot := watcher.ConfigMap{}
+	require.Nil(t, yaml.Unmarshal(b, &snapshot))
+	require.Equal(t, "v3", snapshot["app"]["cluster"]["ns"].Properties["k"])
+
+	t.Run("served", func(t *testing.T) {
+		file := filepath.Join(dir, "config.yaml")
+		require.Nil(t, os.WriteFile(file, []byte("app:\n  cluster:\n    ns:\n      properties: {k: v1}\n"), 0644))
+		a, err := New(context.Background(), Config{ConfigPath: []string{file}})
+		require.Nil(t, err)
+		require.Nil(t, a.store.Upsert(store.Key{AppID: "app", Cluster: "cluster", Namespace: "ns2"}, watcher.Namespace{
+			Properties: map[string]string{"k": "v2"},
+		}))
+		served := a.servedConfig()
+		require.Equal(t, "v1", served["app"]["cluster"]["ns"].Properties["k"])
+		require.Equal(t, "v2", served["app"]["cluster"]["ns2"].Properties["k"])
+	})
+}
+
+func TestParseWarnings(t *testing.T) {
+	// setup apollo
+	a, err := New(context.Background(), Config{ConfigPath: []string{"/dev/null"}})
+	require.EqualError(t, err, "invalid config file")
+	admin := httprouter.New()
+	a.AdminRoutes(admin)
+	load := func(config string) {
+		cm := watcher.ConfigMap{}
+		require.Nil(t, yaml.Unmarshal([]byte(config), &cm))
+		require.Nil(t, a.w[0].SetConfig(cm))
+		a.updateParseWarnings()
+	}
+
+	t.Run("warned", func(t *testing.T) {
+		load("app:\n  cluster:\n    ns:\n      json: '{'\n      yaml: '['\n")
+		require.Equal(t, float64(2), a.metrics.parseWarnings.Value("app", "cluster", "ns"))
+
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("GET", "/admin/status", nil))
+		require.Equal(t, 200, w.Code)
+		s := configStatus{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &s))
+		require.Len(t, s.Files, 1)
+		require.Len(t, s.Warnings, 2)
+		require.Equal(t, "ns", s.Warnings[0].Namespace)
+	})
+
+	t.Run("fixed", func(t *testing.T) {
+		load("app:\n  cluster:\n    ns:\n      json: '{}'\n")
+		require.Equal(t, float64(0), a.metrics.parseWarnings.Value("app", "cluster", "ns"))
+	})
+}
+
+func TestNotificationIDs(t *testing.T) {
+	// the namespaces loaded at startup are unchanged
+	data, err := yaml.Marshal(stubConfigs[0])
+	require.Nil(t, err)
+	file := filepath.Join(t.TempDir(), "config.yml")
+	require.Nil(t, os.WriteFile(file, data, 0644))
+
+	// setup apollo
+	a, err := New(context.Background(), Config{ConfigPath: []string{file}, PollTimeout: time.Second})
+	require.Nil(t, err)
+	r := httprouter.New()
+	a.Routes(r)
+	poll := func(appID string, notifications string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/notifications/v2?appId="+appID+"&cluster=cluster&notifications="+url.QueryEscape(notifications), nil))
+		return w
+	}
+
+	t.Run("initial", func(t *testing.T) {
+		w := poll("app", `[{"namespaceName":"ns","notificationId":-1},{"namespaceName":"missing","notificationId":-1}]`)
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `[{"namespaceName":"ns","notificationId":0}]`, w.Body.String())
+	})
+
+	t.Run("ahead", func(t *testing.T) {
+		w := poll("app", `[{"namespaceName":"ns","notificationId":99}]`)
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `[{"namespaceName":"ns","notificationId":0}]`, w.Body.String())
+	})
+
+	t.Run("change", func(t *testing.T) {
+		results := make(chan *httptest.ResponseRecorder, 2)
+		go func() {
+			results <- poll("app", `[{"namespaceName":"ns","notificationId":0},{"namespaceName":"ns2","notificationId":0}]`)
+		}()
+		go func() {
+			results <- poll("other", `[{"namespaceName":"ns","notificationId":0}]`)
+		}()
+		require.Eventually(t, func() bool {
+			return len(a.snapshotPolls()) == 2
+		}, time.Second, time.Millisecond)
+		require.Nil(t, a.Store().Upsert(store.Key{AppID: "app", Cluster: "cluster", Namespace: "ns"}, watcher.Namespace{Properties: map[string]string{"k": "v"}}))
+
+		// only the changed namespace is returned, to the polls of its app
+		w := <-results
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `[{"namespaceName":"ns","notificationId":1}]`, w.Body.String())
+		w = <-results
+		require.Equal(t, 304, w.Code)
+	})
+
+	t.Run("loose app id", func(t *testing.T) {
+		loose, err := New(context.Background(), Config{ConfigPath: []string{file}, PollTimeout: time.Second, LooseAppID: true})
+		require.Nil(t, err)
+		r := httprouter.New()
+		loose.Routes(r)
+		poll := func(notifications string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "/notifications/v2?appId=other&cluster=cluster&notifications="+url.QueryEscape(notifications), nil))
+			return w
+		}
+		w := poll(`[{"namespaceName":"ns","notificationId":-1}]`)
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `[{"namespaceName":"ns","notificationId":0}]`, w.Body.String())
+
+		// the borrowed namespace follows the changes of the namespace of its app
+		results := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			results <- poll(`[{"namespaceName":"ns","notificationId":0}]`)
+		}()
+		require.Eventually(t, func() bool {
+			return len(loose.snapshotPolls()) == 1
+		}, time.Second, time.Millisecond)
+		require.Nil(t, loose.Store().Upsert(store.Key{AppID: "app", Cluster: "cluster", Namespace: "ns"}, watcher.Namespace{Properties: map[string]string{"k": "v"}}))
+		w = <-results
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `[{"namespaceName":"ns","notificationId":1}]`, w.Body.String())
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		// more namespaces than the events a subscriber buffered
+		cm := watcher.ConfigMap{"app": {"cluster": {}}}
+		notifications := []string{}
+		for i := 0; i < 1000; i++ {
+			namespace := fmt.Sprintf("ns%d", i)
+			cm["app"]["cluster"][namespace] = watcher.Namespace{Properties: map[string]string{"k": "v"}}
+			notifications = append(notifications, fmt.Sprintf(`{"namespaceName":%q,"notificationId":0}`, namespace))
+		}
+		require.Nil(t, a.store.Replace(cm))
+
+		// the ids are bumped once Replace returns
+		w := poll("app", "["+strings.Join(notifications, ",")+"]")
+		require.Equal(t, 200, w.Code)
+		var changed []map[string]interface{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &changed))
+		require.Len(t, changed, 1000)
+	})
+}
+
+func TestAccessKey(t *testing.T) {
+	// setup apollo
+	a, err := New(context.Background(), Config{ConfigPath: []string{"/dev/null"}})
+	require.EqualError(t, err, "invalid config file")
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
+	require.Nil(t, a.store.Upsert(store.Key{AppID: "secured", Cluster: "cluster", Namespace: "ns"},
+		watcher.Namespace{ReleaseKey: "abc", Properties: map[string]string{"k": "v"}, AccessKeys: []string{"secret"}}))
+	r := httprouter.New()
+	a.Routes(r)
+	serve := func(path string, auth string, timestamp time.Time) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		if auth != "" {
+			ts := strconv.FormatInt(timestamp.UnixNano()/int64(time.Millisecond), 10)
+			req.Header.Set("Timestamp", ts)
+			req.Header.Set("Authorization", "Apollo secured:"+signature(ts, path, auth))
+		}
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("apps without access keys", func(t *testing.T) {
+		require.Equal(t, 200, serve("/configs/app/cluster/ns", "", time.Time{}))
+	})
+
+	t.Run("signed", func(t *testing.T) {
+		require.Equal(t, 200, serve("/configs/secured/cluster/ns", "secret", time.Now()))
+		require.Equal(t, 200, serve("/configfiles/json/secured/cluster/ns", "secret", time.Now()))
+		require.Equal(t, 200, serve("/configs/secured/cluster/ns?ip=10.0.0.1", "secret", time.Now()))
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		require.Equal(t, 401, serve("/configs/secured/cluster/ns", "", time.Time{}))
+		require.Equal(t, 401, serve("/configs/secured/cluster/ns", "wrong", time.Now()))
+		require.Equal(t, 401, serve("/configs/secured/cluster/ns", "secret", time.Now().Add(-2*time.Minute)))
+		require.Equal(t, 401, serve(`/notifications/v2?appId=secured&cluster=cluster&notifications=[]`, "", time.Time{}))
+	})
+}
+
+func TestOpenAPI(t *testing.T) {
+	// setup apollo
+	a, err := New(context.Background(), Config{ConfigPath: []string{"/dev/null"}})
+	require.EqualError(t, err, "invalid config file")
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
+	r := httprouter.New()
+	a.Routes(r)
+	a.OpenAPIRoutes(r)
+	serve := func(method string, path string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	const ns = "/openapi/v1/envs/DEV/apps/app/clusters/cluster/namespaces"
+
+	t.Run("namespaces", func(t *testing.T) {
+		w := serve("GET", ns, "")
+		require.Equal(t, 200, w.Code)
+		namespaces := []openAPINamespace{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &namespaces))
+		require.Len(t, namespaces, 2)
+		require.Equal(t, "ns", namespaces[0].Namespace)
+		require.Equal(t, "properties", namespaces[0].Format)
+		require.Equal(t, []openAPIItem{{Key: "mysql", Value: "mysql://root@localhost/mysql"}}, namespaces[0].Items)
+
+		w = serve("GET", ns+"/ns2.xml", "")
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `{"appId":"app","clusterName":"cluster","namespaceName":"ns2.xml","format":"xml","isPublic":false,
+			"items":[{"key":"content","value":"plain text"}]}`, w.Body.String())
+		require.Equal(t, 404, serve("GET", ns+"/missing", "").Code)
+	})
+
+	t.Run("items", func(t *testing.T) {
+		require.Equal(t, 200, serve("POST", ns+"/ns/items", `{"key":"k","value":"v","dataChangeCreatedBy":"apollo"}`).Code)
+		require.Equal(t, 400, serve("POST", ns+"/ns/items", `{"key":"k","value":"v"}`).Code)
+		require.Equal(t, 404, serve("PUT", ns+"/ns/items/new", `{"key":"new","value":"v"}`).Code)
+		require.Equal(t, 200, serve("PUT", ns+"/ns/items/new?createIfNotExists=true", `{"key":"new","value":"v"}`).Code)
+		require.Equal(t, 200, serve("PUT", ns+"/ns/items/k", `{"key":"k","value":"v2","dataChangeLastModifiedBy":"apollo"}`).Code)
+		require.Equal(t, 200, serve("DELETE", ns+"/ns/items/mysql?operator=apollo", "").Code)
+		require.Equal(t, 404, serve("DELETE", ns+"/ns/items/mysql?operator=apollo", "").Code)
+
+		w := serve("GET", ns+"/ns/items/k", "")
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `{"key":"k","value":"v2","dataChangeCreatedBy":"apollo","dataChangeLastModifiedBy":"apollo"}`, w.Body.String())
+		// the items are served once released
+		w = serve("GET", "/configfiles/json/app/cluster/ns", "")
+		require.JSONEq(t, `{"mysql":"mysql://root@localhost/mysql"}`, w.Body.String())
+	})
+
+	t.Run("release", func(t *testing.T) {
+		w := serve("POST", ns+"/ns/releases", `{"releaseTitle":"v1","releasedBy":"apollo"}`)
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `{"appId":"app","clusterName":"cluster","namespaceName":"ns","name":"v1",
+			"configurations":{"k":"v2","new":"v"},"comment":""}`, w.Body.String())
+		w = serve("GET", "/configfiles/json/app/cluster/ns", "")
+		require.JSONEq(t, `{"k":"v2","new":"v"}`, w.Body.String())
+		w = serve("GET", ns+"/ns/releases/latest", "")
+		require.Equal(t, 200, w.Code)
+		require.Contains(t, w.Body.String(), `"name":"v1"`)
+
+		// namespaces never released through the OpenAPI are named after their releaseKey
+		w = serve("GET", ns+"/ns2/releases/latest", "")
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `{"appId":"app","clusterName":"cluster","namespaceName":"ns2","name":"abc",
+			"configurations":{},"comment":""}`, w.Body.String())
+	})
+
+	t.Run("release text formats", func(t *testing.T) {
+		require.Equal(t, 200, serve("PUT", ns+"/ns2.xml/items/content", `{"key":"content","value":"<xml/>"}`).Code)
+		require.Equal(t, 200, serve("POST", ns+"/ns2.xml/releases", `{"releaseTitle":"v1"}`).Code)
+		w := serve("GET", "/configfiles/app/cluster/ns2.xml", "")
+		require.Equal(t, "<xml/>", w.Body.String())
+	})
+}
+
+func TestNotifyWindow(t *testing.T) {
+	data, err := yaml.Marshal(stubConfigs[0])
+	require.Nil(t, err)
+	file := filepath.Join(t.TempDir(), "config.yml")
+	require.Nil(t, os.WriteFile(file, data, 0644))
+
+	// setup apollo
+	a, err := New(context.Background(), Config{ConfigPath: []string{file}, PollTimeout: time.Second, NotifyWindow: 100 * time.Millisecond})
+	require.Nil(t, err)
+	r := httprouter.New()
+	a.Routes(r)
+
+	result := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/notifications/v2?appId=app&cluster=cluster&notifications="+
+			url.QueryEscape(`[{"namespaceName":"ns","notificationId":0},{"namespaceName":"ns2","notificationId":0}]`), nil))
+		result <- w
+	}()
+	require.Eventually(t, func() bool {
+		return len(a.snapshotPolls()) == 1
+	}, time.Second, time.Millisecond)
+
+	// the namespaces changed within the window are answered together
+	ns := watcher.Namespace{Properties: map[string]string{"k": "v"}}
+	require.Nil(t, a.Store().Upsert(store.Key{AppID: "app", Cluster: "cluster", Namespace: "ns"}, ns))
+	time.Sleep(10 * time.Millisecond)
+	require.Nil(t, a.Store().Upsert(store.Key{AppID: "app", Cluster: "cluster", Namespace: "ns2"}, ns))
+	w := <-result
+	require.Equal(t, 200, w.Code)
+	notifications := []longpoll.Notification{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &notifications))
+	require.Len(t, notifications, 2)
+}
+
+func TestFaultInjection(t *testing.T) {
+	// setup apollo
+	a, err := New(context.Background(), Config{ConfigPath: []string{"/dev/null"}})
+	require.EqualError(t, err, "invalid config file")
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
+	r := httprouter.New()
+	a.Routes(r)
+	ctrl := httprouter.New()
+	a.CtrlRoutes(ctrl)
+	serve := func(router *httprouter.Router, method string, path string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		require.Equal(t, 400, serve(ctrl, "PUT", "/ctrl/faults", `[{"errorPercent":101}]`).Code)
+		require.Equal(t, 400, serve(ctrl, "PUT", "/ctrl/faults", `[{"delayMs":-1}]`).Code)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		require.Equal(t, 200, serve(ctrl, "PUT", "/ctrl/faults", `[{"paths":["/configs/"],"appIds":["app"],"errorPercent":100}]`).Code)
+		w := serve(ctrl, "GET", "/ctrl/faults", "")
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `[{"paths":["/configs/"],"appIds":["app"],"errorPercent":100}]`, w.Body.String())
+		require.Equal(t, 500, serve(r, "GET", "/configs/app/cluster/ns", "").Code)
+		require.Equal(t, 200, serve(r, "GET", "/configfiles/json/app/cluster/ns", "").Code)
+		require.NotEqual(t, 500, serve(r, "GET", "/configs/other/cluster/ns", "").Code)
+	})
+
+	t.Run("user agent", func(t *testing.T) {
+		require.Equal(t, 200, serve(ctrl, "PUT", "/ctrl/faults", `[{"userAgents":["apollo-client-go/1."],"errorPercent":100}]`).Code)
+		req := func(userAgent string) int {
+			req := httptest.NewRequest("GET", "/configs/app/cluster/ns", nil)
+			req.Header.Set("User-Agent", userAgent)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			return w.Code
+		}
+		require.Equal(t, 500, req("apollo-client-go/1.2.0"))
+		require.Equal(t, 200, req("apollo-client-go/2.0.0"))
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		require.Equal(t, 200, serve(ctrl, "PUT", "/ctrl/faults", `[{"delayMs":50}]`).Code)
+		start := time.Now()
+		require.Equal(t, 200, serve(r, "GET", "/configs/app/cluster/ns", "").Code)
+		require.True(t, time.Since(start) >= 50*time.Millisecond)
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		require.Equal(t, 200, serve(ctrl, "PUT", "/ctrl/faults", `[{"dropPercent":100}]`).Code)
+		require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			serve(r, "GET", "/configs/app/cluster/ns", "")
+		})
+	})
+
+	t.Run("health checks", func(t *testing.T) {
+		require.Equal(t, 200, serve(ctrl, "PUT", "/ctrl/faults", `[{"errorPercent":100}]`).Code)
+		require.Equal(t, 500, serve(r, "GET", "/configs/app/cluster/ns", "").Code)
+		require.Equal(t, 200, serve(r, "GET", "/healthz", "").Code)
+		require.Equal(t, 200, serve(r, "GET", "/readyz", "").Code)
+		require.Equal(t, 200, serve(r, "GET", "/health", "").Code)
+		require.Equal(t, 200, serve(ctrl, "GET", "/ctrl/faults", "").Code)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.Equal(t, 200, serve(ctrl, "DELETE", "/ctrl/faults", "").Code)
+		require.Equal(t, 200, serve(r, "GET", "/configs/app/cluster/ns", "").Code)
+	})
+}
+
+func TestDuplicateWatches(t *testing.T) {
+	a, err := New(context.Background(), Config{ConfigPath: []string{"/dev/null"}, MaxPollsPerIP: 2})
+	require.EqualError(t, err, "invalid config file")
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
+	r := httprouter.New()
+	a.Routes(r)
+	admin := httprouter.New()
+	a.AdminRoutes(admin)
+
+	poll := func(client pollClient, namespaces ...string) *longpoll.Poll {
+		notifications := []longpoll.Notification{}
+		for _, ns := range namespaces {
+			notifications = append(notifications, longpoll.Notification{ID: 0, Namespace: ns})
+		}
+		p, err := longpoll.New(context.Background(), longpoll.Config{Notifications: notifications, Timeout: time.Minute})
+		require.Nil(t, err)
+		require.True(t, a.addPoll(p, client))
+		return p
+	}
+	client := pollClient{AppID: "app", Cluster: "cluster", IP: "10.0.0.1", RemoteIP: "192.0.2.1"}
+	p1 := poll(client, "ns", "ns2")
+	defer a.removePoll(p1)
+	p2 := poll(client, "ns2.properties")
+	defer a.removePoll(p2)
+	p3 := poll(pollClient{AppID: "app", Cluster: "cluster", IP: "10.0.0.2", RemoteIP: "192.0.2.2"}, "ns")
+	defer a.removePoll(p3)
+
+	t.Run("report", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("GET", "/admin/clients/duplicates", nil))
+		require.Equal(t, 200, w.Code)
+		require.JSONEq(t, `[{"appId":"app","cluster":"cluster","ip":"10.0.0.1","polls":2,"namespaces":["ns2"]}]`, w.Body.String())
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/notifications/v2?appId=app&cluster=cluster&notifications="+
+			url.QueryEscape(`[{"namespaceName":"ns","notificationId":0}]`), nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		r.ServeHTTP(w, req)
+		require.Equal(t, 429, w.Code)
+		require.Equal(t, "", w.Header().Get("Retry-After"))
+		require.Equal(t, "too many polls", w.Body.String())
+		require.Len(t, a.snapshotPolls(), 3)
+
+		a.cfg.Backoff = Backoff{RetryAfter: 5 * time.Second}
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		require.Equal(t, 429, w.Code)
+		require.Equal(t, "5", w.Header().Get("Retry-After"))
+		require.Equal(t, "too many polls", w.Body.String())
+	})
+
+	t.Run("released", func(t *testing.T) {
+		a.removePoll(p2)
+		a.removePoll(p2)
+		p4 := poll(client, "ns3")
+		defer a.removePoll(p4)
+		a.mu.RLock()
+		require.Equal(t, map[string]int{"192.0.2.1": 2, "192.0.2.2": 1}, a.ipPolls)
+		a.mu.RUnlock()
+		a.removePoll(p1)
+		a.removePoll(p3)
+		a.removePoll(p4)
+		a.mu.RLock()
+		require.Empty(t, a.ipPolls)
+		a.mu.RUnlock()
+	})
+}
+
+func TestAppWindows(t *testing.T) {
+	at := func(clock string) time.Time {
+		c, err := time.ParseInLocation("15:04", clock, time.Local)
+		require.Nil(t, err)
+		return c
+	}
+
+	t.Run("open", func(t *testing.T) {
+		day := AppWindow{From: 9 * time.Hour, To: 18 * time.Hour}
+		open, _ := day.open(at("12:00"))
+		require.True(t, open)
+		open, wait := day.open(at("18:00"))
+		require.False(t, open)
+		require.Equal(t, 15*time.Hour, wait)
+		open, wait = day.open(at("08:30"))
+		require.False(t, open)
+		require.Equal(t, 30*time.Minute, wait)
+
+		night := AppWindow{From: 22 * time.Hour, To: 6 * time.Hour}
+		open, _ = night.open(at("23:00"))
+		require.True(t, open)
+		open, _ = night.open(at("05:00"))
+		require.True(t, open)
+		open, wait = night.open(at("12:00"))
+		require.False(t, open)
+		require.Equal(t, 10*time.Hour, wait)
+	})
+
+	t.Run("routes", func(t *testing.T) {
+		// the window of app is closed and the one of other is open, whatever the time of the test
+		now := time.Now()
+		tod := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+		clock := func(d time.Duration) time.Duration {
+			return (d + 24*time.Hour) % (24 * time.Hour)
+		}
+		a, err := New(context.Background(), Config{ConfigPath: []string{"/dev/null"}, AppWindows: map[string]AppWindow{
+			"app":    {From: clock(tod + 2*time.Hour), To: clock(tod + 3*time.Hour)},
+			"other":  {From: clock(tod - time.Hour), To: clock(tod + 2*time.Hour)},
+			"closed": {From: clock(tod + 2*time.Hour), To: clock(tod + 3*time.Hour), Status: 403},
+		}})
+		require.EqualError(t, err, "invalid config file")
+		require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
+		r := httprouter.New()
+		a.Routes(r)
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/configs/app/cluster/ns", nil))
+		require.Equal(t, 503, w.Code)
+		require.Equal(t, "out of service window", w.Body.String())
+		retry, err := strconv.Atoi(w.Header().Get("Retry-After"))
+		require.Nil(t, err)
+		require.True(t, retry > 3600 && retry <= 7200, retry)
+
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/services/config?appId=app", nil))
+		require.Equal(t, 503, w.Code)
+
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/configs/closed/cluster/ns", nil))
+		require.Equal(t, 403, w.Code)
+		require.Equal(t, "", w.Header().Get("Retry-After"))
+
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/configs/other/cluster/ns", nil))
+		require.Equal(t, 404, w.Code)
+	})
+}
+
+func TestRedirectMoved(t *testing.T) {
+	a, err := New(context.Background(), Config{ConfigPath: []string{"/dev/null"}, RedirectPrefixes: []string{"/apollo/"}})
+	require.EqualError(t, err, "invalid config file")
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
+	r := httprouter.New()
+	a.Routes(r)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/apollo/configs/app/cluster/ns?ip=10.0.0.1", nil))
+	require.Equal(t, 301, w.Code)
+	require.Equal(t, "/configs/app/cluster/ns?ip=10.0.0.1", w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/apollo/configfiles/json/app/cluster/ns", nil))
+	require.Equal(t, 301, w.Code)
+	require.Equal(t, "/configfiles/json/app/cluster/ns", w.Header().Get("Location"))
+
+	// paths that are no route once moved are still not found
+	for _, path := range []string{"/apollo/unknown", "/apollox/configs/app/cluster/ns", "/other/configs/app/cluster/ns"} {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		require.Equal(t, 404, w.Code, path)
+	}
+}
+
+func TestEnvs(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "app.yaml")
+	require.Nil(t, os.WriteFile(file, []byte(`app:
+  cluster:
+    ns:
+      properties: {k: default}
+envs:
+  DEV:
+    app:
+      cluster:
+        ns:
+          properties: {k: dev}
+  PRO:
+    app:
+      cluster:
+        ns:
+          properties: {k: pro}`), 0644))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, err := New(ctx, Config{ConfigPath: []string{file}, Envs: []string{"dev", "PRO"}})
+	require.Nil(t, err)
+	r := httprouter.New()
+	a.Routes(r)
+	ctrl := httprouter.New()
+	a.CtrlRoutes(ctrl)
+	serve := func(router *httprouter.Router, method string, path string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	t.Run("configs", func(t *testing.T) {
+		require.JSONEq(t, `{"k":"default"}`, serve(r, "GET", "/configfiles/json/app/cluster/ns", "").Body.String())
+		require.JSONEq(t, `{"k":"dev"}`, serve(r, "GET", "/envs/DEV/configfiles/json/app/cluster/ns", "").Body.String())
+		require.JSONEq(t, `{"k":"pro"}`, serve(r, "GET", "/envs/pro/configfiles/json/app/cluster/ns", "").Body.String())
+		require.Equal(t, 404, serve(r, "GET", "/envs/UAT/configfiles/json/app/cluster/ns", "").Code)
+	})
+
+	t.Run("services", func(t *testing.T) {
+		w := serve(r, "GET", "/envs/DEV/services/config?appId=app", "")
+		require.Equal(t, 200, w.Code)
+		rsp := []map[string]interface{}{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &rsp))
+		require.Equal(t, "http://example.com/envs/DEV/", rsp[0]["homepageUrl"])
+	})
+
+	t.Run("ctrl", func(t *testing.T) {
+		require.Equal(t, 200, serve(ctrl, "PUT", "/envs/DEV/ctrl/configs/app/cluster/ns", `{"properties":{"k":"dev2"}}`).Code)
+		require.JSONEq(t, `{"k":"dev2"}`, serve(r, "GET", "/envs/DEV/configfiles/json/app/cluster/ns", "").Body.String())
+		// the other envs are left as they are
+		require.JSONEq(t, `{"k":"default"}`, serve(r, "GET", "/configfiles/json/app/cluster/ns", "").Body.String())
+		require.JSONEq(t, `{"k":"pro"}`, serve(r, "GET", "/envs/PRO/configfiles/json/app/cluster/ns", "").Body.String())
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		// the envs write the shared metrics under their own env label
+		route := "/configfiles/json/:appId/:cluster/:namespace"
+		require.Equal(t, float64(2), a.envs["DEV"].metrics.requests.Value(route, "200"))
+		require.Equal(t, float64(2), a.envs["PRO"].metrics.requests.Value(route, "200"))
+		a.envs["DEV"].metrics.queueDepth.Set(2)
+		a.metrics.queueDepth.Set(0)
+		require.Equal(t, float64(2), a.envs["DEV"].metrics.queueDepth.Value())
+		w := httptest.NewRecorder()
+		a.cfg.Metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		require.Contains(t, w.Body.String(), `mock_apollo_notification_queue_depth{env="DEV"} 2`)
+		require.Contains(t, w.Body.String(), `mock_apollo_notification_queue_depth{env=""} 0`)
+	})
+
+	require.Nil(t, a.Shutdown(ctx))
+}
+
+func TestMirror(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "app.yaml")
+	require.Nil(t, os.WriteFile(file, []byte("app:\n  cluster:\n    ns:\n      properties: {k: v}\n    ns2:\n      properties: {k: v}\n"), 0644))
+	mirrored := make(chan string, 2)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.URL.RequestURI()
+		if r.URL.Path == "/base/configfiles/json/app/cluster/ns" {
+			// the same JSON written otherwise
+			w.Write([]byte(`{ "k": "v" }`))
+			return
+		}
+		w.Write([]byte(`{"k":"other"}`))
+	}))
+	defer mirror.Close()
+	base, err := url.Parse(mirror.URL + "/base/")
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, err := New(ctx, Config{ConfigPath: []string{file}, MirrorURL: base})
+	require.Nil(t, err)
+	r := httprouter.New()
+	a.Routes(r)
+	ctrl := httprouter.New()
+	a.CtrlRoutes(ctrl)
+	serve := func(router *httprouter.Router, method string, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	require.JSONEq(t, `{"k":"v"}`, serve(r, "GET", "/configfiles/json/app/cluster/ns?ip=10.0.0.1").Body.String())
+	require.Equal(t, "/base/configfiles/json/app/cluster/ns?ip=10.0.0.1", <-mirrored)
+	require.JSONEq(t, `{"k":"v"}`, serve(r, "GET", "/configfiles/json/app/cluster/ns2").Body.String())
+	require.Equal(t, "/base/configfiles/json/app/cluster/ns2", <-mirrored)
+
+	report := mirrorReport{}
+	require.Eventually(t, func() bool {
+		require.Nil(t, json.Unmarshal(serve(ctrl, "GET", "/ctrl/mirror").Body.Bytes(), &report))
+		return report.Mirrored == 2
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, 1, report.Matched)
+	require.Equal(t, 1, report.Differed)
+	require.Len(t, report.Diffs, 1)
+	require.Equal(t, "/base/configfiles/json/app/cluster/ns2", report.Diffs[0].URI)
+	require.Equal(t, 200, report.Diffs[0].MirrorStatus)
+	require.JSONEq(t, `{"k":"other"}`, report.Diffs[0].MirrorBody)
+
+	require.Equal(t, 200, serve(ctrl, "DELETE", "/ctrl/mirror").Code)
+	require.Nil(t, json.Unmarshal(serve(ctrl, "GET", "/ctrl/mirror").Body.Bytes(), &report))
+	require.Equal(t, mirrorReport{Diffs: []mirrorDiff{}}, report)
+}
+
+func TestUpstream(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "app.yaml")
+	require.Nil(t, os.WriteFile(file, []byte(`app:
+  cluster:
+    ns:
+      properties: {k: v}
+    ns2:
+      properties: {k: v, k3: v}
+    local:
+      properties: {k: v}`), 0644))
+	var fetched int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetched, 1)
+		switch r.URL.Path {
+		case "/configs/app/cluster/ns":
+			w.Write([]byte(`{"appId":"app","cluster":"cluster","namespaceName":"ns","releaseKey":"other","configurations":{"k":"v"}}`))
+		case "/configs/app/cluster/ns2":
+			w.Write([]byte(`{"configurations":{"k":"secret","k2":"v"}}`))
+		case "/configs/app/cluster/remote":
+			w.Write([]byte(`{"configurations":{}}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer up.Close()
+	base, err := url.Parse(up.URL)
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reg := metrics.NewRegistry()
+	a, err := New(ctx, Config{ConfigPath: []string{file}, Upstream: base, Metrics: reg})
+	require.Nil(t, err)
+	r := httprouter.New()
+	a.Routes(r)
+	admin := httprouter.New()
+	a.AdminRoutes(admin)
+	serve := func(router *httprouter.Router, method string, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+	report := func() upstreamReport {
+		rsp := upstreamReport{}
+		require.Nil(t, json.Unmarshal(serve(admin, "GET", "/admin/upstream").Body.Bytes(), &rsp))
+		return rsp
+	}
+
+	for _, ns := range []string{"ns", "ns2", "local", "remote", "ns"} {
+		serve(r, "GET", "/configs/app/cluster/"+ns)
+	}
+	require.Eventually(t, func() bool {
+		return report().Checked == 4
+	}, time.Second, 10*time.Millisecond)
+	// a namespace is checked once per interval
+	require.Equal(t, int32(4), atomic.LoadInt32(&fetched))
+
+	rsp := report()
+	require.Equal(t, 1, rsp.Matched)
+	require.Equal(t, 3, rsp.Diverged)
+	for i := range rsp.Divergences {
+		rsp.Divergences[i].Checked = time.Time{}
+	}
+	require.Equal(t, []upstreamDivergence{
+		{Key: store.Key{AppID: "app", Cluster: "cluster", Namespace: "local"}, MissingUpstream: true},
+		{Key: store.Key{AppID: "app", Cluster: "cluster", Namespace: "ns2"}, Missing: []string{"k2"}, Extra: []string{"k3"}, Changed: []string{"k"}},
+		{Key: store.Key{AppID: "app", Cluster: "cluster", Namespace: "remote"}, MissingLocally: true},
+	}, rsp.Divergences)
+	require.Equal(t, float64(3), a.metrics.upstreamDiverged.Value())
+	require.Equal(t, float64(1), a.metrics.upstreamChecks.Value("match"))
+
+	require.Equal(t, 200, serve(admin, "DELETE", "/admin/upstream").Code)
+	require.Equal(t, upstreamReport{Divergences: []upstreamDivergence{}}, report())
+
+	t.Run("due", func(t *testing.T) {
+		u := newUpstream(base, time.Minute)
+		now := time.Now()
+		key := func(i int) store.Key {
+			return store.Key{AppID: "app", Cluster: "cluster", Namespace: strconv.Itoa(i)}
+		}
+		for i := 0; i < upstreamMaxChecked; i++ {
+			require.True(t, u.due(key(i), false, now))
+		}
+		require.False(t, u.due(key(0), true, now))
+		// the namespaces not served are no longer checked, the served ones still are
+		require.False(t, u.due(key(upstreamMaxChecked), false, now))
+		require.True(t, u.due(key(upstreamMaxChecked+1), true, now))
+		// the namespaces checked before the interval are swept
+		now = now.Add(time.Minute)
+		require.True(t, u.due(key(upstreamMaxChecked), false, now))
+		require.Len(t, u.checked, 1)
+	})
+}
+
+func TestCompression(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "app.yaml")
+	require.Nil(t, os.WriteFile(file, []byte("app:\n  cluster:\n    ns:\n      releaseKey: abc\n      properties: {k: v}\n"), 0644))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serve := func(cfg Config, path string, encoding string) *httptest.ResponseRecorder {
+		cfg.ConfigPath = []string{file}
+		a, err := New(ctx, cfg)
+		require.Nil(t, err)
+		r := httprouter.New()
+		a.Routes(r)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		r.ServeHTTP(w, req)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) string {
+		var r io.Reader
+		var err error
+		switch w.Header().Get("Content-Encoding") {
+		case "gzip":
+			r, err = gzip.NewReader(w.Body)
+		case "deflate":
+			r, err = zlib.NewReader(w.Body)
+		default:
+			r = w.Body
+		}
+		require.Nil(t, err)
+		b, err := io.ReadAll(r)
+		require.Nil(t, err)
+		return string(b)
+	}
+
+	for encoding, want := range map[string]string{
+		"gzip":                         "gzip",
+		"deflate, gzip;q=0":            "deflate",
+		"br, deflate;q=0.5, gzip":      "gzip",
+		"identity":                     "",
+		"":                             "",
+		"gzip;q=0, deflate;q=0, *;q=0": "",
+		"*":                            "gzip",
+		"gzip;q=0, *":                  "deflate",
+		"gzip;q=0, deflate;q=0, *":     "",
+	} {
+		w := serve(Config{}, "/configfiles/json/app/cluster/ns", encoding)
+		require.Equal(t, 200, w.Code, encoding)
+		require.Equal(t, want, w.Header().Get("Content-Encoding"), encoding)
+		require.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+		require.JSONEq(t, `{"k":"v"}`, decode(w), encoding)
+	}
+
+	t.Run("min size", func(t *testing.T) {
+		w := serve(Config{CompressionMinSize: 1024}, "/configs/app/cluster/ns", "gzip")
+		require.Equal(t, "", w.Header().Get("Content-Encoding"))
+		require.Contains(t, w.Body.String(), `"releaseKey":"abc"`)
+		// responses without a body keep their status
+		w = serve(Config{}, "/configs/app/cluster/ns?releaseKey=abc", "gzip")
+		require.Equal(t, 304, w.Code)
+		require.Equal(t, "", w.Header().Get("Content-Encoding"))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		w := serve(Config{DisableCompression: true}, "/configfiles/json/app/cluster/ns", "gzip")
+		require.Equal(t, "", w.Header().Get("Content-Encoding"))
+		require.JSONEq(t, `{"k":"v"}`, w.Body.String())
+	})
+}
+
+func TestSoak(t *testing.T) {
+	s := newSoak(3)
+	now := time.Now()
+	sample := func(goroutines int, fds int, polls int) soakSample {
+		now = now.Add(time.Minute)
+		return soakSample{Time: now, Goroutines: goroutines, OpenFDs: fds, Polls: polls}
+	}
+	require.Empty(t, s.add(sample(10, 5, 1)))
+	require.Empty(t, s.add(sample(12, -1, 0)))
+	// growth is only flagged over a full window of samples never decreasing
+	require.Equal(t, []string{"goroutines"}, s.add(sample(12, 6, 2)))
+	require.Equal(t, []string{"goroutines"}, s.status().Growing)
+	// samples that could not be read are never growing
+	require.Equal(t, []string{"polls"}, s.add(sample(13, 7, 3)))
+	require.Equal(t, []string{"goroutines", "polls"}, s.status().Growing)
+	require.Equal(t, []string{"openFds"}, s.add(sample(11, 8, 3)))
+	require.Equal(t, []string{"openFds", "polls"}, s.status().Growing)
+	require.Len(t, s.status().Samples, 3)
+
+	a, err := New(context.Background(), Config{ConfigPath: []string{"/dev/null"}, SoakInterval: time.Hour})
+	require.EqualError(t, err, "invalid config file")
+	a.sampleSoak(time.Now())
+	admin := httprouter.New()
+	a.AdminRoutes(admin)
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/admin/status", nil))
+	status := configStatus{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+	require.Len(t, status.Soak.Samples, 1)
+	require.Greater(t, status.Soak.Samples[0].Goroutines, 0)
+	require.Equal(t, []string{}, status.Soak.Growing)
+}
+
+func TestDashboard(t *testing.T) {
+	a, err := New(context.Background(), Config{ConfigPath: []string{"/dev/null"}})
+	require.EqualError(t, err, "invalid config file")
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
+	admin := httprouter.New()
+	a.AdminRoutes(admin)
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", "/admin/ui", nil))
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Contains(t, w.Body.String(), "<td>ns2</td>")
+	require.Contains(t, w.Body.String(), "mysql=mysql://root@localhost/mysql")
+	require.Contains(t, w.Body.String(), "no open poll")
+
+	notify := func(namespace string) int {
+		form := url.Values{"appId": {"app"}, "cluster": {"cluster"}, "namespace": {namespace}}
+		req := httptest.NewRequest("POST", "/admin/ui/notify", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w.Code
+	}
+	k := store.Key{AppID: "app", Cluster: "cluster", Namespace: "ns"}
+	// wait for the changes of SetConfig
+	require.Eventually(t, func() bool {
+		_, ok := a.notificationIDs.get(k)
+		_, ok2 := a.notificationIDs.get(store.Key{AppID: "app", Cluster: "cluster", Namespace: "ns2"})
+		return ok && ok2
+	}, time.Second, 10*time.Millisecond)
+	id, _ := a.notificationIDs.get(k)
+	require.Equal(t, 404, notify("ns404"))
+	require.Equal(t, 303, notify("ns"))
+	require.Eventually(t, func() bool {
+		next, _ := a.notificationIDs.get(k)
+		return next > id
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRecoverPanic(t *testing.T) {
+	a, err := New(context.Background(), Config{ConfigPath: []string{"/dev/null"}, HandlerTimeout: time.Second})
+	require.EqualError(t, err, "invalid config file")
+	require.Nil(t, a.w[0].SetConfig(stubConfigs[0]))
+	r := httprouter.New()
+	a.Routes(r)
+	r.GET("/panic", a.instrument("/panic", a.withDeadline(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		panic("bug")
+	})))
+	r.GET("/abort", a.instrument("/abort", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		panic(http.ErrAbortHandler)
+	}))
+	serve := func(path string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	// the panic of a handler is answered with a 500, the other requests are still served
+	require.Equal(t, 500, serve("/panic"))
+	require.Equal(t, float64(1), a.metrics.panics.Value())
+	require.Equal(t, float64(1), a.metrics.requests.Value("/panic", "500"))
+	require.Equal(t, 200, serve("/configs/app/cluster/ns"))
+
+	// the connection is still dropped on purpose
+	require.PanicsWithValue(t, http.ErrAbortHandler, func() { serve("/abort") })
+	require.Equal(t, float64(1), a.metrics.panics.Value())
+	require.Equal(t, float64(1), a.metrics.requests.Value("/abort", "444"))
 }
@@ -0,0 +1,121 @@
+package apollo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// ServiceConfig customizes the service discovery response of /services/config,
+// {host} and {port} in the instance ids, homepage URLs and string fields are replaced by the hostname and the config port
+type ServiceConfig struct {
+	// AppName is the name of the config service, defaults to APOLLO-CONFIGSERVICE
+	AppName string
+	// InstanceID is the format of the instance id, defaults to {host}:apollo-configservice:{port}
+	InstanceID string
+	// Fields are added to the response, e.g. dataCenter or port expected by some SDK forks,
+	// they don't replace appName, instanceId and homepageUrl
+	Fields map[string]interface{}
+	// Instances are the listed config services, so that the clients balancing their requests
+	// across them can be tested. Empty lists the mock itself as InstanceID
+	Instances []ServiceInstance
+}
+
+// ServiceInstance is a config service listed by /services/config
+type ServiceInstance struct {
+	InstanceID string
+	// HomepageURL is the base URL the clients send their requests to, empty means the mock itself
+	HomepageURL string
+	// Weight is added to the response as weight for the clients picking the instances by weight,
+	// 0 leaves it out
+	Weight int
+}
+
+func validateServiceConfig(cfg *ServiceConfig) {
+	if cfg.AppName == "" {
+		cfg.AppName = "APOLLO-CONFIGSERVICE"
+	}
+	if cfg.InstanceID == "" {
+		cfg.InstanceID = "{host}:apollo-configservice:{port}"
+	}
+}
+
+func (a *Apollo) queryService(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	log := a.cfg.Log.Get()
+	host, err := os.Hostname()
+	if err != nil {
+		log.Warn(err.Error())
+		host = "localhost"
+	}
+	expand := strings.NewReplacer("{host}", host, "{port}", strconv.Itoa(a.cfg.Port)).Replace
+
+	instances := a.cfg.Service.Instances
+	if len(instances) == 0 {
+		instances = []ServiceInstance{{InstanceID: a.cfg.Service.InstanceID}}
+	}
+	svcs := make([]map[string]interface{}, 0, len(instances))
+	for _, i := range instances {
+		svc := make(map[string]interface{}, len(a.cfg.Service.Fields)+4)
+		for k, v := range a.cfg.Service.Fields {
+			if s, ok := v.(string); ok {
+				v = expand(s)
+			}
+			svc[k] = v
+		}
+		svc["appName"] = a.cfg.Service.AppName
+		svc["instanceId"] = expand(i.InstanceID)
+		if i.HomepageURL != "" {
+			svc["homepageUrl"] = expand(i.HomepageURL)
+		} else {
+			// the clients of an env are sent to its routes
+			svc["homepageUrl"] = fmt.Sprintf("%s://%s/%s", a.advertiseScheme(r), advertiseHost(r), a.envPath())
+		}
+		if i.Weight > 0 {
+			svc["weight"] = i.Weight
+		}
+		svcs = append(svcs, svc)
+	}
+	json, err := json.Marshal(svcs)
+	if err != nil {
+		log.Error(err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", a.contentType(r, "application/json"))
+	w.Write(json)
+	log.Debug(fmt.Sprintf("served service for request: %s", r.URL.String()))
+}
+
+// advertiseScheme returns the scheme clients reached the server with, so that clients
+// behind a TLS terminating ingress keep using it instead of bypassing the ingress
+func (a *Apollo) advertiseScheme(r *http.Request) string {
+	if a.cfg.AdvertiseScheme != "" {
+		return a.cfg.AdvertiseScheme
+	}
+	if proto := forwardedValue(r, "X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		return proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// advertiseHost returns the host clients reached the server with
+func advertiseHost(r *http.Request) string {
+	if host := forwardedValue(r, "X-Forwarded-Host"); host != "" {
+		return host
+	}
+	return r.Host
+}
+
+// forwardedValue returns the value of a forwarded header set by the first proxy
+func forwardedValue(r *http.Request, header string) string {
+	v := strings.SplitN(r.Header.Get(header), ",", 2)[0]
+	return strings.ToLower(strings.TrimSpace(v))
+}
@@ -0,0 +1,157 @@
+package apollo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+	"gopkg.in/yaml.v2"
+)
+
+// snapshotLayout names the snapshot files by their UTC time, so that they sort chronologically
+const snapshotLayout = "20060102T150405.000Z"
+
+// snapshotter periodically writes the served config to timestamped files of a directory,
+// keeping the latest ones
+type snapshotter struct {
+	mu     sync.Mutex
+	dir    string
+	retain int
+	// last is the content of the latest snapshot, an unchanged config is not written again
+	last []byte
+}
+
+func newSnapshotter(dir string, retain int) *snapshotter {
+	return &snapshotter{dir: dir, retain: retain}
+}
+
+// run writes a snapshot every interval until ctx is done
+func (s *snapshotter) run(ctx context.Context, interval time.Duration, served func() watcher.ConfigMap, onError func(error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			if err := s.write(served(), now); err != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// write persists cm as the snapshot of now unless it is the same as the latest snapshot,
+// the files beyond the retained ones are removed
+func (s *snapshotter) write(cm watcher.ConfigMap, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(cm)
+	if err != nil {
+		return err
+	}
+	if s.last != nil && bytes.Equal(b, s.last) {
+		return nil
+	}
+	f, err := os.CreateTemp(s.dir, ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	name := filepath.Join(s.dir, "snapshot-"+now.UTC().Format(snapshotLayout)+".yaml")
+	if err := os.Rename(f.Name(), name); err != nil {
+		return err
+	}
+	s.last = b
+	return s.prune()
+}
+
+// prune removes the oldest snapshots beyond the retained ones, 0 retains all
+func (s *snapshotter) prune() error {
+	if s.retain <= 0 {
+		return nil
+	}
+	files, err := s.list()
+	if err != nil {
+		return err
+	}
+	for len(files) > s.retain {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// list returns the snapshot files from the oldest to the latest
+func (s *snapshotter) list() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, e := range entries {
+		if name := e.Name(); strings.HasPrefix(name, "snapshot-") && strings.HasSuffix(name, ".yaml") {
+			files = append(files, filepath.Join(s.dir, name))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// servedConfig returns the namespaces currently served by the store, with the served releaseKeys
+func (a *Apollo) servedConfig() watcher.ConfigMap {
+	cm := watcher.ConfigMap{}
+	for _, k := range a.store.List() {
+		ns, err := a.getNamespace(k.AppID, k.Cluster, k.Namespace)
+		if err != nil {
+			continue
+		}
+		if cm[k.AppID] == nil {
+			cm[k.AppID] = make(map[string]map[string]watcher.Namespace)
+		}
+		if cm[k.AppID][k.Cluster] == nil {
+			cm[k.AppID][k.Cluster] = make(map[string]watcher.Namespace)
+		}
+		cm[k.AppID][k.Cluster][k.Namespace] = ns
+	}
+	return cm
+}
+
+// runSnapshots writes the served config to SnapshotDir at startup and every SnapshotInterval until ctx is done
+func (a *Apollo) runSnapshots(ctx context.Context) {
+	a.writeSnapshot()
+	a.snapshots.run(ctx, a.cfg.SnapshotInterval, a.servedConfig, a.snapshotError)
+}
+
+// writeSnapshot writes the served config to SnapshotDir right away, if snapshots are enabled
+func (a *Apollo) writeSnapshot() {
+	if a.snapshots == nil {
+		return
+	}
+	if err := a.snapshots.write(a.servedConfig(), time.Now()); err != nil {
+		a.snapshotError(err)
+	}
+}
+
+func (a *Apollo) snapshotError(err error) {
+	a.cfg.Log.Get().Warn(fmt.Sprintf("error writing config snapshot: %v", err))
+}
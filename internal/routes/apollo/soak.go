@@ -0,0 +1,139 @@
+package apollo
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// soakSample is a reading of the resources that leak in a long run
+type soakSample struct {
+	Time       time.Time `json:"time"`
+	Goroutines int       `json:"goroutines"`
+	// OpenFDs is -1 where the open file descriptors can't be counted
+	OpenFDs int `json:"openFds"`
+	Polls   int `json:"polls"`
+}
+
+// soakStatus lists the latest samples along with the resources that grew over all of them
+type soakStatus struct {
+	Samples []soakSample `json:"samples"`
+	Growing []string     `json:"growing"`
+}
+
+// soak keeps the latest samples of a long run, to tell leaks from the usual variations
+type soak struct {
+	mu      sync.Mutex
+	size    int
+	samples []soakSample
+	growing []string
+}
+
+func newSoak(size int) *soak {
+	return &soak{size: size, growing: []string{}}
+}
+
+// add records a sample and returns the resources that started growing with it
+func (s *soak) add(sample soakSample) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples = append(s.samples, sample)
+	if len(s.samples) > s.size {
+		s.samples = s.samples[len(s.samples)-s.size:]
+	}
+	was := make(map[string]bool, len(s.growing))
+	for _, r := range s.growing {
+		was[r] = true
+	}
+	s.growing = []string{}
+	var started []string
+	for _, r := range []struct {
+		name  string
+		value func(soakSample) int
+	}{
+		{"goroutines", func(s soakSample) int { return s.Goroutines }},
+		{"openFds", func(s soakSample) int { return s.OpenFDs }},
+		{"polls", func(s soakSample) int { return s.Polls }},
+	} {
+		if growing(s.samples, s.size, r.value) {
+			s.growing = append(s.growing, r.name)
+			if !was[r.name] {
+				started = append(started, r.name)
+			}
+		}
+	}
+	return started
+}
+
+// growing returns whether value never decreased over a full window of samples and ended up higher,
+// values that could not be sampled are never growing
+func growing(samples []soakSample, size int, value func(soakSample) int) bool {
+	if len(samples) < size || size < 2 {
+		return false
+	}
+	for i := range samples {
+		if value(samples[i]) < 0 || (i > 0 && value(samples[i]) < value(samples[i-1])) {
+			return false
+		}
+	}
+	return value(samples[len(samples)-1]) > value(samples[0])
+}
+
+func (s *soak) status() *soakStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &soakStatus{
+		Samples: append([]soakSample{}, s.samples...),
+		Growing: append([]string{}, s.growing...),
+	}
+}
+
+// openFDs returns the number of open file descriptors of the process, -1 if it can't be counted
+func openFDs() int {
+	d, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return -1
+	}
+	// the descriptor reading the directory is not counted
+	return len(names) - 1
+}
+
+// sampleSoak records the resources of the process and warns about the ones that started growing
+func (a *Apollo) sampleSoak(now time.Time) {
+	a.mu.RLock()
+	polls := len(a.polls)
+	a.mu.RUnlock()
+	started := a.soak.add(soakSample{
+		Time:       now,
+		Goroutines: runtime.NumGoroutine(),
+		OpenFDs:    openFDs(),
+		Polls:      polls,
+	})
+	if len(started) > 0 {
+		a.cfg.Log.Get().Warn(fmt.Sprintf("possible leak, growing over the last %d samples: %s",
+			a.soak.size, strings.Join(started, ", ")))
+	}
+}
+
+// runSoak samples the resources of the process every SoakInterval until ctx is done
+func (a *Apollo) runSoak(ctx context.Context) {
+	t := time.NewTicker(a.cfg.SoakInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			a.sampleSoak(now)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package apollo
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+	"github.com/julienschmidt/httprouter"
+)
+
+// parseWarnings tracks the namespaces counted by the parse warnings metric,
+// so that the ones no longer warned about are reset
+type parseWarnings struct {
+	mu   sync.Mutex
+	keys map[[3]string]bool
+}
+
+// updateParseWarnings sets the parse warnings metric from the files of the live config
+func (a *Apollo) updateParseWarnings() {
+	counts := make(map[[3]string]int)
+	for _, w := range a.watchers() {
+		for _, warn := range w.Status().Warnings {
+			counts[[3]string{warn.AppID, warn.Cluster, warn.Namespace}]++
+		}
+	}
+	a.warnings.mu.Lock()
+	defer a.warnings.mu.Unlock()
+	for k := range a.warnings.keys {
+		if counts[k] == 0 {
+			a.metrics.parseWarnings.Set(0, k[:]...)
+		}
+	}
+	a.warnings.keys = make(map[[3]string]bool, len(counts))
+	for k, n := range counts {
+		a.metrics.parseWarnings.Set(float64(n), k[:]...)
+		a.warnings.keys[k] = true
+	}
+}
+
+type configStatus struct {
+	Polls int              `json:"polls"`
+	Files []watcher.Status `json:"files"`
+	// Warnings are the namespaces of all files whose content failed to parse
+	Warnings []watcher.Warning `json:"warnings"`
+	// Soak is nil unless the resources of the process are sampled
+	Soak *soakStatus `json:"soak,omitempty"`
+}
+
+func (a *Apollo) getStatus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s := configStatus{
+		Polls:    int(atomic.LoadInt64(&a.npolls)),
+		Files:    []watcher.Status{},
+		Warnings: []watcher.Warning{},
+	}
+	for _, fw := range a.watchers() {
+		st := fw.Status()
+		s.Files = append(s.Files, st)
+		s.Warnings = append(s.Warnings, st.Warnings...)
+	}
+	if a.soak != nil {
+		s.Soak = a.soak.status()
+	}
+	json, err := json.Marshal(&s)
+	if err != nil {
+		a.cfg.Log.Get().Error(err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
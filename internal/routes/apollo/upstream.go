@@ -0,0 +1,265 @@
+package apollo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/figroc/mock-apollo-go/pkg/store"
+	"github.com/julienschmidt/httprouter"
+)
+
+// upstreamMaxBody is the max size of the answers of the upstream
+const upstreamMaxBody = 1 << 20
+
+// upstreamMaxChecked is the number of namespaces checked per interval above which the namespaces
+// not served by the mock are no longer checked, so that requests with arbitrary names do not flood the upstream
+const upstreamMaxChecked = 1024
+
+// upstreamDivergence is a namespace served otherwise by the upstream, listing the keys that differ.
+// The values are left out as the ones of the upstream may be production secrets
+type upstreamDivergence struct {
+	store.Key
+	// MissingLocally is set if only the upstream serves the namespace, MissingUpstream if only the mock does
+	MissingLocally  bool      `json:"missingLocally,omitempty"`
+	MissingUpstream bool      `json:"missingUpstream,omitempty"`
+	Missing         []string  `json:"missing,omitempty"`
+	Extra           []string  `json:"extra,omitempty"`
+	Changed         []string  `json:"changed,omitempty"`
+	Checked         time.Time `json:"checked"`
+}
+
+// upstreamReport counts the checks of the served namespaces along with the ones diverging
+type upstreamReport struct {
+	Checked     int                  `json:"checked"`
+	Matched     int                  `json:"matched"`
+	Diverged    int                  `json:"diverged"`
+	Failed      int                  `json:"failed"`
+	Divergences []upstreamDivergence `json:"divergences"`
+}
+
+// upstream compares the served namespaces with the answers of a real Apollo, so that fixtures do not silently
+// drift from it. A namespace is checked at most once per interval, asynchronously to the requests serving it
+type upstream struct {
+	base     *url.URL
+	interval time.Duration
+	client   *http.Client
+	mu       sync.Mutex
+	// checked are the namespaces checked within the interval, the older ones are swept once per interval
+	checked  map[store.Key]time.Time
+	swept    time.Time
+	diverged map[store.Key]upstreamDivergence
+	report   upstreamReport
+}
+
+func newUpstream(base *url.URL, interval time.Duration) *upstream {
+	return &upstream{
+		base:     base,
+		interval: interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		checked:  make(map[store.Key]time.Time),
+		diverged: make(map[store.Key]upstreamDivergence),
+	}
+}
+
+// due returns whether the namespace is to be checked now, marking it checked.
+// A namespace not served by the mock is only checked while fewer than upstreamMaxChecked were checked in the interval
+func (u *upstream) due(k store.Key, served bool, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if now.Sub(u.swept) >= u.interval {
+		for key, last := range u.checked {
+			if now.Sub(last) >= u.interval {
+				delete(u.checked, key)
+			}
+		}
+		u.swept = now
+	}
+	last, ok := u.checked[k]
+	if ok && now.Sub(last) < u.interval {
+		return false
+	}
+	if !ok && !served && len(u.checked) >= upstreamMaxChecked {
+		return false
+	}
+	u.checked[k] = now
+	return true
+}
+
+// withUpstream checks the namespace of the requests served by h against the upstream once they are answered
+func (a *Apollo) withUpstream(h httprouter.Handle) httprouter.Handle {
+	if a.upstream == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		h(w, r, ps)
+		// the namespace is keyed with its extension, which selects the compared format
+		k := store.Key{AppID: ps.ByName("appId"), Cluster: ps.ByName("cluster"), Namespace: ps.ByName("namespace")}
+		name, _ := a.parseNamespace(k.Namespace)
+		_, err := a.getNamespace(k.AppID, k.Cluster, name)
+		if a.upstream.due(k, err == nil, time.Now()) {
+			go a.checkUpstream(k)
+		}
+	}
+}
+
+// checkUpstream compares the configurations of a namespace with the ones of the upstream
+func (a *Apollo) checkUpstream(k store.Key) {
+	name, ext := a.parseNamespace(k.Namespace)
+	var local map[string]string
+	if ns, err := a.getNamespace(k.AppID, k.Cluster, name); err == nil {
+		cfg, _ := a.getNamespaceConfig(ext, ns)
+		local, _ = cfg.(map[string]string)
+	}
+	remote, err := a.fetchUpstream(k)
+	if err != nil {
+		a.cfg.Log.Get().Warn(fmt.Sprintf("error checking %s/%s/%s upstream: %v", k.AppID, k.Cluster, k.Namespace, err))
+		a.metrics.upstreamChecks.Inc("error")
+		a.upstream.mu.Lock()
+		a.upstream.report.Checked++
+		a.upstream.report.Failed++
+		a.upstream.mu.Unlock()
+		return
+	}
+
+	d := upstreamDivergence{Key: k, Checked: time.Now()}
+	switch {
+	case local == nil && remote == nil:
+	case local == nil:
+		d.MissingLocally = true
+	case remote == nil:
+		d.MissingUpstream = true
+	default:
+		for key, v := range remote {
+			if lv, ok := local[key]; !ok {
+				d.Missing = append(d.Missing, key)
+			} else if lv != v {
+				d.Changed = append(d.Changed, key)
+			}
+		}
+		for key := range local {
+			if _, ok := remote[key]; !ok {
+				d.Extra = append(d.Extra, key)
+			}
+		}
+		sort.Strings(d.Missing)
+		sort.Strings(d.Extra)
+		sort.Strings(d.Changed)
+	}
+	ok := !d.MissingLocally && !d.MissingUpstream && len(d.Missing)+len(d.Extra)+len(d.Changed) == 0
+
+	u := a.upstream
+	u.mu.Lock()
+	u.report.Checked++
+	if ok {
+		u.report.Matched++
+		delete(u.diverged, k)
+	} else {
+		u.report.Diverged++
+		u.diverged[k] = d
+	}
+	a.metrics.upstreamDiverged.Set(float64(len(u.diverged)))
+	u.mu.Unlock()
+	if ok {
+		a.metrics.upstreamChecks.Inc("match")
+		return
+	}
+	a.metrics.upstreamChecks.Inc("diverge")
+	a.cfg.Log.Get().Warn(fmt.Sprintf("namespace %s/%s/%s diverges from upstream", k.AppID, k.Cluster, k.Namespace))
+}
+
+// fetchUpstream returns the configurations of a namespace served by the upstream, nil if it is not found.
+// Requests of the apps with access keys are signed with the first one
+func (a *Apollo) fetchUpstream(k store.Key) (map[string]string, error) {
+	path := "/" + a.envPath() + "configs/" + url.PathEscape(k.AppID) + "/" + url.PathEscape(k.Cluster) + "/" + url.PathEscape(k.Namespace)
+	u := *a.upstream.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = ""
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if secrets := a.accessKeys(k.AppID); len(secrets) > 0 {
+		timestamp := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+		req.Header.Set("Timestamp", timestamp)
+		req.Header.Set("Authorization", "Apollo "+k.AppID+":"+signature(timestamp, req.URL.EscapedPath(), secrets[0]))
+	}
+	rsp, err := a.upstream.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	switch rsp.StatusCode {
+	case 200:
+	case 404:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %d", rsp.StatusCode)
+	}
+	body := struct {
+		Configurations map[string]string `json:"configurations"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(rsp.Body, upstreamMaxBody)).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.Configurations == nil {
+		body.Configurations = map[string]string{}
+	}
+	return body.Configurations, nil
+}
+
+// getUpstream reports the checks of the served namespaces along with the ones diverging from the upstream
+func (a *Apollo) getUpstream(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if a.upstream == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("no upstream"))
+		return
+	}
+	u := a.upstream
+	u.mu.Lock()
+	report := u.report
+	report.Divergences = make([]upstreamDivergence, 0, len(u.diverged))
+	for _, d := range u.diverged {
+		report.Divergences = append(report.Divergences, d)
+	}
+	u.mu.Unlock()
+	sort.Slice(report.Divergences, func(i, j int) bool {
+		x, y := report.Divergences[i].Key, report.Divergences[j].Key
+		if x.AppID != y.AppID {
+			return x.AppID < y.AppID
+		}
+		if x.Cluster != y.Cluster {
+			return x.Cluster < y.Cluster
+		}
+		return x.Namespace < y.Namespace
+	})
+	json, err := json.Marshal(report)
+	if err != nil {
+		a.cfg.Log.Get().Error(err.Error())
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(json)
+}
+
+// deleteUpstream resets the report, the namespaces are checked again on their next request
+func (a *Apollo) deleteUpstream(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if a.upstream != nil {
+		u := a.upstream
+		u.mu.Lock()
+		u.checked = make(map[store.Key]time.Time)
+		u.diverged = make(map[store.Key]upstreamDivergence)
+		u.report = upstreamReport{}
+		a.metrics.upstreamDiverged.Set(0)
+		u.mu.Unlock()
+	}
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,63 @@
+package apollo
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+)
+
+// placeholder matches the {{.Name}} placeholders in the served config
+var placeholder = regexp.MustCompile(`{{\s*\.(\w+)\s*}}`)
+
+// requestVars are the values substituted for the placeholders of a request
+type requestVars map[string]string
+
+func newRequestVars(appID string, cluster string, namespace string, r *http.Request) requestVars {
+	return requestVars{
+		"AppID":     appID,
+		"Cluster":   cluster,
+		"Namespace": namespace,
+		"ClientIP":  clientIP(r),
+	}
+}
+
+func (v requestVars) expand(s string) string {
+	if !strings.Contains(s, "{{") {
+		return s
+	}
+	return placeholder.ReplaceAllStringFunc(s, func(m string) string {
+		// unknown placeholders are served as is
+		if value, ok := v[placeholder.FindStringSubmatch(m)[1]]; ok {
+			return value
+		}
+		return m
+	})
+}
+
+// expandVars returns ns with the placeholders substituted by the values of the request,
+// so that one namespace serves distinct values per client
+func expandVars(ns watcher.Namespace, vars requestVars) watcher.Namespace {
+	var props map[string]string
+	for k, v := range ns.Properties {
+		if e := vars.expand(v); e != v {
+			if props == nil {
+				// the namespace is shared, so the values are substituted in a copy
+				props = make(map[string]string, len(ns.Properties))
+				for k, v := range ns.Properties {
+					props[k] = v
+				}
+			}
+			props[k] = e
+		}
+	}
+	if props != nil {
+		ns.Properties = props
+	}
+	ns.Yml = vars.expand(ns.Yml)
+	ns.Yaml = vars.expand(ns.Yaml)
+	ns.JSON = vars.expand(ns.JSON)
+	ns.XML = vars.expand(ns.XML)
+	return ns
+}
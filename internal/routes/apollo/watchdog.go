@@ -0,0 +1,86 @@
+package apollo
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lockHealth is the result of the latest lock acquisition sample
+type lockHealth struct {
+	Healthy bool      `json:"healthy"`
+	Wait    string    `json:"wait"`
+	Sampled time.Time `json:"sampled"`
+}
+
+// watchdog periodically samples how long it takes to acquire a lock,
+// so that a deadlock is reported without blocking the caller
+type watchdog struct {
+	mu      sync.Mutex
+	lock    sync.Locker
+	timeout time.Duration
+	pending int32
+	health  lockHealth
+}
+
+func newWatchdog(lock sync.Locker, timeout time.Duration) *watchdog {
+	return &watchdog{
+		lock:    lock,
+		timeout: timeout,
+		health:  lockHealth{Healthy: true},
+	}
+}
+
+// run samples the lock every interval until ctx is done
+func (d *watchdog) run(ctx context.Context, interval time.Duration, onStuck func(string)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if h := d.sample(); !h.Healthy {
+				onStuck(fmt.Sprintf("lock not acquired within %s", d.timeout))
+			}
+		}
+	}
+}
+
+// sample tries to acquire the lock within the timeout
+func (d *watchdog) sample() lockHealth {
+	// only one probe may be blocked on the lock at a time
+	if !atomic.CompareAndSwapInt32(&d.pending, 0, 1) {
+		return d.set(false, d.timeout)
+	}
+	start := time.Now()
+	acquired := make(chan struct{})
+	go func() {
+		d.lock.Lock()
+		d.lock.Unlock()
+		atomic.StoreInt32(&d.pending, 0)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		return d.set(true, time.Since(start))
+	case <-time.After(d.timeout):
+		return d.set(false, time.Since(start))
+	}
+}
+
+func (d *watchdog) set(healthy bool, wait time.Duration) lockHealth {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.health = lockHealth{Healthy: healthy, Wait: wait.String(), Sampled: time.Now()}
+	return d.health
+}
+
+// current returns the latest lock sample
+func (d *watchdog) current() lockHealth {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.health
+}
@@ -0,0 +1,72 @@
+package apollo
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// AppWindow is the daily service window of an appId, its requests are refused outside of it
+// so that the clients can be verified through the downtime of the config service
+type AppWindow struct {
+	// From and To are the times of day the window opens and closes in the local time zone,
+	// as durations since midnight. A window closing before it opens spans midnight
+	From time.Duration
+	To   time.Duration
+	// Status answers the requests outside of the window, 403 or 503, 0 means 503
+	Status int
+}
+
+// open returns whether the window is open at t, or else how long until it opens
+func (w AppWindow) open(t time.Time) (bool, time.Duration) {
+	day := 24 * time.Hour
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+	var open bool
+	if w.From <= w.To {
+		open = tod >= w.From && tod < w.To
+	} else {
+		open = tod >= w.From || tod < w.To
+	}
+	if open {
+		return true, 0
+	}
+	return false, ((w.From-tod)%day + day) % day
+}
+
+// withWindow refuses the requests of the appIds outside of their service windows,
+// the 503 carries a Retry-After of the time until the window opens
+func (a *Apollo) withWindow(h httprouter.Handle) httprouter.Handle {
+	if len(a.cfg.AppWindows) == 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		appID := ps.ByName("appId")
+		if appID == "" {
+			appID = r.URL.Query().Get("appId")
+		}
+		win, ok := a.cfg.AppWindows[appID]
+		if !ok {
+			h(w, r, ps)
+			return
+		}
+		open, wait := win.open(time.Now())
+		if open {
+			h(w, r, ps)
+			return
+		}
+		a.cfg.Log.Get().Warn(fmt.Sprintf("out of service window for request: %s", r.URL.String()))
+		code := win.Status
+		if code == 0 {
+			code = 503
+		}
+		if code == 503 {
+			w.Header().Set("Retry-After", strconv.FormatInt(seconds(wait), 10))
+		}
+		w.WriteHeader(code)
+		w.Write([]byte("out of service window"))
+	}
+}
@@ -0,0 +1,102 @@
+package scenario
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Result is the outcome of an assertion
+type Result struct {
+	Name   string
+	Passed bool
+	// Elapsed is the time of the matching fetch since the start of the assertion window
+	Elapsed time.Duration
+	Message string
+}
+
+// Report is the outcome of a scenario
+type Report struct {
+	Name     string
+	Duration time.Duration
+	Results  []Result
+}
+
+// Failures returns the number of failed assertions
+func (r Report) Failures() int {
+	n := 0
+	for _, res := range r.Results {
+		if !res.Passed {
+			n++
+		}
+	}
+	return n
+}
+
+// WriteText writes a line per assertion
+func (r Report) WriteText(w io.Writer) error {
+	for _, res := range r.Results {
+		var err error
+		if res.Passed {
+			_, err = fmt.Fprintf(w, "PASS %s (%s)\n", res.Name, res.Elapsed)
+		} else {
+			_, err = fmt.Fprintf(w, "FAIL %s: %s\n", res.Name, res.Message)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d/%d assertions passed in %s\n", len(r.Results)-r.Failures(), len(r.Results), r.Duration)
+	return err
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+// WriteJUnit writes the report as a JUnit XML test suite
+func (r Report) WriteJUnit(w io.Writer) error {
+	seconds := func(d time.Duration) string {
+		return fmt.Sprintf("%.3f", d.Seconds())
+	}
+	suite := junitSuite{
+		Name:     r.Name,
+		Tests:    len(r.Results),
+		Failures: r.Failures(),
+		Time:     seconds(r.Duration),
+	}
+	for _, res := range r.Results {
+		c := junitCase{Name: res.Name, Classname: r.Name, Time: seconds(res.Elapsed)}
+		if !res.Passed {
+			c.Failure = &junitFailure{Message: res.Message}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,248 @@
+package scenario
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/figroc/mock-apollo-go/internal/routes/apollo"
+	"github.com/figroc/mock-apollo-go/pkg/store"
+	"github.com/julienschmidt/httprouter"
+	"github.com/lalamove/nui/nlogger"
+)
+
+// Config is an object that stores the package config
+type Config struct {
+	Log  nlogger.Provider
+	Spec Spec
+	// Output receives the output of the command under test
+	Output io.Writer
+}
+
+// interaction is a request of a client recorded by the runner
+type interaction struct {
+	at     time.Time
+	client string
+	path   string
+}
+
+// Runner runs a scenario against a config server
+type Runner struct {
+	cfg    Config
+	a      *apollo.Apollo
+	srv    *http.Server
+	ln     net.Listener
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	records []interaction
+	applied map[string]time.Time
+}
+
+// New starts the config server of a scenario
+func New(ctx context.Context, cfg Config) (*Runner, error) {
+	validateConfig(&cfg)
+	if err := cfg.Spec.validate(); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(cfg.Spec.Port))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	a, err := apollo.New(ctx, apollo.Config{
+		Log:        cfg.Log,
+		ConfigPath: cfg.Spec.Files,
+		Port:       ln.Addr().(*net.TCPAddr).Port,
+	})
+	if err != nil {
+		cancel()
+		ln.Close()
+		return nil, err
+	}
+	r := &Runner{
+		cfg:     cfg,
+		a:       a,
+		ln:      ln,
+		cancel:  cancel,
+		applied: make(map[string]time.Time),
+	}
+	router := httprouter.New()
+	a.Routes(router)
+	r.srv = &http.Server{Handler: r.record(router)}
+	go r.srv.Serve(ln)
+	return r, nil
+}
+
+func validateConfig(cfg *Config) {
+	if cfg.Log == nil {
+		cfg.Log = nlogger.NewProvider(nlogger.New(os.Stdout, ""))
+	}
+	if cfg.Output == nil {
+		cfg.Output = io.Discard
+	}
+}
+
+// URL returns the URL of the config server
+func (r *Runner) URL() string {
+	return "http://" + r.ln.Addr().String()
+}
+
+// record records the requests of the clients
+func (r *Runner) record(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		client := req.URL.Query().Get("ip")
+		if client == "" {
+			client, _, _ = net.SplitHostPort(req.RemoteAddr)
+		}
+		r.mu.Lock()
+		r.records = append(r.records, interaction{at: time.Now(), client: client, path: req.URL.Path})
+		r.mu.Unlock()
+		h.ServeHTTP(w, req)
+	})
+}
+
+// Run applies the steps of the scenario and evaluates its assertions once it is over,
+// the config server is closed when Run returns
+func (r *Runner) Run(ctx context.Context) (Report, error) {
+	defer r.close()
+	spec := r.cfg.Spec
+	start := time.Now()
+	if len(spec.Command) > 0 {
+		cmd := exec.CommandContext(ctx, spec.Command[0], spec.Command[1:]...)
+		cmd.Env = append(os.Environ(), "MOCK_APOLLO_URL="+r.URL())
+		cmd.Stdout = r.cfg.Output
+		cmd.Stderr = r.cfg.Output
+		if err := cmd.Start(); err != nil {
+			return Report{}, err
+		}
+		defer func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}()
+	}
+
+	steps := make([]Step, len(spec.Steps))
+	copy(steps, spec.Steps)
+	sort.SliceStable(steps, func(i, j int) bool {
+		return steps[i].At < steps[j].At
+	})
+	end := time.NewTimer(spec.duration())
+	defer end.Stop()
+	for _, st := range steps {
+		select {
+		case <-ctx.Done():
+			return Report{}, ctx.Err()
+		case <-time.After(time.Until(start.Add(st.At))):
+		}
+		if err := r.apply(st); err != nil {
+			return Report{}, fmt.Errorf("step %s: %v", st.Name, err)
+		}
+	}
+	select {
+	case <-ctx.Done():
+		return Report{}, ctx.Err()
+	case <-end.C:
+	}
+	return r.evaluate(start, time.Since(start)), nil
+}
+
+// apply mutates the namespace of a step
+func (r *Runner) apply(st Step) error {
+	s := r.a.Store()
+	ns, err := s.Get(st.AppID, st.Cluster, st.Namespace)
+	if err != nil && err != store.ErrNotFound {
+		return err
+	}
+	props := make(map[string]string, len(ns.Properties)+len(st.Properties))
+	for k, v := range ns.Properties {
+		props[k] = v
+	}
+	for k, v := range st.Properties {
+		props[k] = v
+	}
+	for _, k := range st.Remove {
+		delete(props, k)
+	}
+	ns.Properties = props
+	ns.ReleaseKey = st.ReleaseKey
+	if ns.ReleaseKey == "" {
+		ns.ReleaseKey = "scenario-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	key := store.Key{AppID: st.AppID, Cluster: st.Cluster, Namespace: st.Namespace}
+	r.mu.Lock()
+	r.applied[st.Name] = time.Now()
+	r.mu.Unlock()
+	return s.Upsert(key, ns)
+}
+
+// evaluate returns the report of the assertions on the recorded interactions
+func (r *Runner) evaluate(start time.Time, elapsed time.Duration) Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := Report{Name: r.cfg.Spec.Name, Duration: elapsed}
+	for _, as := range r.cfg.Spec.Assertions {
+		from := start
+		if as.After != "" {
+			from = r.applied[as.After]
+		}
+		result := Result{Name: as.Name}
+		for _, rec := range r.records {
+			if rec.at.Before(from) || (as.Within > 0 && rec.at.After(from.Add(as.Within))) {
+				continue
+			}
+			if (as.Client == "" || rec.client == as.Client) && fetches(rec.path, as.Fetched) {
+				result.Passed = true
+				result.Elapsed = rec.at.Sub(from)
+				break
+			}
+		}
+		if !result.Passed {
+			client := as.Client
+			if client == "" {
+				client = "any client"
+			}
+			result.Message = fmt.Sprintf("%s did not fetch %s/%s/%s", client, as.Fetched.AppID, as.Fetched.Cluster, as.Fetched.Namespace)
+			if as.Within > 0 {
+				result.Message += " within " + as.Within.String()
+			}
+			if as.After != "" {
+				result.Message += " of " + as.After
+			}
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report
+}
+
+// fetches returns true if path fetches the config of a namespace
+func fetches(path string, k Key) bool {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) == 4 && (parts[0] == "configs" || parts[0] == "configfiles"):
+		parts = parts[1:]
+	case len(parts) == 5 && parts[0] == "configfiles" && parts[1] == "json":
+		parts = parts[2:]
+	default:
+		return false
+	}
+	return parts[0] == k.AppID && parts[1] == k.Cluster &&
+		(parts[2] == k.Namespace || parts[2] == k.Namespace+".properties")
+}
+
+func (r *Runner) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	r.a.Shutdown(ctx)
+	r.srv.Shutdown(ctx)
+	r.cancel()
+}
@@ -0,0 +1,87 @@
+package scenario
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScenario(t *testing.T) {
+	dir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(`
+app:
+  cluster:
+    ns:
+      releaseKey: abc
+      properties:
+        feature: "off"
+`), 0644))
+	specPath := filepath.Join(dir, "spec.yaml")
+	require.Nil(t, os.WriteFile(specPath, []byte(`
+name: release
+files: [config.yaml]
+steps:
+- name: release feature
+  at: 100ms
+  appId: app
+  cluster: cluster
+  namespace: ns
+  properties: {feature: "on"}
+assertions:
+- name: client fetches the release
+  client: 10.0.0.1
+  fetched: {appId: app, cluster: cluster, namespace: ns}
+  after: release feature
+  within: 300ms
+- name: other client fetches the release
+  client: 10.0.0.2
+  fetched: {appId: app, cluster: cluster, namespace: ns}
+  after: release feature
+  within: 300ms
+`), 0644))
+
+	spec, err := Load(specPath)
+	require.Nil(t, err)
+	require.Equal(t, []string{filepath.Join(dir, "config.yaml")}, spec.Files)
+	require.Equal(t, 400*time.Millisecond, spec.duration())
+
+	r, err := New(context.Background(), Config{Spec: spec})
+	require.Nil(t, err)
+	go func() {
+		// fetched before the release, which does not count
+		http.Get(r.URL() + "/configs/app/cluster/ns?ip=10.0.0.2")
+		time.Sleep(200 * time.Millisecond)
+		http.Get(r.URL() + "/configs/app/cluster/ns?ip=10.0.0.1")
+	}()
+	report, err := r.Run(context.Background())
+	require.Nil(t, err)
+	require.Len(t, report.Results, 2)
+	require.True(t, report.Results[0].Passed)
+	require.False(t, report.Results[1].Passed)
+	require.Equal(t, "10.0.0.2 did not fetch app/cluster/ns within 300ms of release feature", report.Results[1].Message)
+	require.Equal(t, 1, report.Failures())
+
+	buf := &bytes.Buffer{}
+	require.Nil(t, report.WriteJUnit(buf))
+	require.Contains(t, buf.String(), `<testsuite name="release" tests="2" failures="1"`)
+	require.Contains(t, buf.String(), `<failure message="10.0.0.2 did not fetch app/cluster/ns within 300ms of release feature"></failure>`)
+
+	t.Run("invalid", func(t *testing.T) {
+		for spec, msg := range map[string]string{
+			`name: empty`: "missing files",
+			"files: [a]\nsteps: [{name: s, appId: app}]":                                                                 "step s: missing appId, cluster or namespace",
+			"files: [a]\nassertions: [{name: a, fetched: {appId: a, cluster: c, namespace: n}}]":                         "missing duration",
+			"files: [a]\nduration: 1s\nassertions: [{name: a, after: s, fetched: {appId: a, cluster: c, namespace: n}}]": "assertion a: unknown step s",
+		} {
+			require.Nil(t, os.WriteFile(specPath, []byte(spec), 0644))
+			_, err := Load(specPath)
+			require.EqualError(t, err, specPath+": "+msg, spec)
+		}
+	})
+}
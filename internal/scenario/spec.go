@@ -0,0 +1,167 @@
+package scenario
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Spec describes a scenario
+//
+//	name: feature release
+//	files: [example.yaml]
+//	command: [./my-client]
+//	steps:
+//	- name: release feature
+//	  at: 5s
+//	  appId: myAppID
+//	  cluster: myCluster
+//	  namespace: myNamespace
+//	  properties: {feature: "on"}
+//	assertions:
+//	- name: client fetches the release
+//	  client: 10.0.0.1
+//	  fetched: {appId: myAppID, cluster: myCluster, namespace: myNamespace}
+//	  after: release feature
+//	  within: 5s
+type Spec struct {
+	Name string `yaml:"name"`
+	// Files are the served config files, relative to the spec file
+	Files []string `yaml:"files"`
+	// Port is the port of the config server, 0 means a random port
+	Port int `yaml:"port"`
+	// Command is the client under test, started once the server is up with its URL in MOCK_APOLLO_URL
+	Command []string `yaml:"command"`
+	// Duration is how long the scenario runs, 0 means until the last assertion window is over
+	Duration   time.Duration `yaml:"duration"`
+	Steps      []Step        `yaml:"steps"`
+	Assertions []Assertion   `yaml:"assertions"`
+}
+
+// Step is a mutation of a namespace applied at a time of the scenario
+type Step struct {
+	Name string `yaml:"name"`
+	// At is the time of the step since the start of the scenario
+	At        time.Duration `yaml:"at"`
+	AppID     string        `yaml:"appId"`
+	Cluster   string        `yaml:"cluster"`
+	Namespace string        `yaml:"namespace"`
+	// Properties are set onto the namespace
+	Properties map[string]string `yaml:"properties"`
+	// Remove are the keys of the properties removed from the namespace
+	Remove []string `yaml:"remove"`
+	// ReleaseKey is the releaseKey of the mutated namespace, empty means a generated one
+	ReleaseKey string `yaml:"releaseKey"`
+}
+
+// Key identifies a fetched namespace
+type Key struct {
+	AppID     string `yaml:"appId"`
+	Cluster   string `yaml:"cluster"`
+	Namespace string `yaml:"namespace"`
+}
+
+// Assertion expects a client to fetch a namespace in a window of the scenario
+type Assertion struct {
+	Name string `yaml:"name"`
+	// Client is the ip of the client, empty means any client
+	Client  string `yaml:"client"`
+	Fetched Key    `yaml:"fetched"`
+	// After is the name of the step opening the window, empty means the start of the scenario
+	After string `yaml:"after"`
+	// Within is the length of the window, 0 means until the end of the scenario
+	Within time.Duration `yaml:"within"`
+}
+
+// Load reads the spec file at path, the files of the spec are resolved against its directory
+func Load(path string) (Spec, error) {
+	spec := Spec{}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return spec, err
+	}
+	if err := yaml.UnmarshalStrict(b, &spec); err != nil {
+		return spec, fmt.Errorf("%s: %v", path, err)
+	}
+	dir := filepath.Dir(path)
+	for i, f := range spec.Files {
+		if !filepath.IsAbs(f) {
+			spec.Files[i] = filepath.Join(dir, f)
+		}
+	}
+	if err := spec.validate(); err != nil {
+		return spec, fmt.Errorf("%s: %v", path, err)
+	}
+	return spec, nil
+}
+
+func (s *Spec) validate() error {
+	if len(s.Files) == 0 {
+		return errors.New("missing files")
+	}
+	steps := make(map[string]bool)
+	for i, st := range s.Steps {
+		if st.Name == "" {
+			return fmt.Errorf("step %d: missing name", i)
+		}
+		if steps[st.Name] {
+			return fmt.Errorf("step %s: duplicated name", st.Name)
+		}
+		steps[st.Name] = true
+		if st.AppID == "" || st.Cluster == "" || st.Namespace == "" {
+			return fmt.Errorf("step %s: missing appId, cluster or namespace", st.Name)
+		}
+	}
+	for i, as := range s.Assertions {
+		if as.Name == "" {
+			return fmt.Errorf("assertion %d: missing name", i)
+		}
+		if as.Fetched.AppID == "" || as.Fetched.Cluster == "" || as.Fetched.Namespace == "" {
+			return fmt.Errorf("assertion %s: missing fetched appId, cluster or namespace", as.Name)
+		}
+		if as.After != "" && !steps[as.After] {
+			return fmt.Errorf("assertion %s: unknown step %s", as.Name, as.After)
+		}
+	}
+	if s.duration() <= 0 {
+		return errors.New("missing duration")
+	}
+	return nil
+}
+
+// step returns the step of a name
+func (s *Spec) step(name string) (Step, bool) {
+	for _, st := range s.Steps {
+		if st.Name == name {
+			return st, true
+		}
+	}
+	return Step{}, false
+}
+
+// duration returns how long the scenario runs
+func (s *Spec) duration() time.Duration {
+	if s.Duration > 0 {
+		return s.Duration
+	}
+	d := time.Duration(0)
+	for _, as := range s.Assertions {
+		end := as.Within
+		if st, ok := s.step(as.After); ok {
+			end += st.At
+		}
+		if end > d {
+			d = end
+		}
+	}
+	for _, st := range s.Steps {
+		if st.At > d {
+			d = st.At
+		}
+	}
+	return d
+}
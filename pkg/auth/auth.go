@@ -0,0 +1,70 @@
+// Package auth lets the programs embedding the mock Apollo config server authenticate
+// the requests of the config routes, e.g. with their JWTs or SPIFFE IDs
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+)
+
+// Request is the view of a request inspected by an Authenticator
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+	// TLS is the state of the TLS connection, nil for plain http
+	TLS       *tls.ConnectionState
+	AppID     string
+	Cluster   string
+	Namespace string
+	ClientIP  string
+}
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	// Subject names the caller, e.g. the subject of a JWT or a SPIFFE ID
+	Subject string
+	// AppIDs are the apps whose config the caller may read, empty means all apps
+	AppIDs []string
+}
+
+// Allows reports whether the caller may read the config of appID
+func (id Identity) Allows(appID string) bool {
+	if len(id.AppIDs) == 0 {
+		return true
+	}
+	for _, v := range id.AppIDs {
+		if v == appID {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator authenticates the requests of the config routes
+type Authenticator interface {
+	// Authenticate returns the identity of the caller of r, an error denies the request
+	Authenticate(r Request) (Identity, error)
+}
+
+// AuthenticatorFunc is a function used as an Authenticator
+type AuthenticatorFunc func(r Request) (Identity, error)
+
+// Authenticate calls f(r)
+func (f AuthenticatorFunc) Authenticate(r Request) (Identity, error) {
+	return f(r)
+}
+
+type identityKey struct{}
+
+// NewContext returns a copy of ctx holding id
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the identity of the authenticated request of ctx, ok is false if it was not authenticated
+func FromContext(ctx context.Context) (id Identity, ok bool) {
+	id, ok = ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
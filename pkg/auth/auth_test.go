@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentity(t *testing.T) {
+	require.True(t, Identity{}.Allows("app"))
+	id := Identity{Subject: "client", AppIDs: []string{"app"}}
+	require.True(t, id.Allows("app"))
+	require.False(t, id.Allows("app2"))
+
+	_, ok := FromContext(context.Background())
+	require.False(t, ok)
+	got, ok := FromContext(NewContext(context.Background(), id))
+	require.True(t, ok)
+	require.Equal(t, id, got)
+}
+
+func TestCertificates(t *testing.T) {
+	c := Certificates{
+		"spiffe://example.org/web": {"web", "web-admin"},
+		"ops":                      {AllApps},
+	}
+	request := func(cn string, uris ...string) Request {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}}
+		for _, v := range uris {
+			u, err := url.Parse(v)
+			require.Nil(t, err)
+			cert.URIs = append(cert.URIs, u)
+		}
+		return Request{TLS: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}}
+	}
+
+	id, err := c.Authenticate(request("web.example.org", "https://example.org", "spiffe://example.org/web"))
+	require.Nil(t, err)
+	require.Equal(t, Identity{Subject: "spiffe://example.org/web", AppIDs: []string{"web", "web-admin"}}, id)
+	require.False(t, id.Allows("billing"))
+
+	// the common name is matched when no SPIFFE ID is bound
+	id, err = c.Authenticate(request("ops", "spiffe://example.org/ops"))
+	require.Nil(t, err)
+	require.Equal(t, Identity{Subject: "ops"}, id)
+	require.True(t, id.Allows("billing"))
+
+	_, err = c.Authenticate(request("billing", "spiffe://example.org/billing"))
+	require.EqualError(t, err, "no appId bound to client certificate spiffe://example.org/billing")
+	_, err = c.Authenticate(Request{})
+	require.EqualError(t, err, "missing client certificate")
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+// AllApps in the appIds bound to an identity by Certificates allows the identity all apps
+const AllApps = "*"
+
+// Certificates authenticates the requests by the identity of their verified client certificate,
+// a SPIFFE ID of its URI SANs or its common name, and allows them the appIds bound to the identity.
+// The requests of a certificate without any bound identity are denied
+type Certificates map[string][]string
+
+// Authenticate returns the identity of the client certificate of r bound to appIds,
+// the SPIFFE IDs are matched before the common name
+func (c Certificates) Authenticate(r Request) (Identity, error) {
+	ids := certIdentities(r.TLS)
+	if len(ids) == 0 {
+		return Identity{}, errors.New("missing client certificate")
+	}
+	for _, id := range ids {
+		appIDs, ok := c[id]
+		if !ok {
+			continue
+		}
+		for _, v := range appIDs {
+			if v == AllApps {
+				return Identity{Subject: id}, nil
+			}
+		}
+		return Identity{Subject: id, AppIDs: appIDs}, nil
+	}
+	return Identity{}, fmt.Errorf("no appId bound to client certificate %s", ids[0])
+}
+
+// certIdentities returns the SPIFFE IDs of the verified client certificate of state followed by its common name
+func certIdentities(state *tls.ConnectionState) []string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	var ids []string
+	for _, u := range cert.URIs {
+		if u.Scheme == "spiffe" {
+			ids = append(ids, u.String())
+		}
+	}
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return ids
+}
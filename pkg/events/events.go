@@ -0,0 +1,153 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Type is the type of an Event
+type Type string
+
+// supported event types
+const (
+	// NamespaceUpdated is published when a namespace is created or its content changed
+	NamespaceUpdated Type = "NamespaceUpdated"
+	// NamespaceDeleted is published when a namespace is removed
+	NamespaceDeleted Type = "NamespaceDeleted"
+	// FileReloaded is published after a config file has been reloaded
+	FileReloaded Type = "FileReloaded"
+)
+
+// Event describes a change of the served config
+type Event struct {
+	Type      Type      `json:"type"`
+	AppID     string    `json:"appId,omitempty"`
+	Cluster   string    `json:"cluster,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	File      string    `json:"file,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Bus delivers published events to all subscribers. Delivery is lossless: the events a subscriber
+// has not received yet are queued without bound, an event already queued for a subscriber is coalesced
+// with it, so that a slow subscriber holds at most one event per namespace, file and type
+type Bus struct {
+	mu        sync.RWMutex
+	subs      map[*subscriber]bool
+	hooks     []func(Event)
+	coalesced int64
+}
+
+// NewBus creates a new Bus
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*subscriber]bool)}
+}
+
+// Subscribe returns a channel receiving the published events until ctx is done
+func (b *Bus) Subscribe(ctx context.Context) <-chan Event {
+	s := &subscriber{
+		pending: make(map[Event]bool),
+		wake:    make(chan struct{}, 1),
+		out:     make(chan Event),
+	}
+	b.mu.Lock()
+	b.subs[s] = true
+	b.mu.Unlock()
+	go func() {
+		s.run(ctx)
+		b.mu.Lock()
+		delete(b.subs, s)
+		b.mu.Unlock()
+	}()
+	return s.out
+}
+
+// Hook registers fn to be called by Publish with every event before it's queued for the subscribers,
+// so that the state derived from the events is updated once the publisher returns. fn must not block
+func (b *Bus) Hook(fn func(Event)) {
+	b.mu.Lock()
+	b.hooks = append(b.hooks, fn)
+	b.mu.Unlock()
+}
+
+// Publish queues an event for all subscribers without blocking
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, fn := range b.hooks {
+		fn(e)
+	}
+	for s := range b.subs {
+		if !s.push(e) {
+			atomic.AddInt64(&b.coalesced, 1)
+		}
+	}
+}
+
+// Coalesced returns the number of events coalesced with an event already queued for a slow subscriber
+func (b *Bus) Coalesced() int64 {
+	return atomic.LoadInt64(&b.coalesced)
+}
+
+// subscriber queues the events of a subscription until they are received
+type subscriber struct {
+	mu    sync.Mutex
+	queue []Event
+	// pending are the queued events without their time
+	pending map[Event]bool
+	wake    chan struct{}
+	out     chan Event
+}
+
+// push queues e, it returns false if e is coalesced with a queued event
+func (s *subscriber) push(e Event) bool {
+	k := e
+	k.Time = time.Time{}
+	s.mu.Lock()
+	if s.pending[k] {
+		s.mu.Unlock()
+		return false
+	}
+	s.pending[k] = true
+	s.queue = append(s.queue, e)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// run sends the queued events in order until ctx is done
+func (s *subscriber) run(ctx context.Context) {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.wake:
+			}
+			continue
+		}
+		e := s.queue[0]
+		s.queue[0] = Event{}
+		s.queue = s.queue[1:]
+		k := e
+		k.Time = time.Time{}
+		// an event published once this one is sent is queued again
+		delete(s.pending, k)
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case s.out <- e:
+		}
+	}
+}
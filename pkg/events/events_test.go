@@ -0,0 +1,77 @@
+package events
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBus(t *testing.T) {
+	b := NewBus()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub1 := b.Subscribe(ctx)
+	sub2 := b.Subscribe(ctx)
+
+	b.Publish(Event{Type: NamespaceUpdated, AppID: "app", Cluster: "cluster", Namespace: "ns"})
+	for _, sub := range []<-chan Event{sub1, sub2} {
+		select {
+		case e := <-sub:
+			require.Equal(t, NamespaceUpdated, e.Type)
+			require.Equal(t, "ns", e.Namespace)
+			require.False(t, e.Time.IsZero())
+		case <-time.After(time.Second):
+			require.Fail(t, "no event received")
+		}
+	}
+
+	t.Run("slow subscriber", func(t *testing.T) {
+		const n = 1024
+		for i := 0; i < n; i++ {
+			b.Publish(Event{Type: NamespaceUpdated, Namespace: strconv.Itoa(i)})
+		}
+		// a queued event is coalesced, the others are all received in order
+		b.Publish(Event{Type: NamespaceUpdated, Namespace: strconv.Itoa(n - 1)})
+		require.Equal(t, int64(2), b.Coalesced())
+		for _, sub := range []<-chan Event{sub1, sub2} {
+			for i := 0; i < n; i++ {
+				select {
+				case e := <-sub:
+					require.Equal(t, strconv.Itoa(i), e.Namespace)
+				case <-time.After(time.Second):
+					require.Fail(t, "event lost", "namespace %d", i)
+				}
+			}
+			select {
+			case e := <-sub:
+				require.Fail(t, "unexpected event", "%v", e)
+			default:
+			}
+		}
+	})
+
+	t.Run("hook", func(t *testing.T) {
+		var hooked []Event
+		b.Hook(func(e Event) {
+			hooked = append(hooked, e)
+		})
+		b.Publish(Event{Type: FileReloaded, File: "f"})
+		require.Len(t, hooked, 1)
+		require.Equal(t, "f", hooked[0].File)
+		require.False(t, hooked[0].Time.IsZero())
+		<-sub1
+		<-sub2
+	})
+
+	t.Run("unsubscribe", func(t *testing.T) {
+		cancel()
+		require.Eventually(t, func() bool {
+			b.mu.RLock()
+			defer b.mu.RUnlock()
+			return len(b.subs) == 0
+		}, time.Second, time.Millisecond)
+	})
+}
@@ -0,0 +1,192 @@
+package graphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Resolver resolves a root field from its arguments, the result is projected
+// onto the selection set by its JSON representation
+type Resolver func(args map[string]interface{}) (interface{}, error)
+
+// Schema maps the root query fields to their resolvers.
+// It supports a subset of GraphQL queries: fields, aliases, arguments and variables,
+// but no fragments, directives or mutations
+type Schema map[string]Resolver
+
+// Request is a GraphQL request
+type Request struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
+}
+
+// Error is an error of a GraphQL response
+type Error struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// Response is a GraphQL response
+type Response struct {
+	Data   interface{} `json:"data"`
+	Errors []Error     `json:"errors,omitempty"`
+}
+
+// object keeps the fields of a result in the order of the selection
+type object []field
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// MarshalJSON encodes the fields in order
+func (o object) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, err := json.Marshal(f.key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// Execute runs a query against the schema
+func (s Schema) Execute(req Request) Response {
+	set, err := parse(req.Query, req.Variables)
+	if err != nil {
+		return Response{Errors: []Error{{Message: err.Error()}}}
+	}
+	rsp := Response{}
+	data := object{}
+	for _, sel := range set {
+		path := []interface{}{sel.alias}
+		resolve, ok := s[sel.name]
+		if !ok {
+			rsp.Errors = append(rsp.Errors, Error{Message: fmt.Sprintf("cannot query field %q", sel.name), Path: path})
+			data = append(data, field{sel.alias, nil})
+			continue
+		}
+		v, err := resolve(sel.args)
+		if err == nil {
+			v, err = generic(v)
+		}
+		if err == nil {
+			v, err = project(v, sel.selection, path)
+		}
+		if err != nil {
+			rsp.Errors = append(rsp.Errors, Error{Message: err.Error(), Path: path})
+			v = nil
+		}
+		data = append(data, field{sel.alias, v})
+	}
+	rsp.Data = data
+	return rsp
+}
+
+// generic converts v to its JSON representation of maps, slices and scalars
+func generic(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var g interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// project keeps the selected fields of v
+func project(v interface{}, set []selection, path []interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		list := make([]interface{}, len(t))
+		for i, e := range t {
+			p, err := project(e, set, append(path, i))
+			if err != nil {
+				return nil, err
+			}
+			list[i] = p
+		}
+		return list, nil
+	case map[string]interface{}:
+		if len(set) == 0 {
+			return nil, fmt.Errorf("field %s must have a selection of subfields", pathString(path))
+		}
+		o := make(object, 0, len(set))
+		for _, sel := range set {
+			e, ok := t[sel.name]
+			if !ok {
+				return nil, fmt.Errorf("cannot query field %q on %s", sel.name, pathString(path))
+			}
+			p, err := project(e, sel.selection, append(path, sel.alias))
+			if err != nil {
+				return nil, err
+			}
+			o = append(o, field{sel.alias, p})
+		}
+		return o, nil
+	default:
+		if len(set) > 0 {
+			return nil, fmt.Errorf("field %s must not have a selection", pathString(path))
+		}
+		return v, nil
+	}
+}
+
+func pathString(path []interface{}) string {
+	s := make([]string, len(path))
+	for i, p := range path {
+		s[i] = fmt.Sprint(p)
+	}
+	return strings.Join(s, ".")
+}
+
+// Handler serves the schema over HTTP, queries are taken from the query parameter
+// of GET requests or the JSON body of POST requests
+func Handler(s Schema) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := Request{}
+		switch r.Method {
+		case http.MethodGet:
+			req.Query = r.URL.Query().Get("query")
+		case http.MethodPost:
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		default:
+			w.WriteHeader(405)
+			return
+		}
+		json, err := json.Marshal(s.Execute(req))
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+	})
+}
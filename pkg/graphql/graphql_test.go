@@ -0,0 +1,78 @@
+package graphql
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type app struct {
+	AppID    string   `json:"appId"`
+	Clusters []string `json:"clusters"`
+	Stats    struct {
+		Polls int `json:"polls"`
+	} `json:"stats"`
+}
+
+func TestSchema(t *testing.T) {
+	s := Schema{
+		"apps": func(args map[string]interface{}) (interface{}, error) {
+			apps := []app{{AppID: "app1", Clusters: []string{"c1"}}, {AppID: "app2", Clusters: []string{"c2"}}}
+			if id, ok := args["appId"].(string); ok {
+				for _, a := range apps {
+					if a.AppID == id {
+						return []app{a}, nil
+					}
+				}
+				return []app{}, nil
+			}
+			return apps, nil
+		},
+		"version": func(args map[string]interface{}) (interface{}, error) {
+			return "1.0", nil
+		},
+		"broken": func(args map[string]interface{}) (interface{}, error) {
+			return nil, errors.New("broken")
+		},
+	}
+	execute := func(query string, vars map[string]interface{}) string {
+		b, err := json.Marshal(s.Execute(Request{Query: query, Variables: vars}))
+		require.Nil(t, err)
+		return string(b)
+	}
+
+	t.Run("query", func(t *testing.T) {
+		require.Equal(
+			t,
+			`{"data":{"version":"1.0","apps":[{"appId":"app1","clusters":["c1"],"stats":{"polls":0}},{"appId":"app2","clusters":["c2"],"stats":{"polls":0}}]}}`,
+			execute(`# all apps
+			query Apps { version, apps { appId clusters stats { polls } } }`, nil),
+		)
+	})
+	t.Run("arguments", func(t *testing.T) {
+		require.Equal(t, `{"data":{"a":[{"id":"app2"}]}}`, execute(`{ a: apps(appId: "app2") { id: appId } }`, nil))
+		require.Equal(t, `{"data":{"apps":[{"appId":"app1"}]}}`, execute(`query ($id: String) { apps(appId: $id) { appId } }`, map[string]interface{}{"id": "app1"}))
+	})
+	t.Run("errors", func(t *testing.T) {
+		require.Equal(t, `{"data":{"version":"1.0","broken":null},"errors":[{"message":"broken","path":["broken"]}]}`, execute(`{ version broken }`, nil))
+		require.Equal(t, `{"data":{"apps":null},"errors":[{"message":"cannot query field \"name\" on apps.0","path":["apps"]}]}`, execute(`{ apps { name } }`, nil))
+		require.Equal(t, `{"data":{"apps":null},"errors":[{"message":"field apps.0 must have a selection of subfields","path":["apps"]}]}`, execute(`{ apps }`, nil))
+		require.Equal(t, `{"data":null,"errors":[{"message":"syntax error at 9: fragments are not supported"}]}`, execute(`{ apps { ...f } }`, nil))
+		require.Equal(t, `{"data":null,"errors":[{"message":"syntax error at 0: unsupported operation \"mutation\""}]}`, execute(`mutation { apps }`, nil))
+	})
+	t.Run("handler", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		Handler(s).ServeHTTP(w, httptest.NewRequest("POST", "/graphql", strings.NewReader(`{"query":"{ version }"}`)))
+		require.Equal(t, 200, w.Result().StatusCode)
+		require.Equal(t, "application/json", w.Result().Header.Get("Content-Type"))
+		require.Equal(t, `{"data":{"version":"1.0"}}`, w.Body.String())
+
+		w = httptest.NewRecorder()
+		Handler(s).ServeHTTP(w, httptest.NewRequest("GET", "/graphql?query={version}", nil))
+		require.Equal(t, `{"data":{"version":"1.0"}}`, w.Body.String())
+	})
+}
@@ -0,0 +1,288 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// selection is a field selected in a query
+type selection struct {
+	alias     string
+	name      string
+	args      map[string]interface{}
+	selection []selection
+}
+
+type parser struct {
+	src  []rune
+	pos  int
+	vars map[string]interface{}
+}
+
+// parse parses a query document with a single operation into its selection set
+func parse(query string, vars map[string]interface{}) ([]selection, error) {
+	p := &parser{src: []rune(query), vars: vars}
+	p.skip()
+	if name := p.peekName(); name != "" {
+		if name != "query" {
+			return nil, p.errorf("unsupported operation %q", name)
+		}
+		p.name()
+		p.skip()
+		// the operation name and variable definitions are optional
+		if p.peekName() != "" {
+			p.name()
+			p.skip()
+		}
+		if p.peek() == '(' {
+			if err := p.skipVariableDefinitions(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	set, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	p.skip()
+	if p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos])
+	}
+	return set, nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// skip skips white space, commas and comments which are insignificant in GraphQL
+func (p *parser) skip() {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == ',' || unicode.IsSpace(c):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) peek() rune {
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *parser) expect(c rune) error {
+	p.skip()
+	if p.peek() != c {
+		return p.errorf("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+func isNameStart(c rune) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isName(c rune) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
+
+func (p *parser) peekName() string {
+	end := p.pos
+	if end < len(p.src) && isNameStart(p.src[end]) {
+		for end < len(p.src) && isName(p.src[end]) {
+			end++
+		}
+	}
+	return string(p.src[p.pos:end])
+}
+
+func (p *parser) name() string {
+	n := p.peekName()
+	p.pos += len([]rune(n))
+	return n
+}
+
+func (p *parser) skipVariableDefinitions() error {
+	for p.pos < len(p.src) && p.src[p.pos] != ')' {
+		p.pos++
+	}
+	return p.expect(')')
+}
+
+func (p *parser) selectionSet() ([]selection, error) {
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+	set := []selection{}
+	for {
+		p.skip()
+		switch c := p.peek(); {
+		case c == '}':
+			p.pos++
+			if len(set) == 0 {
+				return nil, p.errorf("empty selection set")
+			}
+			return set, nil
+		case c == '.':
+			return nil, p.errorf("fragments are not supported")
+		case c == '@':
+			return nil, p.errorf("directives are not supported")
+		case isNameStart(c):
+			s, err := p.field()
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, s)
+		default:
+			return nil, p.errorf("expected a field")
+		}
+	}
+}
+
+func (p *parser) field() (selection, error) {
+	s := selection{name: p.name()}
+	p.skip()
+	if p.peek() == ':' {
+		p.pos++
+		p.skip()
+		s.alias, s.name = s.name, p.name()
+		if s.name == "" {
+			return s, p.errorf("expected a field name")
+		}
+		p.skip()
+	}
+	if s.alias == "" {
+		s.alias = s.name
+	}
+	if p.peek() == '(' {
+		p.pos++
+		s.args = make(map[string]interface{})
+		for {
+			p.skip()
+			if p.peek() == ')' {
+				p.pos++
+				break
+			}
+			name := p.name()
+			if name == "" {
+				return s, p.errorf("expected an argument name")
+			}
+			if err := p.expect(':'); err != nil {
+				return s, err
+			}
+			v, err := p.value()
+			if err != nil {
+				return s, err
+			}
+			s.args[name] = v
+		}
+		p.skip()
+	}
+	if p.peek() == '{' {
+		set, err := p.selectionSet()
+		if err != nil {
+			return s, err
+		}
+		s.selection = set
+	}
+	return s, nil
+}
+
+func (p *parser) value() (interface{}, error) {
+	p.skip()
+	switch c := p.peek(); {
+	case c == '"':
+		return p.string()
+	case c == '$':
+		p.pos++
+		name := p.name()
+		return p.vars[name], nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.src) && strings.ContainsRune("0123456789.eE+-", p.src[p.pos]) {
+			p.pos++
+		}
+		n := string(p.src[start:p.pos])
+		if i, err := strconv.ParseInt(n, 10, 64); err == nil {
+			return int(i), nil
+		}
+		f, err := strconv.ParseFloat(n, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", n)
+		}
+		return f, nil
+	case isNameStart(c):
+		switch n := p.name(); n {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		default:
+			// enum values are passed as strings
+			return n, nil
+		}
+	default:
+		return nil, p.errorf("unsupported value")
+	}
+}
+
+func (p *parser) string() (string, error) {
+	var b strings.Builder
+	p.pos++
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.pos >= len(p.src) {
+				return "", p.errorf("unterminated string")
+			}
+			e := p.src[p.pos]
+			p.pos++
+			switch e {
+			case 'n':
+				b.WriteRune('\n')
+			case 't':
+				b.WriteRune('\t')
+			case 'r':
+				b.WriteRune('\r')
+			case 'b':
+				b.WriteRune('\b')
+			case 'f':
+				b.WriteRune('\f')
+			case 'u':
+				if p.pos+4 > len(p.src) {
+					return "", p.errorf("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(string(p.src[p.pos:p.pos+4]), 16, 32)
+				if err != nil {
+					return "", p.errorf("invalid unicode escape")
+				}
+				b.WriteRune(rune(r))
+				p.pos += 4
+			default:
+				b.WriteRune(e)
+			}
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
@@ -0,0 +1,65 @@
+package hooks
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Request is the view of a request inspected by a hook
+type Request struct {
+	Method    string
+	Path      string
+	Query     url.Values
+	Header    http.Header
+	AppID     string
+	Cluster   string
+	Namespace string
+	ClientIP  string
+	// UserAgent is the User-Agent of the client, e.g. apollo-client-go/1.2.0
+	UserAgent string
+}
+
+// Action is the behavior a hook applies to a request
+type Action struct {
+	// Delay is waited before the request is handled
+	Delay time.Duration
+	// Drop closes the connection without a response
+	Drop bool
+	// Status responds with a fault instead of handling the request, 0 means the request is handled
+	Status int
+	// Body is the body of the fault response
+	Body string
+	// Headers are set on the response
+	Headers map[string]string
+	// Properties are overlaid onto the served properties
+	Properties map[string]string
+	// Label is the gray label the request is served with in place of its label query parameter,
+	// selecting the branches of that label
+	Label string
+	// Charset replaces the configured charset of the Content-Type, nil keeps it and empty removes it
+	Charset *string
+	// UnicodeEscape replaces the configured escaping of the non-ASCII characters of rendered
+	// properties, nil keeps it
+	UnicodeEscape *bool
+}
+
+// Hook decides the action applied to a request
+type Hook interface {
+	// Handle returns the action for r, ok is false if the request is left untouched
+	Handle(r Request) (action Action, ok bool)
+}
+
+// SDK returns the name and version of the first product of a User-Agent,
+// e.g. apollo-client-go and 1.2.0 for apollo-client-go/1.2.0 (linux)
+func SDK(userAgent string) (name string, version string) {
+	product := strings.Fields(userAgent)
+	if len(product) == 0 {
+		return "", ""
+	}
+	if i := strings.IndexByte(product[0], '/'); i >= 0 {
+		return product[0][:i], product[0][i+1:]
+	}
+	return product[0], ""
+}
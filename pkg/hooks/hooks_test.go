@@ -0,0 +1,214 @@
+package hooks
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScript(t *testing.T) {
+	s, err := Parse(`
+def handle(req):
+    # canary clients
+    if req.appId == "app" and match("^(1|true)$", req.header("x-canary")):
+        return {"delay": "2s", "headers": {"X-Mock": "canary"}, "properties": {"feature": "on"}}
+    if req.path.startswith("/notifications") and chance(10):
+        return {"status": 503, "body": "injected fault"}
+    if req.query("ip") != "" and req.ip == "10.0.0.1":
+        return {"drop": True}
+    return None
+`)
+	require.Nil(t, err)
+
+	t.Run("match", func(t *testing.T) {
+		a, ok := s.Handle(Request{AppID: "app", Header: http.Header{"X-Canary": {"true"}}})
+		require.True(t, ok)
+		require.Equal(t, Action{
+			Delay:      2 * time.Second,
+			Headers:    map[string]string{"X-Mock": "canary"},
+			Properties: map[string]string{"feature": "on"},
+		}, a)
+
+		_, ok = s.Handle(Request{AppID: "app", Header: http.Header{"X-Canary": {"0"}}})
+		require.False(t, ok)
+
+		a, ok = s.Handle(Request{ClientIP: "10.0.0.1", Query: url.Values{"ip": {"10.0.0.1"}}})
+		require.True(t, ok)
+		require.True(t, a.Drop)
+	})
+
+	t.Run("chance", func(t *testing.T) {
+		r := Request{Path: "/notifications/v2"}
+		s.rand = func() float64 { return 0.05 }
+		a, ok := s.Handle(r)
+		require.True(t, ok)
+		require.Equal(t, Action{Status: 503, Body: "injected fault"}, a)
+		s.rand = func() float64 { return 0.5 }
+		_, ok = s.Handle(r)
+		require.False(t, ok)
+	})
+
+	t.Run("sdk", func(t *testing.T) {
+		s, err := Parse(`
+def handle(req):
+    if req.sdk == "apollo-client-go" and match("^1\\.", req.sdkVersion):
+        return {"label": "legacy", "charset": "", "unicodeEscape": True}
+    if "Java" in req.userAgent:
+        return {"status": 500}
+`)
+		require.Nil(t, err)
+		a, ok := s.Handle(Request{UserAgent: "apollo-client-go/1.2.0 (linux)"})
+		require.True(t, ok)
+		charset, escape := "", true
+		require.Equal(t, Action{Label: "legacy", Charset: &charset, UnicodeEscape: &escape}, a)
+		_, ok = s.Handle(Request{UserAgent: "apollo-client-go/2.0.0"})
+		require.False(t, ok)
+		a, ok = s.Handle(Request{UserAgent: "Java/1.8.0_292"})
+		require.True(t, ok)
+		require.Equal(t, 500, a.Status)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for src, msg := range map[string]string{
+			"def handle(req)\n    return None":     "hook.star:2:1: got newline, want ':'",
+			"x = 1":                                "hook.star: no handle function",
+			"def handle(req):\n    return unknown": "hook.star:2:12: undefined: unknown",
+		} {
+			_, err := Parse(src)
+			require.EqualError(t, err, msg, src)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		for body, msg := range map[string]string{
+			`"ok"`:                                  "handle returned a string instead of a dict",
+			`{"status": "ok"}`:                      "invalid status \"ok\"",
+			`{"status": 42}`:                        "invalid status 42",
+			`{"delay": "soon"}`:                     `invalid delay "soon"`,
+			`{"reboot": True}`:                      `unknown action "reboot"`,
+			`{"headers": {"X-Mock": 1}}`:            "headers[X-Mock] is a int instead of a string",
+			`{"unicodeEscape": "yes"}`:              "unicodeEscape is a string instead of a bool",
+			`{"status": match("(", "")}`:            "match: invalid regexp \"(\": error parsing regexp: missing closing ): `(`",
+			`{"drop": chance(200)}`:                 "chance: invalid percent 200",
+			`{"body": req.header()}`:                "header: got 0 arguments, want 1",
+			`{"body": [x for x in range(1 << 30)]}`: "Starlark computation cancelled: too many steps",
+		} {
+			s, err := Parse("def handle(req):\n    return " + body)
+			require.Nil(t, err, body)
+			a, ok := s.Handle(Request{})
+			require.True(t, ok, body)
+			require.Equal(t, Action{Status: 500, Body: "hook script: " + msg}, a, body)
+		}
+	})
+
+	t.Run("load", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "hook.star")
+		require.Nil(t, os.WriteFile(path, []byte("def handle(req):\n    return {\"status\": 500}\n"), 0644))
+		s, err := Load(path)
+		require.Nil(t, err)
+		a, ok := s.Handle(Request{})
+		require.True(t, ok)
+		require.Equal(t, 500, a.Status)
+	})
+
+}
+
+// buildModule builds the WASM module of testdata/hook
+func buildModule(t *testing.T) string {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command to build the module")
+	}
+	path := filepath.Join(t.TempDir(), "hook.wasm")
+	cmd := exec.Command(goBin, "build", "-buildmode=c-shared", "-o", path, "./testdata/hook")
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	out, err := cmd.CombinedOutput()
+	require.Nil(t, err, string(out))
+	return path
+}
+
+func TestModule(t *testing.T) {
+	h, err := Load(buildModule(t))
+	require.Nil(t, err)
+	m := h.(*Module)
+	defer m.Close()
+
+	t.Run("match", func(t *testing.T) {
+		a, ok := m.Handle(Request{
+			Header:    http.Header{"X-Canary": {"1"}},
+			UserAgent: "apollo-client-go/1.2.0",
+		})
+		require.True(t, ok)
+		require.Equal(t, Action{
+			Delay:      10 * time.Millisecond,
+			Headers:    map[string]string{"X-Mock": "canary"},
+			Properties: map[string]string{"feature": "on", "sdk": "apollo-client-go"},
+		}, a)
+
+		a, ok = m.Handle(Request{Path: "/services/config"})
+		require.True(t, ok)
+		require.Equal(t, Action{Status: 503, Body: "injected fault"}, a)
+
+		_, ok = m.Handle(Request{Path: "/configs/app/cluster/ns"})
+		require.False(t, ok)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				a, ok := m.Handle(Request{Path: "/services/config"})
+				require.True(t, ok)
+				require.Equal(t, 503, a.Status)
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		a, ok := m.Handle(Request{Path: "/invalid"})
+		require.True(t, ok)
+		require.Equal(t, Action{Status: 500, Body: `hook module: invalid delay "soon"`}, a)
+
+		m.timeout = 100 * time.Millisecond
+		defer func() { m.timeout = moduleTimeout }()
+		a, ok = m.Handle(Request{Path: "/loop"})
+		require.True(t, ok)
+		require.Equal(t, 500, a.Status)
+		require.Contains(t, a.Body, "deadline exceeded")
+
+		// the looping instance is discarded
+		a, ok = m.Handle(Request{Path: "/services/config"})
+		require.True(t, ok)
+		require.Equal(t, 503, a.Status)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := CompileModule([]byte("not wasm"))
+		require.Error(t, err)
+		// a module with no export
+		_, err = CompileModule([]byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00})
+		require.EqualError(t, err, "no alloc function exported")
+	})
+}
+
+func TestSDK(t *testing.T) {
+	for ua, want := range map[string][2]string{
+		"apollo-client-go/1.2.0 (linux)": {"apollo-client-go", "1.2.0"},
+		"Java/1.8.0_292":                 {"Java", "1.8.0_292"},
+		"curl":                           {"curl", ""},
+		"":                               {"", ""},
+	} {
+		name, version := SDK(ua)
+		require.Equal(t, want, [2]string{name, version}, ua)
+	}
+}
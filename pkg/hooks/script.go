@@ -0,0 +1,261 @@
+package hooks
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// Script is a Hook running a Starlark script, its handle function is called with each request
+// and returns the action applied to it as a dict, None leaves the request untouched.
+//
+//	def handle(req):
+//	    # canary clients
+//	    if req.appId == "myAppID" and match("^(1|true)$", req.header("X-Canary")):
+//	        return {"delay": "2s", "headers": {"X-Mock": "canary"}, "properties": {"feature": "on"}}
+//	    if req.path.startswith("/notifications") and chance(10):
+//	        return {"status": 503, "body": "injected fault"}
+//	    if req.sdk == "apollo-client-go" and match("^1\\.", req.sdkVersion):
+//	        return {"label": "legacy", "unicodeEscape": True}
+//	    return None
+//
+// The request has the fields method, path, appId, cluster, namespace, ip, userAgent, sdk and sdkVersion,
+// and the methods query(name) and header(name) returning a parameter or a header, "" if missing.
+// sdk and sdkVersion are the name and version of the first product of the User-Agent.
+// match(pattern, s) reports whether s matches a regexp and chance(percent) is true for a random share of the calls.
+// The action has the keys delay (a duration), drop, status, body, headers, properties, label serving the gray
+// branches of a label, and the compat switches charset and unicodeEscape. A script failing on a request answers it
+// with a 500 telling the error
+type Script struct {
+	handle starlark.Callable
+	rand   func() float64
+	// patterns caches the regexps compiled by match
+	patterns sync.Map
+}
+
+// maxSteps bounds the computation of a call of the script, so that a looping script fails instead of hanging
+const maxSteps = 1 << 20
+
+// Load loads the hook at path, a WASM module if it has the .wasm extension, a script otherwise
+func Load(path string) (Hook, error) {
+	if strings.EqualFold(filepath.Ext(path), ".wasm") {
+		m, err := LoadModule(path)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := compile(path, string(b))
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Parse compiles a script
+func Parse(src string) (*Script, error) {
+	return compile("hook.star", src)
+}
+
+func compile(filename string, src string) (*Script, error) {
+	s := &Script{rand: rand.Float64}
+	predeclared := starlark.StringDict{
+		"match":  starlark.NewBuiltin("match", s.match),
+		"chance": starlark.NewBuiltin("chance", s.chance),
+	}
+	thread := &starlark.Thread{Name: filename}
+	thread.SetMaxExecutionSteps(maxSteps)
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, filename, src, predeclared)
+	if err != nil {
+		return nil, err
+	}
+	handle, ok := globals["handle"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s: no handle function", filename)
+	}
+	s.handle = handle
+	return s, nil
+}
+
+// Handle returns the action returned by the handle function of the script for r
+func (s *Script) Handle(r Request) (Action, bool) {
+	thread := &starlark.Thread{Name: "handle"}
+	thread.SetMaxExecutionSteps(maxSteps)
+	v, err := starlark.Call(thread, s.handle, starlark.Tuple{request(r)}, nil)
+	if err != nil {
+		return failed(err), true
+	}
+	if v == starlark.None {
+		return Action{}, false
+	}
+	d, ok := v.(*starlark.Dict)
+	if !ok {
+		return failed(fmt.Errorf("handle returned a %s instead of a dict", v.Type())), true
+	}
+	a, err := action(d)
+	if err != nil {
+		return failed(err), true
+	}
+	return a, true
+}
+
+// failed is the action answering a request the script failed on
+func failed(err error) Action {
+	return Action{Status: 500, Body: "hook script: " + err.Error()}
+}
+
+// request returns the Starlark value of r
+func request(r Request) starlark.Value {
+	name, version := SDK(r.UserAgent)
+	lookup := func(fn string, get func(string) string) *starlark.Builtin {
+		return starlark.NewBuiltin(fn, func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var key string
+			if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &key); err != nil {
+				return nil, err
+			}
+			return starlark.String(get(key)), nil
+		})
+	}
+	return starlarkstruct.FromStringDict(starlark.String("request"), starlark.StringDict{
+		"method":     starlark.String(r.Method),
+		"path":       starlark.String(r.Path),
+		"appId":      starlark.String(r.AppID),
+		"cluster":    starlark.String(r.Cluster),
+		"namespace":  starlark.String(r.Namespace),
+		"ip":         starlark.String(r.ClientIP),
+		"userAgent":  starlark.String(r.UserAgent),
+		"sdk":        starlark.String(name),
+		"sdkVersion": starlark.String(version),
+		"query":      lookup("query", r.Query.Get),
+		"header":     lookup("header", r.Header.Get),
+	})
+}
+
+func (s *Script) match(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pattern, str string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 2, &pattern, &str); err != nil {
+		return nil, err
+	}
+	re, ok := s.patterns.Load(pattern)
+	if !ok {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid regexp %q: %v", b.Name(), pattern, err)
+		}
+		re, _ = s.patterns.LoadOrStore(pattern, compiled)
+	}
+	return starlark.Bool(re.(*regexp.Regexp).MatchString(str)), nil
+}
+
+func (s *Script) chance(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var percent starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &percent); err != nil {
+		return nil, err
+	}
+	f, ok := starlark.AsFloat(percent)
+	if !ok || f < 0 || f > 100 {
+		return nil, fmt.Errorf("%s: invalid percent %s", b.Name(), percent)
+	}
+	return starlark.Bool(s.rand()*100 < f), nil
+}
+
+// action converts the dict returned by the script
+func action(d *starlark.Dict) (Action, error) {
+	a := Action{}
+	for _, item := range d.Items() {
+		k, ok := starlark.AsString(item[0])
+		if !ok {
+			return a, fmt.Errorf("invalid action key %s", item[0])
+		}
+		v := item[1]
+		var err error
+		switch k {
+		case "delay":
+			var s string
+			if s, err = str(k, v); err == nil {
+				if a.Delay, err = time.ParseDuration(s); err != nil || a.Delay < 0 {
+					err = fmt.Errorf("invalid delay %q", s)
+				}
+			}
+		case "drop":
+			a.Drop, err = boolean(k, v)
+		case "status":
+			if a.Status, err = starlark.AsInt32(v); err != nil || a.Status < 100 || a.Status > 999 {
+				err = fmt.Errorf("invalid status %s", v)
+			}
+		case "body":
+			a.Body, err = str(k, v)
+		case "headers":
+			a.Headers, err = strs(k, v)
+		case "properties":
+			a.Properties, err = strs(k, v)
+		case "label":
+			a.Label, err = str(k, v)
+		case "charset":
+			var s string
+			if s, err = str(k, v); err == nil {
+				a.Charset = &s
+			}
+		case "unicodeEscape":
+			var b bool
+			if b, err = boolean(k, v); err == nil {
+				a.UnicodeEscape = &b
+			}
+		default:
+			err = fmt.Errorf("unknown action %q", k)
+		}
+		if err != nil {
+			return a, err
+		}
+	}
+	return a, nil
+}
+
+func str(k string, v starlark.Value) (string, error) {
+	s, ok := starlark.AsString(v)
+	if !ok {
+		return "", fmt.Errorf("%s is a %s instead of a string", k, v.Type())
+	}
+	return s, nil
+}
+
+func boolean(k string, v starlark.Value) (bool, error) {
+	b, ok := v.(starlark.Bool)
+	if !ok {
+		return false, fmt.Errorf("%s is a %s instead of a bool", k, v.Type())
+	}
+	return bool(b), nil
+}
+
+func strs(k string, v starlark.Value) (map[string]string, error) {
+	d, ok := v.(*starlark.Dict)
+	if !ok {
+		return nil, fmt.Errorf("%s is a %s instead of a dict", k, v.Type())
+	}
+	m := make(map[string]string, d.Len())
+	for _, item := range d.Items() {
+		name, ok := starlark.AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("%s has the key %s instead of a string", k, item[0])
+		}
+		s, err := str(k+"["+name+"]", item[1])
+		if err != nil {
+			return nil, err
+		}
+		m[name] = s
+	}
+	return m, nil
+}
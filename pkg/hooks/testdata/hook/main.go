@@ -0,0 +1,53 @@
+// Command hook is the WASM hook module of the tests, built with
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"unsafe"
+)
+
+// buf and action are kept alive until the next call
+var buf, action []byte
+
+func main() {}
+
+//go:wasmexport alloc
+func alloc(size uint32) unsafe.Pointer {
+	buf = make([]byte, size+1)
+	return unsafe.Pointer(&buf[0])
+}
+
+//go:wasmexport handle
+func handle(ptr unsafe.Pointer, size uint32) uint64 {
+	var req struct {
+		Path   string              `json:"path"`
+		Header map[string][]string `json:"header"`
+		SDK    string              `json:"sdk"`
+	}
+	if err := json.Unmarshal(unsafe.Slice((*byte)(ptr), size), &req); err != nil {
+		panic(err)
+	}
+	var res interface{}
+	switch {
+	case strings.HasPrefix(req.Path, "/services/"):
+		res = map[string]interface{}{"status": 503, "body": "injected fault"}
+	case req.Path == "/loop":
+		for {
+		}
+	case req.Path == "/invalid":
+		res = map[string]interface{}{"delay": "soon"}
+	case len(req.Header["X-Canary"]) > 0 && req.Header["X-Canary"][0] == "1":
+		res = map[string]interface{}{
+			"delay":      "10ms",
+			"headers":    map[string]string{"X-Mock": "canary"},
+			"properties": map[string]string{"feature": "on", "sdk": req.SDK},
+		}
+	default:
+		return 0
+	}
+	action, _ = json.Marshal(res)
+	return uint64(uintptr(unsafe.Pointer(&action[0])))<<32 | uint64(len(action))
+}
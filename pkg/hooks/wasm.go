@@ -0,0 +1,245 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Module is a Hook running a WASM module implementing the request hook ABI:
+//
+//	alloc(size i32) i32          returns the address of size bytes the request is written to
+//	handle(ptr i32, len i32) i64 returns the address and the length of the action, 0 leaves the request untouched
+//
+// packed as address<<32 | length. The request and the action are JSON encoded, the request with the fields
+// method, path, query, header, appId, cluster, namespace, ip, userAgent, sdk and sdkVersion, the action with
+// the keys of the actions of a Script. The module exports its memory, it may import WASI and export _initialize.
+// Concurrent requests are handled by distinct instances of the module, an instance is reused by later requests
+// so the module may keep state between the calls. A module failing on a request answers it with a 500 telling the error
+type Module struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	// timeout bounds a call of the module
+	timeout time.Duration
+	// idle are the instances waiting for a request
+	idle chan api.Module
+}
+
+// moduleTimeout bounds a call of a module, so that a looping module fails instead of hanging
+const moduleTimeout = time.Second
+
+// maxIdleInstances is the number of instances of a module kept between the requests
+const maxIdleInstances = 16
+
+// moduleRequest is the JSON request passed to a module
+type moduleRequest struct {
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	Query      url.Values  `json:"query"`
+	Header     http.Header `json:"header"`
+	AppID      string      `json:"appId"`
+	Cluster    string      `json:"cluster"`
+	Namespace  string      `json:"namespace"`
+	IP         string      `json:"ip"`
+	UserAgent  string      `json:"userAgent"`
+	SDK        string      `json:"sdk"`
+	SDKVersion string      `json:"sdkVersion"`
+}
+
+// moduleAction is the JSON action returned by a module
+type moduleAction struct {
+	Delay         string            `json:"delay"`
+	Drop          bool              `json:"drop"`
+	Status        int               `json:"status"`
+	Body          string            `json:"body"`
+	Headers       map[string]string `json:"headers"`
+	Properties    map[string]string `json:"properties"`
+	Label         string            `json:"label"`
+	Charset       *string           `json:"charset"`
+	UnicodeEscape *bool             `json:"unicodeEscape"`
+}
+
+// LoadModule compiles the WASM module at path
+func LoadModule(path string) (*Module, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := CompileModule(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// CompileModule compiles a WASM module, checking that it implements the ABI
+func CompileModule(binary []byte) (*Module, error) {
+	ctx := context.Background()
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, rt); err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	compiled, err := rt.CompileModule(ctx, binary)
+	if err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	m := &Module{runtime: rt, compiled: compiled, timeout: moduleTimeout, idle: make(chan api.Module, maxIdleInstances)}
+	// an instance is created upfront to report a broken module at startup
+	inst, err := m.instantiate(ctx)
+	if err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	m.release(inst)
+	return m, nil
+}
+
+func (m *Module) instantiate(ctx context.Context) (api.Module, error) {
+	inst, err := m.runtime.InstantiateModule(ctx, m.compiled, wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range []string{"alloc", "handle"} {
+		if inst.ExportedFunction(fn) == nil {
+			inst.Close(ctx)
+			return nil, fmt.Errorf("no %s function exported", fn)
+		}
+	}
+	if inst.Memory() == nil {
+		inst.Close(ctx)
+		return nil, errors.New("no memory exported")
+	}
+	return inst, nil
+}
+
+// acquire returns an idle instance or a new one
+func (m *Module) acquire(ctx context.Context) (api.Module, error) {
+	select {
+	case inst := <-m.idle:
+		return inst, nil
+	default:
+		return m.instantiate(ctx)
+	}
+}
+
+// release keeps an instance for a later request, or closes it if enough are idle
+func (m *Module) release(inst api.Module) {
+	select {
+	case m.idle <- inst:
+	default:
+		inst.Close(context.Background())
+	}
+}
+
+// Close releases the runtime of the module
+func (m *Module) Close() error {
+	return m.runtime.Close(context.Background())
+}
+
+// Handle returns the action returned by the handle function of the module for r
+func (m *Module) Handle(r Request) (Action, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	inst, err := m.acquire(ctx)
+	if err != nil {
+		return moduleFailed(err), true
+	}
+	res, err := call(ctx, inst, r)
+	if err != nil {
+		// the instance may be left broken, e.g. closed on the timeout
+		inst.Close(context.Background())
+		return moduleFailed(err), true
+	}
+	m.release(inst)
+	if res == nil {
+		return Action{}, false
+	}
+	a, err := res.action()
+	if err != nil {
+		return moduleFailed(err), true
+	}
+	return a, true
+}
+
+// call passes r to the handle function of inst, it returns a nil action if the request is left untouched
+func call(ctx context.Context, inst api.Module, r Request) (*moduleAction, error) {
+	name, version := SDK(r.UserAgent)
+	req, _ := json.Marshal(&moduleRequest{
+		Method:     r.Method,
+		Path:       r.Path,
+		Query:      r.Query,
+		Header:     r.Header,
+		AppID:      r.AppID,
+		Cluster:    r.Cluster,
+		Namespace:  r.Namespace,
+		IP:         r.ClientIP,
+		UserAgent:  r.UserAgent,
+		SDK:        name,
+		SDKVersion: version,
+	})
+	ret, err := inst.ExportedFunction("alloc").Call(ctx, uint64(len(req)))
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(ret[0])
+	if !inst.Memory().Write(ptr, req) {
+		return nil, fmt.Errorf("alloc returned %d out of the memory", ptr)
+	}
+	ret, err = inst.ExportedFunction("handle").Call(ctx, uint64(ptr), uint64(len(req)))
+	if err != nil {
+		return nil, err
+	}
+	if ret[0] == 0 {
+		return nil, nil
+	}
+	b, ok := inst.Memory().Read(uint32(ret[0]>>32), uint32(ret[0]))
+	if !ok {
+		return nil, fmt.Errorf("handle returned an action out of the memory")
+	}
+	a := &moduleAction{}
+	if err := json.Unmarshal(b, a); err != nil {
+		return nil, fmt.Errorf("invalid action: %v", err)
+	}
+	return a, nil
+}
+
+// action converts the action returned by a module
+func (ma *moduleAction) action() (Action, error) {
+	a := Action{
+		Drop:          ma.Drop,
+		Status:        ma.Status,
+		Body:          ma.Body,
+		Headers:       ma.Headers,
+		Properties:    ma.Properties,
+		Label:         ma.Label,
+		Charset:       ma.Charset,
+		UnicodeEscape: ma.UnicodeEscape,
+	}
+	if ma.Delay != "" {
+		d, err := time.ParseDuration(ma.Delay)
+		if err != nil || d < 0 {
+			return a, fmt.Errorf("invalid delay %q", ma.Delay)
+		}
+		a.Delay = d
+	}
+	if a.Status != 0 && (a.Status < 100 || a.Status > 999) {
+		return a, fmt.Errorf("invalid status %d", a.Status)
+	}
+	return a, nil
+}
+
+// moduleFailed is the action answering a request the module failed on
+func moduleFailed(err error) Action {
+	return Action{Status: 500, Body: "hook module: " + err.Error()}
+}
@@ -0,0 +1,102 @@
+// Package jasypt encrypts property values the way jasypt-spring-boot decrypts them, in the ENC(...) form
+// of its default PBEWITHHMACSHA512ANDAES_256 algorithm
+package jasypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Prefix and Suffix enclose the encrypted values decrypted by jasypt-spring-boot
+const (
+	Prefix = "ENC("
+	Suffix = ")"
+)
+
+const (
+	// iterations of the key derivation, as with the defaults of jasypt-spring-boot
+	iterations = 1000
+	saltSize   = aes.BlockSize
+	keySize    = 32
+)
+
+// Encrypt returns plaintext encrypted with password in the ENC(...) form, salted with random bytes
+func Encrypt(password string, plaintext string) (string, error) {
+	salt := make([]byte, saltSize)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(deriveKey(password, salt))
+	if err != nil {
+		return "", err
+	}
+	// PKCS#5 padding
+	pad := aes.BlockSize - len(plaintext)%aes.BlockSize
+	b := append([]byte(plaintext), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(b, b)
+	// the salt and the iv lead the result, like jasypt does
+	out := append(append(salt, iv...), b...)
+	return Prefix + base64.StdEncoding.EncodeToString(out) + Suffix, nil
+}
+
+// Decrypt returns the plaintext of a value encrypted with password, in the ENC(...) form or not
+func Decrypt(password string, value string) (string, error) {
+	if strings.HasPrefix(value, Prefix) && strings.HasSuffix(value, Suffix) {
+		value = value[len(Prefix) : len(value)-len(Suffix)]
+	}
+	b, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	if len(b) < saltSize+2*aes.BlockSize || (len(b)-saltSize)%aes.BlockSize != 0 {
+		return "", errors.New("invalid jasypt value")
+	}
+	salt, iv, b := b[:saltSize], b[saltSize:saltSize+aes.BlockSize], b[saltSize+aes.BlockSize:]
+	block, err := aes.NewCipher(deriveKey(password, salt))
+	if err != nil {
+		return "", err
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(b, b)
+	pad := int(b[len(b)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(b[len(b)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return "", errors.New("invalid jasypt password")
+	}
+	return string(b[:len(b)-pad]), nil
+}
+
+// deriveKey derives the AES key of password and salt with PBKDF2-HMAC-SHA512
+func deriveKey(password string, salt []byte) []byte {
+	prf := hmac.New(sha512.New, []byte(password))
+	var key []byte
+	for i := uint32(1); len(key) < keySize; i++ {
+		prf.Reset()
+		prf.Write(salt)
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], i)
+		prf.Write(n[:])
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for j := 1; j < iterations; j++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for k := range t {
+				t[k] ^= u[k]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keySize]
+}
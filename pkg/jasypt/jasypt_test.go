@@ -0,0 +1,33 @@
+package jasypt
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJasypt(t *testing.T) {
+	enc, err := Encrypt("secret", "hello jasypt")
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(enc, Prefix) && strings.HasSuffix(enc, Suffix))
+	v, err := Decrypt("secret", enc)
+	require.Nil(t, err)
+	require.Equal(t, "hello jasypt", v)
+
+	// the salt is random
+	again, err := Encrypt("secret", "hello jasypt")
+	require.Nil(t, err)
+	require.NotEqual(t, enc, again)
+
+	// encrypted by PBKDF2WithHmacSHA512 and AES/CBC/PKCS5Padding elsewhere, with a fixed salt and iv
+	fixed := "ENC(AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh9Iz4E9mZgE2UyTxEMKHJi/)"
+	v, err = Decrypt("secret", fixed)
+	require.Nil(t, err)
+	require.Equal(t, "hello jasypt", v)
+
+	_, err = Decrypt("wrong", fixed)
+	require.EqualError(t, err, "invalid jasypt password")
+	_, err = Decrypt("secret", "ENC(c2hvcnQ=)")
+	require.EqualError(t, err, "invalid jasypt value")
+}
@@ -26,61 +26,102 @@ type Notification struct {
 	Namespace string `json:"namespaceName"`
 }
 
-// Poll provides long polling functionality with an ability to notify the client at most once
+// Reason tells why a poll completed
+type Reason int
+
+// reasons of the completion of a poll
+const (
+	// Changed is a poll notified of changed namespaces
+	Changed Reason = iota
+	// TimedOut is a poll completed with no change after its timeout
+	TimedOut
+	// Cancelled is a poll whose context was done, e.g. the client went away
+	Cancelled
+	// Closed is a poll closed with no change
+	Closed
+)
+
+func (r Reason) String() string {
+	switch r {
+	case Changed:
+		return "changed"
+	case TimedOut:
+		return "timed out"
+	case Cancelled:
+		return "cancelled"
+	case Closed:
+		return "closed"
+	}
+	return fmt.Sprintf("Reason(%d)", int(r))
+}
+
+// Result is the outcome of a poll
+type Result struct {
+	Reason Reason
+	// Changed are the changed namespaces with their new notification ids if the Reason is Changed
+	Changed []Notification
+}
+
+// Poll provides long polling functionality with an ability to notify the client at most once,
+// the transport of the client responds with the Result once the poll is done
 type Poll struct {
 	mu      sync.Mutex
-	ctx     context.Context
 	updated bool
 	ns      []Notification
-	c       chan<- struct{}
+	c       chan []Notification
+	once    sync.Once
+	closing chan struct{}
+	// done is closed once result is set
+	done   chan struct{}
+	result Result
 }
 
-// New creates a new long Poll
-func New(ctx context.Context, cfg Config, w http.ResponseWriter) (*Poll, error) {
+// New creates a new long Poll completing once it's updated, closed, timed out or ctx is done
+func New(ctx context.Context, cfg Config) (*Poll, error) {
 	validateConfig(&cfg)
-	// pollCtx is used to check whether the poll is still open
-	// it is guaranteed to be done only after the input ctx is done
-	// and a response has been written to w
-	pollCtx, cancel := context.WithCancel(context.Background())
-	c := make(chan struct{})
 	done := time.After(cfg.Timeout)
 	p := &Poll{
-		ctx:     pollCtx,
 		updated: false,
 		ns:      cfg.Notifications,
-		c:       c,
+		c:       make(chan []Notification),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
 	}
 	go func() {
-		defer func() {
-			cancel()
-			// make sure there is no deadlock incase
-			// there is an update event received while closing pole
-			select {
-			case <-c:
-				cfg.Log.Get().Debug("poll chan received event while closing")
-			default:
-				// expected behaviour, do nothing
-			}
-		}()
+		defer close(p.done)
 		select {
 		case <-ctx.Done():
 			cfg.Log.Get().Debug("poll context was cancelled, stopped watching for a change")
-			w.WriteHeader(304)
+			p.result = Result{Reason: Cancelled}
 		case <-done:
 			cfg.Log.Get().Debug("poll timed out with no updates")
-			w.WriteHeader(304)
-		case <-c:
+			p.result = Result{Reason: TimedOut}
+		case <-p.closing:
+			cfg.Log.Get().Debug("poll was closed with no updates")
+			p.result = Result{Reason: Closed}
+		case changed := <-p.c:
 			cfg.Log.Get().Info("poll received a change notification")
-			res, _ := json.Marshal(p.ns)
-			_, err := w.Write(res)
-			if err != nil {
-				cfg.Log.Get().Error(fmt.Sprintf("error writing poll rsp: %v\n", err))
-			}
+			p.result = Result{Reason: Changed, Changed: changed}
 		}
 	}()
 	return p, nil
 }
 
+// WriteResult writes the response of Apollo to a completed poll,
+// the changed namespaces or 304 with no body if there was no change
+func WriteResult(w http.ResponseWriter, res Result) error {
+	if res.Reason != Changed {
+		w.WriteHeader(304)
+		return nil
+	}
+	b, err := json.Marshal(res.Changed)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
 func validateConfig(cfg *Config) {
 	if cfg.Timeout == 0 {
 		cfg.Timeout = time.Minute
@@ -90,18 +131,36 @@ func validateConfig(cfg *Config) {
 	}
 }
 
-// Wait waits until poll is closed
-func (p *Poll) Wait() {
-	<-p.ctx.Done()
+// Notifications returns the notifications the poll is watching
+func (p *Poll) Notifications() []Notification {
+	return p.ns
+}
+
+// Done returns a channel closed once the poll completed
+func (p *Poll) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait waits until the poll completed and returns its outcome
+func (p *Poll) Wait() Result {
+	<-p.done
+	return p.result
 }
 
-// Update notifies the client of a version change
-func (p *Poll) Update() error {
+// Close completes the poll with no change unless an update has already been sent
+func (p *Poll) Close() {
+	p.once.Do(func() {
+		close(p.closing)
+	})
+}
+
+// Update notifies the client of the changed namespaces with their new notification ids
+func (p *Poll) Update(changed []Notification) error {
 	// mutex guarantees that multiple concurrent calls to Update func will be handled gracefully
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	select {
-	case <-p.ctx.Done():
+	case <-p.done:
 		return errors.New("poll is closed")
 	default:
 		if p.updated {
@@ -109,7 +168,12 @@ func (p *Poll) Update() error {
 		}
 	}
 
-	p.c <- struct{}{}
+	// the poll may close while the update is being delivered
+	select {
+	case p.c <- changed:
+	case <-p.done:
+		return errors.New("poll is closed")
+	}
 	p.updated = true
 	return nil
 }
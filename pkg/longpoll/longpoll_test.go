@@ -12,53 +12,63 @@ import (
 
 func TestPoll(t *testing.T) {
 	t.Run("update", func(t *testing.T) {
-		recorder := httptest.NewRecorder()
 		ctx := context.Background()
-		poll, err := New(ctx, Config{Notifications: []Notification{{1, "test"}}, Timeout: time.Second}, recorder)
+		poll, err := New(ctx, Config{Notifications: []Notification{{1, "test"}}, Timeout: time.Second})
 		require.Nil(t, err)
-		require.Nil(t, poll.Update())
-
-		poll.Wait()
-
-		res := recorder.Result()
-		b, err := io.ReadAll(res.Body)
-		require.Nil(t, err)
-		require.Equal(t, 200, res.StatusCode)
-		require.JSONEq(t, `[{"namespaceName": "test","notificationId": 1}]`, string(b))
-
+		require.Nil(t, poll.Update([]Notification{{2, "test"}}))
+		require.Equal(t, Result{Reason: Changed, Changed: []Notification{{2, "test"}}}, poll.Wait())
 		// no further updates should be accepted now
-		require.Error(t, poll.Update())
+		require.Error(t, poll.Update(poll.Notifications()))
 	})
 
 	t.Run("no change", func(t *testing.T) {
-		recorder := httptest.NewRecorder()
 		ctx := context.Background()
-		poll, err := New(ctx, Config{Notifications: []Notification{{1, "test"}}, Timeout: time.Millisecond}, recorder)
+		poll, err := New(ctx, Config{Notifications: []Notification{{1, "test"}}, Timeout: time.Millisecond})
 		require.Nil(t, err)
-
-		poll.Wait()
-
-		res := recorder.Result()
-		b, err := io.ReadAll(res.Body)
-		require.Nil(t, err)
-		require.Equal(t, 304, res.StatusCode)
-		require.Equal(t, "", string(b))
+		<-poll.Done()
+		require.Equal(t, Result{Reason: TimedOut}, poll.Wait())
 	})
 
 	t.Run("client canceled", func(t *testing.T) {
-		recorder := httptest.NewRecorder()
 		ctx, cancel := context.WithCancel(context.Background())
-		poll, err := New(ctx, Config{Notifications: []Notification{{1, "test"}}, Timeout: time.Second}, recorder)
+		poll, err := New(ctx, Config{Notifications: []Notification{{1, "test"}}, Timeout: time.Second})
 		require.Nil(t, err)
 		// mock cancel from the client
 		cancel()
+		require.Equal(t, Result{Reason: Cancelled}, poll.Wait())
+	})
 
-		poll.Wait()
+	t.Run("closed", func(t *testing.T) {
+		ctx := context.Background()
+		poll, err := New(ctx, Config{Notifications: []Notification{{1, "test"}}, Timeout: time.Second})
+		require.Nil(t, err)
+		poll.Close()
+		poll.Close()
+		require.Equal(t, Result{Reason: Closed}, poll.Wait())
+		require.Error(t, poll.Update(poll.Notifications()))
+	})
+}
 
+func TestWriteResult(t *testing.T) {
+	t.Run("changed", func(t *testing.T) {
+		recorder := httptest.NewRecorder()
+		require.Nil(t, WriteResult(recorder, Result{Reason: Changed, Changed: []Notification{{2, "test"}}}))
 		res := recorder.Result()
 		b, err := io.ReadAll(res.Body)
 		require.Nil(t, err)
-		require.Equal(t, 304, res.StatusCode)
-		require.Equal(t, "", string(b))
+		require.Equal(t, 200, res.StatusCode)
+		require.JSONEq(t, `[{"namespaceName": "test","notificationId": 2}]`, string(b))
+	})
+
+	t.Run("no change", func(t *testing.T) {
+		for _, reason := range []Reason{TimedOut, Cancelled, Closed} {
+			recorder := httptest.NewRecorder()
+			require.Nil(t, WriteResult(recorder, Result{Reason: reason}))
+			res := recorder.Result()
+			b, err := io.ReadAll(res.Body)
+			require.Nil(t, err)
+			require.Equal(t, 304, res.StatusCode, reason.String())
+			require.Equal(t, "", string(b))
+		}
 	})
 }
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DashboardTitle is the title of the generated Grafana dashboard
+const DashboardTitle = "mock-apollo-go"
+
+type dashboard struct {
+	Title         string            `json:"title"`
+	UID           string            `json:"uid"`
+	SchemaVersion int               `json:"schemaVersion"`
+	Refresh       string            `json:"refresh"`
+	Time          map[string]string `json:"time"`
+	Templating    templating        `json:"templating"`
+	Panels        []panel           `json:"panels"`
+}
+
+type templating struct {
+	List []variable `json:"list"`
+}
+
+type variable struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Type  string `json:"type"`
+	Query string `json:"query"`
+}
+
+type panel struct {
+	ID          int      `json:"id"`
+	Type        string   `json:"type"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Datasource  string   `json:"datasource"`
+	GridPos     gridPos  `json:"gridPos"`
+	Targets     []target `json:"targets"`
+}
+
+type gridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type target struct {
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+	RefID        string `json:"refId"`
+}
+
+// Dashboard generates a Grafana dashboard with one panel per registered metric
+func (r *Registry) Dashboard() ([]byte, error) {
+	d := dashboard{
+		Title:         DashboardTitle,
+		UID:           DashboardTitle,
+		SchemaVersion: 27,
+		Refresh:       "30s",
+		Time:          map[string]string{"from": "now-1h", "to": "now"},
+		Templating: templating{List: []variable{{
+			Name:  "datasource",
+			Label: "Data source",
+			Type:  "datasource",
+			Query: "prometheus",
+		}}},
+		Panels: []panel{},
+	}
+	for i, desc := range r.Descs() {
+		expr := desc.Name
+		if desc.Kind == Counter {
+			expr = fmt.Sprintf("rate(%s[5m])", desc.Name)
+		}
+		legend := "{{instance}}"
+		if len(desc.Labels) > 0 {
+			expr = fmt.Sprintf("sum by (%s) (%s)", strings.Join(desc.Labels, ", "), expr)
+			legend = "{{" + strings.Join(desc.Labels, "}} {{") + "}}"
+		}
+		d.Panels = append(d.Panels, panel{
+			ID:          i + 1,
+			Type:        "timeseries",
+			Title:       desc.Name,
+			Description: desc.Help,
+			Datasource:  "${datasource}",
+			GridPos:     gridPos{H: 8, W: 12, X: (i % 2) * 12, Y: (i / 2) * 8},
+			Targets: []target{{
+				Expr:         expr,
+				LegendFormat: legend,
+				RefID:        "A",
+			}},
+		})
+	}
+	return json.MarshalIndent(d, "", "  ")
+}
+
+// DashboardHandler serves the Grafana dashboard of a Registry
+func DashboardHandler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, err := r.Dashboard()
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
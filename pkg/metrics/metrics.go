@@ -0,0 +1,214 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Kind is the type of a metric
+type Kind string
+
+// supported metric kinds
+const (
+	Counter Kind = "counter"
+	Gauge   Kind = "gauge"
+)
+
+// Desc describes a registered metric
+type Desc struct {
+	Name   string
+	Help   string
+	Kind   Kind
+	Labels []string
+}
+
+// Sample is a single value of a metric with its label values
+type Sample struct {
+	Desc   Desc
+	Labels []string
+	Value  float64
+}
+
+// Metric holds the values of a metric per label combination
+type Metric struct {
+	mu     sync.Mutex
+	desc   Desc
+	values map[string]*Sample
+	// parent holds the values of a metric returned by With, prefix are the label values it was given
+	parent *Metric
+	prefix []string
+}
+
+// Registry holds a set of metrics
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*Metric
+	names   map[string]*Metric
+}
+
+// NewRegistry creates a new Registry
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]*Metric)}
+}
+
+// Counter registers a counter, or returns the existing one of the same name
+func (r *Registry) Counter(name string, help string, labels ...string) *Metric {
+	return r.register(Desc{Name: name, Help: help, Kind: Counter, Labels: labels})
+}
+
+// Gauge registers a gauge, or returns the existing one of the same name
+func (r *Registry) Gauge(name string, help string, labels ...string) *Metric {
+	return r.register(Desc{Name: name, Help: help, Kind: Gauge, Labels: labels})
+}
+
+func (r *Registry) register(desc Desc) *Metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m, ok := r.names[desc.Name]; ok {
+		return m
+	}
+	m := &Metric{desc: desc, values: make(map[string]*Sample)}
+	r.metrics = append(r.metrics, m)
+	r.names[desc.Name] = m
+	return m
+}
+
+// Descs returns the descriptions of all registered metrics in registration order
+func (r *Registry) Descs() []Desc {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	descs := make([]Desc, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		descs = append(descs, m.desc)
+	}
+	return descs
+}
+
+// Gather returns a snapshot of all metric values
+func (r *Registry) Gather() []Sample {
+	r.mu.Lock()
+	metrics := append([]*Metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	samples := []Sample{}
+	for _, m := range metrics {
+		samples = append(samples, m.samples()...)
+	}
+	return samples
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.mu.Lock()
+	metrics := append([]*Metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	var b strings.Builder
+	for _, m := range metrics {
+		d := m.desc
+		fmt.Fprintf(&b, "# HELP %s %s\n", d.Name, d.Help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", d.Name, d.Kind)
+		for _, s := range m.samples() {
+			b.WriteString(d.Name)
+			if len(d.Labels) > 0 {
+				pairs := make([]string, len(d.Labels))
+				for i, l := range d.Labels {
+					pairs[i] = fmt.Sprintf("%s=%s", l, strconv.Quote(s.Labels[i]))
+				}
+				b.WriteString("{" + strings.Join(pairs, ",") + "}")
+			}
+			b.WriteString(" " + strconv.FormatFloat(s.Value, 'g', -1, 64) + "\n")
+		}
+	}
+	w.Write([]byte(b.String()))
+}
+
+// Desc returns the description of the metric
+func (m *Metric) Desc() Desc {
+	return m.desc
+}
+
+// With returns the metric with its leading labels set to labels,
+// its methods are passed the values of the remaining labels
+func (m *Metric) With(labels ...string) *Metric {
+	root, labels := m.root(labels)
+	return &Metric{desc: root.desc, parent: root, prefix: labels}
+}
+
+// root returns the registered metric holding the values of m, with the label values of m prepended to labels
+func (m *Metric) root(labels []string) (*Metric, []string) {
+	if m.parent == nil {
+		return m, labels
+	}
+	return m.parent, append(append([]string{}, m.prefix...), labels...)
+}
+
+// Inc increments the metric by 1
+func (m *Metric) Inc(labels ...string) {
+	m.Add(1, labels...)
+}
+
+// Dec decrements the metric by 1
+func (m *Metric) Dec(labels ...string) {
+	m.Add(-1, labels...)
+}
+
+// Add adds v to the metric
+func (m *Metric) Add(v float64, labels ...string) {
+	m, labels = m.root(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sample(labels).Value += v
+}
+
+// Set sets the metric to v
+func (m *Metric) Set(v float64, labels ...string) {
+	m, labels = m.root(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sample(labels).Value = v
+}
+
+// Value returns the current value of the metric
+func (m *Metric) Value(labels ...string) float64 {
+	m, labels = m.root(labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.values[strings.Join(labels, "\xff")]; ok {
+		return s.Value
+	}
+	return 0
+}
+
+func (m *Metric) sample(labels []string) *Sample {
+	if len(labels) != len(m.desc.Labels) {
+		panic(fmt.Sprintf("metric %s expects %d labels, got %d", m.desc.Name, len(m.desc.Labels), len(labels)))
+	}
+	key := strings.Join(labels, "\xff")
+	s, ok := m.values[key]
+	if !ok {
+		s = &Sample{Desc: m.desc, Labels: append([]string{}, labels...)}
+		m.values[key] = s
+	}
+	return s
+}
+
+func (m *Metric) samples() []Sample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	samples := make([]Sample, 0, len(keys))
+	for _, k := range keys {
+		samples = append(samples, *m.values[k])
+	}
+	return samples
+}
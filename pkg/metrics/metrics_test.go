@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.Counter("requests_total", "Requests served.", "code")
+	g := reg.Gauge("polls_active", "Open polls.")
+	require.Equal(t, c, reg.Counter("requests_total", "Requests served.", "code"))
+
+	c.Inc("200")
+	c.Add(2, "200")
+	c.Inc("404")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	require.Equal(t, float64(3), c.Value("200"))
+	require.Equal(t, float64(1), g.Value())
+	require.Equal(t, float64(0), c.Value("500"))
+	require.Panics(t, func() { c.Inc() })
+
+	t.Run("with", func(t *testing.T) {
+		reg := NewRegistry()
+		m := reg.Counter("requests_total", "Requests served.", "env", "route", "code")
+		dev := m.With("DEV")
+		dev.Inc("/configs", "200")
+		dev.With("/configs").Add(2, "200")
+		m.With("PRO").Inc("/configs", "200")
+		require.Equal(t, float64(3), dev.Value("/configs", "200"))
+		require.Equal(t, float64(3), m.Value("DEV", "/configs", "200"))
+		require.Equal(t, float64(1), m.Value("PRO", "/configs", "200"))
+		require.Equal(t, m.Desc(), dev.Desc())
+		require.Panics(t, func() { dev.Inc("200") })
+		require.Len(t, reg.Gather(), 2)
+	})
+
+	require.Equal(t, []Desc{c.Desc(), g.Desc()}, reg.Descs())
+	require.Len(t, reg.Gather(), 3)
+
+	t.Run("prometheus", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		reg.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		b, err := io.ReadAll(w.Result().Body)
+		require.Nil(t, err)
+		require.Equal(t, `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{code="200"} 3
+requests_total{code="404"} 1
+# HELP polls_active Open polls.
+# TYPE polls_active gauge
+polls_active 1
+`, string(b))
+	})
+}
+
+func TestStatsD(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer pc.Close()
+
+	reg := NewRegistry()
+	c := reg.Counter("requests_total", "Requests served.", "code")
+	g := reg.Gauge("polls_active", "Open polls.")
+	c.Add(2, "200")
+	c.Inc("")
+	g.Set(5)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := NewStatsD(ctx, StatsDConfig{
+		Addr:     pc.LocalAddr().String(),
+		Prefix:   "mock.",
+		Interval: time.Hour,
+		Tags:     []string{"env:test"},
+	}, reg)
+	require.Nil(t, err)
+
+	// empty labels are left out
+	require.Equal(t, []string{
+		"mock.requests_total:1|c|#env:test",
+		"mock.requests_total:2|c|#env:test,code:200",
+		"mock.polls_active:5|g|#env:test",
+	}, s.lines())
+
+	// counters are pushed as deltas
+	c.Inc("200")
+	require.Equal(t, []string{
+		"mock.requests_total:1|c|#env:test,code:200",
+		"mock.polls_active:5|g|#env:test",
+	}, s.lines())
+
+	// metrics are flushed when ctx is done
+	g.Set(1)
+	cancel()
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 512)
+	n, _, err := pc.ReadFrom(buf)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(string(buf[:n]), "mock.polls_active:1|g"), string(buf[:n]))
+}
+
+func TestDashboard(t *testing.T) {
+	reg := NewRegistry()
+	reg.Counter("requests_total", "Requests served.", "route", "code")
+	reg.Gauge("polls_active", "Open polls.")
+
+	w := httptest.NewRecorder()
+	DashboardHandler(reg).ServeHTTP(w, httptest.NewRequest("GET", "/admin/dashboard.json", nil))
+	rsp := w.Result()
+	require.Equal(t, 200, rsp.StatusCode)
+	require.Equal(t, "application/json", rsp.Header.Get("Content-Type"))
+
+	d := dashboard{}
+	require.Nil(t, json.NewDecoder(rsp.Body).Decode(&d))
+	require.Equal(t, DashboardTitle, d.Title)
+	require.Len(t, d.Panels, 2)
+	require.Equal(t, "requests_total", d.Panels[0].Title)
+	require.Equal(t, "sum by (route, code) (rate(requests_total[5m]))", d.Panels[0].Targets[0].Expr)
+	require.Equal(t, "{{route}} {{code}}", d.Panels[0].Targets[0].LegendFormat)
+	require.Equal(t, "polls_active", d.Panels[1].Targets[0].Expr)
+	require.Equal(t, gridPos{H: 8, W: 12, X: 12, Y: 0}, d.Panels[1].GridPos)
+}
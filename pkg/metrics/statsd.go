@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lalamove/nui/nlogger"
+)
+
+// StatsDConfig is an object that stores the StatsD pusher config
+type StatsDConfig struct {
+	Log      nlogger.Provider
+	Addr     string
+	Prefix   string
+	Interval time.Duration
+	// Tags are appended to every metric in the DogStatsD format, e.g. env:dev
+	Tags []string
+}
+
+// StatsD periodically pushes the metrics of a Registry to a StatsD agent
+type StatsD struct {
+	cfg  StatsDConfig
+	reg  *Registry
+	conn net.Conn
+	last map[string]float64
+}
+
+// NewStatsD creates a new StatsD pusher which pushes until ctx is done
+func NewStatsD(ctx context.Context, cfg StatsDConfig, reg *Registry) (*StatsD, error) {
+	validateStatsDConfig(&cfg)
+	conn, err := net.Dial("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &StatsD{
+		cfg:  cfg,
+		reg:  reg,
+		conn: conn,
+		last: make(map[string]float64),
+	}
+	go func() {
+		t := time.NewTicker(cfg.Interval)
+		defer t.Stop()
+		defer conn.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				s.push()
+				return
+			case <-t.C:
+				s.push()
+			}
+		}
+	}()
+	return s, nil
+}
+
+func validateStatsDConfig(cfg *StatsDConfig) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.Log == nil {
+		cfg.Log = nlogger.NewProvider(nlogger.New(os.Stdout, ""))
+	}
+}
+
+// push sends the current metric values, counters are sent as deltas since the last push
+func (s *StatsD) push() {
+	for _, line := range s.lines() {
+		if _, err := s.conn.Write([]byte(line)); err != nil {
+			s.cfg.Log.Get().Warn(fmt.Sprintf("error pushing statsd metric: %v", err))
+			return
+		}
+	}
+}
+
+func (s *StatsD) lines() []string {
+	lines := []string{}
+	for _, sample := range s.reg.Gather() {
+		tags := append([]string{}, s.cfg.Tags...)
+		for i, l := range sample.Desc.Labels {
+			// an empty label is left out like with Prometheus
+			if sample.Labels[i] != "" {
+				tags = append(tags, l+":"+sample.Labels[i])
+			}
+		}
+		name := s.cfg.Prefix + sample.Desc.Name
+		v := sample.Value
+		t := "g"
+		if sample.Desc.Kind == Counter {
+			key := name + "\xff" + strings.Join(sample.Labels, "\xff")
+			v, s.last[key] = v-s.last[key], v
+			if v == 0 {
+				continue
+			}
+			t = "c"
+		}
+		line := name + ":" + strconv.FormatFloat(v, 'g', -1, 64) + "|" + t
+		if len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,136 @@
+// Package mockapollo embeds the mock Apollo config server into Go programs and tests
+//
+//	func TestClient(t *testing.T) {
+//		srv := mockapollo.Start(t, `
+//	myAppID:
+//	  myCluster:
+//	    application:
+//	      properties: {feature: "on"}
+//	`)
+//		client := newClient(srv.URL())
+//		...
+//	}
+package mockapollo
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/figroc/mock-apollo-go/internal/routes/apollo"
+	"github.com/figroc/mock-apollo-go/pkg/auth"
+	"github.com/figroc/mock-apollo-go/pkg/store"
+	"github.com/julienschmidt/httprouter"
+	"github.com/lalamove/nui/nlogger"
+)
+
+// Config is an object that stores the package config
+type Config struct {
+	Log nlogger.Provider
+	// Files are the served config files, earlier files take precedence
+	Files []string
+	// Addr is the address the server listens on, empty means a random port of 127.0.0.1
+	Addr string
+	// PollTimeout is the long poll timeout, 0 means the default of a minute
+	PollTimeout time.Duration
+	// Authenticator authenticates the requests of the config routes, nil means no authentication
+	Authenticator auth.Authenticator
+	// Envs are the envs, e.g. DEV, served under /envs/{env} from the envs sections of the files
+	Envs []string
+}
+
+// Server is a mock Apollo config server
+type Server struct {
+	a      *apollo.Apollo
+	srv    *http.Server
+	ln     net.Listener
+	cancel context.CancelFunc
+}
+
+// New starts a server serving the config files until it is closed or ctx is done
+func New(ctx context.Context, cfg Config) (*Server, error) {
+	validateConfig(&cfg)
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	a, err := apollo.New(ctx, apollo.Config{
+		Log:           cfg.Log,
+		ConfigPath:    cfg.Files,
+		PollTimeout:   cfg.PollTimeout,
+		Port:          ln.Addr().(*net.TCPAddr).Port,
+		Authenticator: cfg.Authenticator,
+		Envs:          cfg.Envs,
+	})
+	if err != nil {
+		cancel()
+		ln.Close()
+		return nil, err
+	}
+	router := httprouter.New()
+	a.Routes(router)
+	a.OpenAPIRoutes(router)
+	s := &Server{
+		a:      a,
+		srv:    &http.Server{Handler: router},
+		ln:     ln,
+		cancel: cancel,
+	}
+	go s.srv.Serve(ln)
+	return s, nil
+}
+
+func validateConfig(cfg *Config) {
+	if cfg.Log == nil {
+		cfg.Log = nlogger.NewProvider(nlogger.New(os.Stdout, ""))
+	}
+	if cfg.Addr == "" {
+		cfg.Addr = "127.0.0.1:0"
+	}
+}
+
+// Start starts a server serving configYAML, in the format of the config files, for the duration of a test
+func Start(t testing.TB, configYAML string) *Server {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(configYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(context.Background(), Config{
+		Log:   nlogger.NewProvider(nlogger.New(io.Discard, "")),
+		Files: []string{path},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+	})
+	return s
+}
+
+// URL returns the base URL of the server, e.g. http://127.0.0.1:54321
+func (s *Server) URL() string {
+	return "http://" + s.ln.Addr().String()
+}
+
+// Store returns the store of the served namespaces, namespaces upserted into it
+// take precedence over the config files and notify the long polls watching them
+func (s *Server) Store() store.Store {
+	return s.a.Store()
+}
+
+// Close completes the open long polls and stops the server
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	defer s.cancel()
+	s.a.Shutdown(ctx)
+	return s.srv.Shutdown(ctx)
+}
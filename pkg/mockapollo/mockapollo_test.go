@@ -0,0 +1,88 @@
+package mockapollo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/figroc/mock-apollo-go/pkg/auth"
+	"github.com/figroc/mock-apollo-go/pkg/store"
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+	"github.com/lalamove/nui/nlogger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	srv := Start(t, `
+app:
+  cluster:
+    ns:
+      releaseKey: abc
+      properties: {feature: "on"}
+`)
+	get := func(path string) (int, string) {
+		rsp, err := http.Get(srv.URL() + path)
+		require.Nil(t, err)
+		defer rsp.Body.Close()
+		b, err := io.ReadAll(rsp.Body)
+		require.Nil(t, err)
+		return rsp.StatusCode, string(b)
+	}
+
+	t.Run("serve", func(t *testing.T) {
+		code, body := get("/configfiles/json/app/cluster/ns")
+		require.Equal(t, 200, code)
+		require.JSONEq(t, `{"feature":"on"}`, body)
+		code, _ = get("/configs/app/cluster/missing")
+		require.Equal(t, 404, code)
+	})
+
+	t.Run("store", func(t *testing.T) {
+		require.Nil(t, srv.Store().Upsert(store.Key{AppID: "app", Cluster: "cluster", Namespace: "ns"},
+			watcher.Namespace{ReleaseKey: "def", Properties: map[string]string{"feature": "off"}}))
+		code, body := get("/configfiles/json/app/cluster/ns")
+		require.Equal(t, 200, code)
+		require.JSONEq(t, `{"feature":"off"}`, body)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := New(context.Background(), Config{Files: []string{"/dev/null"}})
+		require.EqualError(t, err, "invalid config file")
+	})
+	t.Run("auth", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "config.yaml")
+		require.Nil(t, os.WriteFile(file, []byte("app:\n  cluster:\n    ns:\n      properties: {k: v}\napp2:\n  cluster:\n    ns:\n      properties: {k: v}\n"), 0644))
+		srv, err := New(context.Background(), Config{
+			Log:   nlogger.NewProvider(nlogger.New(io.Discard, "")),
+			Files: []string{file},
+			Authenticator: auth.AuthenticatorFunc(func(r auth.Request) (auth.Identity, error) {
+				if r.Header.Get("Authorization") != "Bearer token" {
+					return auth.Identity{}, errors.New("invalid token")
+				}
+				return auth.Identity{Subject: "client", AppIDs: []string{"app"}}, nil
+			}),
+		})
+		require.Nil(t, err)
+		defer srv.Close()
+		get := func(path string, token string) int {
+			req, err := http.NewRequest("GET", srv.URL()+path, nil)
+			require.Nil(t, err)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			rsp, err := http.DefaultClient.Do(req)
+			require.Nil(t, err)
+			rsp.Body.Close()
+			return rsp.StatusCode
+		}
+		require.Equal(t, 401, get("/configfiles/json/app/cluster/ns", ""))
+		require.Equal(t, 401, get("/configs/app/cluster/ns", "invalid"))
+		require.Equal(t, 200, get("/configfiles/json/app/cluster/ns", "token"))
+		require.Equal(t, 403, get("/configs/app2/cluster/ns", "token"))
+		require.Equal(t, 200, get("/healthz", ""))
+	})
+}
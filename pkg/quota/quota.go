@@ -0,0 +1,93 @@
+package quota
+
+import (
+	"sync"
+	"time"
+)
+
+// Config is an object that stores the quota config
+type Config struct {
+	// Limit is the default number of requests allowed per appId in a window, 0 means unlimited
+	Limit int
+	// AppLimits overrides Limit for specific appIds
+	AppLimits map[string]int
+	Window    time.Duration
+}
+
+// Result describes the quota state of an appId after a request has been counted
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+type bucket struct {
+	count int
+	reset time.Time
+}
+
+// Quota counts requests per appId over fixed time windows
+type Quota struct {
+	mu  sync.Mutex
+	cfg Config
+	// buckets are the windows of the appIds, the ones past their reset are swept once per window
+	// so that requests with arbitrary appIds are forgotten
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+// New creates a new Quota
+func New(cfg Config) *Quota {
+	validateConfig(&cfg)
+	return &Quota{
+		cfg:     cfg,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func validateConfig(cfg *Config) {
+	if cfg.Window <= 0 {
+		cfg.Window = time.Minute
+	}
+}
+
+// Limit returns the request limit of an appId, 0 means unlimited
+func (q *Quota) Limit(appID string) int {
+	if l, ok := q.cfg.AppLimits[appID]; ok {
+		return l
+	}
+	return q.cfg.Limit
+}
+
+// Take counts a request for the appId and reports whether it is within quota
+func (q *Quota) Take(appID string) Result {
+	limit := q.Limit(appID)
+	if limit <= 0 {
+		return Result{Allowed: true}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	if now.Sub(q.swept) >= q.cfg.Window {
+		for id, b := range q.buckets {
+			if !now.Before(b.reset) {
+				delete(q.buckets, id)
+			}
+		}
+		q.swept = now
+	}
+	b, ok := q.buckets[appID]
+	if !ok || !now.Before(b.reset) {
+		b = &bucket{reset: now.Add(q.cfg.Window)}
+		q.buckets[appID] = b
+	}
+	if b.count >= limit {
+		return Result{Allowed: false, Limit: limit, Remaining: 0, Reset: b.reset}
+	}
+	b.count++
+	return Result{Allowed: true, Limit: limit, Remaining: limit - b.count, Reset: b.reset}
+}
@@ -0,0 +1,56 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuota(t *testing.T) {
+	t.Run("unlimited", func(t *testing.T) {
+		q := New(Config{})
+		for i := 0; i < 100; i++ {
+			require.True(t, q.Take("app").Allowed)
+		}
+	})
+
+	t.Run("over quota", func(t *testing.T) {
+		now := time.Unix(1600000000, 0)
+		q := New(Config{Limit: 2})
+		q.now = func() time.Time { return now }
+
+		res := q.Take("app")
+		require.True(t, res.Allowed)
+		require.Equal(t, 1, res.Remaining)
+		require.True(t, q.Take("app").Allowed)
+
+		res = q.Take("app")
+		require.False(t, res.Allowed)
+		require.Equal(t, 2, res.Limit)
+		require.Equal(t, 0, res.Remaining)
+		require.Equal(t, now.Add(time.Minute), res.Reset)
+
+		// other apps have their own quota
+		require.True(t, q.Take("app2").Allowed)
+
+		// quota is restored once the window has passed
+		now = now.Add(time.Minute)
+		require.True(t, q.Take("app").Allowed)
+		// the buckets past their window are swept
+		require.Len(t, q.buckets, 1)
+	})
+
+	t.Run("app limits", func(t *testing.T) {
+		q := New(Config{Limit: 1, AppLimits: map[string]int{"app": 0, "app2": 2}})
+		require.Equal(t, 0, q.Limit("app"))
+		require.Equal(t, 2, q.Limit("app2"))
+		require.Equal(t, 1, q.Limit("app3"))
+		for i := 0; i < 10; i++ {
+			require.True(t, q.Take("app").Allowed)
+		}
+		require.True(t, q.Take("app2").Allowed)
+		require.True(t, q.Take("app2").Allowed)
+		require.False(t, q.Take("app2").Allowed)
+	})
+}
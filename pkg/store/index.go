@@ -0,0 +1,101 @@
+package store
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+)
+
+// index is the flattened view of the served namespaces, so that a lookup doesn't walk the layers.
+// It's rebuilt once the overlay or the ConfigMap of a source changes
+type index struct {
+	// version is the version of the overlay indexed
+	version uint64
+	// configs are the ConfigMaps of the sources indexed, referenced so that
+	// their identities can't be reused by the ConfigMaps of later reloads
+	configs    []watcher.ConfigMap
+	namespaces map[Key]watcher.Namespace
+	// keys are the keys of all namespaces sorted
+	keys []Key
+	// apps are the keys of the namespaces of each app
+	apps map[string][]Key
+}
+
+// sameConfig reports whether a and b are the same ConfigMap, sources return a new ConfigMap on every change
+func sameConfig(a watcher.ConfigMap, b watcher.ConfigMap) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+// fresh reports whether idx indexes the overlay of version and the current ConfigMaps of sources
+func (idx *index) fresh(version uint64, sources []Source) bool {
+	if idx == nil || idx.version != version || len(idx.configs) != len(sources) {
+		return false
+	}
+	for i, src := range sources {
+		if !sameConfig(src.Config(), idx.configs[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// newIndex indexes the namespaces of the overlay and the sources, the caller holds the lock
+func (s *Layered) newIndex() *index {
+	idx := &index{
+		version:    s.version,
+		namespaces: make(map[Key]watcher.Namespace),
+		apps:       make(map[string][]Key),
+	}
+	layers := []watcher.ConfigMap{s.overlay}
+	for _, src := range s.sources {
+		cm := src.Config()
+		idx.configs = append(idx.configs, cm)
+		layers = append(layers, cm)
+	}
+	for _, cm := range layers {
+		for appID, app := range cm {
+			for cluster, c := range app {
+				for namespace, ns := range c {
+					k := Key{AppID: appID, Cluster: cluster, Namespace: namespace}
+					if _, ok := idx.namespaces[k]; ok || s.deleted[k] {
+						continue
+					}
+					idx.namespaces[k] = ns
+					idx.keys = append(idx.keys, k)
+				}
+			}
+		}
+	}
+	sort.Slice(idx.keys, func(i, j int) bool {
+		a, b := idx.keys[i], idx.keys[j]
+		if a.AppID != b.AppID {
+			return a.AppID < b.AppID
+		}
+		if a.Cluster != b.Cluster {
+			return a.Cluster < b.Cluster
+		}
+		return a.Namespace < b.Namespace
+	})
+	for _, k := range idx.keys {
+		idx.apps[k.AppID] = append(idx.apps[k.AppID], k)
+	}
+	return idx
+}
+
+// indexed returns the index of the served namespaces, rebuilt if it's stale
+func (s *Layered) indexed() *index {
+	s.mu.RLock()
+	idx := s.idx
+	fresh := idx.fresh(s.version, s.sources)
+	s.mu.RUnlock()
+	if fresh {
+		return idx
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.idx.fresh(s.version, s.sources) {
+		s.idx = s.newIndex()
+	}
+	return s.idx
+}
@@ -0,0 +1,248 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/figroc/mock-apollo-go/pkg/events"
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+)
+
+// ErrNotFound is returned when a namespace does not exist in the store
+var ErrNotFound = errors.New("namespace no found")
+
+// Key identifies a namespace
+type Key struct {
+	AppID     string `json:"appId"`
+	Cluster   string `json:"cluster"`
+	Namespace string `json:"namespace"`
+}
+
+// Store provides access to the served namespaces
+type Store interface {
+	// Get returns the namespace of an app
+	Get(appID string, cluster string, namespace string) (watcher.Namespace, error)
+	// List returns the keys of all namespaces
+	List() []Key
+	// Watch returns a channel that receives the change events of the namespaces until ctx is done
+	Watch(ctx context.Context) <-chan events.Event
+	// Upsert creates or updates a namespace
+	Upsert(key Key, ns watcher.Namespace) error
+	// Delete removes a namespace until it is upserted again
+	Delete(key Key) error
+}
+
+// Source provides a read-only ConfigMap, e.g. a watched file
+type Source interface {
+	// Config returns the ConfigMap of the source, a new one on every change
+	// as the returned ones are never modified
+	Config() watcher.ConfigMap
+}
+
+// Layered is a Store serving upserted namespaces on top of a list of sources
+type Layered struct {
+	mu      sync.RWMutex
+	bus     *events.Bus
+	overlay watcher.ConfigMap
+	// deleted hides the namespaces of the sources
+	deleted map[Key]bool
+	sources []Source
+	// version is bumped on every change of the overlay and the sources, staling idx
+	version uint64
+	idx     *index
+}
+
+// New creates a new Layered store publishing its changes to bus, earlier sources take precedence
+func New(bus *events.Bus, sources ...Source) *Layered {
+	return &Layered{
+		bus:     bus,
+		overlay: watcher.ConfigMap{},
+		deleted: make(map[Key]bool),
+		sources: sources,
+	}
+}
+
+// AddSource appends a source with the lowest precedence
+func (s *Layered) AddSource(src Source) {
+	s.mu.Lock()
+	s.sources = append(s.sources, src)
+	s.version++
+	s.mu.Unlock()
+}
+
+// ReplaceSource replaces a source keeping its precedence, it returns false if old is not a source.
+// Sources are compared by identity, they must be comparable, e.g. pointers
+func (s *Layered) ReplaceSource(old Source, src Source) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.sources {
+		if s.sources[i] == old {
+			s.sources[i] = src
+			s.version++
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the namespace of the cluster of an app
+func (s *Layered) Get(appID string, cluster string, namespace string) (watcher.Namespace, error) {
+	ns, ok := s.indexed().namespaces[Key{AppID: appID, Cluster: cluster, Namespace: namespace}]
+	if !ok {
+		return watcher.Namespace{}, ErrNotFound
+	}
+	return ns, nil
+}
+
+// get walks the layers for the namespace, the caller holds the lock
+func (s *Layered) get(appID string, cluster string, namespace string) (watcher.Namespace, error) {
+	if s.deleted[Key{AppID: appID, Cluster: cluster, Namespace: namespace}] {
+		return watcher.Namespace{}, ErrNotFound
+	}
+	if ns, ok := s.overlay[appID][cluster][namespace]; ok {
+		return ns, nil
+	}
+	for _, src := range s.sources {
+		if ns, ok := src.Config()[appID][cluster][namespace]; ok {
+			return ns, nil
+		}
+	}
+	return watcher.Namespace{}, ErrNotFound
+}
+
+// List returns the keys of all namespaces sorted
+func (s *Layered) List() []Key {
+	return append([]Key{}, s.indexed().keys...)
+}
+
+// ListApp returns the keys of the namespaces of an app sorted
+func (s *Layered) ListApp(appID string) []Key {
+	return append([]Key{}, s.indexed().apps[appID]...)
+}
+
+// Watch returns a channel that receives the change events of the store and its sources,
+// sources are expected to publish to the same bus
+func (s *Layered) Watch(ctx context.Context) <-chan events.Event {
+	return s.bus.Subscribe(ctx)
+}
+
+// Upsert creates or updates a namespace in the overlay
+func (s *Layered) Upsert(key Key, ns watcher.Namespace) error {
+	if key.AppID == "" || key.Cluster == "" || key.Namespace == "" {
+		return errors.New("invalid namespace key")
+	}
+	s.mu.Lock()
+	if s.overlay[key.AppID] == nil {
+		s.overlay[key.AppID] = make(map[string]map[string]watcher.Namespace)
+	}
+	if s.overlay[key.AppID][key.Cluster] == nil {
+		s.overlay[key.AppID][key.Cluster] = make(map[string]watcher.Namespace)
+	}
+	s.overlay[key.AppID][key.Cluster][key.Namespace] = ns
+	delete(s.deleted, key)
+	s.version++
+	s.mu.Unlock()
+	s.bus.Publish(events.Event{
+		Type:      events.NamespaceUpdated,
+		AppID:     key.AppID,
+		Cluster:   key.Cluster,
+		Namespace: key.Namespace,
+	})
+	return nil
+}
+
+// Replace atomically serves the namespaces of cm in place of all the upserted ones and the ones of the sources,
+// the namespaces of the sources missing from cm are deleted. An event is published for every changed namespace
+func (s *Layered) Replace(cm watcher.ConfigMap) error {
+	overlay := watcher.ConfigMap{}
+	for appID, app := range cm {
+		for cluster, c := range app {
+			for namespace, ns := range c {
+				if appID == "" || cluster == "" || namespace == "" {
+					return errors.New("invalid namespace key")
+				}
+				if overlay[appID] == nil {
+					overlay[appID] = make(map[string]map[string]watcher.Namespace)
+				}
+				if overlay[appID][cluster] == nil {
+					overlay[appID][cluster] = make(map[string]watcher.Namespace)
+				}
+				overlay[appID][cluster][namespace] = ns
+			}
+		}
+	}
+	s.mu.Lock()
+	old := s.config()
+	s.overlay = overlay
+	s.version++
+	s.deleted = make(map[Key]bool)
+	for _, src := range s.sources {
+		for appID, app := range src.Config() {
+			for cluster, c := range app {
+				for namespace := range c {
+					if _, ok := overlay[appID][cluster][namespace]; !ok {
+						s.deleted[Key{AppID: appID, Cluster: cluster, Namespace: namespace}] = true
+					}
+				}
+			}
+		}
+	}
+	s.mu.Unlock()
+	for _, e := range watcher.Diff(old, overlay) {
+		s.bus.Publish(e)
+	}
+	return nil
+}
+
+// config returns the served namespaces, the caller holds the lock
+func (s *Layered) config() watcher.ConfigMap {
+	layers := []watcher.ConfigMap{s.overlay}
+	for _, src := range s.sources {
+		layers = append(layers, src.Config())
+	}
+	cm := watcher.ConfigMap{}
+	for _, layer := range layers {
+		for appID, app := range layer {
+			for cluster, c := range app {
+				for namespace, ns := range c {
+					if s.deleted[Key{AppID: appID, Cluster: cluster, Namespace: namespace}] {
+						continue
+					}
+					if _, ok := cm[appID][cluster][namespace]; ok {
+						continue
+					}
+					if cm[appID] == nil {
+						cm[appID] = make(map[string]map[string]watcher.Namespace)
+					}
+					if cm[appID][cluster] == nil {
+						cm[appID][cluster] = make(map[string]watcher.Namespace)
+					}
+					cm[appID][cluster][namespace] = ns
+				}
+			}
+		}
+	}
+	return cm
+}
+
+// Delete removes an upserted namespace and hides the namespace of the sources,
+// it returns ErrNotFound if the namespace is not served
+func (s *Layered) Delete(key Key) error {
+	s.mu.Lock()
+	if _, err := s.get(key.AppID, key.Cluster, key.Namespace); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	delete(s.overlay[key.AppID][key.Cluster], key.Namespace)
+	s.deleted[key] = true
+	s.version++
+	s.mu.Unlock()
+	s.bus.Publish(events.Event{
+		Type:      events.NamespaceDeleted,
+		AppID:     key.AppID,
+		Cluster:   key.Cluster,
+		Namespace: key.Namespace,
+	})
+	return nil
+}
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"context"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/figroc/mock-apollo-go/pkg/events"
+	"github.com/figroc/mock-apollo-go/pkg/watcher"
+	"github.com/stretchr/testify/require"
+)
+
+type stubSource watcher.ConfigMap
+
+func (s stubSource) Config() watcher.ConfigMap {
+	return watcher.ConfigMap(s)
+}
+
+// reloadedSource serves a new ConfigMap on every reload, like a watched file
+type reloadedSource struct {
+	cm atomic.Value
+}
+
+func (s *reloadedSource) Config() watcher.ConfigMap {
+	return s.cm.Load().(watcher.ConfigMap)
+}
+
+func TestLayered(t *testing.T) {
+	ns := func(releaseKey string) watcher.Namespace {
+		return watcher.Namespace{ReleaseKey: releaseKey, Properties: map[string]string{"k": "v"}}
+	}
+	s := New(
+		events.NewBus(),
+		stubSource{"app": {"cluster": {"ns": ns("file1")}}},
+		stubSource{"app": {"cluster": {"ns": ns("file2"), "ns2": ns("file2")}}},
+	)
+
+	t.Run("get", func(t *testing.T) {
+		n, err := s.Get("app", "cluster", "ns")
+		require.Nil(t, err)
+		require.Equal(t, "file1", n.ReleaseKey)
+		n, err = s.Get("app", "cluster", "ns2")
+		require.Nil(t, err)
+		require.Equal(t, "file2", n.ReleaseKey)
+		_, err = s.Get("app", "cluster", "ns404")
+		require.Equal(t, ErrNotFound, err)
+		// namespaces are not served to other apps
+		_, err = s.Get("app2", "cluster", "ns")
+		require.Equal(t, ErrNotFound, err)
+	})
+
+	t.Run("upsert", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		changes := s.Watch(ctx)
+
+		require.Error(t, s.Upsert(Key{AppID: "app"}, ns("overlay")))
+		require.Nil(t, s.Upsert(Key{AppID: "app", Cluster: "cluster", Namespace: "ns"}, ns("overlay")))
+		require.Nil(t, s.Upsert(Key{AppID: "app", Cluster: "cluster", Namespace: "ns3"}, ns("overlay")))
+		select {
+		case e := <-changes:
+			require.Equal(t, events.Event{
+				Type:      events.NamespaceUpdated,
+				AppID:     "app",
+				Cluster:   "cluster",
+				Namespace: "ns",
+				Time:      e.Time,
+			}, e)
+		case <-time.After(time.Second):
+			require.Fail(t, "no change event")
+		}
+
+		n, err := s.Get("app", "cluster", "ns")
+		require.Nil(t, err)
+		require.Equal(t, "overlay", n.ReleaseKey)
+		_, err = s.Get("app2", "cluster", "ns3")
+		require.Equal(t, ErrNotFound, err)
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		blue := &stubSource{"app": {"cluster": {"blue": ns("blue")}}}
+		green := &stubSource{"app": {"cluster": {"green": ns("green")}}}
+		s := New(events.NewBus(), blue)
+		require.True(t, s.ReplaceSource(blue, green))
+		require.False(t, s.ReplaceSource(blue, green))
+		_, err := s.Get("app", "cluster", "blue")
+		require.Equal(t, ErrNotFound, err)
+		n, err := s.Get("app", "cluster", "green")
+		require.Nil(t, err)
+		require.Equal(t, "green", n.ReleaseKey)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		s := New(events.NewBus(), stubSource{"app": {"cluster": {"ns": ns("file")}}})
+		require.Nil(t, s.Upsert(Key{AppID: "app", Cluster: "cluster", Namespace: "ns2"}, ns("overlay")))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		changes := s.Watch(ctx)
+
+		require.Nil(t, s.Delete(Key{AppID: "app", Cluster: "cluster", Namespace: "ns"}))
+		require.Nil(t, s.Delete(Key{AppID: "app", Cluster: "cluster", Namespace: "ns2"}))
+		require.Equal(t, ErrNotFound, s.Delete(Key{AppID: "app", Cluster: "cluster", Namespace: "ns"}))
+		select {
+		case e := <-changes:
+			require.Equal(t, events.NamespaceDeleted, e.Type)
+			require.Equal(t, "ns", e.Namespace)
+		case <-time.After(time.Second):
+			require.Fail(t, "no change event")
+		}
+		_, err := s.Get("app", "cluster", "ns")
+		require.Equal(t, ErrNotFound, err)
+		_, err = s.Get("app", "cluster", "ns2")
+		require.Equal(t, ErrNotFound, err)
+		require.Empty(t, s.List())
+
+		// an upsert serves the deleted namespace again
+		require.Nil(t, s.Upsert(Key{AppID: "app", Cluster: "cluster", Namespace: "ns"}, ns("overlay")))
+		n, err := s.Get("app", "cluster", "ns")
+		require.Nil(t, err)
+		require.Equal(t, "overlay", n.ReleaseKey)
+	})
+
+	t.Run("import", func(t *testing.T) {
+		s := New(events.NewBus(), stubSource{"app": {"cluster": {"ns": ns("file"), "ns2": ns("file")}}})
+		require.Nil(t, s.Upsert(Key{AppID: "app", Cluster: "cluster", Namespace: "ns3"}, ns("overlay")))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		changes := s.Watch(ctx)
+
+		require.Error(t, s.Replace(watcher.ConfigMap{"app": {"": {"ns": ns("import")}}}))
+		require.Nil(t, s.Replace(watcher.ConfigMap{"app": {"cluster": {"ns": ns("file"), "ns4": ns("import")}}}))
+		got := map[string]events.Type{}
+		for len(got) < 3 {
+			select {
+			case e := <-changes:
+				got[e.Namespace] = e.Type
+			case <-time.After(time.Second):
+				require.Fail(t, "no change event")
+			}
+		}
+		// the unchanged namespace is not notified
+		require.Equal(t, map[string]events.Type{
+			"ns2": events.NamespaceDeleted,
+			"ns3": events.NamespaceDeleted,
+			"ns4": events.NamespaceUpdated,
+		}, got)
+		require.Equal(t, []Key{
+			{AppID: "app", Cluster: "cluster", Namespace: "ns"},
+			{AppID: "app", Cluster: "cluster", Namespace: "ns4"},
+		}, s.List())
+	})
+
+	t.Run("index", func(t *testing.T) {
+		src := &reloadedSource{}
+		src.cm.Store(watcher.ConfigMap{"app": {"cluster": {"ns": ns("v1")}}})
+		s := New(events.NewBus(), src)
+		n, err := s.Get("app", "cluster", "ns")
+		require.Nil(t, err)
+		require.Equal(t, "v1", n.ReleaseKey)
+
+		// a reload of the source is served without notifying the store
+		src.cm.Store(watcher.ConfigMap{"app": {"cluster": {"ns": ns("v2")}}, "app2": {"cluster": {"ns": ns("v2")}}})
+		n, err = s.Get("app", "cluster", "ns")
+		require.Nil(t, err)
+		require.Equal(t, "v2", n.ReleaseKey)
+		require.Equal(t, []Key{{AppID: "app2", Cluster: "cluster", Namespace: "ns"}}, s.ListApp("app2"))
+		require.Empty(t, s.ListApp("app3"))
+
+		require.Nil(t, s.Upsert(Key{AppID: "app2", Cluster: "cluster", Namespace: "ns2"}, ns("overlay")))
+		require.Len(t, s.ListApp("app2"), 2)
+	})
+
+	t.Run("index gc", func(t *testing.T) {
+		src := &reloadedSource{}
+		src.cm.Store(watcher.ConfigMap{})
+		s := New(events.NewBus(), src)
+		empty := watcher.ConfigMap{}
+		for i := 0; i < 100; i++ {
+			src.cm.Store(watcher.ConfigMap{"app": {"cluster": {"ns": ns(strconv.Itoa(i))}}})
+			n, err := s.Get("app", "cluster", "ns")
+			require.Nil(t, err)
+			require.Equal(t, strconv.Itoa(i), n.ReleaseKey)
+			// the ConfigMap indexed is collected before the next reload unless the index references it
+			src.cm.Store(empty)
+			runtime.GC()
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		require.Equal(t, []Key{
+			{AppID: "app", Cluster: "cluster", Namespace: "ns"},
+			{AppID: "app", Cluster: "cluster", Namespace: "ns2"},
+			{AppID: "app", Cluster: "cluster", Namespace: "ns3"},
+		}, s.List())
+	})
+}
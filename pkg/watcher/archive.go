@@ -0,0 +1,160 @@
+package watcher
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// archiveExts are the extensions of the compressed config files and archives, longest first
+var archiveExts = []string{".tar.gz", ".tgz", ".tar", ".zip", ".gz"}
+
+// archiveExt returns the archive extension of path, empty if it's a plain config file
+func archiveExt(path string) string {
+	lower := strings.ToLower(path)
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(lower, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// archiveEntry is a config file of an archive, named by its path as if the archive
+// was a directory named after it without its extension
+type archiveEntry struct {
+	name    string
+	content []byte
+}
+
+// readArchive returns the config files of the gzip file, tar or zip archive at path sorted by name.
+// A gzip file that is not a tar archive holds a single config file. The decompressed entries
+// may not exceed limit bytes in total, 0 means no limit
+func readArchive(r io.ReaderAt, size int64, path string, limit int64) ([]archiveEntry, error) {
+	ext := archiveExt(path)
+	base := path[:len(path)-len(ext)]
+	lr := &limitedReader{limit: limit}
+	var entries []archiveEntry
+	add := func(name string, rc io.Reader) error {
+		lr.r = rc
+		b, err := io.ReadAll(lr)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, archiveEntry{name: name, content: b})
+		return nil
+	}
+
+	switch ext {
+	case ".zip":
+		zr, err := zip.NewReader(r, size)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() || !isArchivedConfig(f.Name) {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			err = add(filepath.Join(base, filepath.FromSlash(f.Name)), rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	case ".gz":
+		gr, err := gzip.NewReader(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		if err := add(base, gr); err != nil {
+			return nil, err
+		}
+	default:
+		var tr *tar.Reader
+		if ext == ".tar" {
+			tr = tar.NewReader(io.NewSectionReader(r, 0, size))
+		} else {
+			gr, err := gzip.NewReader(io.NewSectionReader(r, 0, size))
+			if err != nil {
+				return nil, err
+			}
+			defer gr.Close()
+			tr = tar.NewReader(gr)
+		}
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if h.Typeflag != tar.TypeReg || !isArchivedConfig(h.Name) {
+				continue
+			}
+			if err := add(filepath.Join(base, filepath.FromSlash(h.Name)), tr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+	return entries, nil
+}
+
+// isArchivedConfig reports whether the entry of an archive is a config file, hidden files are skipped
+func isArchivedConfig(name string) bool {
+	base := path.Base(name)
+	return !strings.HasPrefix(base, ".") && configExts[path.Ext(base)]
+}
+
+// limitedReader fails with ErrFileTooLarge once more than limit bytes are read, 0 means no limit
+type limitedReader struct {
+	r     io.Reader
+	read  int64
+	limit int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.limit > 0 && l.read > l.limit {
+		return n, &ErrFileTooLarge{Limit: l.limit}
+	}
+	return n, err
+}
+
+// mergeConfigMaps merges the config maps of the entries of an archive, a namespace is taken
+// from the first entry defining it
+func mergeConfigMaps(cms []ConfigMap) ConfigMap {
+	cm := ConfigMap{}
+	for _, c := range cms {
+		for appID, app := range c {
+			if cm[appID] == nil {
+				cm[appID] = make(map[string]map[string]Namespace)
+			}
+			for cluster, namespaces := range app {
+				if cm[appID][cluster] == nil {
+					cm[appID][cluster] = make(map[string]Namespace)
+				}
+				for name, ns := range namespaces {
+					if _, ok := cm[appID][cluster][name]; !ok {
+						cm[appID][cluster][name] = ns
+					}
+				}
+			}
+		}
+	}
+	return cm
+}
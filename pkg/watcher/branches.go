@@ -0,0 +1,82 @@
+package watcher
+
+import "hash/fnv"
+
+// AllIPs in the IPs of a Branch matches the clients of any ip, like in the gray rules of Apollo
+const AllIPs = "*"
+
+// Branch is a gray release of a namespace, served to the clients matching its ips, labels
+// or percent in place of the mainline namespace
+type Branch struct {
+	Name string `yaml:"name" json:"name"`
+	// IPs are the ips of the clients served the branch, AllIPs matches all the clients
+	IPs []string `yaml:"ips,omitempty" json:"ips,omitempty"`
+	// Labels are the labels of the clients served the branch
+	Labels []string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	// Percent of the clients served the branch, picked by their ClientBucket
+	Percent int `yaml:"percent,omitempty" json:"percent,omitempty"`
+	// ReleaseKey is the releaseKey of the branch, empty means the releaseKey of the namespace
+	// suffixed with the name of the branch
+	ReleaseKey string `yaml:"releaseKey,omitempty" json:"releaseKey,omitempty"`
+	// Properties are merged over the properties of the namespace
+	Properties map[string]string `yaml:"properties,omitempty" json:"properties,omitempty"`
+}
+
+// Match reports whether the client of appID, ip and label is served the branch
+func (b Branch) Match(appID string, ip string, label string) bool {
+	for _, v := range b.IPs {
+		if v == AllIPs || (ip != "" && v == ip) {
+			return true
+		}
+	}
+	for _, v := range b.Labels {
+		if label != "" && v == label {
+			return true
+		}
+	}
+	return b.Percent > 0 && ClientBucket(appID, ip) < b.Percent
+}
+
+// ClientBucket assigns a client to one of 100 buckets by the hash of its appId and ip,
+// so that a client stays in its bucket across requests and restarts. The clients of a share
+// are the ones below it, so a growing share keeps the clients it already had
+func ClientBucket(appID string, ip string) int {
+	h := fnv.New32a()
+	h.Write([]byte(appID))
+	h.Write([]byte{0})
+	h.Write([]byte(ip))
+	return int(h.Sum32() % 100)
+}
+
+// Gray returns the namespace served to the client of appID, ip and label,
+// the first matching branch applies and the mainline is served if none matches
+func (ns Namespace) Gray(appID string, ip string, label string) Namespace {
+	if len(ns.Branches) == 0 {
+		return ns
+	}
+	branches := ns.Branches
+	ns.Branches = nil
+	for _, b := range branches {
+		if !b.Match(appID, ip, label) {
+			continue
+		}
+		if b.ReleaseKey != "" {
+			ns.ReleaseKey = b.ReleaseKey
+		} else {
+			ns.ReleaseKey += "-" + b.Name
+		}
+		if len(b.Properties) > 0 {
+			// the namespace is shared, so the branch is merged into a copy
+			props := make(map[string]string, len(ns.Properties)+len(b.Properties))
+			for k, v := range ns.Properties {
+				props[k] = v
+			}
+			for k, v := range b.Properties {
+				props[k] = v
+			}
+			ns.Properties = props
+		}
+		return ns
+	}
+	return ns
+}
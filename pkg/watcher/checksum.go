@@ -0,0 +1,43 @@
+package watcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// checksumExt is the extension of the sidecar file holding the sha256 checksum of a config file,
+// e.g. example.yaml.sha256 for example.yaml
+const checksumExt = ".sha256"
+
+// verifyChecksum checks the content of f against the checksum of its sidecar file at path+checksumExt,
+// in the format of sha256sum. Files without a sidecar are not verified.
+// f is rewound to its start
+func verifyChecksum(fs afero.Fs, f io.ReadSeeker, path string) error {
+	b, err := afero.ReadFile(fs, path+checksumExt)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	want := ""
+	if fields := strings.Fields(string(b)); len(fields) > 0 {
+		want = strings.ToLower(fields[0])
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return &ErrChecksumMismatch{Want: want, Got: got}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package watcher
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// encryptedPrefix and encryptedSuffix enclose the base64 age ciphertext of an encrypted value, the version of the
+// format is the one of the age header. Other values, e.g. the ENC[...] ones of SOPS, are served as they are
+const (
+	encryptedPrefix = "AGE["
+	encryptedSuffix = "]"
+)
+
+// NewKey returns a new random age X25519 identity, the content of a key file
+func NewKey() (string, error) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// ParseKey checks the age identities of a key file, e.g. the output of age-keygen, and returns them
+// as the key decrypting the values
+func ParseKey(s string) ([]byte, error) {
+	if _, err := age.ParseIdentities(strings.NewReader(s)); err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	return []byte(s), nil
+}
+
+// Encrypt returns the encrypted value of plaintext for the X25519 identities of key, in the form AGE[...] decrypted at load
+func Encrypt(key []byte, plaintext string) (string, error) {
+	ids, err := age.ParseIdentities(bytes.NewReader(key))
+	if err != nil {
+		return "", fmt.Errorf("invalid key: %v", err)
+	}
+	recipients := []age.Recipient{}
+	for _, id := range ids {
+		if x, ok := id.(*age.X25519Identity); ok {
+			recipients = append(recipients, x.Recipient())
+		}
+	}
+	if len(recipients) == 0 {
+		return "", errors.New("invalid key: no X25519 identity")
+	}
+	b := &bytes.Buffer{}
+	w, err := age.Encrypt(b, recipients...)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(w, plaintext); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(b.Bytes()) + encryptedSuffix, nil
+}
+
+// isEncrypted reports whether s is a value encrypted with Encrypt
+func isEncrypted(s string) bool {
+	return strings.HasPrefix(s, encryptedPrefix) && strings.HasSuffix(s, encryptedSuffix)
+}
+
+// decrypt returns the plaintext of an encrypted value
+func decrypt(ids []age.Identity, s string) (string, error) {
+	if len(ids) == 0 {
+		return "", errors.New("no decryption key")
+	}
+	b, err := base64.StdEncoding.DecodeString(s[len(encryptedPrefix) : len(s)-len(encryptedSuffix)])
+	if err != nil {
+		return "", err
+	}
+	r, err := age.Decrypt(bytes.NewReader(b), ids...)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// decryptValues decrypts the encrypted values of the properties, overrides and branches of the namespaces of cm,
+// and the text formats encrypted as a whole. Namespaces without encrypted values are left as they are
+func decryptValues(cm ConfigMap, key []byte) error {
+	var ids []age.Identity
+	if key != nil {
+		var err error
+		if ids, err = age.ParseIdentities(bytes.NewReader(key)); err != nil {
+			return fmt.Errorf("invalid key: %v", err)
+		}
+	}
+	for appID, app := range cm {
+		for cluster, namespaces := range app {
+			for name, ns := range namespaces {
+				fail := func(err error) error {
+					return &ErrDecrypt{AppID: appID, Cluster: cluster, Namespace: name, Err: err}
+				}
+				props, err := decryptProperties(ns.Properties, ids)
+				if err != nil {
+					return fail(err)
+				}
+				ns.Properties = props
+				for _, text := range []*string{&ns.Yml, &ns.Yaml, &ns.JSON, &ns.XML} {
+					if isEncrypted(*text) {
+						if *text, err = decrypt(ids, *text); err != nil {
+							return fail(err)
+						}
+					}
+				}
+				if ns.Overrides != nil {
+					overrides := make(map[string]map[string]string, len(ns.Overrides))
+					for c, p := range ns.Overrides {
+						if overrides[c], err = decryptProperties(p, ids); err != nil {
+							return fail(err)
+						}
+					}
+					ns.Overrides = overrides
+				}
+				if ns.Branches != nil {
+					branches := make([]Branch, len(ns.Branches))
+					for i, b := range ns.Branches {
+						if b.Properties, err = decryptProperties(b.Properties, ids); err != nil {
+							return fail(err)
+						}
+						branches[i] = b
+					}
+					ns.Branches = branches
+				}
+				namespaces[name] = ns
+			}
+		}
+	}
+	return nil
+}
+
+// decryptProperties returns props with its encrypted values decrypted, props itself if none is encrypted
+func decryptProperties(props map[string]string, ids []age.Identity) (map[string]string, error) {
+	encrypted := false
+	for _, v := range props {
+		if isEncrypted(v) {
+			encrypted = true
+			break
+		}
+	}
+	if !encrypted {
+		return props, nil
+	}
+	decrypted := make(map[string]string, len(props))
+	for k, v := range props {
+		if isEncrypted(v) {
+			var err error
+			if v, err = decrypt(ids, v); err != nil {
+				return nil, fmt.Errorf("property '%s': %v", k, err)
+			}
+		}
+		decrypted[k] = v
+	}
+	return decrypted, nil
+}
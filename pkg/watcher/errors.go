@@ -0,0 +1,154 @@
+package watcher
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrClosed is returned by the reloads of a closed watcher
+var ErrClosed = errors.New("watcher is closed")
+
+// ErrInvalidConfig is returned for a config file without any app
+var ErrInvalidConfig = errors.New("invalid config file")
+
+// ErrFileTooLarge is returned for a config file exceeding the size limit
+type ErrFileTooLarge struct {
+	Limit int64
+}
+
+func (e *ErrFileTooLarge) Error() string {
+	return fmt.Sprintf("config file exceeds the size limit of %d bytes", e.Limit)
+}
+
+// ErrChecksumMismatch is returned for a config file not matching the checksum of its sidecar file,
+// e.g. while it is being copied
+type ErrChecksumMismatch struct {
+	Want string
+	Got  string
+}
+
+func (e *ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("config file checksum %s does not match the expected %s", e.Got, e.Want)
+}
+
+// ErrDecrypt is returned for a namespace with an encrypted value that fails to decrypt,
+// e.g. without a decryption key
+type ErrDecrypt struct {
+	AppID     string
+	Cluster   string
+	Namespace string
+	Err       error
+}
+
+func (e *ErrDecrypt) Error() string {
+	return fmt.Sprintf("error decrypting namespace '%s' in %s/%s: %v", e.Namespace, e.AppID, e.Cluster, e.Err)
+}
+
+func (e *ErrDecrypt) Unwrap() error {
+	return e.Err
+}
+
+// ErrEncrypt is returned for a namespace with jasypt properties that fail to encrypt,
+// e.g. without a jasypt password
+type ErrEncrypt struct {
+	AppID     string
+	Cluster   string
+	Namespace string
+	Err       error
+}
+
+func (e *ErrEncrypt) Error() string {
+	return fmt.Sprintf("error encrypting namespace '%s' in %s/%s: %v", e.Namespace, e.AppID, e.Cluster, e.Err)
+}
+
+func (e *ErrEncrypt) Unwrap() error {
+	return e.Err
+}
+
+// ErrEmptyApp is returned for an app with an empty name or without any cluster
+type ErrEmptyApp struct {
+	AppID string
+}
+
+func (e *ErrEmptyApp) Error() string {
+	if e.AppID == "" {
+		return "invalid app name ''"
+	}
+	return fmt.Sprintf("invalid app '%s'", e.AppID)
+}
+
+// ErrEmptyCluster is returned for a cluster with an empty name or without any namespace
+type ErrEmptyCluster struct {
+	AppID   string
+	Cluster string
+}
+
+func (e *ErrEmptyCluster) Error() string {
+	if e.Cluster == "" {
+		return fmt.Sprintf("invalid cluster name '' in %s", e.AppID)
+	}
+	return fmt.Sprintf("invalid cluster '%s' in %s", e.Cluster, e.AppID)
+}
+
+// reasons of an ErrBadNamespace
+const (
+	// NamespaceEmptyName is a namespace with an empty name
+	NamespaceEmptyName = "empty name"
+	// NamespaceNoContent is a namespace without properties nor a text format
+	NamespaceNoContent = "no content"
+	// NamespaceEmptyKey is a namespace with an empty config key in its properties
+	NamespaceEmptyKey = "empty config key"
+	// NamespaceEmptyOverride is a namespace overriding a cluster with an empty name
+	NamespaceEmptyOverride = "empty override cluster"
+	// NamespaceConflictingOverrides is a namespace derived by the overrides of several clusters,
+	// From holds the clusters
+	NamespaceConflictingOverrides = "conflicting overrides"
+	// NamespaceEmptyBranch is a namespace with a branch with an empty name
+	NamespaceEmptyBranch = "empty branch name"
+	// NamespaceBranchNoRule is a namespace with a branch matching no ip, label nor percent, From holds the branch
+	NamespaceBranchNoRule = "branch without rules"
+	// NamespaceBranchPercent is a namespace with a branch whose percent is not within 0 and 100, From holds the branch
+	NamespaceBranchPercent = "invalid branch percent"
+)
+
+// ErrBadNamespace is returned for an invalid namespace, Reason is one of the Namespace* constants
+type ErrBadNamespace struct {
+	AppID     string
+	Cluster   string
+	Namespace string
+	Reason    string
+	From      []string
+}
+
+func (e *ErrBadNamespace) Error() string {
+	switch e.Reason {
+	case NamespaceEmptyName:
+		return fmt.Sprintf("invalid namespace name '' in %s/%s", e.AppID, e.Cluster)
+	case NamespaceEmptyKey:
+		return fmt.Sprintf("invalid config key '' in %s/%s/%s", e.AppID, e.Cluster, e.Namespace)
+	case NamespaceEmptyOverride:
+		return fmt.Sprintf("invalid override cluster name '' in %s/%s/%s", e.AppID, e.Cluster, e.Namespace)
+	case NamespaceEmptyBranch:
+		return fmt.Sprintf("invalid branch name '' in %s/%s/%s", e.AppID, e.Cluster, e.Namespace)
+	case NamespaceBranchNoRule:
+		if len(e.From) == 1 {
+			return fmt.Sprintf("branch '%s' of namespace '%s' in %s/%s has no ips, labels nor percent",
+				e.From[0], e.Namespace, e.AppID, e.Cluster)
+		}
+		return fmt.Sprintf("branch of namespace '%s' in %s/%s has no ips, labels nor percent", e.Namespace, e.AppID, e.Cluster)
+	case NamespaceBranchPercent:
+		if len(e.From) == 1 {
+			return fmt.Sprintf("invalid percent of branch '%s' of namespace '%s' in %s/%s",
+				e.From[0], e.Namespace, e.AppID, e.Cluster)
+		}
+		return fmt.Sprintf("invalid branch percent of namespace '%s' in %s/%s", e.Namespace, e.AppID, e.Cluster)
+	case NamespaceConflictingOverrides:
+		if len(e.From) == 2 {
+			return fmt.Sprintf("conflicting overrides of namespace '%s' in %s/%s from %s and %s",
+				e.Namespace, e.AppID, e.Cluster, e.From[0], e.From[1])
+		}
+		return fmt.Sprintf("conflicting overrides of namespace '%s' in %s/%s", e.Namespace, e.AppID, e.Cluster)
+	default:
+		return fmt.Sprintf("invalid namespace '%s' in %s/%s", e.Namespace, e.AppID, e.Cluster)
+	}
+}
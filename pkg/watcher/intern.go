@@ -0,0 +1,80 @@
+package watcher
+
+import (
+	"crypto/sha256"
+	"sort"
+)
+
+// interner deduplicates the content of namespaces shared by many apps,
+// so that identical strings and properties are only held once in memory
+type interner struct {
+	strings    map[string]string
+	properties map[[sha256.Size]byte]map[string]string
+}
+
+func newInterner() *interner {
+	return &interner{
+		strings:    make(map[string]string),
+		properties: make(map[[sha256.Size]byte]map[string]string),
+	}
+}
+
+func (in *interner) string(s string) string {
+	if s == "" {
+		return s
+	}
+	if v, ok := in.strings[s]; ok {
+		return v
+	}
+	in.strings[s] = s
+	return s
+}
+
+func (in *interner) props(p map[string]string) map[string]string {
+	if p == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(p))
+	for k := range p {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		// keys and values are length prefixed so that the digest is unambiguous
+		for _, s := range []string{k, p[k]} {
+			n := len(s)
+			h.Write([]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+			h.Write([]byte(s))
+		}
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	if v, ok := in.properties[sum]; ok {
+		return v
+	}
+	shared := make(map[string]string, len(p))
+	for k, v := range p {
+		shared[in.string(k)] = in.string(v)
+	}
+	in.properties[sum] = shared
+	return shared
+}
+
+// dedupe replaces the content of cm with shared instances, the content must be read-only afterwards
+func dedupe(cm ConfigMap) {
+	in := newInterner()
+	for _, app := range cm {
+		for _, cluster := range app {
+			for nsKey, ns := range cluster {
+				ns.ReleaseKey = in.string(ns.ReleaseKey)
+				ns.Properties = in.props(ns.Properties)
+				ns.Yml = in.string(ns.Yml)
+				ns.Yaml = in.string(ns.Yaml)
+				ns.JSON = in.string(ns.JSON)
+				ns.XML = in.string(ns.XML)
+				cluster[nsKey] = ns
+			}
+		}
+	}
+}
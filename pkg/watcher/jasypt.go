@@ -0,0 +1,99 @@
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/figroc/mock-apollo-go/pkg/jasypt"
+)
+
+// jasyptCache holds the ENC(...) forms of the values encrypted by the last load of a file by their plaintexts.
+// The encryption is salted with random bytes, the unchanged values of a reloaded file keep their ENC(...) forms
+// so that their namespaces are left unchanged
+type jasyptCache map[string]string
+
+// encryptJasypt encrypts the values of the properties listed in the Jasypt field of the namespaces of cm,
+// in their base properties, overrides and branches, so that jasypt clients decrypt them with password.
+// Values already in the ENC(...) form are left as they are, values of prev keep their ENC(...) forms.
+// It returns the cache of the values encrypted
+func encryptJasypt(cm ConfigMap, password string, prev jasyptCache) (jasyptCache, error) {
+	cache := jasyptCache{}
+	for appID, app := range cm {
+		for cluster, namespaces := range app {
+			for name, ns := range namespaces {
+				if len(ns.Jasypt) == 0 {
+					continue
+				}
+				fail := func(err error) error {
+					return &ErrEncrypt{AppID: appID, Cluster: cluster, Namespace: name, Err: err}
+				}
+				if password == "" {
+					return nil, fail(errors.New("missing jasypt password"))
+				}
+				keys := make(map[string]bool, len(ns.Jasypt))
+				for _, k := range ns.Jasypt {
+					keys[k] = true
+				}
+				var err error
+				if ns.Properties, err = jasyptProperties(ns.Properties, keys, password, prev, cache); err != nil {
+					return nil, fail(err)
+				}
+				if ns.Overrides != nil {
+					overrides := make(map[string]map[string]string, len(ns.Overrides))
+					for c, p := range ns.Overrides {
+						if overrides[c], err = jasyptProperties(p, keys, password, prev, cache); err != nil {
+							return nil, fail(err)
+						}
+					}
+					ns.Overrides = overrides
+				}
+				if ns.Branches != nil {
+					branches := make([]Branch, len(ns.Branches))
+					for i, b := range ns.Branches {
+						if b.Properties, err = jasyptProperties(b.Properties, keys, password, prev, cache); err != nil {
+							return nil, fail(err)
+						}
+						branches[i] = b
+					}
+					ns.Branches = branches
+				}
+				namespaces[name] = ns
+			}
+		}
+	}
+	return cache, nil
+}
+
+// jasyptProperties returns a copy of props with the values of keys encrypted, props itself if it has none of keys.
+// The values of prev are taken from it, the encrypted values are added to cache
+func jasyptProperties(props map[string]string, keys map[string]bool, password string, prev jasyptCache, cache jasyptCache) (map[string]string, error) {
+	found := false
+	for k := range props {
+		if keys[k] {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return props, nil
+	}
+	encrypted := make(map[string]string, len(props))
+	for k, v := range props {
+		if keys[k] && !(strings.HasPrefix(v, jasypt.Prefix) && strings.HasSuffix(v, jasypt.Suffix)) {
+			enc, ok := cache[v]
+			if !ok {
+				if enc, ok = prev[v]; !ok {
+					var err error
+					if enc, err = jasypt.Encrypt(password, v); err != nil {
+						return nil, fmt.Errorf("property '%s': %v", k, err)
+					}
+				}
+				cache[v] = enc
+			}
+			v = enc
+		}
+		encrypted[k] = v
+	}
+	return encrypted, nil
+}
@@ -0,0 +1,857 @@
+package watcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/figroc/mock-apollo-go/pkg/events"
+	"github.com/fsnotify/fsnotify"
+	"github.com/lalamove/nui/nlogger"
+	"github.com/radovskyb/watcher"
+	"github.com/spf13/afero"
+)
+
+// ManagerConfig holds the manager config
+type ManagerConfig struct {
+	Log nlogger.Provider
+	// Files are the config files to watch, earlier files take precedence.
+	// A directory or a glob pattern, e.g. ./configs/*.yaml, watches the files it contains or matches,
+	// in the order of their names, files are picked up and dropped as they are added and removed
+	Files         []string
+	WatchInterval time.Duration
+	// Notify watches the files with the notifications of the OS, e.g. inotify, in place of polling them
+	// every WatchInterval, the files are polled where the notifications are not supported
+	Notify bool
+	// Debounce delays the reload of the changed files until no event was received for it, so that a file
+	// written several times in quick succession is loaded once and its namespaces are published once.
+	// 0 reloads on each event
+	Debounce time.Duration
+	// MaxFileSize is the max size of each watched file in bytes, 0 means no limit
+	MaxFileSize int64
+	// DecryptionKey decrypts the encrypted values of the watched files, see Encrypt.
+	// Files with encrypted values fail to load without it
+	DecryptionKey []byte
+	// JasyptPassword encrypts the jasypt properties of the watched files, see Namespace.Jasypt.
+	// Files with jasypt properties fail to load without it
+	JasyptPassword string
+	// Env is the env whose apps are served from the envs sections of the watched files, e.g. DEV,
+	// empty serves the apps outside of them
+	Env string
+	// Bus receives the change events of the merged config
+	Bus *events.Bus
+}
+
+// Manager watches all config files with a single file watcher
+// and merges them into one ConfigMap
+type Manager struct {
+	// mu guards files and serializes the merges of the loaded files
+	mu sync.Mutex
+	// loading serializes the loads of the files with the publishing of their changes
+	loading sync.Mutex
+	log     nlogger.Provider
+	fw      *watcher.Watcher
+	// notify is nil unless the files are watched with notifications, fw is never started then
+	notify *notifier
+	// debounce delays the reloads, see ManagerConfig.Debounce
+	debounce time.Duration
+	sources  []source
+	files    []*Watcher
+	// dynamic is set if any source is a directory or a glob pattern
+	dynamic        bool
+	maxFileSize    int64
+	decryptionKey  []byte
+	jasyptPassword string
+	env            string
+	cm             atomic.Value
+	bus            *events.Bus
+	// reloads requests the event loop to reload all files, the error is sent back unless the channel is nil
+	reloads chan chan error
+	// edits runs the changes of the sources in the event loop
+	edits     chan func()
+	closing   chan struct{}
+	closeOnce sync.Once
+	// done is closed once the event loop returned
+	done chan struct{}
+}
+
+// NewManager returns a new Manager, the manager is returned along with the first error
+// if any of the files could be watched but failed to load
+func NewManager(ctx context.Context, cfg ManagerConfig) (*Manager, error) {
+	validateConfig(&cfg)
+	fw := watcher.New()
+	m := &Manager{
+		log:            cfg.Log,
+		fw:             fw,
+		bus:            cfg.Bus,
+		maxFileSize:    cfg.MaxFileSize,
+		decryptionKey:  cfg.DecryptionKey,
+		jasyptPassword: cfg.JasyptPassword,
+		env:            strings.ToUpper(cfg.Env),
+		debounce:       cfg.Debounce,
+		reloads:        make(chan chan error),
+		edits:          make(chan func()),
+		closing:        make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	if cfg.Notify {
+		n, err := newNotifier()
+		if err != nil {
+			cfg.Log.Get().Warn(fmt.Sprintf("polling the files, error watching them with notifications: %v", err))
+		} else {
+			m.notify = n
+		}
+	}
+	started := false
+	defer func() {
+		// the notifier is released if the manager fails to start
+		if m.notify != nil && !started {
+			m.notify.Close()
+		}
+	}()
+	plain := make(map[string]bool)
+	for _, file := range cfg.Files {
+		s, err := newSource(file)
+		if err != nil {
+			return nil, err
+		}
+		if s.dir == "" {
+			if plain[s.pattern] {
+				return nil, fmt.Errorf("got an invalid file path to watch: %s", file)
+			}
+			plain[s.pattern] = true
+		}
+		if err := m.watch(s); err != nil {
+			return nil, err
+		}
+		m.sources = append(m.sources, s)
+	}
+	m.dynamic = isDynamic(m.sources)
+	// keep the files in the order of precedence
+	paths, err := expand(m.sources)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		m.files = append(m.files, m.newWatcher(path))
+	}
+	m.cm.Store(ConfigMap{})
+	files := m.Files()
+
+	started = true
+	go m.run(ctx)
+
+	go func() {
+		for _, w := range files {
+			cfg.Log.Get().Info(fmt.Sprintf("started watching file: %s", w.filePath))
+		}
+		if m.notify != nil {
+			m.notify.Start()
+			return
+		}
+		if err := fw.Start(cfg.WatchInterval); err != nil {
+			cfg.Log.Get().Error(fmt.Sprintf("error starting watcher: %v", err))
+			return
+		}
+	}()
+
+	for _, w := range files {
+		if e := w.readConfigMap(cfg.Log); e != nil && err == nil {
+			err = e
+		}
+	}
+	return m, err
+}
+
+// add watches a file or all files of a directory
+func (m *Manager) add(path string, dir bool) error {
+	if err := m.fw.Add(path); err != nil {
+		return err
+	}
+	if m.notify != nil {
+		return m.notify.Add(path, dir)
+	}
+	return nil
+}
+
+// watch watches the file of a source, or its directory for the files added to and removed from it
+func (m *Manager) watch(s source) error {
+	if s.dir != "" {
+		return m.add(s.dir, true)
+	}
+	if err := m.add(s.pattern, false); err != nil {
+		return err
+	}
+	if info, ok := m.fw.WatchedFiles()[s.pattern]; !ok || info.IsDir() {
+		return fmt.Errorf("got an invalid file path to watch: %s", s.pattern)
+	}
+	// the checksum is watched too, so that the file loads once the checksum is updated after it
+	if _, err := os.Stat(s.pattern + checksumExt); err == nil {
+		return m.add(s.pattern+checksumExt, false)
+	}
+	return nil
+}
+
+// unwatch stops watching the files or the directories of sources, the remaining sources are watched again
+// in case they share them
+func (m *Manager) unwatch(sources []source, remaining []source) {
+	for _, s := range sources {
+		paths := []string{s.dir}
+		if s.dir == "" {
+			paths = []string{s.pattern, s.pattern + checksumExt}
+		}
+		for _, path := range paths {
+			m.fw.Remove(path)
+			if m.notify != nil {
+				m.notify.Remove(path)
+			}
+		}
+	}
+	for _, r := range remaining {
+		if err := m.watch(r); err != nil {
+			m.log.Get().Error(fmt.Sprintf("error watching %s: %v", r.pattern, err))
+		}
+	}
+}
+
+// isDynamic returns true if any source is a directory or a glob pattern
+func isDynamic(sources []source) bool {
+	for _, s := range sources {
+		if s.dir != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// newWatcher returns the watcher of a file, its config is empty until it is loaded
+func (m *Manager) newWatcher(path string) *Watcher {
+	return &Watcher{
+		m:              m,
+		fs:             afero.NewOsFs(),
+		filePath:       path,
+		maxFileSize:    m.maxFileSize,
+		decryptionKey:  m.decryptionKey,
+		jasyptPassword: m.jasyptPassword,
+		env:            m.env,
+		status:         Status{File: path},
+	}
+}
+
+// expand returns the files of sources in the order of precedence, a file is kept at its first occurrence
+func expand(sources []source) ([]string, error) {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, s := range sources {
+		files, err := s.files()
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if !seen[f] {
+				seen[f] = true
+				paths = append(paths, f)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// rescan updates the watched files to the ones the directories and glob patterns contain now,
+// the added files are loaded and the changes of the added and removed files are published.
+// It returns the paths of the added files
+func (m *Manager) rescan() map[string]bool {
+	if !m.dynamic {
+		return nil
+	}
+	paths, err := expand(m.sources)
+	if err != nil {
+		m.log.Get().Error(fmt.Sprintf("error listing config files: %v", err))
+		return nil
+	}
+	m.loading.Lock()
+	defer m.loading.Unlock()
+	m.mu.Lock()
+	removed := make(map[string]*Watcher, len(m.files))
+	for _, w := range m.files {
+		removed[w.filePath] = w
+	}
+	files := make([]*Watcher, 0, len(paths))
+	var added []*Watcher
+	for _, path := range paths {
+		w, ok := removed[path]
+		if ok {
+			delete(removed, path)
+		} else {
+			w = m.newWatcher(path)
+			added = append(added, w)
+		}
+		files = append(files, w)
+	}
+	m.files = files
+	m.mu.Unlock()
+
+	gone := make([]string, 0, len(removed))
+	for path := range removed {
+		gone = append(gone, path)
+	}
+	sort.Strings(gone)
+	for _, path := range gone {
+		old := m.Config()
+		m.merge()
+		m.publish(old, m.Config(), path)
+		m.log.Get().Info(fmt.Sprintf("stopped watching removed file: %s", path))
+	}
+	for _, w := range added {
+		m.log.Get().Info(fmt.Sprintf("started watching file: %s", w.filePath))
+	}
+	m.load(added)
+	news := make(map[string]bool, len(added))
+	for _, w := range added {
+		news[w.filePath] = true
+	}
+	return news
+}
+
+func validateConfig(cfg *ManagerConfig) {
+	if cfg.WatchInterval < time.Second {
+		cfg.WatchInterval = time.Second
+	}
+	if cfg.Log == nil {
+		cfg.Log = nlogger.NewProvider(nlogger.New(os.Stdout, ""))
+	}
+	if cfg.Bus == nil {
+		cfg.Bus = events.NewBus()
+	}
+}
+
+// run reloads the files on the events of the file watcher until the manager is closed or ctx is done
+func (m *Manager) run(ctx context.Context) {
+	defer close(m.done)
+	// the events of the file watcher in use, the other one never sends any
+	var notified <-chan string
+	var notifyErrs <-chan error
+	if m.notify != nil {
+		notified = m.notify.Event
+		notifyErrs = m.notify.Error
+	}
+	// pending are the paths of the events received within the debounce window, reloaded once it elapses
+	pending := make(map[string]bool)
+	var timer *time.Timer
+	var debounced <-chan time.Time
+	received := func(path string) {
+		if m.debounce <= 0 {
+			m.apply([]string{path})
+			return
+		}
+		pending[path] = true
+		if timer == nil {
+			timer = time.NewTimer(m.debounce)
+		} else {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(m.debounce)
+		}
+		debounced = timer.C
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			m.log.Get().Debug("ctx was cancelled, stopping watcher")
+			m.stop()
+			return
+		case <-m.closing:
+			m.log.Get().Debug("watcher is closed")
+			m.stop()
+			return
+		case event := <-m.fw.Event:
+			m.log.Get().Debug(fmt.Sprintf("watcher received event: %s", event))
+			received(event.Path)
+		case path := <-notified:
+			m.log.Get().Debug(fmt.Sprintf("watcher received notified event: %s", path))
+			received(path)
+		case <-debounced:
+			debounced = nil
+			paths := make([]string, 0, len(pending))
+			for path := range pending {
+				paths = append(paths, path)
+			}
+			pending = make(map[string]bool)
+			m.apply(paths)
+		case edit := <-m.edits:
+			edit()
+		case errc := <-m.reloads:
+			m.rescan()
+			err := m.reload(m.Files())
+			if errc != nil {
+				errc <- err
+			}
+		case err := <-m.fw.Error:
+			m.log.Get().Error(fmt.Sprintf("watcher received error: %v", err))
+		case err := <-notifyErrs:
+			m.log.Get().Error(fmt.Sprintf("watcher received error: %v", err))
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// the changed files are unknown once events were dropped
+				m.rescan()
+				m.reload(m.Files())
+			}
+		}
+	}
+}
+
+// apply reloads the files changed by the events on paths, each file once in the order of precedence
+func (m *Manager) apply(paths []string) {
+	added := m.rescan()
+	changed := make(map[*Watcher]bool)
+	for _, path := range paths {
+		for _, w := range m.changed(path, added) {
+			changed[w] = true
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	files := make([]*Watcher, 0, len(changed))
+	for _, w := range m.Files() {
+		if changed[w] {
+			files = append(files, w)
+		}
+	}
+	m.reload(files)
+}
+
+// reload reads files and publishes the changes, it returns the first error
+func (m *Manager) reload(files []*Watcher) error {
+	m.loading.Lock()
+	defer m.loading.Unlock()
+	return m.load(files)
+}
+
+// load reads files and publishes the changes, the caller holds the loading lock
+func (m *Manager) load(files []*Watcher) error {
+	var err error
+	for _, w := range files {
+		old := m.Config()
+		if e := w.readConfigMap(m.log); e != nil {
+			m.log.Get().Error(fmt.Sprintf("error reading file %s: %v", w.filePath, e))
+			if err == nil {
+				err = e
+			}
+		} else {
+			m.publish(old, m.Config(), w.filePath)
+			m.log.Get().Info(fmt.Sprintf("watcher loaded new config from %s", w.filePath))
+		}
+	}
+	return err
+}
+
+// stop closes the file watcher in the background, it stops polling within the watch interval.
+// Its events are drained meanwhile so that it never blocks sending them
+func (m *Manager) stop() {
+	if m.notify != nil {
+		m.notify.Close()
+		return
+	}
+	go func() {
+		m.fw.Wait()
+		go m.fw.Close()
+		for {
+			select {
+			case <-m.fw.Closed:
+				return
+			case <-m.fw.Event:
+			case <-m.fw.Error:
+			}
+		}
+	}()
+}
+
+// Reload reloads all files and publishes the changes, it returns the first error
+// or ErrClosed once the manager is closed
+func (m *Manager) Reload() error {
+	errc := make(chan error, 1)
+	select {
+	case m.reloads <- errc:
+	case <-m.done:
+		return ErrClosed
+	}
+	return <-errc
+}
+
+// AddFiles watches files along with the others with the lowest precedence, files are config files, directories
+// or glob patterns like ManagerConfig.Files. The files are loaded and their changes published,
+// none is watched if any fails to load or is watched already
+func (m *Manager) AddFiles(files []string) error {
+	return m.edit(func() error {
+		m.loading.Lock()
+		defer m.loading.Unlock()
+		sources := append([]source{}, m.sources...)
+		for _, file := range files {
+			s, err := newSource(file)
+			if err != nil {
+				return err
+			}
+			if containsSource(sources, s) {
+				return fmt.Errorf("file already watched: %s", file)
+			}
+			sources = append(sources, s)
+		}
+		added := sources[len(m.sources):]
+		for i, s := range added {
+			if err := m.watch(s); err != nil {
+				m.unwatch(added[:i+1], m.sources)
+				return err
+			}
+		}
+		paths, err := expand(sources)
+		if err != nil {
+			m.unwatch(added, m.sources)
+			return err
+		}
+		// the added files are loaded before they are merged, so that none is served if any fails to load
+		current := make(map[string]*Watcher)
+		for _, w := range m.Files() {
+			current[w.filePath] = w
+		}
+		watchers := make([]*Watcher, 0, len(paths))
+		var news []string
+		for _, path := range paths {
+			w, ok := current[path]
+			if !ok {
+				w = m.newWatcher(path)
+				if err := w.readConfigMap(m.log); err != nil {
+					m.unwatch(added, m.sources)
+					return fmt.Errorf("%s: %v", path, err)
+				}
+				news = append(news, path)
+			}
+			watchers = append(watchers, w)
+		}
+		m.sources = sources
+		m.dynamic = isDynamic(sources)
+		m.replace(watchers, strings.Join(files, ", "))
+		for _, path := range news {
+			m.log.Get().Info(fmt.Sprintf("started watching file: %s", path))
+		}
+		return nil
+	})
+}
+
+// RemoveFiles stops watching files, the config files, directories or glob patterns given to NewManager or AddFiles,
+// their namespaces are served by the other files or removed and the changes published.
+// verify, unless nil, is called with the merged config without the files, they are kept if it returns an error
+func (m *Manager) RemoveFiles(files []string, verify func(cm ConfigMap) error) error {
+	return m.edit(func() error {
+		m.loading.Lock()
+		defer m.loading.Unlock()
+		removed := make(map[string]bool, len(files))
+		for _, file := range files {
+			s, err := newSource(file)
+			if err != nil {
+				return err
+			}
+			if !containsSource(m.sources, s) {
+				return fmt.Errorf("file not watched: %s", file)
+			}
+			removed[s.pattern] = true
+		}
+		var sources, gone []source
+		for _, s := range m.sources {
+			if removed[s.pattern] {
+				gone = append(gone, s)
+			} else {
+				sources = append(sources, s)
+			}
+		}
+		paths, err := expand(sources)
+		if err != nil {
+			return err
+		}
+		current := make(map[string]*Watcher)
+		for _, w := range m.Files() {
+			current[w.filePath] = w
+		}
+		watchers := make([]*Watcher, 0, len(paths))
+		for _, path := range paths {
+			if w, ok := current[path]; ok {
+				watchers = append(watchers, w)
+			}
+		}
+		if verify != nil {
+			if err := verify(mergeFiles(watchers)); err != nil {
+				return err
+			}
+		}
+		m.unwatch(gone, sources)
+		m.sources = sources
+		m.dynamic = isDynamic(sources)
+		for _, w := range watchers {
+			delete(current, w.filePath)
+		}
+		for path := range current {
+			m.log.Get().Info(fmt.Sprintf("stopped watching removed file: %s", path))
+		}
+		m.replace(watchers, strings.Join(files, ", "))
+		return nil
+	})
+}
+
+func containsSource(sources []source, s source) bool {
+	for _, other := range sources {
+		if other.pattern == s.pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// edit runs fn in the event loop, so that the sources are not changed while the events are handled.
+// It returns the error of fn or ErrClosed once the manager is closed
+func (m *Manager) edit(fn func() error) error {
+	errc := make(chan error, 1)
+	select {
+	case m.edits <- func() { errc <- fn() }:
+	case <-m.done:
+		return ErrClosed
+	}
+	return <-errc
+}
+
+// replace serves watchers in place of the watched files and publishes the changes of the files, the caller
+// holds the loading lock
+func (m *Manager) replace(watchers []*Watcher, files string) {
+	m.mu.Lock()
+	m.files = watchers
+	m.mu.Unlock()
+	old := m.Config()
+	m.merge()
+	m.publish(old, m.Config(), files)
+}
+
+// Close stops watching the files, the loaded config is still served.
+// It is safe to call Close more than once, the manager is closed as well once the ctx of NewManager is done
+func (m *Manager) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closing)
+	})
+	<-m.done
+	return nil
+}
+
+// changed returns the files to reload for an event on path, added files are loaded already.
+// Events of a checksum file are bound to its config file, events of a watched directory
+// or its other files are ignored, all files are reloaded for events not bound to a watched file
+func (m *Manager) changed(path string, added map[string]bool) []*Watcher {
+	path = strings.TrimSuffix(path, checksumExt)
+	if added[path] {
+		return nil
+	}
+	files := m.Files()
+	for _, w := range files {
+		if w.filePath == path {
+			return []*Watcher{w}
+		}
+	}
+	for _, s := range m.sources {
+		if s.dir != "" && (path == s.dir || filepath.Dir(path) == s.dir) {
+			return nil
+		}
+	}
+	return files
+}
+
+// Files returns the watchers of the files in the order of precedence
+func (m *Manager) Files() []*Watcher {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Watcher{}, m.files...)
+}
+
+// Bus returns the bus receiving the change events of the merged config
+func (m *Manager) Bus() *events.Bus {
+	return m.bus
+}
+
+// TriggerEvent triggers the reload of all files without waiting for it, it does nothing once the manager is closed
+func (m *Manager) TriggerEvent() {
+	go func() {
+		select {
+		case m.reloads <- nil:
+		case <-m.done:
+		}
+	}()
+}
+
+// Config returns the stored read-only ConfigMap merged from all files
+func (m *Manager) Config() ConfigMap {
+	return m.cm.Load().(ConfigMap)
+}
+
+// merge rebuilds the merged ConfigMap
+func (m *Manager) merge() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cm.Store(mergeFiles(m.files))
+}
+
+// mergeFiles merges the configs of files, a namespace is served from the first file defining it
+func mergeFiles(files []*Watcher) ConfigMap {
+	cm := ConfigMap{}
+	for _, w := range files {
+		for appID, app := range w.Config() {
+			if cm[appID] == nil {
+				cm[appID] = make(map[string]map[string]Namespace)
+			}
+			for cluster, c := range app {
+				if cm[appID][cluster] == nil {
+					cm[appID][cluster] = make(map[string]Namespace)
+				}
+				for namespace, ns := range c {
+					if _, ok := cm[appID][cluster][namespace]; !ok {
+						cm[appID][cluster][namespace] = ns
+					}
+				}
+			}
+		}
+	}
+	return cm
+}
+
+// publish sends an event for every namespace that changed between old and cm,
+// followed by the reload of the file
+func (m *Manager) publish(old ConfigMap, cm ConfigMap, file string) {
+	for _, e := range Diff(old, cm) {
+		e.File = file
+		m.bus.Publish(e)
+	}
+	m.bus.Publish(events.Event{Type: events.FileReloaded, File: file})
+}
+
+// Diff returns an event for every namespace updated or deleted between old and cm,
+// a namespace is updated if the hash of its content changed
+func Diff(old ConfigMap, cm ConfigMap) []events.Event {
+	diff := []events.Event{}
+	for appID, app := range cm {
+		for cluster, c := range app {
+			for namespace, ns := range c {
+				if prev, ok := old[appID][cluster][namespace]; !ok || contentSum(prev) != contentSum(ns) {
+					diff = append(diff, events.Event{
+						Type:      events.NamespaceUpdated,
+						AppID:     appID,
+						Cluster:   cluster,
+						Namespace: namespace,
+					})
+				}
+			}
+		}
+	}
+	for appID, app := range old {
+		for cluster, c := range app {
+			for namespace := range c {
+				if _, ok := cm[appID][cluster][namespace]; !ok {
+					diff = append(diff, events.Event{
+						Type:      events.NamespaceDeleted,
+						AppID:     appID,
+						Cluster:   cluster,
+						Namespace: namespace,
+					})
+				}
+			}
+		}
+	}
+	return diff
+}
+
+// contentSum returns the hash of the content of a namespace, its fields encoded in JSON with the keys sorted
+func contentSum(ns Namespace) [sha256.Size]byte {
+	// a namespace holds strings, maps and slices of them only, it always encodes
+	b, _ := json.Marshal(ns)
+	return sha256.Sum256(b)
+}
+
+// source is a config file, a directory or a glob pattern of ManagerConfig.Files
+type source struct {
+	// pattern is the absolute path of the file, the directory or the pattern
+	pattern string
+	// dir is the watched directory of a directory or a glob pattern, empty for a file
+	dir  string
+	glob bool
+}
+
+// configExts are the extensions of the config files picked up from a directory or an archive,
+// compressed files and archives are picked up from a directory too
+var configExts = map[string]bool{".yaml": true, ".yml": true, ".json": true}
+
+func newSource(file string) (source, error) {
+	// the file watcher reports events with absolute paths
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return source{}, err
+	}
+	if strings.ContainsAny(path, "*?[") {
+		if _, err := filepath.Match(path, ""); err != nil {
+			return source{}, fmt.Errorf("invalid glob pattern %s: %v", file, err)
+		}
+		dir := filepath.Dir(path)
+		if strings.ContainsAny(dir, "*?[") {
+			return source{}, fmt.Errorf("invalid glob pattern %s: only file names can be matched", file)
+		}
+		return source{pattern: path, dir: dir, glob: true}, nil
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return source{pattern: path, dir: path}, nil
+	}
+	return source{pattern: path}, nil
+}
+
+// files returns the files of the source sorted by name, hidden files of a directory are skipped
+func (s source) files() ([]string, error) {
+	if s.dir == "" {
+		return []string{s.pattern}, nil
+	}
+	var names []string
+	if s.glob {
+		matches, err := filepath.Glob(s.pattern)
+		if err != nil {
+			return nil, err
+		}
+		names = matches
+	} else {
+		entries, err := os.ReadDir(s.dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !strings.HasPrefix(e.Name(), ".") && (configExts[filepath.Ext(e.Name())] || archiveExt(e.Name()) != "") {
+				names = append(names, filepath.Join(s.dir, e.Name()))
+			}
+		}
+	}
+	files := []string{}
+	for _, name := range names {
+		// symlinks such as the files of a mounted ConfigMap are followed
+		if info, err := os.Stat(name); err == nil && !info.IsDir() {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,113 @@
+package watcher
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envsKey is the top level key of a config file holding the apps of each env, e.g. DEV or PRO,
+// the apps outside of it are the ones of the default env
+const envsKey = "envs"
+
+// namespaceFields are the yaml keys of a Namespace
+var namespaceFields = func() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(Namespace{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		fields[name] = true
+	}
+	return fields
+}()
+
+// fileConfig is the content of a config file, either a ConfigMap along with the ConfigMaps of its envs
+// or only the namespaces of the app and cluster given by the path of the file
+type fileConfig struct {
+	cm         ConfigMap
+	envs       map[string]ConfigMap
+	namespaces map[string]Namespace
+}
+
+// UnmarshalYAML decodes the namespaces of a file whose second level keys are all Namespace fields,
+// any other file is decoded as a ConfigMap
+func (fc *fileConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw map[string]map[string]interface{}
+	if err := unmarshal(&raw); err == nil && isNamespaces(raw) {
+		return unmarshal(&fc.namespaces)
+	}
+	if _, ok := raw[envsKey]; !ok {
+		return unmarshal(&fc.cm)
+	}
+	var envs struct {
+		Envs map[string]ConfigMap `yaml:"envs"`
+	}
+	if err := unmarshal(&envs); err != nil {
+		return err
+	}
+	fc.envs = make(map[string]ConfigMap, len(envs.Envs))
+	for env, cm := range envs.Envs {
+		// env names are case insensitive like with Apollo
+		fc.envs[strings.ToUpper(env)] = cm
+	}
+	// the apps are decoded again without the envs, whose apps are not Namespaces
+	var apps map[string]interface{}
+	if err := unmarshal(&apps); err != nil {
+		return err
+	}
+	delete(apps, envsKey)
+	b, err := yaml.Marshal(apps)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(b, &fc.cm)
+}
+
+func isNamespaces(raw map[string]map[string]interface{}) bool {
+	if len(raw) == 0 {
+		return false
+	}
+	for _, ns := range raw {
+		if len(ns) == 0 {
+			return false
+		}
+		for k := range ns {
+			if !namespaceFields[k] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// configMaps returns the ConfigMaps of the envs of the file at path, the default env is keyed by "".
+// The default env is left out of a file with envs and no other apps
+func (fc fileConfig) configMaps(path string) map[string]ConfigMap {
+	cms := make(map[string]ConfigMap, len(fc.envs)+1)
+	for env, cm := range fc.envs {
+		if cm == nil {
+			cm = ConfigMap{}
+		}
+		cms[env] = cm
+	}
+	if cm := fc.configMap(path); len(cm) > 0 || len(fc.envs) == 0 {
+		cms[""] = cm
+	}
+	return cms
+}
+
+// configMap returns the ConfigMap of the file at path, the namespaces of a file
+// such as fixtures/myAppID/myCluster.yaml are served to the app and cluster of its path
+func (fc fileConfig) configMap(path string) ConfigMap {
+	if fc.namespaces == nil {
+		if fc.cm == nil {
+			return ConfigMap{}
+		}
+		return fc.cm
+	}
+	appID := filepath.Base(filepath.Dir(path))
+	cluster := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	return ConfigMap{appID: {cluster: fc.namespaces}}
+}
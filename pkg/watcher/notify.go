@@ -0,0 +1,151 @@
+package watcher
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// notifyOps are the events of the entries of a watched directory that change a config file
+const notifyOps = fsnotify.Write | fsnotify.Create | fsnotify.Remove | fsnotify.Rename
+
+// notifyBuffer is the number of events queued by the watcher
+const notifyBuffer = 64
+
+// notifier watches files and directories with fsnotify, e.g. inotify on linux. The directory of a watched file
+// is watched in its place, so that the file is still watched once replaced by an editor or a rename
+type notifier struct {
+	mu sync.Mutex
+	fw *fsnotify.Watcher
+	// dirs are the watched directories
+	dirs map[string]bool
+	// files are the watched paths, all entries of a watched directory are watched
+	files map[string]bool
+	// Event and Error receive the absolute paths of the changed entries and the errors of the watcher
+	Event  chan string
+	Error  chan error
+	closed chan struct{}
+}
+
+func newNotifier() (*notifier, error) {
+	fw, err := fsnotify.NewBufferedWatcher(notifyBuffer)
+	if err != nil {
+		return nil, err
+	}
+	return &notifier{
+		fw:     fw,
+		dirs:   make(map[string]bool),
+		files:  make(map[string]bool),
+		Event:  make(chan string),
+		Error:  make(chan error),
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// Add watches a file or all entries of a directory by their absolute paths
+func (n *notifier) Add(path string, dir bool) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.files[path] = true
+	if !dir {
+		path = filepath.Dir(path)
+	}
+	if n.dirs[path] {
+		return nil
+	}
+	if err := n.fw.Add(path); err != nil {
+		return err
+	}
+	n.dirs[path] = true
+	return nil
+}
+
+// Remove stops watching a file or the entries of a directory, the directory stays watched for the other files
+func (n *notifier) Remove(path string) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.files, path)
+}
+
+// Start sends the events until the notifier is closed, the events received at once are sent once per path.
+// The errors are sent as they are, fsnotify.ErrEventOverflow once events were dropped
+func (n *notifier) Start() {
+	for {
+		var paths []string
+		seen := make(map[string]bool)
+		received := func(e fsnotify.Event) {
+			if !e.Has(notifyOps) {
+				return
+			}
+			if path, ok := n.match(e.Name); ok && !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+		select {
+		case <-n.closed:
+			return
+		case e, ok := <-n.fw.Events:
+			if !ok {
+				return
+			}
+			received(e)
+			// the events already queued, e.g. the writes of a file, are sent along
+			for len(n.fw.Events) > 0 {
+				received(<-n.fw.Events)
+			}
+		case err, ok := <-n.fw.Errors:
+			if !ok {
+				return
+			}
+			select {
+			case <-n.closed:
+				return
+			case n.Error <- err:
+			}
+		}
+		for _, path := range paths {
+			select {
+			case <-n.closed:
+				return
+			case n.Event <- path:
+			}
+		}
+	}
+}
+
+// match returns the path of an entry of a watched directory if it is watched. Kubernetes swaps the ..data symlink
+// of a mounted ConfigMap to update its files, such entries are bound to all watched files of the directory
+func (n *notifier) match(path string) (string, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	dir, name := filepath.Split(path)
+	dir = filepath.Clean(dir)
+	if !n.dirs[dir] || name == "" {
+		return "", false
+	}
+	if n.files[path] || n.files[dir] {
+		return path, true
+	}
+	if strings.HasPrefix(name, "..") {
+		// an event not bound to a watched file reloads all files
+		return dir, true
+	}
+	return "", false
+}
+
+// Close stops watching, Start returns
+func (n *notifier) Close() error {
+	close(n.closed)
+	return n.fw.Close()
+}
@@ -0,0 +1,73 @@
+package watcher
+
+import (
+	"sort"
+)
+
+// applyOverrides serves the namespaces with per-cluster overrides in the overridden clusters,
+// with their base properties overlaid by the overrides of each cluster.
+// A namespace defined in the overridden cluster itself takes precedence.
+func applyOverrides(cm ConfigMap) error {
+	type base struct {
+		cluster   string
+		namespace string
+		ns        Namespace
+	}
+	for appKey, app := range cm {
+		bases := []base{}
+		for clusterKey, cluster := range app {
+			for nsKey, ns := range cluster {
+				if ns.Overrides != nil {
+					bases = append(bases, base{clusterKey, nsKey, ns})
+				}
+			}
+		}
+		// bases are walked in order so that conflicts are reported consistently
+		sort.Slice(bases, func(i, j int) bool {
+			if bases[i].cluster != bases[j].cluster {
+				return bases[i].cluster < bases[j].cluster
+			}
+			return bases[i].namespace < bases[j].namespace
+		})
+		derived := make(map[string]string)
+		for _, b := range bases {
+			app[b.cluster][b.namespace] = overlay(b.ns, b.ns.Overrides[b.cluster])
+			for target, props := range b.ns.Overrides {
+				if target == "" {
+					return &ErrBadNamespace{AppID: appKey, Cluster: b.cluster, Namespace: b.namespace, Reason: NamespaceEmptyOverride}
+				}
+				if target == b.cluster {
+					continue
+				}
+				key := target + "/" + b.namespace
+				if from, ok := derived[key]; ok {
+					return &ErrBadNamespace{AppID: appKey, Cluster: target, Namespace: b.namespace,
+						Reason: NamespaceConflictingOverrides, From: []string{from, b.cluster}}
+				}
+				if _, ok := app[target][b.namespace]; ok {
+					continue
+				}
+				if app[target] == nil {
+					app[target] = make(map[string]Namespace)
+				}
+				app[target][b.namespace] = overlay(b.ns, props)
+				derived[key] = b.cluster
+			}
+		}
+	}
+	return nil
+}
+
+// overlay returns a copy of ns without overrides, its properties overlaid by props
+func overlay(ns Namespace, props map[string]string) Namespace {
+	merged := make(map[string]string, len(ns.Properties)+len(props))
+	for k, v := range ns.Properties {
+		merged[k] = v
+	}
+	for k, v := range props {
+		merged[k] = v
+	}
+	ns.Properties = merged
+	ns.Overrides = nil
+	return ns
+}
@@ -1,17 +1,21 @@
 package watcher
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"os"
+	"io"
+	"regexp"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/figroc/mock-apollo-go/pkg/events"
 	"github.com/lalamove/nui/nlogger"
 	"github.com/paradime-io/gonja"
-	"github.com/radovskyb/watcher"
 	"github.com/spf13/afero"
 	"gopkg.in/yaml.v2"
 )
@@ -24,97 +28,170 @@ type Namespace struct {
 	Yaml       string            `yaml:"yaml" json:"yaml"`
 	JSON       string            `yaml:"json" json:"json"`
 	XML        string            `yaml:"xml" json:"xml"`
+	// PollTimeout overrides the long poll timeout for clients watching the namespace
+	PollTimeout time.Duration `yaml:"pollTimeout,omitempty" json:"pollTimeout,omitempty"`
+	// MaxPollTimeout is the longest timeout the clients watching the namespace may ask for,
+	// 0 means the poll timeout they are served otherwise
+	MaxPollTimeout time.Duration `yaml:"maxPollTimeout,omitempty" json:"maxPollTimeout,omitempty"`
+	// AppPollTimeout overrides the long poll timeout for all the clients of the app,
+	// the shortest of the namespaces of an app applies to the whole app
+	AppPollTimeout time.Duration `yaml:"appPollTimeout,omitempty" json:"appPollTimeout,omitempty"`
+	// Overrides are the properties overlaid onto the base properties per cluster,
+	// the namespace is served in the overridden clusters that do not define it
+	Overrides map[string]map[string]string `yaml:"overrides,omitempty" json:"overrides,omitempty"`
+	// AccessKeys are the secrets the clients of the app sign their requests with,
+	// the keys of all the namespaces of an app apply to the whole app
+	AccessKeys []string `yaml:"accessKeys,omitempty" json:"accessKeys,omitempty"`
+	// Branches are the gray releases of the namespace, the first branch matching a client is served to it
+	Branches []Branch `yaml:"branches,omitempty" json:"branches,omitempty"`
+	// Jasypt are the keys of the properties served encrypted in the ENC(...) form of jasypt,
+	// with the jasypt password of the watcher
+	Jasypt []string `yaml:"jasypt,omitempty" json:"jasypt,omitempty"`
 }
 
 // ConfigMap holds the app config
 type ConfigMap map[string]map[string]map[string]Namespace
 
+// clone returns a copy of cm sharing none of its maps
+func (cm ConfigMap) clone() ConfigMap {
+	c := make(ConfigMap, len(cm))
+	for appID, app := range cm {
+		c[appID] = make(map[string]map[string]Namespace, len(app))
+		for cluster, namespaces := range app {
+			c[appID][cluster] = make(map[string]Namespace, len(namespaces))
+			for name, ns := range namespaces {
+				if ns.Properties != nil {
+					props := make(map[string]string, len(ns.Properties))
+					for k, v := range ns.Properties {
+						props[k] = v
+					}
+					ns.Properties = props
+				}
+				c[appID][cluster][name] = ns
+			}
+		}
+	}
+	return c
+}
+
 // Config holds the watcher config
 type Config struct {
 	Log           nlogger.Provider
 	File          string
 	WatchInterval time.Duration
+	// Notify watches the file with the notifications of the OS in place of polling it, see ManagerConfig.Notify
+	Notify bool
+	// Debounce delays the reload of the file, see ManagerConfig.Debounce
+	Debounce time.Duration
+	// MaxFileSize is the max size of the watched file in bytes, 0 means no limit
+	MaxFileSize int64
+	// DecryptionKey decrypts the encrypted values of the watched file, see Encrypt
+	DecryptionKey []byte
+	// JasyptPassword encrypts the jasypt properties of the watched file, see Namespace.Jasypt
+	JasyptPassword string
+	// Env is the env whose apps are served from the envs section of the watched file,
+	// empty serves the apps outside of it
+	Env string
+	// Bus receives the change events of the watched file
+	Bus *events.Bus
+}
+
+// Status holds the reload status of the watched file
+type Status struct {
+	File       string    `json:"file"`
+	LastReload time.Time `json:"lastReload"`
+	LastError  string    `json:"lastError,omitempty"`
+	// FailingSince is the time of the first of the consecutive failed loads, zero if the last load succeeded
+	FailingSince time.Time `json:"failingSince"`
+	// Warnings are the namespaces of the loaded config whose content failed to parse
+	Warnings []Warning `json:"warnings,omitempty"`
 }
 
-// Watcher holds information for the watcher
+// Warning is a namespace whose yml, yaml or json content failed to parse,
+// the namespace is still served as is
+type Warning struct {
+	AppID     string `json:"appId"`
+	Cluster   string `json:"cluster"`
+	Namespace string `json:"namespace"`
+	// Format is one of yml, yaml or json
+	Format string `json:"format"`
+	Error  string `json:"error"`
+}
+
+// Watcher holds the config loaded from one of the files of a Manager
 type Watcher struct {
+	mu          sync.Mutex
+	m           *Manager
 	fs          afero.Fs
-	fw          *watcher.Watcher
 	cm          atomic.Value
 	filePath    string
-	UpdateEvent <-chan struct{}
+	maxFileSize int64
+	// decryptionKey decrypts the encrypted values of the file, nil fails loading them
+	decryptionKey []byte
+	// jasyptPassword encrypts the jasypt properties of the file, empty fails loading them
+	jasyptPassword string
+	// jasypted are the values encrypted by the last load of the file, guarded by mu
+	jasypted jasyptCache
+	// env is the upper cased env of the apps loaded from the file
+	env    string
+	status Status
 }
 
-// New returns a new Watcher
+// New returns a new Watcher of a single file
 func New(ctx context.Context, cfg Config) (*Watcher, error) {
-	validateConfig(&cfg)
-	fw := watcher.New()
-	if err := fw.Add(cfg.File); err != nil {
+	m, err := NewManager(ctx, ManagerConfig{
+		Log:            cfg.Log,
+		Files:          []string{cfg.File},
+		WatchInterval:  cfg.WatchInterval,
+		Notify:         cfg.Notify,
+		Debounce:       cfg.Debounce,
+		MaxFileSize:    cfg.MaxFileSize,
+		DecryptionKey:  cfg.DecryptionKey,
+		JasyptPassword: cfg.JasyptPassword,
+		Env:            cfg.Env,
+		Bus:            cfg.Bus,
+	})
+	if m == nil {
 		return nil, err
 	}
-	if len(fw.WatchedFiles()) != 1 {
+	if len(m.files) != 1 {
+		m.Close()
 		return nil, fmt.Errorf("got an invalid file path to watch: %s", cfg.File)
 	}
-	updateChan := make(chan struct{})
-	w := &Watcher{
-		fs:          afero.NewOsFs(),
-		fw:          fw,
-		UpdateEvent: updateChan,
-	}
-	for path := range fw.WatchedFiles() {
-		w.filePath = path
-	}
-	go func() {
-		for {
-			select {
-			case <-fw.Closed:
-				cfg.Log.Get().Debug("watcher is closed")
-				return
-			case <-ctx.Done():
-				cfg.Log.Get().Debug("ctx was cancelled, stopping watcher")
-				fw.Close()
-				return
-			case event := <-fw.Event:
-				cfg.Log.Get().Debug(fmt.Sprintf("watcher received event: %s", event))
-				if err := w.readConfigMap(cfg.Log); err != nil {
-					cfg.Log.Get().Error(fmt.Sprintf("error reading file: %v", err))
-				} else {
-					updateChan <- struct{}{}
-					cfg.Log.Get().Info("watcher loaded new config")
-				}
-			case err := <-fw.Error:
-				cfg.Log.Get().Error(fmt.Sprintf("watcher received error: %v", err))
-			}
-		}
-	}()
-
-	go func() {
-		cfg.Log.Get().Info(fmt.Sprintf("started watching file: %s", w.filePath))
-		if err := fw.Start(cfg.WatchInterval); err != nil {
-			cfg.Log.Get().Error(fmt.Sprintf("error starting watcher: %v", err))
-			return
-		}
-	}()
+	return m.files[0], err
+}
 
-	err := w.readConfigMap(cfg.Log)
-	return w, err
+// MockFS injects mocked fs into Watcher, the file is read from fs from the next reload on
+//
+// Deprecated: use SetConfig to serve a ConfigMap without a file
+func (w *Watcher) MockFS(fs afero.Fs) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.fs = fs
 }
 
-func validateConfig(cfg *Config) {
-	if cfg.WatchInterval < time.Second {
-		cfg.WatchInterval = time.Second
+// SetConfig serves cm in place of the content of the file until the next reload,
+// the changes are published like those of a reload. It is safe for concurrent use
+func (w *Watcher) SetConfig(cm ConfigMap) error {
+	cm = cm.clone()
+	w.m.loading.Lock()
+	defer w.m.loading.Unlock()
+	old := w.m.Config()
+	warnings, err := validate(cm, w.m.log)
+	if err == nil {
+		err = w.store(cm)
 	}
-	if cfg.Log == nil {
-		cfg.Log = nlogger.NewProvider(nlogger.New(os.Stdout, ""))
+	w.setStatus(warnings, err)
+	if err != nil {
+		return err
 	}
+	w.m.publish(old, w.m.Config(), w.filePath)
+	return nil
 }
 
-// MockFS injects mocked fs into Watcher
-// this should only be called immediately after watcher is initialized
-// since it's not a thread safe operation
-func (w *Watcher) MockFS(fs afero.Fs) {
-	w.fs = fs
-	return
+// Bus returns the bus receiving the change events of the watched file
+func (w *Watcher) Bus() *events.Bus {
+	return w.m.bus
 }
 
 // ReloadConfig reloads file config without senging an update event
@@ -122,57 +199,186 @@ func (w *Watcher) ReloadConfig(log nlogger.Provider) error {
 	return w.readConfigMap(log)
 }
 
-// TriggerEvent triggers the update event
+// TriggerEvent triggers the update event of all files watched with w
 func (w *Watcher) TriggerEvent() {
-	w.fw.TriggerEvent(watcher.Write, nil)
+	w.m.TriggerEvent()
+}
+
+// Reload reloads all files watched with w and publishes the changes, it returns the first error
+// or ErrClosed once w is closed
+func (w *Watcher) Reload() error {
+	return w.m.Reload()
+}
+
+// Close stops watching all files watched with w, the loaded config is still served
+func (w *Watcher) Close() error {
+	return w.m.Close()
 }
 
 func (w *Watcher) readConfigMap(log nlogger.Provider) error {
-	b, err := afero.ReadFile(w.fs, w.filePath)
+	warnings, err := w.loadConfigMap(log)
+	w.setStatus(warnings, err)
+	return err
+}
+
+// setStatus records the result of a load
+func (w *Watcher) setStatus(warnings []Warning, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	if err != nil {
-		return err
+		w.status.LastError = err.Error()
+		if w.status.FailingSince.IsZero() {
+			w.status.FailingSince = time.Now()
+		}
+	} else {
+		w.status.LastReload = time.Now()
+		w.status.LastError = ""
+		w.status.FailingSince = time.Time{}
+		w.status.Warnings = warnings
 	}
-	t, err := gonja.FromBytes(b)
+}
+
+func (w *Watcher) loadConfigMap(log nlogger.Provider) ([]Warning, error) {
+	w.mu.Lock()
+	fs := w.fs
+	jasypted := w.jasypted
+	w.mu.Unlock()
+	f, err := fs.Open(w.filePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	s, err := t.ExecuteBytes(nil)
+	defer f.Close()
+	info, err := f.Stat()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if w.maxFileSize > 0 && info.Size() > w.maxFileSize {
+		return nil, &ErrFileTooLarge{Limit: w.maxFileSize}
+	}
+	// a file being copied is not loaded until it matches its checksum
+	if err := verifyChecksum(fs, f, w.filePath); err != nil {
+		return nil, err
+	}
+
+	var envs map[string]ConfigMap
+	if archiveExt(w.filePath) != "" {
+		entries, err := readArchive(f, info.Size(), w.filePath, w.maxFileSize)
+		if err != nil {
+			return nil, err
+		}
+		cms := make(map[string][]ConfigMap)
+		for _, e := range entries {
+			c, err := decodeConfigMaps(bytes.NewReader(e.content), e.name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", e.name, err)
+			}
+			for env, cm := range c {
+				cms[env] = append(cms[env], cm)
+			}
+		}
+		envs = make(map[string]ConfigMap, len(cms))
+		for env, c := range cms {
+			envs[env] = mergeConfigMaps(c)
+		}
+	} else if envs, err = decodeConfigMaps(f, w.filePath); err != nil {
+		return nil, err
+	}
+	// a file serving only other envs serves nothing to the env of the watcher
+	cm, ok := envs[w.env]
+	if !ok {
+		cm = ConfigMap{}
+	}
+	if err := decryptValues(cm, w.decryptionKey); err != nil {
+		return nil, err
+	}
+	if jasypted, err = encryptJasypt(cm, w.jasyptPassword, jasypted); err != nil {
+		return nil, err
 	}
-	cm := ConfigMap{}
-	err = yaml.Unmarshal(s, &cm)
+	var warnings []Warning
+	if ok {
+		if warnings, err = validate(cm, log); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.store(cm); err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	w.jasypted = jasypted
+	w.mu.Unlock()
+	return warnings, nil
+}
+
+// decodeConfigMaps decodes the ConfigMaps of the envs of the config file at path from r, rendering its templates,
+// see fileConfig.configMaps
+func decodeConfigMaps(r io.ReadSeeker, path string) (map[string]ConfigMap, error) {
+	// files without templates are decoded straight from the file
+	// instead of holding the raw and rendered bytes in memory
+	templated, err := hasTemplate(r)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var br io.Reader = bufio.NewReader(r)
+	if templated {
+		b, err := io.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		t, err := gonja.FromBytes(protectPlaceholders(b))
+		if err != nil {
+			return nil, err
+		}
+		s, err := t.ExecuteBytes(nil)
+		if err != nil {
+			return nil, err
+		}
+		br = bytes.NewReader(s)
+	}
+	var fc fileConfig
+	if err := yaml.NewDecoder(br).Decode(&fc); err != nil && err != io.EOF {
+		return nil, err
 	}
-	// validate configuration
+	return fc.configMaps(path), nil
+}
+
+// validate checks cm and returns the namespaces whose content failed to parse
+func validate(cm ConfigMap, log nlogger.Provider) ([]Warning, error) {
+	var warnings []Warning
 	if len(cm) == 0 {
-		return errors.New("invalid config file")
+		return nil, ErrInvalidConfig
 	}
 	for appKey, app := range cm {
-		if appKey == "" {
-			return fmt.Errorf("invalid app name '%s'", appKey)
-		}
-		if len(app) == 0 {
-			return fmt.Errorf("invalid app '%s'", appKey)
+		if appKey == "" || len(app) == 0 {
+			return nil, &ErrEmptyApp{AppID: appKey}
 		}
 		for clusterKey, cluster := range app {
-			if clusterKey == "" {
-				return fmt.Errorf("invalid cluster name '%s' in %s", clusterKey, appKey)
-			}
-			if len(cluster) == 0 {
-				return fmt.Errorf("invalid cluster '%s' in %s", clusterKey, appKey)
+			if clusterKey == "" || len(cluster) == 0 {
+				return nil, &ErrEmptyCluster{AppID: appKey, Cluster: clusterKey}
 			}
 			for nsKey, ns := range cluster {
 				if nsKey == "" {
-					return fmt.Errorf("invalid namespace name '%s' in %s/%s", nsKey, appKey, clusterKey)
+					return nil, &ErrBadNamespace{AppID: appKey, Cluster: clusterKey, Reason: NamespaceEmptyName}
 				}
 				if ns.Properties == nil && ns.Yml == "" && ns.Yaml == "" && ns.XML == "" && ns.JSON == "" {
-					return fmt.Errorf("invalid namespace '%s' in %s/%s", nsKey, appKey, clusterKey)
+					return nil, &ErrBadNamespace{AppID: appKey, Cluster: clusterKey, Namespace: nsKey, Reason: NamespaceNoContent}
 				}
 				for configKey := range ns.Properties {
 					if configKey == "" {
-						return fmt.Errorf("invalid config key '%s' in %s/%s/%s", configKey, appKey, clusterKey, nsKey)
+						return nil, &ErrBadNamespace{AppID: appKey, Cluster: clusterKey, Namespace: nsKey, Reason: NamespaceEmptyKey}
+					}
+				}
+				for _, b := range ns.Branches {
+					if b.Name == "" {
+						return nil, &ErrBadNamespace{AppID: appKey, Cluster: clusterKey, Namespace: nsKey, Reason: NamespaceEmptyBranch}
+					}
+					if b.Percent < 0 || b.Percent > 100 {
+						return nil, &ErrBadNamespace{AppID: appKey, Cluster: clusterKey, Namespace: nsKey, Reason: NamespaceBranchPercent, From: []string{b.Name}}
+					}
+					if len(b.IPs) == 0 && len(b.Labels) == 0 && b.Percent == 0 {
+						return nil, &ErrBadNamespace{AppID: appKey, Cluster: clusterKey, Namespace: nsKey, Reason: NamespaceBranchNoRule, From: []string{b.Name}}
 					}
 				}
 				// validate Yml
@@ -183,6 +389,9 @@ func (w *Watcher) readConfigMap(log nlogger.Provider) error {
 							"failed to parse yml config for namespace '%s' in %s/%s: %s",
 							nsKey, appKey, clusterKey, err.Error(),
 						))
+						warnings = append(warnings, Warning{
+							AppID: appKey, Cluster: clusterKey, Namespace: nsKey, Format: "yml", Error: err.Error(),
+						})
 					}
 				}
 
@@ -194,6 +403,9 @@ func (w *Watcher) readConfigMap(log nlogger.Provider) error {
 							"failed to parse yaml config for namespace '%s' in %s/%s: %s",
 							nsKey, appKey, clusterKey, err.Error(),
 						))
+						warnings = append(warnings, Warning{
+							AppID: appKey, Cluster: clusterKey, Namespace: nsKey, Format: "yaml", Error: err.Error(),
+						})
 					}
 				}
 
@@ -205,16 +417,79 @@ func (w *Watcher) readConfigMap(log nlogger.Provider) error {
 							"failed to parse json config for namespace '%s' in %s/%s: %s",
 							nsKey, appKey, clusterKey, err.Error(),
 						))
+						warnings = append(warnings, Warning{
+							AppID: appKey, Cluster: clusterKey, Namespace: nsKey, Format: "json", Error: err.Error(),
+						})
 					}
 				}
 			}
 		}
 	}
+	sort.Slice(warnings, func(i, j int) bool {
+		a, b := warnings[i], warnings[j]
+		if a.AppID != b.AppID {
+			return a.AppID < b.AppID
+		}
+		if a.Cluster != b.Cluster {
+			return a.Cluster < b.Cluster
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Format < b.Format
+	})
+	return warnings, nil
+}
+
+// store serves cm once its overrides are applied
+func (w *Watcher) store(cm ConfigMap) error {
+	if err := applyOverrides(cm); err != nil {
+		return err
+	}
+	dedupe(cm)
 	w.cm.Store(cm)
+	w.m.merge()
 	return nil
 }
 
+// Status returns the reload status of the watched file
+func (w *Watcher) Status() Status {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status
+}
+
+// placeholder matches the {{.Name}} placeholders substituted when a namespace is served
+var placeholder = regexp.MustCompile(`{{\s*\.\w+\s*}}`)
+
+// protectPlaceholders keeps the placeholders substituted at serve time from being rendered
+// when the file is loaded, gonja variables can't start with a dot so they are unambiguous
+func protectPlaceholders(b []byte) []byte {
+	return placeholder.ReplaceAll(b, []byte("{% raw %}$0{% endraw %}"))
+}
+
+// hasTemplate reports whether r contains any template delimiter
+func hasTemplate(r io.Reader) (bool, error) {
+	br := bufio.NewReader(r)
+	var prev byte
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if prev == '{' && (c == '{' || c == '%' || c == '#') {
+			return true, nil
+		}
+		prev = c
+	}
+}
+
 // Config returns a stored read-only ConfigMap
 func (w *Watcher) Config() ConfigMap {
-	return w.cm.Load().(ConfigMap)
+	// the ConfigMap is empty until a file has been loaded successfully
+	cm, _ := w.cm.Load().(ConfigMap)
+	return cm
 }
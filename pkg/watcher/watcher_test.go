@@ -1,13 +1,25 @@
 package watcher
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/figroc/mock-apollo-go/pkg/events"
+	"github.com/figroc/mock-apollo-go/pkg/jasypt"
+	"github.com/fsnotify/fsnotify"
 	"github.com/lalamove/nui/nlogger"
-	"github.com/radovskyb/watcher"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v2"
@@ -50,12 +62,21 @@ var stubConfigs = []ConfigMap{
 	},
 }
 
-func triggerWriteEvent(ctx context.Context, t *testing.T, w *Watcher) {
-	w.fw.TriggerEvent(watcher.Write, nil)
-	select {
-	case <-ctx.Done():
-		require.Fail(t, "context cancelled")
-	case <-w.UpdateEvent:
+func triggerWriteEvent(ctx context.Context, t *testing.T, w *Watcher) []events.Event {
+	sub := w.Bus().Subscribe(ctx)
+	w.TriggerEvent()
+	received := []events.Event{}
+	for {
+		select {
+		case <-ctx.Done():
+			require.Fail(t, "context cancelled")
+			return received
+		case e := <-sub:
+			received = append(received, e)
+			if e.Type == events.FileReloaded {
+				return received
+			}
+		}
 	}
 }
 func TestWatcher(t *testing.T) {
@@ -74,9 +95,16 @@ func TestWatcher(t *testing.T) {
 	// mock fs and load the stubbed config
 	w, _ := New(ctx, Config{File: "/dev/null"})
 	w.MockFS(appFS)
-	triggerWriteEvent(ctx, t, w)
+	received := triggerWriteEvent(ctx, t, w)
 	// verify config values
 	require.EqualValues(t, stubConfigs[0], w.Config())
+	require.Len(t, received, 2)
+	require.Equal(t, events.NamespaceUpdated, received[0].Type)
+	require.Equal(t, "myNamespace", received[0].Namespace)
+	require.Equal(t, "/dev/null", received[1].File)
+	require.Equal(t, "/dev/null", w.Status().File)
+	require.Empty(t, w.Status().LastError)
+	require.False(t, w.Status().LastReload.IsZero())
 
 	// update the initial config
 	data, err = yaml.Marshal(stubConfigs[1])
@@ -85,6 +113,54 @@ func TestWatcher(t *testing.T) {
 	triggerWriteEvent(ctx, t, w)
 	// verify config values
 	require.EqualValues(t, stubConfigs[1], w.Config())
+
+	// unchanged namespaces are not published
+	received = triggerWriteEvent(ctx, t, w)
+	require.Len(t, received, 1)
+	require.Equal(t, events.FileReloaded, received[0].Type)
+
+	// removed namespaces are published as deleted
+	require.Nil(t, afero.WriteFile(appFS, "/dev/null", []byte(`myApp:
+  myCluster:
+    myNamespace2:
+      properties:
+        k: v`), 0644))
+	received = triggerWriteEvent(ctx, t, w)
+	require.Len(t, received, 3)
+	types := map[events.Type]string{}
+	for _, e := range received {
+		types[e.Type] = e.Namespace
+	}
+	require.Equal(t, map[events.Type]string{
+		events.NamespaceUpdated: "myNamespace2",
+		events.NamespaceDeleted: "myNamespace",
+		events.FileReloaded:     "",
+	}, types)
+}
+
+func TestSetConfig(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	w, err := New(ctx, Config{File: "/dev/null"})
+	require.EqualError(t, err, "invalid config file")
+	sub := w.Bus().Subscribe(ctx)
+
+	cm := ConfigMap{"myApp": {"myCluster": {"myNamespace": {ReleaseKey: "abc", Properties: map[string]string{"k": "v"}}}}}
+	require.Nil(t, w.SetConfig(cm))
+	require.Equal(t, "v", w.Config()["myApp"]["myCluster"]["myNamespace"].Properties["k"])
+	require.Empty(t, w.Status().LastError)
+	require.Equal(t, events.NamespaceUpdated, (<-sub).Type)
+	require.Equal(t, events.FileReloaded, (<-sub).Type)
+
+	// the set ConfigMap is copied
+	cm["myApp"]["myCluster"]["myNamespace"].Properties["k"] = "changed"
+	require.Equal(t, "v", w.Config()["myApp"]["myCluster"]["myNamespace"].Properties["k"])
+
+	// invalid config maps are rejected
+	require.EqualError(t, w.SetConfig(ConfigMap{"myApp": {}}), "invalid app 'myApp'")
+	require.Equal(t, "invalid app 'myApp'", w.Status().LastError)
+	require.Equal(t, "v", w.Config()["myApp"]["myCluster"]["myNamespace"].Properties["k"])
 }
 
 func TestReadConfigMap(t *testing.T) {
@@ -103,6 +179,8 @@ func TestReadConfigMap(t *testing.T) {
 
 	t.Run("file not exist", func(t *testing.T) {
 		require.EqualError(t, w.readConfigMap(log), "open /dev/null: file does not exist")
+		require.Equal(t, "open /dev/null: file does not exist", w.Status().LastError)
+		require.True(t, w.Status().LastReload.IsZero())
 	})
 	t.Run("empty config", func(t *testing.T) {
 		require.Nil(t, afero.WriteFile(appFS, "/dev/null", []byte(""), 0644))
@@ -173,6 +251,19 @@ func TestReadConfigMap(t *testing.T) {
                   "": "mysql://root@localhost/mysql"
                   snowflake.uri: "http://192.168.0.1/snowflake"`,
 		},
+		{
+			name:        "branch without rules",
+			expectedErr: "branch 'canary' of namespace 'myNamespace' in myApp/myCluster has no ips, labels nor percent",
+			configMap: `myApp:
+            myCluster:
+              myNamespace:
+                properties:
+                  snowflake.uri: "http://192.168.0.1/snowflake"
+                branches:
+                  - name: canary
+                    properties:
+                      snowflake.uri: "http://192.168.0.2/snowflake"`,
+		},
 	}
 
 	for _, test := range testMatrix {
@@ -181,4 +272,857 @@ func TestReadConfigMap(t *testing.T) {
 			require.EqualError(t, w.readConfigMap(log), test.expectedErr)
 		})
 	}
+
+	t.Run("typed errors", func(t *testing.T) {
+		require.Nil(t, afero.WriteFile(appFS, "/dev/null", []byte(""), 0644))
+		require.True(t, errors.Is(w.readConfigMap(log), ErrInvalidConfig))
+
+		require.Nil(t, afero.WriteFile(appFS, "/dev/null", []byte(`myApp: {}`), 0644))
+		var appErr *ErrEmptyApp
+		require.True(t, errors.As(w.readConfigMap(log), &appErr))
+		require.Equal(t, "myApp", appErr.AppID)
+
+		require.Nil(t, afero.WriteFile(appFS, "/dev/null", []byte(`myApp:
+            myCluster:
+              myNamespace:
+                properties:
+                  "": "mysql://root@localhost/mysql"`), 0644))
+		var nsErr *ErrBadNamespace
+		require.True(t, errors.As(w.readConfigMap(log), &nsErr))
+		require.Equal(t, ErrBadNamespace{AppID: "myApp", Cluster: "myCluster", Namespace: "myNamespace",
+			Reason: NamespaceEmptyKey}, *nsErr)
+	})
+
+	t.Run("parse warnings", func(t *testing.T) {
+		require.Nil(t, afero.WriteFile(appFS, "/dev/null", []byte(`myApp:
+            myCluster:
+              myNamespace:
+                json: "{"
+              other:
+                yml: "a: b"`), 0644))
+		require.Nil(t, w.readConfigMap(log))
+		warnings := w.Status().Warnings
+		require.Len(t, warnings, 1)
+		require.Equal(t, Warning{
+			AppID:     "myApp",
+			Cluster:   "myCluster",
+			Namespace: "myNamespace",
+			Format:    "json",
+			Error:     warnings[0].Error,
+		}, warnings[0])
+		require.NotEmpty(t, warnings[0].Error)
+	})
+}
+
+func TestReadLargeConfigMap(t *testing.T) {
+	log := nlogger.NewProvider(nlogger.New(os.Stdout, ""))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	// mock fs
+	appFS := afero.NewMemMapFs()
+	appFS.MkdirAll("/dev", 0755)
+
+	w, err := New(ctx, Config{File: "/dev/null", MaxFileSize: 256})
+	require.EqualError(t, err, "invalid config file")
+	w.MockFS(appFS)
+
+	t.Run("plain", func(t *testing.T) {
+		data, err := yaml.Marshal(stubConfigs[0])
+		require.Nil(t, err)
+		require.Nil(t, afero.WriteFile(appFS, "/dev/null", data, 0644))
+		require.Nil(t, w.readConfigMap(log))
+		require.EqualValues(t, stubConfigs[0], w.Config())
+	})
+	t.Run("templated", func(t *testing.T) {
+		require.Nil(t, afero.WriteFile(appFS, "/dev/null", []byte(`myApp:
+  myCluster:
+    myNamespace:
+      properties:
+        {% for i in range(2) %}key{{ i }}: "{{ i }}"
+        {% endfor %}`), 0644))
+		require.Nil(t, w.readConfigMap(log))
+		require.Equal(t, map[string]string{"key0": "0", "key1": "1"}, w.Config()["myApp"]["myCluster"]["myNamespace"].Properties)
+	})
+	t.Run("placeholders", func(t *testing.T) {
+		require.Nil(t, afero.WriteFile(appFS, "/dev/null", []byte(`myApp:
+  myCluster:
+    myNamespace:
+      properties:
+        token: "{{.AppID}}-{{ .ClientIP }}-{{ 1 + 1 }}"`), 0644))
+		require.Nil(t, w.readConfigMap(log))
+		require.Equal(t, "{{.AppID}}-{{ .ClientIP }}-2", w.Config()["myApp"]["myCluster"]["myNamespace"].Properties["token"])
+	})
+	t.Run("size limit", func(t *testing.T) {
+		require.Nil(t, afero.WriteFile(appFS, "/dev/null", make([]byte, 257), 0644))
+		require.EqualError(t, w.readConfigMap(log), "config file exceeds the size limit of 256 bytes")
+	})
+}
+
+func TestDedupe(t *testing.T) {
+	cm := ConfigMap{}
+	for _, app := range []string{"app1", "app2"} {
+		cm[app] = map[string]map[string]Namespace{
+			"cluster": {
+				"ns": {
+					ReleaseKey: "abc",
+					Properties: map[string]string{"k": "v", "k2": "v2"},
+					Yml:        "k: v",
+				},
+			},
+		}
+	}
+	dedupe(cm)
+
+	ns1, ns2 := cm["app1"]["cluster"]["ns"], cm["app2"]["cluster"]["ns"]
+	require.Equal(t, ns1, ns2)
+	// identical properties share the same map
+	ns1.Properties["k3"] = "v3"
+	require.Equal(t, "v3", ns2.Properties["k3"])
+
+	// different properties are kept apart
+	in := newInterner()
+	require.Equal(t, map[string]string{"a": "bc"}, in.props(map[string]string{"a": "bc"}))
+	require.Equal(t, map[string]string{"ab": "c"}, in.props(map[string]string{"ab": "c"}))
+}
+
+func TestManager(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	dir := t.TempDir()
+	file1, file2 := filepath.Join(dir, "file1.yml"), filepath.Join(dir, "file2.yml")
+	require.Nil(t, os.WriteFile(file1, []byte(`app:
+  cluster:
+    ns:
+      releaseKey: file1
+      properties:
+        k: v`), 0644))
+	require.Nil(t, os.WriteFile(file2, []byte(`app:
+  cluster:
+    ns:
+      releaseKey: file2
+      properties:
+        k: v
+    ns2:
+      releaseKey: file2
+      properties:
+        k: v`), 0644))
+
+	m, err := NewManager(ctx, ManagerConfig{Files: []string{file1, file2}})
+	require.Nil(t, err)
+	require.Len(t, m.Files(), 2)
+
+	// earlier files take precedence per namespace
+	cm := m.Config()
+	require.Equal(t, "file1", cm["app"]["cluster"]["ns"].ReleaseKey)
+	require.Equal(t, "file2", cm["app"]["cluster"]["ns2"].ReleaseKey)
+
+	// shadowed namespaces are not published
+	sub := m.Bus().Subscribe(ctx)
+	m.TriggerEvent()
+	received := []events.Event{}
+	for len(received) < 2 {
+		select {
+		case <-ctx.Done():
+			require.Fail(t, "context cancelled")
+			return
+		case e := <-sub:
+			received = append(received, e)
+		}
+	}
+	require.Equal(t, []events.Event{
+		{Type: events.FileReloaded, File: file1, Time: received[0].Time},
+		{Type: events.FileReloaded, File: file2, Time: received[1].Time},
+	}, received)
+
+	t.Run("duplicate file", func(t *testing.T) {
+		_, err := NewManager(ctx, ManagerConfig{Files: []string{file1, file1}})
+		require.EqualError(t, err, "got an invalid file path to watch: "+file1)
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		require.Nil(t, os.WriteFile(file1, []byte(`app:
+  cluster:
+    ns:
+      releaseKey: reloaded
+      properties:
+        k: v`), 0644))
+		require.Nil(t, m.Reload())
+		require.Equal(t, "reloaded", m.Config()["app"]["cluster"]["ns"].ReleaseKey)
+
+		require.Nil(t, os.WriteFile(file1, []byte(`app: {}`), 0644))
+		require.EqualError(t, m.Reload(), "invalid app 'app'")
+		require.Equal(t, "reloaded", m.Config()["app"]["cluster"]["ns"].ReleaseKey)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		require.Nil(t, m.Close())
+		require.Nil(t, m.Close())
+		require.Equal(t, ErrClosed, m.Reload())
+		m.TriggerEvent()
+		// the loaded config is still served
+		require.Equal(t, "reloaded", m.Config()["app"]["cluster"]["ns"].ReleaseKey)
+	})
+}
+
+func TestManagerSources(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	dir := t.TempDir()
+	write := func(name string, releaseKey string) {
+		require.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte(`app:
+  cluster:
+    ns:
+      releaseKey: `+releaseKey+`
+      properties:
+        k: v
+    `+releaseKey+`:
+      properties:
+        k: v`), 0644))
+	}
+	write("b.yml", "b")
+	write("c.yaml", "c")
+	write(".hidden.yaml", "hidden")
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a config"), 0644))
+	require.Nil(t, os.Mkdir(filepath.Join(dir, "sub.yaml"), 0755))
+	paths := func(m *Manager) []string {
+		files := []string{}
+		for _, w := range m.Files() {
+			files = append(files, filepath.Base(w.filePath))
+		}
+		return files
+	}
+
+	t.Run("directory", func(t *testing.T) {
+		m, err := NewManager(ctx, ManagerConfig{Files: []string{dir}})
+		require.Nil(t, err)
+		defer m.Close()
+		require.Equal(t, []string{"b.yml", "c.yaml"}, paths(m))
+		require.Equal(t, "b", m.Config()["app"]["cluster"]["ns"].ReleaseKey)
+	})
+
+	t.Run("glob", func(t *testing.T) {
+		m, err := NewManager(ctx, ManagerConfig{Files: []string{filepath.Join(dir, "*.yaml")}})
+		require.Nil(t, err)
+		defer m.Close()
+		require.Equal(t, []string{".hidden.yaml", "c.yaml"}, paths(m))
+
+		_, err = NewManager(ctx, ManagerConfig{Files: []string{filepath.Join(dir, "*", "a.yaml")}})
+		require.Error(t, err)
+	})
+
+	t.Run("edited", func(t *testing.T) {
+		b, c := filepath.Join(dir, "b.yml"), filepath.Join(dir, "c.yaml")
+		m, err := NewManager(ctx, ManagerConfig{Files: []string{b}})
+		require.Nil(t, err)
+		defer m.Close()
+		loaded := m.Files()[0]
+
+		require.Nil(t, m.AddFiles([]string{c}))
+		require.Equal(t, []string{"b.yml", "c.yaml"}, paths(m))
+		require.Equal(t, loaded, m.Files()[0])
+		require.Equal(t, "b", m.Config()["app"]["cluster"]["ns"].ReleaseKey)
+		require.Contains(t, m.Config()["app"]["cluster"], "c")
+		require.EqualError(t, m.AddFiles([]string{b}), "file already watched: "+b)
+		// none of the files is watched if any fails to load
+		require.Error(t, m.AddFiles([]string{dir, filepath.Join(dir, "notes.txt")}))
+		require.Equal(t, []string{"b.yml", "c.yaml"}, paths(m))
+
+		require.EqualError(t, m.RemoveFiles([]string{b}, func(cm ConfigMap) error {
+			require.Equal(t, "c", cm["app"]["cluster"]["ns"].ReleaseKey)
+			return errors.New("verification failed")
+		}), "verification failed")
+		require.Equal(t, []string{"b.yml", "c.yaml"}, paths(m))
+		require.Nil(t, m.RemoveFiles([]string{b}, nil))
+		require.Equal(t, []string{"c.yaml"}, paths(m))
+		require.Equal(t, "c", m.Config()["app"]["cluster"]["ns"].ReleaseKey)
+		require.EqualError(t, m.RemoveFiles([]string{b}, nil), "file not watched: "+b)
+	})
+
+	t.Run("added and removed", func(t *testing.T) {
+		m, err := NewManager(ctx, ManagerConfig{Files: []string{dir}})
+		require.Nil(t, err)
+		defer m.Close()
+		sub := m.Bus().Subscribe(ctx)
+
+		write("a.yml", "a")
+		require.Nil(t, os.Remove(filepath.Join(dir, "c.yaml")))
+		require.Nil(t, m.Reload())
+		require.Equal(t, []string{"a.yml", "b.yml"}, paths(m))
+		cm := m.Config()
+		require.Equal(t, "a", cm["app"]["cluster"]["ns"].ReleaseKey)
+		require.Contains(t, cm["app"]["cluster"], "a")
+		require.NotContains(t, cm["app"]["cluster"], "c")
+
+		deleted := false
+		for !deleted {
+			select {
+			case <-ctx.Done():
+				require.Fail(t, "context cancelled")
+				return
+			case e := <-sub:
+				deleted = e.Type == events.NamespaceDeleted && e.Namespace == "c"
+			}
+		}
+	})
+}
+
+func TestManagerNotify(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.yaml")
+	write := func(path string, releaseKey string) {
+		require.Nil(t, os.WriteFile(path, []byte(`app:
+  cluster:
+    ns:
+      releaseKey: `+releaseKey+`
+      properties:
+        k: v`), 0644))
+	}
+	write(file, "v1")
+	m, err := NewManager(ctx, ManagerConfig{Files: []string{file}, Notify: true})
+	require.Nil(t, err)
+	defer m.Close()
+	if m.notify == nil {
+		t.Skip("notifications are not supported")
+	}
+	sub := m.Bus().Subscribe(ctx)
+	// the changes are picked up well within the poll interval
+	wait := func(releaseKey string) {
+		for m.Config()["app"]["cluster"]["ns"].ReleaseKey != releaseKey {
+			select {
+			case <-ctx.Done():
+				require.Fail(t, "context cancelled")
+				return
+			case <-sub:
+			}
+		}
+	}
+
+	// the other files of the directory are not loaded
+	write(filepath.Join(dir, "other.yaml"), "other")
+	write(file, "v2")
+	wait("v2")
+	require.Len(t, m.Files(), 1)
+
+	// the file is still watched once replaced
+	tmp := filepath.Join(dir, "app.yaml.tmp")
+	write(tmp, "v3")
+	require.Nil(t, os.Rename(tmp, file))
+	wait("v3")
+	write(file, "v4")
+	wait("v4")
+
+	// the files are reloaded once events were dropped
+	m.notify.Remove(file)
+	write(file, "v5")
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, "v4", m.Config()["app"]["cluster"]["ns"].ReleaseKey)
+	require.Nil(t, m.notify.Add(file, false))
+	m.notify.Error <- fsnotify.ErrEventOverflow
+	wait("v5")
+}
+
+func TestManagerDebounce(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	file := filepath.Join(t.TempDir(), "app.yaml")
+	write := func(releaseKey string) {
+		require.Nil(t, os.WriteFile(file, []byte(`app:
+  cluster:
+    ns:
+      releaseKey: `+releaseKey+`
+      properties:
+        k: `+releaseKey), 0644))
+	}
+	write("v0")
+	m, err := NewManager(ctx, ManagerConfig{Files: []string{file}, Notify: true, Debounce: 200 * time.Millisecond})
+	require.Nil(t, err)
+	defer m.Close()
+	if m.notify == nil {
+		t.Skip("notifications are not supported")
+	}
+	sub := m.Bus().Subscribe(ctx)
+
+	// the writes in quick succession are published once
+	for _, releaseKey := range []string{"v1", "v2", "v3"} {
+		write(releaseKey)
+		time.Sleep(20 * time.Millisecond)
+	}
+	received := []events.Event{}
+	for len(received) < 2 {
+		select {
+		case <-ctx.Done():
+			require.Fail(t, "context cancelled")
+			return
+		case e := <-sub:
+			received = append(received, e)
+		}
+	}
+	require.Equal(t, events.NamespaceUpdated, received[0].Type)
+	require.Equal(t, events.FileReloaded, received[1].Type)
+	require.Equal(t, "v3", m.Config()["app"]["cluster"]["ns"].ReleaseKey)
+	select {
+	case e := <-sub:
+		require.Fail(t, "unexpected event", "%v", e)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestNamespacesFile(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	dir := filepath.Join(t.TempDir(), "web")
+	require.Nil(t, os.Mkdir(dir, 0755))
+	file := filepath.Join(dir, "default.yaml")
+	require.Nil(t, os.WriteFile(file, []byte(`application:
+  releaseKey: abc
+  properties:
+    k: v
+config.json:
+  json: '{"k": "v"}'`), 0644))
+
+	w, err := New(ctx, Config{File: file})
+	require.Nil(t, err)
+	defer w.Close()
+	require.Equal(t, ConfigMap{"web": {"default": {
+		"application": {ReleaseKey: "abc", Properties: map[string]string{"k": "v"}},
+		"config.json": {JSON: `{"k": "v"}`},
+	}}}, w.Config())
+
+	// a ConfigMap is served as is wherever the file is
+	require.Nil(t, os.WriteFile(file, []byte(`myApp:
+  myCluster:
+    application:
+      properties:
+        k: v`), 0644))
+	require.Nil(t, w.Reload())
+	require.Equal(t, ConfigMap{"myApp": {"myCluster": {
+		"application": {Properties: map[string]string{"k": "v"}},
+	}}}, w.Config())
+}
+
+func TestEnvs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	file := filepath.Join(t.TempDir(), "app.yaml")
+	require.Nil(t, os.WriteFile(file, []byte(`myApp:
+  default:
+    application:
+      properties:
+        k: v
+envs:
+  dev:
+    myApp:
+      default:
+        application:
+          properties:
+            k: dev
+  PRO:
+    properties:
+      default:
+        application:
+          properties:
+            k: pro`), 0644))
+
+	w, err := New(ctx, Config{File: file})
+	require.Nil(t, err)
+	defer w.Close()
+	require.Equal(t, ConfigMap{"myApp": {"default": {
+		"application": {Properties: map[string]string{"k": "v"}},
+	}}}, w.Config())
+
+	dev, err := New(ctx, Config{File: file, Env: "DEV"})
+	require.Nil(t, err)
+	defer dev.Close()
+	require.Equal(t, "dev", dev.Config()["myApp"]["default"]["application"].Properties["k"])
+	pro, err := New(ctx, Config{File: file, Env: "pro"})
+	require.Nil(t, err)
+	defer pro.Close()
+	require.Equal(t, "pro", pro.Config()["properties"]["default"]["application"].Properties["k"])
+
+	// a file serves nothing to the envs it does not define
+	uat, err := New(ctx, Config{File: file, Env: "UAT"})
+	require.Nil(t, err)
+	defer uat.Close()
+	require.Empty(t, uat.Config())
+
+	// and nothing to the default env if it only defines envs
+	require.Nil(t, os.WriteFile(file, []byte(`envs:
+  DEV:
+    myApp:
+      default:
+        application:
+          properties:
+            k: dev`), 0644))
+	require.Nil(t, w.Reload())
+	require.Empty(t, w.Config())
+	require.Nil(t, dev.Reload())
+	require.Equal(t, "dev", dev.Config()["myApp"]["default"]["application"].Properties["k"])
+}
+
+func TestArchives(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	dir := t.TempDir()
+	app := []byte(`myApp:
+  myCluster:
+    application:
+      properties:
+        k: v`)
+	namespaces := []byte(`application:
+  properties:
+    k: v2
+config.json:
+  json: '{"k": "v"}'`)
+
+	t.Run("gzip", func(t *testing.T) {
+		var b bytes.Buffer
+		gw := gzip.NewWriter(&b)
+		gw.Write(app)
+		require.Nil(t, gw.Close())
+		file := filepath.Join(dir, "app.yaml.gz")
+		require.Nil(t, os.WriteFile(file, b.Bytes(), 0644))
+
+		w, err := New(ctx, Config{File: file})
+		require.Nil(t, err)
+		defer w.Close()
+		require.Equal(t, ConfigMap{"myApp": {"myCluster": {
+			"application": {Properties: map[string]string{"k": "v"}},
+		}}}, w.Config())
+	})
+	t.Run("zip", func(t *testing.T) {
+		var b bytes.Buffer
+		zw := zip.NewWriter(&b)
+		for name, content := range map[string][]byte{
+			"app.yaml":         app,
+			"web/default.yaml": namespaces,
+			"web/.hidden.yaml": []byte("invalid: ["),
+			"web/README.md":    []byte("not a config file"),
+		} {
+			f, err := zw.Create(name)
+			require.Nil(t, err)
+			f.Write(content)
+		}
+		require.Nil(t, zw.Close())
+		file := filepath.Join(dir, "configs.zip")
+		require.Nil(t, os.WriteFile(file, b.Bytes(), 0644))
+
+		w, err := New(ctx, Config{File: file})
+		require.Nil(t, err)
+		defer w.Close()
+		require.Equal(t, ConfigMap{
+			"myApp": {"myCluster": {
+				"application": {Properties: map[string]string{"k": "v"}},
+			}},
+			"web": {"default": {
+				"application": {Properties: map[string]string{"k": "v2"}},
+				"config.json": {JSON: `{"k": "v"}`},
+			}},
+		}, w.Config())
+	})
+	t.Run("tgz", func(t *testing.T) {
+		var b bytes.Buffer
+		gw := gzip.NewWriter(&b)
+		tw := tar.NewWriter(gw)
+		require.Nil(t, tw.WriteHeader(&tar.Header{Name: "web/", Typeflag: tar.TypeDir, Mode: 0755}))
+		require.Nil(t, tw.WriteHeader(&tar.Header{Name: "web/default.yaml", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(namespaces))}))
+		tw.Write(namespaces)
+		require.Nil(t, tw.Close())
+		require.Nil(t, gw.Close())
+		file := filepath.Join(dir, "configs.tgz")
+		require.Nil(t, os.WriteFile(file, b.Bytes(), 0644))
+
+		w, err := New(ctx, Config{File: file})
+		require.Nil(t, err)
+		defer w.Close()
+		require.Equal(t, ConfigMap{"web": {"default": {
+			"application": {Properties: map[string]string{"k": "v2"}},
+			"config.json": {JSON: `{"k": "v"}`},
+		}}}, w.Config())
+	})
+	t.Run("size limit", func(t *testing.T) {
+		var b bytes.Buffer
+		gw := gzip.NewWriter(&b)
+		gw.Write(bytes.Repeat([]byte("# comment\n"), 100))
+		require.Nil(t, gw.Close())
+		file := filepath.Join(dir, "large.yaml.gz")
+		require.Nil(t, os.WriteFile(file, b.Bytes(), 0644))
+
+		// the limit applies to the decompressed content
+		_, err := New(ctx, Config{File: file, MaxFileSize: 256})
+		require.EqualError(t, err, "config file exceeds the size limit of 256 bytes")
+	})
+}
+
+func TestChecksum(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	file := filepath.Join(t.TempDir(), "app.yaml")
+	write := func(content string, sum string) {
+		require.Nil(t, os.WriteFile(file, []byte(content), 0644))
+		if sum != "" {
+			require.Nil(t, os.WriteFile(file+".sha256", []byte(sum+"  app.yaml\n"), 0644))
+		}
+	}
+	sum := func(content string) string {
+		h := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(h[:])
+	}
+	v1 := "myApp:\n  myCluster:\n    application:\n      properties:\n        k: v1\n"
+	v2 := "myApp:\n  myCluster:\n    application:\n      properties:\n        k: v2\n"
+
+	write(v1, sum(v1))
+	w, err := New(ctx, Config{File: file})
+	require.Nil(t, err)
+	defer w.Close()
+	require.Equal(t, "v1", w.Config()["myApp"]["myCluster"]["application"].Properties["k"])
+
+	// a partially copied file is not loaded until its checksum matches
+	write(v2[:20], "")
+	require.Equal(t, &ErrChecksumMismatch{Want: sum(v1), Got: sum(v2[:20])}, w.Reload())
+	require.Equal(t, "v1", w.Config()["myApp"]["myCluster"]["application"].Properties["k"])
+	write(v2, "")
+	require.Error(t, w.Reload())
+	write(v2, strings.ToUpper(sum(v2)))
+	require.Nil(t, w.Reload())
+	require.Equal(t, "v2", w.Config()["myApp"]["myCluster"]["application"].Properties["k"])
+
+	// the events of the checksum reload its file
+	require.Equal(t, []*Watcher{w}, w.m.changed(file+".sha256", nil))
+}
+
+func TestEncryption(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	encoded, err := NewKey()
+	require.Nil(t, err)
+	key, err := ParseKey(encoded + "\n")
+	require.Nil(t, err)
+	_, err = ParseKey("c2hvcnQ=")
+	require.Error(t, err)
+	require.True(t, strings.HasPrefix(err.Error(), "invalid key: "))
+	encrypt := func(plaintext string) string {
+		v, err := Encrypt(key, plaintext)
+		require.Nil(t, err)
+		// the plaintexts hold a dash out of the base64 alphabet, so that they cannot show up in the ciphertexts by chance
+		require.NotContains(t, v, plaintext)
+		return v
+	}
+
+	file := filepath.Join(t.TempDir(), "app.yaml")
+	require.Nil(t, os.WriteFile(file, []byte(fmt.Sprintf(`myApp:
+  myCluster:
+    application:
+      properties:
+        password: %s
+        user: admin
+        sops: ENC[AES256_GCM,data:Zm9v,iv:YmFy,tag:YmF6,type:str]
+        legacy: ENC[jolsqckMMp8jX0YaLna8Ihw6/QzMpMFbdqymnPupcvkNIA==]
+      overrides:
+        sg:
+          password: %s
+      branches:
+      - name: canary
+        labels: [canary]
+        properties:
+          password: %s
+    secrets.json:
+      json: %s`, encrypt("pass-1"), encrypt("pass-2"), encrypt("pass-3"), encrypt(`{"token": "t"}`))), 0644))
+
+	w, err := New(ctx, Config{File: file, DecryptionKey: key})
+	require.Nil(t, err)
+	defer w.Close()
+	app := w.Config()["myApp"]
+	// the ENC[...] values of other tools are served as they are
+	require.Equal(t, map[string]string{
+		"password": "pass-1",
+		"user":     "admin",
+		"sops":     "ENC[AES256_GCM,data:Zm9v,iv:YmFy,tag:YmF6,type:str]",
+		"legacy":   "ENC[jolsqckMMp8jX0YaLna8Ihw6/QzMpMFbdqymnPupcvkNIA==]",
+	}, app["myCluster"]["application"].Properties)
+	require.Equal(t, "pass-2", app["sg"]["application"].Properties["password"])
+	require.Equal(t, "pass-3", app["myCluster"]["application"].Branches[0].Properties["password"])
+	require.Equal(t, `{"token": "t"}`, app["myCluster"]["secrets.json"].JSON)
+
+	// encrypted values fail to load without the key
+	_, err = New(ctx, Config{File: file})
+	var de *ErrDecrypt
+	require.True(t, errors.As(err, &de))
+	require.Equal(t, "myApp", de.AppID)
+	other, err := NewKey()
+	require.Nil(t, err)
+	_, err = New(ctx, Config{File: file, DecryptionKey: []byte(other)})
+	require.True(t, errors.As(err, &de))
+}
+
+func TestJasypt(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	file := filepath.Join(t.TempDir(), "app.yaml")
+	require.Nil(t, os.WriteFile(file, []byte(`myApp:
+  myCluster:
+    application:
+      jasypt: [password]
+      properties:
+        password: p1
+        user: admin
+      overrides:
+        sg:
+          password: p2
+      branches:
+      - name: canary
+        labels: [canary]
+        properties:
+          password: p3`), 0644))
+
+	w, err := New(ctx, Config{File: file, JasyptPassword: "secret"})
+	require.Nil(t, err)
+	defer w.Close()
+	app := w.Config()["myApp"]
+	decrypt := func(v string) string {
+		require.True(t, strings.HasPrefix(v, jasypt.Prefix))
+		p, err := jasypt.Decrypt("secret", v)
+		require.Nil(t, err)
+		return p
+	}
+	require.Equal(t, "admin", app["myCluster"]["application"].Properties["user"])
+	require.Equal(t, "p1", decrypt(app["myCluster"]["application"].Properties["password"]))
+	require.Equal(t, "p2", decrypt(app["sg"]["application"].Properties["password"]))
+	require.Equal(t, "p3", decrypt(app["myCluster"]["application"].Branches[0].Properties["password"]))
+
+	// a reload of the unchanged file keeps the encrypted values, so that no namespace is updated
+	sub := w.Bus().Subscribe(ctx)
+	require.Nil(t, w.m.Reload())
+	for e := range sub {
+		require.Equal(t, events.FileReloaded, e.Type)
+		break
+	}
+	require.Equal(t, app, w.Config()["myApp"])
+
+	// jasypt properties fail to load without the password
+	_, err = New(ctx, Config{File: file})
+	var ee *ErrEncrypt
+	require.True(t, errors.As(err, &ee))
+	require.Equal(t, "error encrypting namespace 'application' in myApp/myCluster: missing jasypt password", err.Error())
+}
+
+func TestGray(t *testing.T) {
+	ns := Namespace{
+		ReleaseKey: "abc",
+		Properties: map[string]string{"k": "v", "k2": "v2"},
+		Branches: []Branch{
+			{Name: "canary", IPs: []string{"10.0.0.1"}, Labels: []string{"canary"}, Properties: map[string]string{"k": "canary"}},
+			{Name: "all", IPs: []string{AllIPs}, ReleaseKey: "all"},
+		},
+	}
+
+	gray := ns.Gray("app", "10.0.0.1", "")
+	require.Equal(t, Namespace{ReleaseKey: "abc-canary", Properties: map[string]string{"k": "canary", "k2": "v2"}}, gray)
+	require.Equal(t, gray, ns.Gray("app", "10.0.0.2", "canary"))
+	require.Equal(t, "v", ns.Properties["k"])
+	require.Equal(t, Namespace{ReleaseKey: "all", Properties: ns.Properties}, ns.Gray("app", "10.0.0.2", ""))
+
+	ns.Branches = ns.Branches[:1]
+	require.Equal(t, Namespace{ReleaseKey: "abc", Properties: ns.Properties}, ns.Gray("app", "10.0.0.2", ""))
+}
+
+func TestClientBucket(t *testing.T) {
+	// buckets are kept across releases so that clients keep their variant after an upgrade
+	require.Equal(t, 52, ClientBucket("app", "10.0.0.1"))
+	require.Equal(t, 9, ClientBucket("app", "10.0.0.2"))
+	require.Equal(t, 71, ClientBucket("other", "10.0.0.1"))
+
+	share := func(percent int) map[string]bool {
+		b := Branch{Name: "gray", Percent: percent}
+		clients := make(map[string]bool)
+		for i := 0; i < 1000; i++ {
+			ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+			if b.Match("app", ip, "") {
+				clients[ip] = true
+			}
+		}
+		return clients
+	}
+	ten, twenty := share(10), share(20)
+	require.InDelta(t, 100, len(ten), 30)
+	require.InDelta(t, 200, len(twenty), 40)
+	// a growing share keeps the clients it already had
+	for ip := range ten {
+		require.True(t, twenty[ip], ip)
+	}
+	require.Equal(t, ten, share(10))
+}
+
+func TestOverrides(t *testing.T) {
+	log := nlogger.NewProvider(nlogger.New(os.Stdout, ""))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+
+	// mock fs
+	appFS := afero.NewMemMapFs()
+	appFS.MkdirAll("/dev", 0755)
+
+	w, err := New(ctx, Config{File: "/dev/null"})
+	require.EqualError(t, err, "invalid config file")
+	w.MockFS(appFS)
+
+	require.Nil(t, afero.WriteFile(appFS, "/dev/null", []byte(`myApp:
+  default:
+    myNamespace:
+      releaseKey: abc
+      properties:
+        mysql.uri: mysql://localhost/mysql
+        timeout: 5s
+      overrides:
+        default:
+          timeout: 1s
+        sg:
+          mysql.uri: mysql://sg/mysql
+        us:
+          mysql.uri: mysql://us/mysql
+  us:
+    myNamespace:
+      properties:
+        mysql.uri: mysql://explicit/mysql`), 0644))
+	require.Nil(t, w.readConfigMap(log))
+	require.Equal(t, ConfigMap{
+		"myApp": {
+			"default": {
+				"myNamespace": {ReleaseKey: "abc", Properties: map[string]string{"mysql.uri": "mysql://localhost/mysql", "timeout": "1s"}},
+			},
+			"sg": {
+				"myNamespace": {ReleaseKey: "abc", Properties: map[string]string{"mysql.uri": "mysql://sg/mysql", "timeout": "5s"}},
+			},
+			"us": {
+				"myNamespace": {Properties: map[string]string{"mysql.uri": "mysql://explicit/mysql"}},
+			},
+		},
+	}, w.Config())
+
+	t.Run("conflict", func(t *testing.T) {
+		require.Nil(t, afero.WriteFile(appFS, "/dev/null", []byte(`myApp:
+  a:
+    myNamespace:
+      properties: {k: a}
+      overrides: {sg: {k: sg}}
+  b:
+    myNamespace:
+      properties: {k: b}
+      overrides: {sg: {k: sg}}`), 0644))
+		require.EqualError(t, w.readConfigMap(log), "conflicting overrides of namespace 'myNamespace' in myApp/sg from a and b")
+	})
 }